@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/logzio/firehose-logs/common"
+	"github.com/logzio/firehose-logs/config"
 	"github.com/logzio/firehose-logs/logger"
 	"go.uber.org/zap"
-	"os"
+	"strconv"
+	"strings"
 )
 
 var sugLog *zap.SugaredLogger
@@ -38,11 +40,17 @@ func HandleRequest(ctx context.Context, event cfn.Event) (physicalResourceID str
 func createCustomResource(ctx context.Context, event cfn.Event) (physicalResourceID string, data map[string]interface{}, err error) {
 	physicalResourceID = generatePhysicalResourceId(event)
 
+	envConfig := config.Load()
+	if err = envConfig.Validate(common.EnvAwsRegion); err != nil {
+		sugLog.Error("Error while validating the configuration: ", err.Error())
+		return physicalResourceID, nil, err
+	}
+
 	payload := common.NewSubscriptionFilterEvent(common.RequestParameters{
 		Action:      common.AddSF,
-		NewServices: os.Getenv(common.EnvServices),
-		NewCustom:   os.Getenv(common.EnvCustomGroups),
-		NewIsSecret: os.Getenv(common.EnvSecretEnabled),
+		NewServices: strings.Join(envConfig.Services, ","),
+		NewCustom:   envConfig.CustomLogGroups,
+		NewIsSecret: strconv.FormatBool(envConfig.SecretEnabled),
 	})
 	sugLog.Debug("Created SubscriptionFilter Event: ", payload)
 
@@ -67,6 +75,11 @@ func createCustomResource(ctx context.Context, event cfn.Event) (physicalResourc
 func updateCustomResource(ctx context.Context, event cfn.Event) (physicalResourceID string, data map[string]interface{}, err error) {
 	physicalResourceID = generatePhysicalResourceId(event)
 
+	if err = config.Load().Validate(common.EnvAwsRegion); err != nil {
+		sugLog.Error("Error while validating the configuration: ", err.Error())
+		return physicalResourceID, nil, err
+	}
+
 	oldConfig := event.OldResourceProperties
 	newConfig := event.ResourceProperties
 
@@ -109,11 +122,17 @@ func updateCustomResource(ctx context.Context, event cfn.Event) (physicalResourc
 func deleteCustomResource(ctx context.Context, event cfn.Event) (physicalResourceID string, data map[string]interface{}, err error) {
 	physicalResourceID = generatePhysicalResourceId(event)
 
+	// an invalid configuration must not block the deletion of the stack
+	envConfig := config.Load()
+	if validationErr := envConfig.Validate(common.EnvAwsRegion); validationErr != nil {
+		sugLog.Warn("Invalid configuration, removing the subscription filters anyway: ", validationErr.Error())
+	}
+
 	payload := common.NewSubscriptionFilterEvent(common.RequestParameters{
 		Action:      common.DeleteSF,
-		NewServices: os.Getenv(common.EnvServices),
-		NewCustom:   os.Getenv(common.EnvCustomGroups),
-		NewIsSecret: os.Getenv(common.EnvSecretEnabled),
+		NewServices: strings.Join(envConfig.Services, ","),
+		NewCustom:   envConfig.CustomLogGroups,
+		NewIsSecret: strconv.FormatBool(envConfig.SecretEnabled),
 	})
 	sugLog.Debug("Created SubscriptionFilter Event: ", payload)
 
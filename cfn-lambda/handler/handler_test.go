@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/logzio/firehose-logs/common"
 	lp "github.com/logzio/firehose-logs/logger"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
@@ -47,3 +48,18 @@ func TestGeneratePhysicalResourceId(t *testing.T) {
 	physicalId := generatePhysicalResourceId(mockEvent)
 	assert.Equal(t, "arn:aws:cloudformation:us-west-2:EXAMPLE/stack-name/guid-MyTestResource", physicalId)
 }
+
+func TestInvalidConfigurationFailsCreate(t *testing.T) {
+	ctx, mockEvent, _ := setup("Create")
+	t.Setenv(common.EnvAwsRegion, "us-east-1")
+	t.Setenv(common.EnvServices, "lambda,not-a-service")
+	t.Setenv(common.EnvSecretEnabled, "true")
+	t.Setenv(common.EnvCustomGroups, "my-secret")
+
+	physicalId, data, err := createCustomResource(ctx, mockEvent)
+
+	assert.Equal(t, "arn:aws:cloudformation:us-west-2:EXAMPLE/stack-name/guid-MyTestResource", physicalId)
+	assert.Nil(t, data)
+	assert.ErrorContains(t, err, "unknown service 'not-a-service'")
+	assert.ErrorContains(t, err, "invalid custom log groups secret ARN 'my-secret'")
+}
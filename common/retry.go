@@ -0,0 +1,108 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// retryableErrorCodes are AWS error codes of transient failures which are worth retrying
+var retryableErrorCodes = map[string]struct{}{
+	"ThrottlingException":          {},
+	"Throttling":                   {},
+	"TooManyRequestsException":     {},
+	"ServiceUnavailableException":  {},
+	"ServiceUnavailable":           {},
+	"OperationAbortedException":    {},
+	"InternalFailure":              {},
+	"RequestTimeout":               {},
+	"RequestTimeoutException":      {},
+	request.ErrCodeResponseTimeout: {},
+}
+
+// ErrDeadlineNear is returned when a retry is skipped since it would pass the context deadline
+var ErrDeadlineNear = errors.New("not retrying, deadline is near")
+
+// RetryPolicy retries AWS calls with exponential backoff and full jitter
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of calls, including the first one
+	MaxAttempts int
+	// BaseDelay is the upper bound of the delay before the first retry, doubled on each retry
+	BaseDelay time.Duration
+	// MaxDelay caps the upper bound of the delay between retries
+	MaxDelay time.Duration
+	// DeadlineMargin is the time left before the context deadline, under which no more retries are attempted
+	DeadlineMargin time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used for CloudWatch Logs API calls
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    10,
+	BaseDelay:      200 * time.Millisecond,
+	MaxDelay:       20 * time.Second,
+	DeadlineMargin: 5 * time.Second,
+}
+
+// WithoutSDKRetries returns the config of clients whose calls are retried by a RetryPolicy. The retries of the SDK are
+// disabled, so every attempt of the policy is a single call, and the deadline margin of the policy holds.
+func WithoutSDKRetries() *aws.Config {
+	return aws.NewConfig().WithMaxRetries(0)
+}
+
+// IsRetryableError checks if the given error is a transient AWS error which is worth retrying
+func IsRetryableError(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+
+	if _, ok := retryableErrorCodes[awsErr.Code()]; ok {
+		return true
+	}
+	return request.IsErrorThrottle(err)
+}
+
+// Do calls fn until it succeeds, fails with a non retryable error, the attempts are exhausted,
+// or waiting for the next attempt would pass the context deadline. It returns the last error of fn.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !IsRetryableError(err) || attempt+1 >= p.MaxAttempts {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline)-delay < p.DeadlineMargin {
+			return fmt.Errorf("%w: %w", ErrDeadlineNear, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a random delay between zero and the exponential upper bound of the given attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	upperBound := p.MaxDelay
+	if attempt < 32 {
+		if exp := p.BaseDelay << attempt; exp > 0 && exp < p.MaxDelay {
+			upperBound = exp
+		}
+	}
+	if upperBound <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(upperBound)))
+}
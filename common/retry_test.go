@@ -0,0 +1,177 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "throttling",
+			err:      awserr.New("ThrottlingException", "Rate exceeded", nil),
+			expected: true,
+		},
+		{
+			name:     "service unavailable",
+			err:      awserr.New("ServiceUnavailableException", "Service unavailable", nil),
+			expected: true,
+		},
+		{
+			name:     "operation aborted",
+			err:      awserr.New("OperationAbortedException", "Multiple requests to update the same resource were in conflict", nil),
+			expected: true,
+		},
+		{
+			name:     "request timeout",
+			err:      awserr.New("RequestTimeout", "Request timed out", nil),
+			expected: true,
+		},
+		{
+			name:     "wrapped throttling",
+			err:      fmt.Errorf("group1: %w", awserr.New("ThrottlingException", "Rate exceeded", nil)),
+			expected: true,
+		},
+		{
+			name:     "limit exceeded",
+			err:      awserr.New("LimitExceededException", "Resource limit exceeded", nil),
+			expected: false,
+		},
+		{
+			name:     "not an aws error",
+			err:      fmt.Errorf("an error occurred"),
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, IsRetryableError(test.err))
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		BaseDelay:      time.Millisecond,
+		MaxDelay:       5 * time.Millisecond,
+		DeadlineMargin: time.Second,
+	}
+	throttlingErr := awserr.New("ThrottlingException", "Rate exceeded", nil)
+
+	tests := []struct {
+		name             string
+		ctx              func() (context.Context, context.CancelFunc)
+		errs             []error
+		expectedAttempts int
+		expectedError    bool
+		deadlineNear     bool
+	}{
+		{
+			name:             "success on first attempt",
+			ctx:              func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			errs:             []error{nil},
+			expectedAttempts: 1,
+			expectedError:    false,
+		},
+		{
+			name:             "success after retries",
+			ctx:              func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			errs:             []error{throttlingErr, throttlingErr, nil},
+			expectedAttempts: 3,
+			expectedError:    false,
+		},
+		{
+			name:             "non retryable error",
+			ctx:              func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			errs:             []error{fmt.Errorf("an error occurred"), nil},
+			expectedAttempts: 1,
+			expectedError:    true,
+		},
+		{
+			name:             "attempts exhausted",
+			ctx:              func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			errs:             []error{throttlingErr, throttlingErr, throttlingErr, nil},
+			expectedAttempts: 3,
+			expectedError:    true,
+		},
+		{
+			name: "deadline is near",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 500*time.Millisecond)
+			},
+			errs:             []error{throttlingErr, nil},
+			expectedAttempts: 1,
+			expectedError:    true,
+			deadlineNear:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := test.ctx()
+			defer cancel()
+
+			attempts := 0
+			err := policy.Do(ctx, func() error {
+				err := test.errs[attempts]
+				attempts++
+				return err
+			})
+
+			assert.Equal(t, test.expectedAttempts, attempts)
+			if test.deadlineNear {
+				assert.ErrorIs(t, err, ErrDeadlineNear)
+				assert.True(t, IsRetryableError(err))
+			}
+			if test.expectedError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDoCancelled(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Minute,
+		MaxDelay:    time.Minute,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := policy.Do(ctx, func() error {
+		return awserr.New("ThrottlingException", "Rate exceeded", nil)
+	})
+
+	assert.NotNil(t, err)
+	assert.True(t, IsRetryableError(err))
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  time.Second,
+	}
+
+	for attempt := 0; attempt < 64; attempt++ {
+		delay := policy.backoff(attempt)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.Less(t, delay, policy.MaxDelay)
+		if attempt == 0 {
+			assert.Less(t, delay, policy.BaseDelay)
+		}
+	}
+}
@@ -7,10 +7,21 @@ import (
 
 type ActionType string
 
+// SubscriptionFilterEventName is the name of the internal event which invokes a subscription filter action
+const SubscriptionFilterEventName = "SubscriptionFilterEvent"
+
 const (
 	AddSF    ActionType = "add"
 	UpdateSF ActionType = "update"
 	DeleteSF ActionType = "delete"
+	// ReplaySF re-dispatches the failed events of the replay queue
+	ReplaySF ActionType = "replay"
+	// ReconcileSF converges the subscription filters to the current configuration of the function
+	ReconcileSF ActionType = "reconcile"
+	// StatusSF reports the subscription filters which reconcile would change, without changing them
+	StatusSF ActionType = "status"
+	// InventorySF reports the subscription state of every log group of the account and region of the function
+	InventorySF ActionType = "inventory"
 )
 
 type RequestParameters struct {
@@ -21,6 +32,44 @@ type RequestParameters struct {
 	OldCustom   string `json:"oldCustom,omitempty"`
 	NewIsSecret string `json:"newIsSecret,omitempty"`
 	OldIsSecret string `json:"oldIsSecret,omitempty"`
+	// DryRun plans the subscription filter changes of the action without applying them
+	DryRun bool `json:"dryRun,omitempty"`
+	// Continuation is set when the event resumes an action which didn't finish in a previous invocation
+	Continuation *Continuation `json:"continuation,omitempty"`
+}
+
+// Continuation is the checkpoint of an action which didn't finish within a single invocation
+type Continuation struct {
+	Iteration int `json:"iteration"`
+	// Account is the member account of the remaining work, it's empty for the account of the function
+	Account string `json:"account,omitempty"`
+	// Region is the region of the remaining work, it's empty for the region of the function
+	Region            string          `json:"region,omitempty"`
+	LogGroupsToAdd    []string        `json:"logGroupsToAdd,omitempty"`
+	LogGroupsToRemove []string        `json:"logGroupsToRemove,omitempty"`
+	PrefixesToAdd     []PrefixCursor  `json:"prefixesToAdd,omitempty"`
+	PrefixesToRemove  []PrefixCursor  `json:"prefixesToRemove,omitempty"`
+	Result            json.RawMessage `json:"result,omitempty"`
+	// AppliedVersion is the version of the custom log groups which is marked as applied once the action completes
+	AppliedVersion *AppliedVersion `json:"appliedVersion,omitempty"`
+}
+
+// AppliedVersion is a version of the custom log groups secret or SSM parameter whose changes the action applies
+type AppliedVersion struct {
+	// SecretId is the secret of the version, it's empty for a version of an SSM parameter
+	SecretId  string `json:"secretId,omitempty"`
+	VersionId string `json:"versionId,omitempty"`
+	// PreviousVersionId is the version of the secret which the applied staging label is moved from, if any
+	PreviousVersionId string `json:"previousVersionId,omitempty"`
+	// ParameterName is the SSM parameter of the version, it's empty for a version of a secret
+	ParameterName    string `json:"parameterName,omitempty"`
+	ParameterVersion int64  `json:"parameterVersion,omitempty"`
+}
+
+// PrefixCursor is the position of the log groups discovery under a prefix
+type PrefixCursor struct {
+	Prefix    string `json:"prefix"`
+	NextToken string `json:"nextToken,omitempty"`
 }
 
 type Detail struct {
@@ -35,7 +84,7 @@ type SubscriptionFilterEvent struct {
 func NewSubscriptionFilterEvent(params RequestParameters) SubscriptionFilterEvent {
 	return SubscriptionFilterEvent{
 		Detail: Detail{
-			EventName:         "SubscriptionFilterEvent",
+			EventName:         SubscriptionFilterEventName,
 			RequestParameters: params,
 		},
 	}
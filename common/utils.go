@@ -3,8 +3,10 @@ package common
 import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"os"
+	"sync"
 )
 
 const (
@@ -15,9 +17,20 @@ const (
 )
 
 func GetSession() (*session.Session, error) {
+	return GetSessionInRegion(os.Getenv(EnvAwsRegion))
+}
+
+// sessionLock serializes creating sessions, since the SDK sets up the shared default HTTP client while creating a
+// session, such as with the custom CA bundle of AWS_CA_BUNDLE
+var sessionLock sync.Mutex
+
+// GetSessionInRegion returns a session of the given region
+func GetSessionInRegion(region string) (*session.Session, error) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
 	sess, err := session.NewSessionWithOptions(session.Options{
 		Config: aws.Config{
-			Region: aws.String(os.Getenv(EnvAwsRegion)),
+			Region: aws.String(region),
 		},
 	})
 
@@ -27,3 +40,19 @@ func GetSession() (*session.Session, error) {
 
 	return sess, nil
 }
+
+// GetSessionWithRole returns a session of the given region which uses the credentials of the given role, assumed with
+// the credentials of the function. The external id is only sent when it's not empty.
+func GetSessionWithRole(region, roleArn, externalId string) (*session.Session, error) {
+	sess, err := GetSessionInRegion(region)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := stscreds.NewCredentials(sess, roleArn, func(p *stscreds.AssumeRoleProvider) {
+		if externalId != "" {
+			p.ExternalID = aws.String(externalId)
+		}
+	})
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
@@ -11,3 +11,17 @@ func TestGetSession(t *testing.T) {
 	assert.IsType(t, (*session.Session)(nil), result)
 	assert.Nil(t, err)
 }
+
+func TestGetSessionWithRole(t *testing.T) {
+	result, err := GetSessionWithRole("us-west-2", "arn:aws:iam::123456789012:role/test-role", "external-id")
+	assert.Nil(t, err)
+	assert.IsType(t, (*session.Session)(nil), result)
+	assert.NotNil(t, result.Config.Credentials)
+	assert.Equal(t, "us-west-2", *result.Config.Region)
+}
+
+func TestGetSessionInRegion(t *testing.T) {
+	result, err := GetSessionInRegion("eu-central-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "eu-central-1", *result.Config.Region)
+}
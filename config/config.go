@@ -0,0 +1,366 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/hashicorp/go-multierror"
+	"github.com/logzio/firehose-logs/common"
+)
+
+const (
+	EnvAccountId                 = "ACCOUNT_ID"
+	EnvAwsPartition              = "AWS_PARTITION"
+	EnvFirehoseArn               = "FIREHOSE_ARN"
+	EnvDestinationArn            = "DESTINATION_ARN"
+	EnvPutSubscriptionFilterRole = "PUT_SF_ROLE"
+	EnvStackName                 = "STACK_NAME"
+	EnvFunctionName              = "AWS_LAMBDA_FUNCTION_NAME" // reserved env
+	EnvFilterPattern             = "FILTER_PATTERN"
+	EnvTagEventsEnabled          = "TAG_EVENTS_ENABLED"
+	EnvMaxConcurrency            = "MAX_CONCURRENCY"
+	EnvApiRateLimit              = "API_RATE_LIMIT"
+	EnvDryRun                    = "DRY_RUN"
+	EnvDistribution              = "DISTRIBUTION"
+	EnvDistributionRules         = "DISTRIBUTION_RULES"
+	EnvMode                      = "MODE"
+	EnvAccountPolicyExclusions   = "ACCOUNT_POLICY_EXCLUDED_LOG_GROUPS"
+	EnvDestinations              = "DESTINATIONS"
+	EnvRoutingRules              = "ROUTING_RULES"
+	EnvMemberAccounts            = "MEMBER_ACCOUNTS"
+	EnvMemberAccountRoleName     = "MEMBER_ACCOUNT_ROLE_NAME"
+	EnvMemberAccountExternalId   = "MEMBER_ACCOUNT_EXTERNAL_ID"
+	EnvMemberAccountSource       = "MEMBER_ACCOUNT_SOURCE"
+	EnvOrganizationUnits         = "ORGANIZATION_UNITS"
+	EnvOrganizationAccountTags   = "ORGANIZATION_ACCOUNT_TAGS"
+	EnvRegions                   = "REGIONS"
+	EnvRegionDestinations        = "REGION_DESTINATIONS"
+	EnvReplayQueueArn            = "REPLAY_QUEUE_ARN"
+	EnvInventoryBucket           = "INVENTORY_BUCKET"
+	EnvConfigObject              = "CONFIG_OBJECT"
+
+	// DefaultApiRateLimit matches the CloudWatch Logs quota of PutSubscriptionFilter and DeleteSubscriptionFilter, in
+	// transactions per second
+	DefaultApiRateLimit   = 5
+	DefaultMaxConcurrency = 10
+
+	valuesSeparator = ","
+)
+
+// Config is the configuration which the functions of the stack share, as it's set in their env variables
+type Config struct {
+	Services []string
+	// CustomLogGroups is either a comma-separated list of log groups, or the ARN of the secret or the SSM parameter
+	// which stores them
+	CustomLogGroups string
+	SecretEnabled   bool
+	AccountId       string
+	Partition       string
+	Region          string
+	StackName       string
+	FunctionName    string
+	// DestinationArn is the destination of the subscription filters, which defaults to the Firehose of the stack
+	DestinationArn string
+	// RoleArn is the role which CloudWatch Logs assumes to deliver the logs to the destination
+	RoleArn string
+
+	FilterPattern    string
+	TagEventsEnabled bool
+	// DryRun plans the subscription filter changes of every event without applying them
+	DryRun bool
+	// MaxConcurrency is the maximum number of log groups, and of member accounts and regions, which are handled
+	// concurrently
+	MaxConcurrency int
+	// ApiRateLimit is the rate of subscription filter API calls in each account and region, per second
+	ApiRateLimit float64
+	Distribution string
+	// DistributionRules are <service or log group prefix>:<distribution> rules
+	DistributionRules       []string
+	Mode                    string
+	AccountPolicyExclusions []string
+	// Destinations are the named destinations of the routing rules, in addition to the default destination
+	Destinations map[string]Destination
+	RoutingRules []RoutingRule
+	// MemberAccounts are the accounts which the trigger function manages in addition to its own account
+	MemberAccounts          []string
+	MemberAccountRoleName   string
+	MemberAccountExternalId string
+	MemberAccountSource     string
+	OrganizationUnits       []string
+	OrganizationAccountTags map[string]string
+	// Regions are the regions which the trigger function manages in addition to its own region
+	Regions []string
+	// RegionDestinations are the default destinations of the regions which don't follow the naming convention
+	RegionDestinations map[string]Destination
+	ReplayQueueArn     string
+	InventoryBucket    string
+	// ConfigObject is the S3 URI of the declarative configuration file
+	ConfigObject string
+
+	// secretEnabledValue is the value of SECRET_ENABLED, which must be a boolean when it's set
+	secretEnabledValue string
+	// invalid are the errors of the env variables whose values don't match the type of their setting, by env variable
+	invalid map[string]error
+}
+
+// Destination is a destination of the subscription filters, and the role which CloudWatch Logs assumes to deliver the
+// logs to it
+type Destination struct {
+	Arn     string `json:"arn"`
+	RoleArn string `json:"roleArn,omitempty"`
+}
+
+// RoutingRule routes the log groups of services, prefixes or tags to a named destination
+type RoutingRule struct {
+	Destination string            `json:"destination"`
+	Services    []string          `json:"services,omitempty"`
+	Prefixes    []string          `json:"prefixes,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// Load reads the configuration from the env variables. It's validated separately, since each function requires
+// different variables. The values which don't match the type of their setting are reported by Validate.
+func Load() *Config {
+	c := &Config{
+		Services:                parseList(os.Getenv(common.EnvServices)),
+		CustomLogGroups:         strings.TrimSpace(os.Getenv(common.EnvCustomGroups)),
+		AccountId:               strings.TrimSpace(os.Getenv(EnvAccountId)),
+		Partition:               strings.TrimSpace(os.Getenv(EnvAwsPartition)),
+		Region:                  strings.TrimSpace(os.Getenv(common.EnvAwsRegion)),
+		StackName:               strings.TrimSpace(os.Getenv(EnvStackName)),
+		FunctionName:            strings.TrimSpace(os.Getenv(EnvFunctionName)),
+		DestinationArn:          strings.TrimSpace(os.Getenv(EnvDestinationArn)),
+		RoleArn:                 strings.TrimSpace(os.Getenv(EnvPutSubscriptionFilterRole)),
+		FilterPattern:           os.Getenv(EnvFilterPattern),
+		Distribution:            strings.TrimSpace(os.Getenv(EnvDistribution)),
+		DistributionRules:       parseList(os.Getenv(EnvDistributionRules)),
+		Mode:                    strings.TrimSpace(os.Getenv(EnvMode)),
+		AccountPolicyExclusions: parseList(os.Getenv(EnvAccountPolicyExclusions)),
+		MemberAccounts:          parseList(os.Getenv(EnvMemberAccounts)),
+		MemberAccountRoleName:   strings.TrimSpace(os.Getenv(EnvMemberAccountRoleName)),
+		MemberAccountExternalId: strings.TrimSpace(os.Getenv(EnvMemberAccountExternalId)),
+		MemberAccountSource:     strings.TrimSpace(os.Getenv(EnvMemberAccountSource)),
+		OrganizationUnits:       parseList(os.Getenv(EnvOrganizationUnits)),
+		Regions:                 parseList(os.Getenv(EnvRegions)),
+		ReplayQueueArn:          strings.TrimSpace(os.Getenv(EnvReplayQueueArn)),
+		InventoryBucket:         strings.TrimSpace(os.Getenv(EnvInventoryBucket)),
+		ConfigObject:            strings.TrimSpace(os.Getenv(EnvConfigObject)),
+		secretEnabledValue:      strings.TrimSpace(os.Getenv(common.EnvSecretEnabled)),
+		invalid:                 make(map[string]error),
+	}
+	c.SecretEnabled = strings.EqualFold(c.secretEnabledValue, "true")
+	if c.DestinationArn == "" {
+		c.DestinationArn = strings.TrimSpace(os.Getenv(EnvFirehoseArn))
+	}
+
+	c.TagEventsEnabled = c.parseBool(EnvTagEventsEnabled)
+	c.DryRun = c.parseBool(EnvDryRun)
+	c.MaxConcurrency = c.parsePositiveInt(EnvMaxConcurrency, DefaultMaxConcurrency)
+	c.ApiRateLimit = c.parsePositiveFloat(EnvApiRateLimit, DefaultApiRateLimit)
+	c.parseJSON(EnvDestinations, &c.Destinations, `a JSON object of names to {"arn": ..., "roleArn": ...}`)
+	c.parseJSON(EnvRoutingRules, &c.RoutingRules, `a JSON array of {"destination": ..., "services": [...], "prefixes": [...], "tags": {...}}`)
+	c.parseJSON(EnvOrganizationAccountTags, &c.OrganizationAccountTags, "a JSON object of tag keys to values")
+	c.parseJSON(EnvRegionDestinations, &c.RegionDestinations, `a JSON object of regions to {"arn": ..., "roleArn": ...}`)
+	return c
+}
+
+// parseBool parses the boolean value of the env variable, which is false when it's not set
+func (c *Config) parseBool(env string) bool {
+	value := strings.TrimSpace(os.Getenv(env))
+	if value != "" && !strings.EqualFold(value, "true") && !strings.EqualFold(value, "false") {
+		c.invalid[env] = fmt.Errorf("invalid %s '%s', must be true or false", env, value)
+	}
+	return strings.EqualFold(value, "true")
+}
+
+// parsePositiveInt parses the positive integer value of the env variable, which is the default value when it's not set
+func (c *Config) parsePositiveInt(env string, defaultValue int) int {
+	value := strings.TrimSpace(os.Getenv(env))
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		c.invalid[env] = fmt.Errorf("invalid %s '%s', must be a positive integer", env, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+// parsePositiveFloat parses the positive number value of the env variable, which is the default value when it's not
+// set
+func (c *Config) parsePositiveFloat(env string, defaultValue float64) float64 {
+	value := strings.TrimSpace(os.Getenv(env))
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed <= 0 {
+		c.invalid[env] = fmt.Errorf("invalid %s '%s', must be a positive number", env, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+// parseJSON decodes the JSON value of the env variable into target, which is left unset when the env variable isn't
+// set. The form describes the expected value in the error.
+func (c *Config) parseJSON(env string, target interface{}, form string) {
+	value := strings.TrimSpace(os.Getenv(env))
+	if value == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(value), target); err != nil {
+		c.invalid[env] = fmt.Errorf("invalid %s, must be %s: %v", env, form, err)
+	}
+}
+
+// Valid checks that the value of the env variable matches the type of its setting
+func (c *Config) Valid(env string) bool {
+	return c.invalid[env] == nil
+}
+
+// Validate validates the configuration, and checks that the given env variables are set. The error lists every
+// problem of the configuration.
+func (c *Config) Validate(required ...string) error {
+	var result *multierror.Error
+	for _, env := range required {
+		if c.valueOf(env) == "" {
+			result = multierror.Append(result, fmt.Errorf("%s must be set", env))
+		}
+	}
+
+	invalidEnvs := make([]string, 0, len(c.invalid))
+	for env := range c.invalid {
+		invalidEnvs = append(invalidEnvs, env)
+	}
+	sort.Strings(invalidEnvs)
+	for _, env := range invalidEnvs {
+		result = multierror.Append(result, c.invalid[env])
+	}
+
+	serviceToPrefix := ServicePrefixes()
+	for _, service := range c.Services {
+		if _, ok := serviceToPrefix[service]; !ok {
+			result = multierror.Append(result, fmt.Errorf("unknown service '%s' in %s", service, common.EnvServices))
+		}
+	}
+
+	if c.secretEnabledValue != "" && !strings.EqualFold(c.secretEnabledValue, "true") && !strings.EqualFold(c.secretEnabledValue, "false") {
+		result = multierror.Append(result, fmt.Errorf("invalid %s '%s', must be true or false", common.EnvSecretEnabled, c.secretEnabledValue))
+	}
+	if c.SecretEnabled {
+		if err := validateArn(c.CustomLogGroups, "secretsmanager", "secret:"); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid custom log groups secret ARN '%s': %v", c.CustomLogGroups, err))
+		}
+	}
+
+	if c.RoleArn != "" {
+		if err := validateArn(c.RoleArn, "iam", "role/"); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid role ARN '%s' in %s: %v", c.RoleArn, EnvPutSubscriptionFilterRole, err))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// valueOf returns the value of the configuration which is read from the given env variable
+func (c *Config) valueOf(env string) string {
+	switch env {
+	case common.EnvServices:
+		return strings.Join(c.Services, valuesSeparator)
+	case common.EnvCustomGroups:
+		return c.CustomLogGroups
+	case common.EnvSecretEnabled:
+		return c.secretEnabledValue
+	case EnvAccountId:
+		return c.AccountId
+	case EnvAwsPartition:
+		return c.Partition
+	case common.EnvAwsRegion:
+		return c.Region
+	case EnvStackName:
+		return c.StackName
+	case EnvFunctionName:
+		return c.FunctionName
+	case EnvDestinationArn, EnvFirehoseArn:
+		return c.DestinationArn
+	case EnvPutSubscriptionFilterRole:
+		return c.RoleArn
+	default:
+		return os.Getenv(env)
+	}
+}
+
+// validateArn validates that the value is an ARN of a resource of the service, whose resource has the given prefix
+func validateArn(value, service, resourcePrefix string) error {
+	parsed, err := arn.Parse(value)
+	if err != nil {
+		return err
+	}
+	if parsed.Service != service {
+		return fmt.Errorf("expected an ARN of %s, got an ARN of %s", service, parsed.Service)
+	}
+	if !strings.HasPrefix(parsed.Resource, resourcePrefix) || parsed.Resource == resourcePrefix {
+		return fmt.Errorf("expected a resource of the form %s<name>, got %s", resourcePrefix, parsed.Resource)
+	}
+	return nil
+}
+
+// parseList parses a comma-separated list, ignoring spaces and empty values
+func parseList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(strings.ReplaceAll(value, " ", ""), valuesSeparator) {
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ServicePrefixes returns the log group name prefix of every supported service, by service name
+func ServicePrefixes() map[string]string {
+	return map[string]string{
+		"apigateway":       "/aws/apigateway/",
+		"apigateway-rest":  "API-Gateway-Execution-Logs*",
+		"rds":              "/aws/rds/",
+		"cloudhsm":         "/aws/cloudhsm/",
+		"codebuild":        "/aws/codebuild/",
+		"connect":          "/aws/connect/",
+		"elasticbeanstalk": "/aws/elasticbeanstalk/",
+		"ecs":              "/aws/ecs/containerinsights/",
+		"eks":              "/aws/eks/",
+		"aws-glue":         "/aws-glue/",
+		"aws-iot":          "AWSIotLogsV2",
+		"lambda":           "/aws/lambda/",
+		"vpc":              "/aws/vpc/",
+		"macie":            "/aws/macie/",
+		"amazon-mq":        "/aws/amazonmq/broker/",
+		"batch":            "/aws/batch/",
+		"athena":           "/aws-athena/",
+		"cloudfront":       "/aws/cloudfront/",
+		"codepipeline":     "/aws/codepipeline/",
+		"config":           "/aws/config/",
+		"dms":              "/aws/dms/",
+		"emr":              "/aws/elasticmapreduce/",
+		"es":               "/aws/es/",
+		"events":           "/aws/events/",
+		"firehose":         "/aws/kinesisfirehose/",
+		"fsx":              "/aws/fsx/",
+		"guardduty":        "/aws/guardduty/",
+		"inspector":        "/aws/inspector/",
+		"kafka":            "/aws/msk/",
+		"kinesis":          "/aws/kinesis/",
+		"redshift":         "/aws/redshift/",
+		"route53":          "/aws/route53/",
+		"sagemaker":        "/aws/sagemaker/",
+		"secretsmanager":   "/aws/secretsmanager/",
+		"sns":              "sns/",
+		"ssm":              "/aws/ssm/",
+		"stepfunctions":    "/aws/states/",
+		"transfer":         "/aws/transfer/",
+	}
+}
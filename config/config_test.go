@@ -0,0 +1,180 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/logzio/firehose-logs/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testFirehoseArn = "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream"
+	testRoleArn     = "arn:aws:iam::123456789012:role/test-role"
+	testSecretArn   = "arn:aws:secretsmanager:us-east-1:123456789012:secret:custom-groups-AbCdEf"
+)
+
+func TestLoad(t *testing.T) {
+	t.Setenv(common.EnvServices, " lambda, rds,,vpc ")
+	t.Setenv(common.EnvCustomGroups, " group1,group2 ")
+	t.Setenv(common.EnvSecretEnabled, "TRUE")
+	t.Setenv(common.EnvAwsRegion, "us-east-1")
+	t.Setenv(EnvStackName, "test-stack")
+	t.Setenv(EnvFirehoseArn, testFirehoseArn)
+	t.Setenv(EnvDestinationArn, "")
+	t.Setenv(EnvPutSubscriptionFilterRole, testRoleArn)
+
+	c := Load()
+
+	assert.Equal(t, []string{"lambda", "rds", "vpc"}, c.Services)
+	assert.Equal(t, "group1,group2", c.CustomLogGroups)
+	assert.True(t, c.SecretEnabled)
+	assert.Equal(t, "us-east-1", c.Region)
+	assert.Equal(t, "test-stack", c.StackName)
+	assert.Equal(t, testFirehoseArn, c.DestinationArn)
+	assert.Equal(t, testRoleArn, c.RoleArn)
+}
+
+func TestLoadDestinationArn(t *testing.T) {
+	t.Setenv(EnvFirehoseArn, testFirehoseArn)
+	t.Setenv(EnvDestinationArn, "")
+	assert.Equal(t, testFirehoseArn, Load().DestinationArn)
+
+	t.Setenv(EnvDestinationArn, "arn:aws:kinesis:us-east-1:123456789012:stream/stream1")
+	assert.Equal(t, "arn:aws:kinesis:us-east-1:123456789012:stream/stream1", Load().DestinationArn)
+}
+
+func TestLoadTypedValues(t *testing.T) {
+	t.Setenv(EnvMaxConcurrency, " 20 ")
+	t.Setenv(EnvApiRateLimit, "2.5")
+	t.Setenv(EnvDryRun, "True")
+	t.Setenv(EnvTagEventsEnabled, "")
+	t.Setenv(EnvRegions, "us-west-2, eu-central-1")
+	t.Setenv(EnvDestinations, `{"security":{"arn":"arn:aws:logs:us-east-1:123456789012:destination:security"}}`)
+	t.Setenv(EnvRoutingRules, `[{"destination":"security","services":["lambda"]}]`)
+	t.Setenv(EnvOrganizationAccountTags, `{"team":"a"}`)
+
+	c := Load()
+
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, 20, c.MaxConcurrency)
+	assert.Equal(t, 2.5, c.ApiRateLimit)
+	assert.True(t, c.DryRun)
+	assert.False(t, c.TagEventsEnabled)
+	assert.Equal(t, []string{"us-west-2", "eu-central-1"}, c.Regions)
+	assert.Equal(t, map[string]Destination{"security": {Arn: "arn:aws:logs:us-east-1:123456789012:destination:security"}}, c.Destinations)
+	assert.Equal(t, []RoutingRule{{Destination: "security", Services: []string{"lambda"}}}, c.RoutingRules)
+	assert.Equal(t, map[string]string{"team": "a"}, c.OrganizationAccountTags)
+}
+
+func TestLoadDefaults(t *testing.T) {
+	t.Setenv(EnvMaxConcurrency, "")
+	t.Setenv(EnvApiRateLimit, "")
+
+	c := Load()
+
+	assert.Equal(t, DefaultMaxConcurrency, c.MaxConcurrency)
+	assert.Equal(t, float64(DefaultApiRateLimit), c.ApiRateLimit)
+}
+
+func TestLoadInvalidValues(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           string
+		value         string
+		expectedError string
+	}{
+		{name: "not an integer", env: EnvMaxConcurrency, value: "abc", expectedError: "invalid MAX_CONCURRENCY 'abc', must be a positive integer"},
+		{name: "not a positive integer", env: EnvMaxConcurrency, value: "0", expectedError: "invalid MAX_CONCURRENCY '0', must be a positive integer"},
+		{name: "not a number", env: EnvApiRateLimit, value: "fast", expectedError: "invalid API_RATE_LIMIT 'fast', must be a positive number"},
+		{name: "not a boolean", env: EnvTagEventsEnabled, value: "yes", expectedError: "invalid TAG_EVENTS_ENABLED 'yes', must be true or false"},
+		{name: "destinations are not an object", env: EnvDestinations, value: `["security"]`, expectedError: "invalid DESTINATIONS, must be a JSON object of names to"},
+		{name: "routing rules are not an array", env: EnvRoutingRules, value: `{"destination":"security"}`, expectedError: "invalid ROUTING_RULES, must be a JSON array of"},
+		{name: "account tags are not an object", env: EnvOrganizationAccountTags, value: "team=a", expectedError: "invalid ORGANIZATION_ACCOUNT_TAGS, must be a JSON object of tag keys to values"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(test.env, test.value)
+
+			c := Load()
+
+			assert.False(t, c.Valid(test.env))
+			assert.ErrorContains(t, c.Validate(), test.expectedError)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name           string
+		conf           Config
+		required       []string
+		expectedErrors []string
+	}{
+		{
+			name:     "valid",
+			conf:     Config{Services: []string{"lambda", "apigateway"}, Region: "us-east-1", StackName: "test-stack", RoleArn: testRoleArn},
+			required: []string{common.EnvAwsRegion, EnvStackName},
+		},
+		{
+			name:     "valid secret",
+			conf:     Config{CustomLogGroups: testSecretArn, SecretEnabled: true, secretEnabledValue: "true"},
+			required: []string{common.EnvCustomGroups},
+		},
+		{
+			name:           "missing required",
+			conf:           Config{DestinationArn: testFirehoseArn},
+			required:       []string{common.EnvAwsRegion, EnvStackName, EnvFirehoseArn},
+			expectedErrors: []string{"AWS_REGION must be set", "STACK_NAME must be set"},
+		},
+		{
+			name:           "unknown services",
+			conf:           Config{Services: []string{"lambda", "apigateway-websocket", "cloudwatch"}},
+			expectedErrors: []string{"unknown service 'apigateway-websocket' in SERVICES", "unknown service 'cloudwatch' in SERVICES"},
+		},
+		{
+			name:           "invalid secret enabled",
+			conf:           Config{secretEnabledValue: "yes"},
+			expectedErrors: []string{"invalid SECRET_ENABLED 'yes', must be true or false"},
+		},
+		{
+			name:           "secret is not an ARN",
+			conf:           Config{CustomLogGroups: "group1,group2", SecretEnabled: true, secretEnabledValue: "true"},
+			expectedErrors: []string{"invalid custom log groups secret ARN 'group1,group2'"},
+		},
+		{
+			name:           "secret is an SSM parameter",
+			conf:           Config{CustomLogGroups: "arn:aws:ssm:us-east-1:123456789012:parameter/groups", SecretEnabled: true, secretEnabledValue: "true"},
+			expectedErrors: []string{"expected an ARN of secretsmanager, got an ARN of ssm"},
+		},
+		{
+			name:           "role is not a role",
+			conf:           Config{RoleArn: "arn:aws:iam::123456789012:user/test-user"},
+			expectedErrors: []string{"invalid role ARN 'arn:aws:iam::123456789012:user/test-user' in PUT_SF_ROLE: expected a resource of the form role/<name>"},
+		},
+		{
+			name:     "every problem is listed",
+			conf:     Config{Services: []string{"not-a-service"}, RoleArn: "some-role"},
+			required: []string{EnvStackName},
+			expectedErrors: []string{
+				"3 errors occurred",
+				"STACK_NAME must be set",
+				"unknown service 'not-a-service'",
+				"invalid role ARN 'some-role'",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.conf.Validate(test.required...)
+
+			if len(test.expectedErrors) == 0 {
+				assert.Nil(t, err)
+			}
+			for _, expected := range test.expectedErrors {
+				assert.ErrorContains(t, err, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/logzio/firehose-logs/common"
+)
+
+// accountPolicyDocument is the policy document of an account level subscription filter policy
+type accountPolicyDocument struct {
+	DestinationArn string `json:"DestinationArn"`
+	RoleArn        string `json:"RoleArn,omitempty"`
+	FilterPattern  string `json:"FilterPattern"`
+	Distribution   string `json:"Distribution,omitempty"`
+}
+
+// buildSelectionCriteria returns the account policy selection criteria which excludes the given log groups
+func buildSelectionCriteria(exclusions []string) string {
+	if len(exclusions) == 0 {
+		return emptyString
+	}
+
+	// the log group names are quoted the same way as JSON strings
+	names, _ := json.Marshal(exclusions)
+	return fmt.Sprintf("LogGroupName NOT IN %s", names)
+}
+
+// desiredAccountPolicy returns the account policy which matches the config
+func desiredAccountPolicy() (*cloudwatchlogs.PutAccountPolicyInput, error) {
+	document, err := json.Marshal(accountPolicyDocument{
+		DestinationArn: envConfig.destinationArn,
+		RoleArn:        envConfig.roleArn,
+		FilterPattern:  envConfig.filterPattern,
+		Distribution:   envConfig.distribution,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	input := &cloudwatchlogs.PutAccountPolicyInput{
+		PolicyName:     aws.String(envConfig.filterName),
+		PolicyType:     aws.String(cloudwatchlogs.PolicyTypeSubscriptionFilterPolicy),
+		PolicyDocument: aws.String(string(document)),
+		Scope:          aws.String(cloudwatchlogs.ScopeAll),
+	}
+	if criteria := buildSelectionCriteria(envConfig.accountPolicyExclusions); criteria != emptyString {
+		input.SelectionCriteria = aws.String(criteria)
+	}
+	return input, nil
+}
+
+// getAccountPolicy returns our account level subscription filter policy, or nil if it doesn't exist
+func (cwLogsClient *CloudWatchLogsClient) getAccountPolicy(ctx context.Context, policyName string) (*cloudwatchlogs.AccountPolicy, error) {
+	var output *cloudwatchlogs.DescribeAccountPoliciesOutput
+	err := retryPolicy.Do(ctx, func() error {
+		var err error
+		output, err = cwLogsClient.Client.DescribeAccountPoliciesWithContext(ctx, &cloudwatchlogs.DescribeAccountPoliciesInput{
+			PolicyName: aws.String(policyName),
+			PolicyType: aws.String(cloudwatchlogs.PolicyTypeSubscriptionFilterPolicy),
+		})
+		return err
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, policy := range output.AccountPolicies {
+		if aws.StringValue(policy.PolicyName) == policyName {
+			return policy, nil
+		}
+	}
+	return nil, nil
+}
+
+// isAccountPolicyDrifted checks if the existing account policy differs from the desired one. A policy without a
+// distribution has the default one, which CloudWatch Logs may store in the policy document.
+func isAccountPolicyDrifted(existing *cloudwatchlogs.AccountPolicy, desired *cloudwatchlogs.PutAccountPolicyInput) bool {
+	var existingDocument, desiredDocument accountPolicyDocument
+	if err := json.Unmarshal([]byte(aws.StringValue(existing.PolicyDocument)), &existingDocument); err != nil {
+		return true
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(desired.PolicyDocument)), &desiredDocument); err != nil {
+		return true
+	}
+	for _, document := range []*accountPolicyDocument{&existingDocument, &desiredDocument} {
+		if document.Distribution == emptyString {
+			document.Distribution = defaultDistribution
+		}
+	}
+
+	return existingDocument != desiredDocument ||
+		aws.StringValue(existing.SelectionCriteria) != aws.StringValue(desired.SelectionCriteria)
+}
+
+// putAccountPolicy creates or updates our account level subscription filter policy, unless it's up to date
+func (cwLogsClient *CloudWatchLogsClient) putAccountPolicy(ctx context.Context) (filterStatus, error) {
+	desired, err := desiredAccountPolicy()
+	if err != nil {
+		return emptyString, err
+	}
+
+	existing, err := cwLogsClient.getAccountPolicy(ctx, aws.StringValue(desired.PolicyName))
+	if err != nil {
+		return emptyString, fmt.Errorf("failed to get account policy %s: %w", aws.StringValue(desired.PolicyName), err)
+	}
+
+	status := filterAdded
+	if existing != nil {
+		if !isAccountPolicyDrifted(existing, desired) {
+			sugLog.Debugf("Account policy %s is up to date, skipping", aws.StringValue(desired.PolicyName))
+			return filterUnchanged, nil
+		}
+		status = filterUpdated
+	}
+
+	if cwLogsClient.dryRun {
+		sugLog.Infof("Dry run, planned putting account policy %s (%s): %s", aws.StringValue(desired.PolicyName), status, desired)
+		return status, nil
+	}
+
+	err = retryPolicy.Do(ctx, func() error {
+		_, err := cwLogsClient.Client.PutAccountPolicyWithContext(ctx, desired)
+		return err
+	})
+	if err != nil {
+		return emptyString, fmt.Errorf("failed to put account policy %s: %w", aws.StringValue(desired.PolicyName), err)
+	}
+
+	sugLog.Infof("Put account policy %s (%s)", aws.StringValue(desired.PolicyName), status)
+	return status, nil
+}
+
+// deleteAccountPolicy deletes our account level subscription filter policy if it exists
+func (cwLogsClient *CloudWatchLogsClient) deleteAccountPolicy(ctx context.Context) (filterStatus, error) {
+	policyName := envConfig.filterName
+
+	existing, err := cwLogsClient.getAccountPolicy(ctx, policyName)
+	if err != nil {
+		return emptyString, fmt.Errorf("failed to get account policy %s: %w", policyName, err)
+	}
+	if existing == nil {
+		sugLog.Debugf("Account policy %s doesn't exist, skipping", policyName)
+		return emptyString, nil
+	}
+
+	if cwLogsClient.dryRun {
+		sugLog.Infof("Dry run, planned deleting account policy %s", policyName)
+		return filterRemoved, nil
+	}
+
+	err = retryPolicy.Do(ctx, func() error {
+		_, err := cwLogsClient.Client.DeleteAccountPolicyWithContext(ctx, &cloudwatchlogs.DeleteAccountPolicyInput{
+			PolicyName: aws.String(policyName),
+			PolicyType: aws.String(cloudwatchlogs.PolicyTypeSubscriptionFilterPolicy),
+		})
+		return err
+	})
+	if err != nil {
+		return emptyString, fmt.Errorf("failed to delete account policy %s: %w", policyName, err)
+	}
+
+	sugLog.Info("Deleted account policy ", policyName)
+	return filterRemoved, nil
+}
+
+// handleAccountPolicyEvent manages the lifecycle of the account level subscription filter policy
+func handleAccountPolicyEvent(ctx context.Context, action common.ActionType, dryRun bool) (Result, error) {
+	cwClient, err := getCloudWatchLogsClient()
+	if err != nil {
+		sugLog.Error("Failed to get cloudwatch logs client")
+		return Result{}, err
+	}
+	cwClient.dryRun = cwClient.dryRun || dryRun
+
+	var status filterStatus
+	switch action {
+	case common.AddSF, common.UpdateSF, common.ReconcileSF:
+		status, err = cwClient.putAccountPolicy(ctx)
+	case common.StatusSF:
+		cwClient.dryRun = true
+		status, err = cwClient.putAccountPolicy(ctx)
+	case common.DeleteSF:
+		status, err = cwClient.deleteAccountPolicy(ctx)
+	default:
+		return Result{}, fmt.Errorf("unsupported account policy action %s", action)
+	}
+
+	return Result{AccountPolicy: status, DryRun: cwClient.dryRun}, err
+}
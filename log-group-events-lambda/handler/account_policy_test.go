@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func (m *MockCloudWatchLogsClient) DescribeAccountPoliciesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeAccountPoliciesInput, opts ...request.Option) (*cloudwatchlogs.DescribeAccountPoliciesOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*cloudwatchlogs.DescribeAccountPoliciesOutput), args.Error(1)
+}
+
+func (m *MockCloudWatchLogsClient) PutAccountPolicyWithContext(ctx aws.Context, input *cloudwatchlogs.PutAccountPolicyInput, opts ...request.Option) (*cloudwatchlogs.PutAccountPolicyOutput, error) {
+	args := m.Called(input)
+	return &cloudwatchlogs.PutAccountPolicyOutput{}, args.Error(1)
+}
+
+func (m *MockCloudWatchLogsClient) DeleteAccountPolicyWithContext(ctx aws.Context, input *cloudwatchlogs.DeleteAccountPolicyInput, opts ...request.Option) (*cloudwatchlogs.DeleteAccountPolicyOutput, error) {
+	args := m.Called(input)
+	return &cloudwatchlogs.DeleteAccountPolicyOutput{}, args.Error(1)
+}
+
+func TestBuildSelectionCriteria(t *testing.T) {
+	tests := []struct {
+		name       string
+		exclusions []string
+		expected   string
+	}{
+		{
+			name:       "no exclusions",
+			exclusions: nil,
+			expected:   "",
+		},
+		{
+			name:       "exclusions",
+			exclusions: []string{"/aws/lambda/function1", "/custom/\"quoted\""},
+			expected:   `LogGroupName NOT IN ["/aws/lambda/function1","/custom/\"quoted\""]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, buildSelectionCriteria(test.exclusions))
+		})
+	}
+}
+
+func TestPutAccountPolicy(t *testing.T) {
+	setupSFTest()
+	envConfig.accountPolicyExclusions = []string{"/aws/lambda/function1"}
+
+	desired, err := desiredAccountPolicy()
+	assert.Nil(t, err)
+
+	// CloudWatch Logs stores the default distribution of a policy which doesn't set one
+	var stored accountPolicyDocument
+	assert.Nil(t, json.Unmarshal([]byte(*desired.PolicyDocument), &stored))
+	assert.Equal(t, emptyString, stored.Distribution)
+	stored.Distribution = defaultDistribution
+	storedDocument, err := json.Marshal(stored)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name           string
+		existing       []*cloudwatchlogs.AccountPolicy
+		dryRun         bool
+		expectedStatus filterStatus
+		expectedPut    bool
+	}{
+		{
+			name:           "new policy",
+			existing:       nil,
+			expectedStatus: filterAdded,
+			expectedPut:    true,
+		},
+		{
+			name: "up to date policy",
+			existing: []*cloudwatchlogs.AccountPolicy{{
+				PolicyName:        desired.PolicyName,
+				PolicyDocument:    desired.PolicyDocument,
+				SelectionCriteria: desired.SelectionCriteria,
+			}},
+			expectedStatus: filterUnchanged,
+			expectedPut:    false,
+		},
+		{
+			name: "up to date policy with the default distribution",
+			existing: []*cloudwatchlogs.AccountPolicy{{
+				PolicyName:        desired.PolicyName,
+				PolicyDocument:    aws.String(string(storedDocument)),
+				SelectionCriteria: desired.SelectionCriteria,
+			}},
+			expectedStatus: filterUnchanged,
+			expectedPut:    false,
+		},
+		{
+			name: "drifted selection criteria",
+			existing: []*cloudwatchlogs.AccountPolicy{{
+				PolicyName:     desired.PolicyName,
+				PolicyDocument: desired.PolicyDocument,
+			}},
+			expectedStatus: filterUpdated,
+			expectedPut:    true,
+		},
+		{
+			name: "drifted document in dry run",
+			existing: []*cloudwatchlogs.AccountPolicy{{
+				PolicyName:        desired.PolicyName,
+				PolicyDocument:    aws.String(`{"DestinationArn":"other-arn","FilterPattern":""}`),
+				SelectionCriteria: desired.SelectionCriteria,
+			}},
+			dryRun:         true,
+			expectedStatus: filterUpdated,
+			expectedPut:    false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockClient := new(MockCloudWatchLogsClient)
+			mockClient.On("DescribeAccountPoliciesWithContext", mock.Anything).Return(&cloudwatchlogs.DescribeAccountPoliciesOutput{AccountPolicies: test.existing}, nil)
+			mockClient.On("PutAccountPolicyWithContext", desired).Return(&cloudwatchlogs.PutAccountPolicyOutput{}, nil)
+
+			cwClient := &CloudWatchLogsClient{Client: mockClient, dryRun: test.dryRun}
+			status, err := cwClient.putAccountPolicy(context.Background())
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedStatus, status)
+			if test.expectedPut {
+				mockClient.AssertCalled(t, "PutAccountPolicyWithContext", desired)
+			} else {
+				mockClient.AssertNotCalled(t, "PutAccountPolicyWithContext", mock.Anything)
+			}
+		})
+	}
+}
+
+func TestDeleteAccountPolicy(t *testing.T) {
+	setupSFTest()
+
+	tests := []struct {
+		name           string
+		existing       []*cloudwatchlogs.AccountPolicy
+		describeErr    error
+		expectedStatus filterStatus
+		expectedDelete bool
+	}{
+		{
+			name:           "existing policy",
+			existing:       []*cloudwatchlogs.AccountPolicy{{PolicyName: aws.String(envConfig.filterName)}},
+			expectedStatus: filterRemoved,
+			expectedDelete: true,
+		},
+		{
+			name:           "policy doesn't exist",
+			describeErr:    awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "policy not found", nil),
+			expectedStatus: "",
+			expectedDelete: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockClient := new(MockCloudWatchLogsClient)
+			mockClient.On("DescribeAccountPoliciesWithContext", mock.Anything).Return(&cloudwatchlogs.DescribeAccountPoliciesOutput{AccountPolicies: test.existing}, test.describeErr)
+			mockClient.On("DeleteAccountPolicyWithContext", mock.Anything).Return(&cloudwatchlogs.DeleteAccountPolicyOutput{}, nil)
+
+			cwClient := &CloudWatchLogsClient{Client: mockClient}
+			status, err := cwClient.deleteAccountPolicy(context.Background())
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedStatus, status)
+			if test.expectedDelete {
+				mockClient.AssertCalled(t, "DeleteAccountPolicyWithContext", mock.Anything)
+			} else {
+				mockClient.AssertNotCalled(t, "DeleteAccountPolicyWithContext", mock.Anything)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// accountIdPattern matches the 12 digits id of an AWS account
+var accountIdPattern = regexp.MustCompile(`^\d{12}$`)
+
+// parseMemberAccounts validates the account ids, skipping this account and duplicates
+func parseMemberAccounts(values []string, thisAccountId string) ([]string, error) {
+	accounts := make([]string, 0)
+	for _, account := range values {
+		if account == emptyString {
+			continue
+		}
+		if !accountIdPattern.MatchString(account) {
+			return nil, fmt.Errorf("invalid member account id '%s', must be 12 digits", account)
+		}
+		if account == thisAccountId || slices.Contains(accounts, account) {
+			continue
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+// validateMemberAccounts validates that member accounts can be managed with the config. The log groups of a member
+// account can only be subscribed to a CloudWatch Logs destination which allows the member account in its access policy.
+func (c *Config) validateMemberAccounts() error {
+	if len(c.memberAccounts) == 0 && !c.usesOrganizations() {
+		return nil
+	}
+
+	if c.memberRoleName == emptyString {
+		return fmt.Errorf("member account role name must be set to manage member accounts")
+	}
+
+	if c.mode == modeAccountPolicy {
+		return fmt.Errorf("member accounts are not supported in %s mode", modeAccountPolicy)
+	}
+
+	if c.destinationType != destinationLogs {
+		return fmt.Errorf("destination must be a CloudWatch Logs destination to manage member accounts, got a %s destination", c.destinationType)
+	}
+	for name, destination := range c.destinations {
+		if destination.destinationType != destinationLogs {
+			return fmt.Errorf("destination '%s' must be a CloudWatch Logs destination to manage member accounts, got a %s destination", name, destination.destinationType)
+		}
+	}
+	for region, destination := range c.regionDestinations {
+		if destination.destinationType != destinationLogs {
+			return fmt.Errorf("destination of region %s must be a CloudWatch Logs destination to manage member accounts, got a %s destination", region, destination.destinationType)
+		}
+	}
+	return nil
+}
+
+// memberRoleArn returns the ARN of the role which manages the subscription filters of the member account
+func (c *Config) memberRoleArn(account string) string {
+	return roleArn(account, c.memberRoleName)
+}
+
+// isThisAccount checks if the account is the account of the function, an empty account is this account
+func (c *Config) isThisAccount(account string) bool {
+	return account == emptyString || account == c.accountId
+}
+
+// isManagedAccount checks if the subscription filters of the account are managed by the function
+func (c *Config) isManagedAccount(account string) bool {
+	return c.isThisAccount(account) || slices.Contains(c.memberAccounts, account)
+}
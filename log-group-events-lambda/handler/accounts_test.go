@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLogsDestinationArn = "arn:aws:logs:us-east-1:123456789012:destination:test-destination"
+
+func TestParseMemberAccounts(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expected      []string
+		errorExpected bool
+	}{
+		{
+			name:     "empty",
+			value:    "",
+			expected: []string{},
+		},
+		{
+			name:     "skips this account and duplicates",
+			value:    "111111111111, 222222222222,123456789012,111111111111",
+			expected: []string{"111111111111", "222222222222"},
+		},
+		{
+			name:          "invalid account id",
+			value:         "111111111111,not-an-account",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			accounts, err := parseMemberAccounts(convertStrToArr(test.value), "123456789012")
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, accounts)
+			}
+		})
+	}
+}
+
+func TestValidateMemberAccounts(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        Config
+		errorExpected bool
+	}{
+		{
+			name:   "no member accounts",
+			config: Config{destinationType: destinationFirehose},
+		},
+		{
+			name:   "valid",
+			config: Config{memberAccounts: []string{"111111111111"}, memberRoleName: "member-role", mode: modeLogGroups, destinationType: destinationLogs},
+		},
+		{
+			name:          "missing role name",
+			config:        Config{memberAccounts: []string{"111111111111"}, mode: modeLogGroups, destinationType: destinationLogs},
+			errorExpected: true,
+		},
+		{
+			name:          "account policy mode",
+			config:        Config{memberAccounts: []string{"111111111111"}, memberRoleName: "member-role", mode: modeAccountPolicy, destinationType: destinationLogs},
+			errorExpected: true,
+		},
+		{
+			name:          "firehose destination",
+			config:        Config{memberAccounts: []string{"111111111111"}, memberRoleName: "member-role", mode: modeLogGroups, destinationType: destinationFirehose},
+			errorExpected: true,
+		},
+		{
+			name: "named lambda destination",
+			config: Config{memberAccounts: []string{"111111111111"}, memberRoleName: "member-role", mode: modeLogGroups, destinationType: destinationLogs,
+				destinations: map[string]*namedDestination{"function": {name: "function", arn: testLambdaArn, destinationType: destinationLambda}}},
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.validateMemberAccounts()
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestNewConfigWithMemberAccounts(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	t.Setenv(envDestinationArn, testLogsDestinationArn)
+	t.Setenv(envMemberAccounts, "111111111111,222222222222")
+	t.Setenv(envMemberAccountRoleName, "member-role")
+
+	c, err := NewConfig()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"111111111111", "222222222222"}, c.memberAccounts)
+	assert.Equal(t, "arn:test-partition:iam::111111111111:role/member-role", c.memberRoleArn("111111111111"))
+	assert.True(t, c.isManagedAccount("222222222222"))
+	assert.True(t, c.isManagedAccount(""))
+	assert.False(t, c.isManagedAccount("333333333333"))
+}
+
+func TestAddSubscriptionFilterInMemberAccount(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	t.Setenv(envDestinationArn, testLogsDestinationArn)
+	t.Setenv(envMemberAccounts, "111111111111")
+	t.Setenv(envMemberAccountRoleName, "member-role")
+	var err error
+	envConfig, err = NewConfig()
+	assert.Nil(t, err)
+
+	// the real client validates the input before sending it, so an invalid input never gets to the server
+	var mu sync.Mutex
+	puts := make([]map[string]interface{}, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".PutSubscriptionFilter") {
+			input := make(map[string]interface{})
+			_ = json.NewDecoder(r.Body).Decode(&input)
+			mu.Lock()
+			puts = append(puts, input)
+			mu.Unlock()
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	assert.Nil(t, err)
+	cwClient := newCloudWatchLogsClient(sess, "111111111111", emptyString)
+
+	changes, err := cwClient.addSubscriptionFilter(context.Background(), []string{"group1"})
+
+	assert.Nil(t, err)
+	assert.Len(t, changes, 1)
+	assert.Len(t, puts, 1)
+	assert.Equal(t, testLogsDestinationArn, puts[0]["destinationArn"])
+	assert.NotContains(t, puts[0], "roleArn")
+}
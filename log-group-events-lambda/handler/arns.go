@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+// buildArn returns the ARN of a resource in the partition of the function
+func buildArn(service, region, account, resource string) string {
+	return arn.ARN{
+		Partition: envConfig.awsPartition,
+		Service:   service,
+		Region:    region,
+		AccountID: account,
+		Resource:  resource,
+	}.String()
+}
+
+// parseArn parses the ARN, and validates that it's in the partition of the function
+func parseArn(resourceArn string) (arn.ARN, error) {
+	parsed, err := arn.Parse(resourceArn)
+	if err != nil {
+		return arn.ARN{}, fmt.Errorf("invalid ARN format: %v", err)
+	}
+	if parsed.Partition != envConfig.awsPartition {
+		return arn.ARN{}, fmt.Errorf("ARN %s is in partition %s, while the function is in partition %s", resourceArn, parsed.Partition, envConfig.awsPartition)
+	}
+	return parsed, nil
+}
+
+// logGroupArn returns the ARN of the log group
+func logGroupArn(region, account, logGroup string) string {
+	return buildArn("logs", region, account, logGroupResourcePrefix+logGroup)
+}
+
+// roleArn returns the ARN of the IAM role
+func roleArn(account, roleName string) string {
+	return buildArn("iam", emptyString, account, roleResourcePrefix+roleName)
+}
+
+// secretNameFromArn returns the name of a secret of the account and region of the function from its ARN, which ends
+// with a hyphen and 6 random characters
+func secretNameFromArn(secretArn string) (string, error) {
+	parsed, err := parseArn(secretArn)
+	if err != nil {
+		return emptyString, err
+	}
+	if parsed.Service != "secretsmanager" || !strings.HasPrefix(parsed.Resource, secretResourcePrefix) {
+		return emptyString, fmt.Errorf("%s is not a secret ARN", secretArn)
+	}
+	if parsed.Region != envConfig.region || parsed.AccountID != envConfig.accountId {
+		return emptyString, fmt.Errorf("secret %s is not in the account and region of the function", secretArn)
+	}
+
+	name := strings.TrimPrefix(parsed.Resource, secretResourcePrefix)
+	suffixIdx := strings.LastIndex(name, "-")
+	if suffixIdx <= 0 {
+		return emptyString, fmt.Errorf("secret ARN %s is missing the random suffix", secretArn)
+	}
+	return name[:suffixIdx], nil
+}
+
+// isParameterArn checks if the value is the ARN of an SSM parameter, which can't be a log group name
+func isParameterArn(value string) bool {
+	parsed, err := arn.Parse(value)
+	return err == nil && parsed.Service == "ssm"
+}
+
+// parameterNameFromArn returns the name of an SSM parameter of the account and region of the function from its ARN. The
+// ARN of a parameter of a hierarchy omits the leading slash of its name.
+func parameterNameFromArn(parameterArn string) (string, error) {
+	parsed, err := parseArn(parameterArn)
+	if err != nil {
+		return emptyString, err
+	}
+	if parsed.Service != "ssm" || !strings.HasPrefix(parsed.Resource, parameterResourcePrefix) {
+		return emptyString, fmt.Errorf("%s is not a parameter ARN", parameterArn)
+	}
+	if parsed.Region != envConfig.region || parsed.AccountID != envConfig.accountId {
+		return emptyString, fmt.Errorf("parameter %s is not in the account and region of the function", parameterArn)
+	}
+
+	name := strings.TrimPrefix(parsed.Resource, parameterResourcePrefix)
+	if name == emptyString {
+		return emptyString, fmt.Errorf("parameter ARN %s is missing the parameter name", parameterArn)
+	}
+	if strings.Contains(name, "/") {
+		return "/" + name, nil
+	}
+	return name, nil
+}
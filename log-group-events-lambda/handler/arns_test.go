@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildArns(t *testing.T) {
+	defer setupSFTest()
+
+	tests := []struct {
+		partition           string
+		region              string
+		expectedLogGroupArn string
+		expectedRoleArn     string
+	}{
+		{
+			partition:           "aws",
+			region:              "us-east-1",
+			expectedLogGroupArn: "arn:aws:logs:us-east-1:123456789012:log-group:/aws/lambda/function1",
+			expectedRoleArn:     "arn:aws:iam::123456789012:role/role1",
+		},
+		{
+			partition:           "aws-us-gov",
+			region:              "us-gov-west-1",
+			expectedLogGroupArn: "arn:aws-us-gov:logs:us-gov-west-1:123456789012:log-group:/aws/lambda/function1",
+			expectedRoleArn:     "arn:aws-us-gov:iam::123456789012:role/role1",
+		},
+		{
+			partition:           "aws-cn",
+			region:              "cn-north-1",
+			expectedLogGroupArn: "arn:aws-cn:logs:cn-north-1:123456789012:log-group:/aws/lambda/function1",
+			expectedRoleArn:     "arn:aws-cn:iam::123456789012:role/role1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.partition, func(t *testing.T) {
+			envConfig.awsPartition = test.partition
+
+			assert.Equal(t, test.expectedLogGroupArn, logGroupArn(test.region, "123456789012", "/aws/lambda/function1"))
+			assert.Equal(t, test.expectedRoleArn, roleArn("123456789012", "role1"))
+		})
+	}
+}
+
+func TestSecretNameFromArn(t *testing.T) {
+	defer setupSFTest()
+	envConfig.accountId = "486140753397"
+
+	tests := []struct {
+		name               string
+		partition          string
+		region             string
+		arn                string
+		expectedSecretName string
+		errorExpected      bool
+	}{
+		{
+			name:               "aws partition",
+			partition:          "aws",
+			region:             "us-east-1",
+			arn:                "arn:aws:secretsmanager:us-east-1:486140753397:secret:secret-name-56y7ud",
+			expectedSecretName: "secret-name",
+		},
+		{
+			name:               "aws-us-gov partition",
+			partition:          "aws-us-gov",
+			region:             "us-gov-west-1",
+			arn:                "arn:aws-us-gov:secretsmanager:us-gov-west-1:486140753397:secret:secret-name-56y7ud",
+			expectedSecretName: "secret-name",
+		},
+		{
+			name:               "aws-cn partition",
+			partition:          "aws-cn",
+			region:             "cn-north-1",
+			arn:                "arn:aws-cn:secretsmanager:cn-north-1:486140753397:secret:secret-name-56y7ud",
+			expectedSecretName: "secret-name",
+		},
+		{
+			name:          "other partition",
+			partition:     "aws-cn",
+			region:        "cn-north-1",
+			arn:           "arn:aws:secretsmanager:cn-north-1:486140753397:secret:secret-name-56y7ud",
+			errorExpected: true,
+		},
+		{
+			name:          "other region",
+			partition:     "aws",
+			region:        "us-east-1",
+			arn:           "arn:aws:secretsmanager:us-east-2:486140753397:secret:secret-name-56y7ud",
+			errorExpected: true,
+		},
+		{
+			name:          "other account",
+			partition:     "aws",
+			region:        "us-east-1",
+			arn:           "arn:aws:secretsmanager:us-east-1:123456789012:secret:secret-name-56y7ud",
+			errorExpected: true,
+		},
+		{
+			name:          "other service",
+			partition:     "aws",
+			region:        "us-east-1",
+			arn:           "arn:aws:ssm:us-east-1:486140753397:parameter/secret-name",
+			errorExpected: true,
+		},
+		{
+			name:          "missing suffix",
+			partition:     "aws",
+			region:        "us-east-1",
+			arn:           "arn:aws:secretsmanager:us-east-1:486140753397:secret:secretName",
+			errorExpected: true,
+		},
+		{
+			name:          "not an ARN",
+			partition:     "aws",
+			region:        "us-east-1",
+			arn:           "secret-name",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envConfig.awsPartition = test.partition
+			envConfig.region = test.region
+
+			secretName, err := secretNameFromArn(test.arn)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+				assert.Equal(t, "", getSecretNameFromArn(test.arn))
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedSecretName, secretName)
+			}
+		})
+	}
+}
+
+func TestParameterNameFromArn(t *testing.T) {
+	defer setupSFTest()
+	envConfig.awsPartition = "aws"
+	envConfig.region = "us-east-1"
+	envConfig.accountId = "486140753397"
+
+	tests := []struct {
+		name                  string
+		arn                   string
+		expectedParameterName string
+		errorExpected         bool
+	}{
+		{
+			name:                  "parameter",
+			arn:                   "arn:aws:ssm:us-east-1:486140753397:parameter/custom-groups",
+			expectedParameterName: "custom-groups",
+		},
+		{
+			name:                  "parameter of a hierarchy",
+			arn:                   "arn:aws:ssm:us-east-1:486140753397:parameter/logzio/custom-groups",
+			expectedParameterName: "/logzio/custom-groups",
+		},
+		{
+			name:          "other region",
+			arn:           "arn:aws:ssm:us-east-2:486140753397:parameter/custom-groups",
+			errorExpected: true,
+		},
+		{
+			name:          "other account",
+			arn:           "arn:aws:ssm:us-east-1:123456789012:parameter/custom-groups",
+			errorExpected: true,
+		},
+		{
+			name:          "other resource",
+			arn:           "arn:aws:ssm:us-east-1:486140753397:document/custom-groups",
+			errorExpected: true,
+		},
+		{
+			name:          "missing name",
+			arn:           "arn:aws:ssm:us-east-1:486140753397:parameter/",
+			errorExpected: true,
+		},
+		{
+			name:          "other service",
+			arn:           "arn:aws:secretsmanager:us-east-1:486140753397:secret:custom-groups-56y7ud",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parameterName, err := parameterNameFromArn(test.arn)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedParameterName, parameterName)
+				assert.True(t, isParameterArn(test.arn))
+			}
+		})
+	}
+	assert.False(t, isParameterArn("/aws/lambda/function1"))
+}
+
+func TestGetLogGroupFromArn(t *testing.T) {
+	defer setupSFTest()
+
+	tests := []struct {
+		name             string
+		partition        string
+		arn              string
+		expectedLogGroup string
+		errorExpected    bool
+	}{
+		{
+			name:             "aws log group",
+			partition:        "aws",
+			arn:              "arn:aws:logs:us-east-1:123456789012:log-group:/aws/lambda/function1",
+			expectedLogGroup: "/aws/lambda/function1",
+		},
+		{
+			name:             "aws-us-gov log group",
+			partition:        "aws-us-gov",
+			arn:              "arn:aws-us-gov:logs:us-gov-west-1:123456789012:log-group:/aws/lambda/function1",
+			expectedLogGroup: "/aws/lambda/function1",
+		},
+		{
+			name:             "aws-cn log group",
+			partition:        "aws-cn",
+			arn:              "arn:aws-cn:logs:cn-north-1:123456789012:log-group:/aws/lambda/function1",
+			expectedLogGroup: "/aws/lambda/function1",
+		},
+		{
+			name:             "aws function",
+			partition:        "aws",
+			arn:              "arn:aws:lambda:us-east-1:123456789012:function:function1",
+			expectedLogGroup: "/aws/lambda/function1",
+		},
+		{
+			name:             "aws-us-gov function alias",
+			partition:        "aws-us-gov",
+			arn:              "arn:aws-us-gov:lambda:us-gov-west-1:123456789012:function:function1:alias1",
+			expectedLogGroup: "/aws/lambda/function1",
+		},
+		{
+			name:             "aws-cn function",
+			partition:        "aws-cn",
+			arn:              "arn:aws-cn:lambda:cn-north-1:123456789012:function:function1",
+			expectedLogGroup: "/aws/lambda/function1",
+		},
+		{
+			name:          "other partition",
+			partition:     "aws-cn",
+			arn:           "arn:aws:logs:us-east-1:123456789012:log-group:/aws/lambda/function1",
+			errorExpected: true,
+		},
+		{
+			name:          "function without name",
+			partition:     "aws",
+			arn:           "arn:aws:lambda:us-east-1:123456789012:function:",
+			errorExpected: true,
+		},
+		{
+			name:          "unsupported service",
+			partition:     "aws",
+			arn:           "arn:aws:s3:::bucket1",
+			errorExpected: true,
+		},
+		{
+			name:          "not an ARN",
+			partition:     "aws",
+			arn:           "/aws/lambda/function1",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envConfig.awsPartition = test.partition
+
+			logGroup, err := getLogGroupFromArn(test.arn)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedLogGroup, logGroup)
+			}
+		})
+	}
+}
@@ -2,72 +2,254 @@ package handler
 
 import (
 	"fmt"
-	"os"
+	"slices"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/hashicorp/go-multierror"
 	"github.com/logzio/firehose-logs/common"
+	"github.com/logzio/firehose-logs/config"
 )
 
 type Config struct {
 	awsPartition         string
 	destinationArn       string
+	destinationType      destinationType
 	roleArn              string
 	accountId            string
 	region               string
 	thisFunctionLogGroup string
 	thisFunctionName     string
 	customGroupsValue    string
-	servicesValue        string
-	filterName           string
-	filterPattern        string
-	tagEventsEnabled     bool
+	// secretEnabled is set when customGroupsValue is the ARN of the secret of the custom log groups
+	secretEnabled    bool
+	servicesValue    string
+	filterName       string
+	filterPattern    string
+	tagEventsEnabled bool
+	maxConcurrency   int
+	apiRateLimit     float64
+	// dryRun plans the subscription filter changes of every event without applying them
+	dryRun bool
+	// distribution is the distribution of the subscription filters, unless a distribution rule matches the log group.
+	// The CloudWatch Logs default is used when it's empty.
+	distribution      string
+	distributionRules []distributionRule
+	// mode is either modeLogGroups or modeAccountPolicy
+	mode string
+	// accountPolicyExclusions are the log groups which the account policy doesn't apply to
+	accountPolicyExclusions []string
+	// destinations are the named destinations of the routing rules, in addition to the default destination
+	destinations map[string]*namedDestination
+	routingRules []routingRule
+	// memberAccounts are the accounts which the function manages in addition to its own account, by assuming the
+	// memberRoleName role in each of them
+	memberAccounts   []string
+	memberRoleName   string
+	memberExternalId string
+	// memberAccountSource is either accountSourceList, where the member accounts are listed explicitly, or
+	// accountSourceOrganizations, where the active accounts of the organization are added to them
+	memberAccountSource     string
+	organizationUnits       []string
+	organizationAccountTags map[string]string
+	// memberAccountsListed is set once the accounts of the organization are added to the member accounts
+	memberAccountsListed bool
+	// regions are the regions which the function manages in addition to its own region
+	regions []string
+	// regionDestinations are the default destinations of the regions which don't follow the naming convention
+	regionDestinations map[string]*namedDestination
+	// replayQueueArn is the queue of the failed events, which the replay action re-dispatches
+	replayQueueArn string
+	// inventoryBucket is the bucket which the inventory reports are written to, in addition to the response
+	inventoryBucket string
+	// configBucket and configKey are the S3 object of the configuration file, which replaces the services, custom log
+	// groups, filter pattern, destinations and routing rules of the env variables that it sets
+	configBucket string
+	configKey    string
+	// configFileErr is the error of loading the configuration file, which only the event of a new version of the file
+	// fails with
+	configFileErr error
+	// customLogGroupsSpec are the custom log groups along with the options of their subscription filters, which are
+	// loaded when they are first needed
+	customLogGroupsSpec *customLogGroupsSpec
 }
 
-func NewConfig() *Config {
+// distributionRule sets the subscription filter distribution of the log groups with a prefix
+type distributionRule struct {
+	prefix       string
+	distribution string
+}
+
+// NewConfig reads the configuration of the function from its env variables, and validates it. The error lists every
+// problem of the configuration.
+func NewConfig() (*Config, error) {
+	shared := config.Load()
 	c := Config{
-		awsPartition:         os.Getenv(envAwsPartition),
-		destinationArn:       os.Getenv(envFirehoseArn),
-		roleArn:              os.Getenv(envPutSubscriptionFilterRole),
-		accountId:            os.Getenv(envAccountId),
-		region:               os.Getenv(common.EnvAwsRegion),
-		thisFunctionLogGroup: lambdaPrefix + os.Getenv(envFunctionName),
-		thisFunctionName:     os.Getenv(envFunctionName),
-		customGroupsValue:    os.Getenv(common.EnvCustomGroups),
-		servicesValue:        os.Getenv(common.EnvServices),
-		filterName:           os.Getenv(envStackName) + "_" + subscriptionFilterName,
-		filterPattern:        os.Getenv(envFilterPattern),
-		tagEventsEnabled:     strings.EqualFold(os.Getenv(envTagEventsEnabled), "true"),
-	}
-
-	err := c.validateRequired()
+		awsPartition:         shared.Partition,
+		destinationArn:       shared.DestinationArn,
+		roleArn:              shared.RoleArn,
+		accountId:            shared.AccountId,
+		region:               shared.Region,
+		thisFunctionLogGroup: lambdaPrefix + shared.FunctionName,
+		thisFunctionName:     shared.FunctionName,
+		customGroupsValue:    shared.CustomLogGroups,
+		secretEnabled:        shared.SecretEnabled,
+		servicesValue:        strings.Join(shared.Services, valuesSeparator),
+		filterName:           shared.StackName + "_" + subscriptionFilterName,
+		filterPattern:        shared.FilterPattern,
+		tagEventsEnabled:     shared.TagEventsEnabled,
+		maxConcurrency:       shared.MaxConcurrency,
+		apiRateLimit:         shared.ApiRateLimit,
+		dryRun:               shared.DryRun,
+		distribution:         shared.Distribution,
+		mode:                 shared.Mode,
+		memberRoleName:       shared.MemberAccountRoleName,
+		memberExternalId:     shared.MemberAccountExternalId,
+		memberAccountSource:  shared.MemberAccountSource,
+	}
+	if c.memberAccountSource == emptyString {
+		c.memberAccountSource = accountSourceList
+	}
+	if c.mode == emptyString {
+		c.mode = modeLogGroups
+	}
+	c.accountPolicyExclusions = getAccountPolicyExclusions(c.thisFunctionLogGroup, shared.StackName, shared.AccountPolicyExclusions)
+
+	var result *multierror.Error
+	if err := shared.Validate(envStackName, common.EnvAwsRegion); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := c.validateRequired(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	var err error
+	if c.distributionRules, err = parseDistributionRules(shared.DistributionRules); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	// the routing rules are only validated against valid destinations
+	if shared.Valid(envDestinations) {
+		if c.destinations, err = newNamedDestinations(shared.Destinations); err != nil {
+			result = multierror.Append(result, err)
+		} else if c.routingRules, err = newRoutingRules(shared.RoutingRules, c.destinations); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	c.regions, err = parseRegions(shared.Regions, c.region)
+	if err == nil {
+		c.regionDestinations, err = newRegionDestinations(shared.RegionDestinations, c.regions, c.roleArn)
+	}
+	if err == nil {
+		err = c.validateRegions()
+	}
 	if err != nil {
-		sugLog.Error("Error while validating required environment variables: ", err)
-		return nil
+		result = multierror.Append(result, err)
+	}
+
+	c.memberAccounts, err = parseMemberAccounts(shared.MemberAccounts, c.accountId)
+	if err == nil {
+		c.organizationUnits, err = parseOrganizationUnits(shared.OrganizationUnits)
 	}
-	return &c
+	if err == nil {
+		c.organizationAccountTags = shared.OrganizationAccountTags
+		if c.organizationAccountTags == nil {
+			c.organizationAccountTags = make(map[string]string)
+		}
+		err = c.validateMemberAccountSource()
+	}
+	if err == nil {
+		err = c.validateMemberAccounts()
+	}
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if c.replayQueueArn, err = parseReplayQueueArn(shared.ReplayQueueArn, c.awsPartition); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if c.inventoryBucket, err = parseInventoryBucket(shared.InventoryBucket); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if c.configBucket, c.configKey, err = parseConfigObject(shared.ConfigObject); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if err = result.ErrorOrNil(); err != nil {
+		sugLog.Error("Error while validating the configuration: ", err)
+		return nil, err
+	}
+	return &c, nil
 }
 
+// validateRequired validates the required values, the mode, the distribution, the destination and the filter pattern
+// of the function. The error lists every problem of them.
 func (c *Config) validateRequired() error {
+	var result *multierror.Error
 	if c.destinationArn == emptyString {
-		return fmt.Errorf("destination ARN must be set")
+		result = multierror.Append(result, fmt.Errorf("destination ARN must be set"))
 	}
-
 	if c.accountId == emptyString {
-		return fmt.Errorf("account id must be set")
+		result = multierror.Append(result, fmt.Errorf("account id must be set"))
 	}
-
 	if c.awsPartition == emptyString {
-		return fmt.Errorf("aws partition must be set")
+		result = multierror.Append(result, fmt.Errorf("aws partition must be set"))
+	}
+
+	if c.mode != emptyString && c.mode != modeLogGroups && c.mode != modeAccountPolicy {
+		result = multierror.Append(result, fmt.Errorf("invalid mode '%s', must be one of [%s %s]", c.mode, modeLogGroups, modeAccountPolicy))
+	}
+
+	if c.mode == modeAccountPolicy {
+		if size := len(buildSelectionCriteria(c.accountPolicyExclusions)); size > maxSelectionCriteriaSize {
+			result = multierror.Append(result, fmt.Errorf("account policy excluded log groups are too long, %d bytes exceed the %d bytes limit", size, maxSelectionCriteriaSize))
+		}
+	}
+
+	if c.distribution != emptyString && !isValidDistribution(c.distribution) {
+		result = multierror.Append(result, fmt.Errorf("invalid distribution '%s', must be one of %v", c.distribution, cloudwatchlogs.Distribution_Values()))
+	}
+
+	if c.destinationArn != emptyString {
+		if err := c.validateDestination(); err != nil {
+			result = multierror.Append(result, err)
+		}
 	}
 
 	if c.filterPattern != emptyString {
 		if err := c.validateFilterPattern(); err != nil {
-			return err
+			result = multierror.Append(result, err)
 		}
 	}
 
+	return result.ErrorOrNil()
+}
+
+// validateDestination validates the destination ARN and its role according to the destination type
+func (c *Config) validateDestination() error {
+	destType, err := parseDestinationType(c.destinationArn)
+	if err != nil {
+		return err
+	}
+	c.destinationType = destType
+
+	if !destType.requiresRole() {
+		if c.roleArn != emptyString {
+			sugLog.Warnf("A role is not used with %s destinations, ignoring role %s", destType, c.roleArn)
+			c.roleArn = emptyString
+		}
+		return nil
+	}
+
+	if c.roleArn == emptyString {
+		return fmt.Errorf("role ARN must be set for %s destinations", destType)
+	}
+	if _, err = arn.Parse(c.roleArn); err != nil {
+		return fmt.Errorf("invalid role ARN '%s': %v", c.roleArn, err)
+	}
 	return nil
 }
 
@@ -95,3 +277,69 @@ func (c *Config) validateFilterPattern() error {
 
 	return nil
 }
+
+// isValidDistribution checks if the given value is a distribution of CloudWatch Logs subscription filters
+func isValidDistribution(distribution string) bool {
+	for _, value := range cloudwatchlogs.Distribution_Values() {
+		if distribution == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDistributionRules parses the <service or log group prefix>:<distribution> rules
+func parseDistributionRules(values []string) ([]distributionRule, error) {
+	serviceToPrefix := getServicesMap()
+	rules := make([]distributionRule, 0)
+	for _, rule := range values {
+		sepIdx := strings.LastIndex(rule, ruleSeparator)
+		if sepIdx <= 0 {
+			return nil, fmt.Errorf("invalid distribution rule '%s', must be of the form <service or log group prefix>%s<distribution>", rule, ruleSeparator)
+		}
+
+		prefix := strings.TrimSpace(rule[:sepIdx])
+		distribution := strings.TrimSpace(rule[sepIdx+1:])
+		if !isValidDistribution(distribution) {
+			return nil, fmt.Errorf("invalid distribution '%s' in rule '%s', must be one of %v", distribution, rule, cloudwatchlogs.Distribution_Values())
+		}
+		if servicePrefix, ok := serviceToPrefix[prefix]; ok {
+			prefix = servicePrefix
+		}
+
+		rules = append(rules, distributionRule{prefix: prefix, distribution: distribution})
+	}
+	return rules, nil
+}
+
+// distributionOf returns the subscription filter distribution of the log group, by its longest matching distribution rule
+func (c *Config) distributionOf(logGroup string) string {
+	distribution := c.distribution
+	if distribution == emptyString {
+		distribution = defaultDistribution
+	}
+	matchLen := 0
+	for _, rule := range c.distributionRules {
+		if strings.HasPrefix(logGroup, rule.prefix) && len(rule.prefix) > matchLen {
+			distribution = rule.distribution
+			matchLen = len(rule.prefix)
+		}
+	}
+	return distribution
+}
+
+// getAccountPolicyExclusions returns the log groups which the account policy must not apply to. The log groups of the
+// functions of the stack are always excluded, to prevent their own logs from triggering them.
+func getAccountPolicyExclusions(thisFunctionLogGroup, stackName string, excluded []string) []string {
+	exclusions := []string{thisFunctionLogGroup}
+	if stackName != emptyString {
+		exclusions = append(exclusions, lambdaPrefix+stackName+cfnLambdaSuffix)
+	}
+
+	for _, logGroup := range excluded {
+		if logGroup != emptyString && !slices.Contains(exclusions, logGroup) {
+			exclusions = append(exclusions, logGroup)
+		}
+	}
+	return exclusions
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the declarative configuration of the function, which is a YAML or JSON object in S3. The keys which
+// the file sets replace the configuration of the env variables, and the others keep it.
+type configFile struct {
+	Services []string `json:"services,omitempty"`
+	// CustomLogGroups is either a comma-separated list of log groups, an array of custom log groups, or an object of
+	// include and exclude lists, as in the logzioCustomLogGroups key of the secret
+	CustomLogGroups json.RawMessage              `json:"customLogGroups,omitempty"`
+	FilterPattern   *string                      `json:"filterPattern,omitempty"`
+	Destinations    map[string]destinationConfig `json:"destinations,omitempty"`
+	// RoutingRules route the log groups of services, prefixes or tag selectors to the destinations
+	RoutingRules []routingRule `json:"routingRules,omitempty"`
+}
+
+// lastValidConfigFile is the configuration file which the function instance loaded last, which the events keep using
+// while the file is invalid or can't be downloaded
+var lastValidConfigFile *configFile
+
+// parseConfigObject parses the S3 URI of the configuration file, s3://<bucket>/<key>, into its bucket and key
+func parseConfigObject(value string) (string, string, error) {
+	uri := strings.TrimSpace(value)
+	if uri == emptyString {
+		return emptyString, emptyString, nil
+	}
+
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(uri, s3UriScheme), "/")
+	if !strings.HasPrefix(uri, s3UriScheme) || !ok || bucket == emptyString || key == emptyString {
+		return emptyString, emptyString, fmt.Errorf("invalid configuration file object %q, expected an S3 URI of the form %s<bucket>/<key>", value, s3UriScheme)
+	}
+	return bucket, key, nil
+}
+
+// parseConfigFile parses a YAML or JSON configuration file. The file is decoded as JSON, since YAML is a superset of
+// it, so the values of its keys have the same forms as the env variables. Unknown keys are rejected.
+func parseConfigFile(source string, body []byte) (*configFile, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(body, &document); err != nil {
+		return nil, fmt.Errorf("%s is not valid YAML or JSON: %v", source, err)
+	}
+	if document == nil {
+		return nil, fmt.Errorf("%s is empty", source)
+	}
+
+	raw, err := json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a mapping of string keys: %v", source, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var f configFile
+	if err = decoder.Decode(&f); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", source, err)
+	}
+	return &f, nil
+}
+
+// applyConfigFile validates the configuration file, and replaces the configuration of the env variables with the keys
+// which it sets. Nothing is replaced when any of its keys is invalid, and the error lists the problem of each key.
+func (c *Config) applyConfigFile(source string, f *configFile) error {
+	var result *multierror.Error
+	serviceToPrefix := getServicesMap()
+	for _, service := range f.Services {
+		if _, ok := serviceToPrefix[service]; !ok {
+			result = multierror.Append(result, fmt.Errorf("unknown service '%s'", service))
+		}
+	}
+
+	destinations := c.destinations
+	var destinationsErr error
+	if f.Destinations != nil {
+		if destinations, destinationsErr = newNamedDestinations(f.Destinations); destinationsErr != nil {
+			result = multierror.Append(result, destinationsErr)
+		}
+	}
+
+	// the routing rules and the custom log groups are validated against the destinations of the file
+	routingRules := c.routingRules
+	if f.RoutingRules != nil {
+		routingRules = f.RoutingRules
+	}
+	var customLogGroups *customLogGroupsSpec
+	if destinationsErr == nil {
+		if err := validateRoutingRules(routingRules, destinations); err != nil {
+			result = multierror.Append(result, err)
+		}
+		if len(f.CustomLogGroups) > 0 {
+			var err error
+			if customLogGroups, err = parseCustomLogGroupsField(source, "customLogGroups", f.CustomLogGroups, destinations); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+	}
+
+	if f.FilterPattern != nil && len(*f.FilterPattern) > maxFilterPatternLength {
+		result = multierror.Append(result, fmt.Errorf("filter pattern is longer than %d characters", maxFilterPatternLength))
+	}
+
+	if err := result.ErrorOrNil(); err != nil {
+		return fmt.Errorf("invalid %s: %w", source, err)
+	}
+
+	if f.Services != nil {
+		c.servicesValue = strings.Join(f.Services, valuesSeparator)
+	}
+	if customLogGroups != nil {
+		c.customLogGroupsSpec = customLogGroups
+	}
+	if f.FilterPattern != nil {
+		c.filterPattern = *f.FilterPattern
+	}
+	c.destinations = destinations
+	c.routingRules = routingRules
+	return nil
+}
+
+// loadConfigFile downloads the configuration file and applies it. Its filter pattern is validated with CloudWatch
+// Logs, as the filter pattern of the env variable. Nothing is replaced when the file is invalid.
+func (c *Config) loadConfigFile(ctx context.Context, s3Client *S3Client) error {
+	body, err := s3Client.getObject(ctx, c.configBucket, c.configKey)
+	if err != nil {
+		return err
+	}
+
+	f, err := parseConfigFile(c.configSource(), body)
+	if err != nil {
+		return err
+	}
+	loaded := *c
+	if err = loaded.applyConfigFile(c.configSource(), f); err != nil {
+		return err
+	}
+	if f.FilterPattern != nil {
+		if err = loaded.validateFilterPattern(); err != nil {
+			return err
+		}
+	}
+
+	*c = loaded
+	lastValidConfigFile = f
+	return nil
+}
+
+// useLastValidConfigFile applies the last valid configuration file of the function instance when the configuration
+// file failed to load, or keeps the configuration of the env variables when there is none. The error is kept for the
+// event of a new version of the file, which rejects it.
+func (c *Config) useLastValidConfigFile(loadErr error) {
+	c.configFileErr = loadErr
+	if lastValidConfigFile == nil {
+		sugLog.Warn("Error while loading configuration file, using the configuration of the env variables: ", loadErr.Error())
+		return
+	}
+
+	sugLog.Warn("Error while loading configuration file, using the last valid configuration file: ", loadErr.Error())
+	if err := c.applyConfigFile(c.configSource(), lastValidConfigFile); err != nil {
+		sugLog.Warn("Error while applying the last valid configuration file, using the configuration of the env variables: ", err.Error())
+	}
+}
+
+// configFileError returns the error of loading the configuration file, which fails the reconciliation with the file
+// so the subscription filters aren't reconciled with an outdated configuration
+func (c *Config) configFileError() error {
+	if c.configFileErr == nil {
+		return nil
+	}
+	return fmt.Errorf("error while loading configuration file: %w", c.configFileErr)
+}
+
+// configSource describes the configuration file in errors
+func (c *Config) configSource() string {
+	return fmt.Sprintf("configuration file %s%s/%s", s3UriScheme, c.configBucket, c.configKey)
+}
+
+// isConfigObject checks if the object of an S3 event is the configuration file. The key of the event may be
+// URL-encoded.
+func (c *Config) isConfigObject(bucket, key string) bool {
+	if c.configKey == emptyString || bucket != c.configBucket {
+		return false
+	}
+	if key == c.configKey {
+		return true
+	}
+	unescaped, err := url.QueryUnescape(key)
+	return err == nil && unescaped == c.configKey
+}
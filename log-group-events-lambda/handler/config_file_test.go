@@ -0,0 +1,362 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/logzio/firehose-logs/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfigSource = "configuration file s3://config-bucket/firehose/config.yaml"
+
+func TestParseConfigObject(t *testing.T) {
+	tests := []struct {
+		name           string
+		value          string
+		expectedBucket string
+		expectedKey    string
+		expectedError  bool
+	}{
+		{name: "empty", value: ""},
+		{name: "object", value: "s3://config-bucket/firehose/config.yaml", expectedBucket: "config-bucket", expectedKey: "firehose/config.yaml"},
+		{name: "missing scheme", value: "config-bucket/config.yaml", expectedError: true},
+		{name: "missing key", value: "s3://config-bucket/", expectedError: true},
+		{name: "bucket only", value: "s3://config-bucket", expectedError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket, key, err := parseConfigObject(test.value)
+
+			if test.expectedError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedBucket, bucket)
+				assert.Equal(t, test.expectedKey, key)
+			}
+		})
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	filterPattern := "ERROR"
+
+	tests := []struct {
+		name          string
+		body          string
+		expected      *configFile
+		expectedError string
+	}{
+		{
+			name: "YAML file",
+			body: `
+services: [lambda, rds]
+filterPattern: ERROR
+routingRules:
+  - destination: security
+    tags:
+      team: security
+`,
+			expected: &configFile{
+				Services:      []string{"lambda", "rds"},
+				FilterPattern: &filterPattern,
+				RoutingRules:  []routingRule{{Destination: "security", Tags: map[string]string{"team": "security"}}},
+			},
+		},
+		{
+			name:     "JSON file",
+			body:     `{"services": ["lambda"], "customLogGroups": "group1,group2"}`,
+			expected: &configFile{Services: []string{"lambda"}, CustomLogGroups: []byte(`"group1,group2"`)},
+		},
+		{
+			name:          "unknown key",
+			body:          "service: [lambda]",
+			expectedError: `unknown field "service"`,
+		},
+		{
+			name:          "empty file",
+			body:          "# nothing is configured",
+			expectedError: "is empty",
+		},
+		{
+			name:          "invalid YAML",
+			body:          "services: [lambda",
+			expectedError: "is not valid YAML or JSON",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := parseConfigFile(testConfigSource, []byte(test.body))
+
+			if test.expectedError != "" {
+				assert.ErrorContains(t, err, test.expectedError)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, f)
+			}
+		})
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.servicesValue = "lambda"
+
+	f, err := parseConfigFile(testConfigSource, []byte(`
+services: [rds, ecs]
+customLogGroups:
+  include:
+    - /my/app/*
+    - logGroup: /my/app/audit
+      destination: security
+  exclude: [/my/app/debug*]
+filterPattern: ERROR
+destinations:
+  security:
+    arn: arn:aws:logs:us-east-1:123456789012:destination:security
+routingRules:
+  - destination: security
+    tags:
+      team: security
+`))
+	assert.Nil(t, err)
+
+	err = envConfig.applyConfigFile(testConfigSource, f)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "rds,ecs", envConfig.servicesValue)
+	assert.Equal(t, "ERROR", envConfig.filterPattern)
+	assert.Contains(t, envConfig.destinations, "security")
+	assert.Len(t, envConfig.routingRules, 1)
+	customLogGroups, err := envConfig.customLogGroups()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/my/app/*", "/my/app/audit"}, customLogGroups.names())
+	assert.True(t, customLogGroups.excludes("/my/app/debug-1"))
+}
+
+func TestApplyInvalidConfigFile(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.servicesValue = "lambda"
+
+	f, err := parseConfigFile(testConfigSource, []byte(`
+services: [rds, not-a-service]
+customLogGroups:
+  - logGroup: /my/app/audit
+    destination: security
+filterPattern: `+strings.Repeat("a", maxFilterPatternLength+1)+`
+`))
+	assert.Nil(t, err)
+
+	err = envConfig.applyConfigFile(testConfigSource, f)
+
+	assert.NotNil(t, err)
+	assert.ErrorContains(t, err, "unknown service 'not-a-service'")
+	assert.ErrorContains(t, err, "unknown destination 'security'")
+	assert.ErrorContains(t, err, "filter pattern is longer than 1024 characters")
+	// nothing is replaced
+	assert.Equal(t, "lambda", envConfig.servicesValue)
+	assert.Equal(t, "", envConfig.filterPattern)
+	assert.Nil(t, envConfig.customLogGroupsSpec)
+}
+
+func TestIsConfigObject(t *testing.T) {
+	c := &Config{configBucket: "config-bucket", configKey: "firehose/my config.yaml"}
+
+	assert.True(t, c.isConfigObject("config-bucket", "firehose/my config.yaml"))
+	assert.True(t, c.isConfigObject("config-bucket", "firehose/my+config.yaml"))
+	assert.False(t, c.isConfigObject("other-bucket", "firehose/my config.yaml"))
+	assert.False(t, c.isConfigObject("config-bucket", "firehose/other.yaml"))
+	assert.False(t, (&Config{}).isConfigObject("config-bucket", ""))
+}
+
+func TestObjectCreatedEventSkipped(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.configBucket, envConfig.configKey = "config-bucket", "firehose/config.yaml"
+
+	event := objectCreatedEvent{Bucket: s3EventBucket{Name: "config-bucket"}, Object: s3EventObject{Key: "firehose/other.yaml"}}
+	result, err := event.handle(context.Background(), emptyString, emptyString)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "Object Created event skipped - not the configuration file", result.Message)
+}
+
+func TestLoadInvalidConfigFile(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	defer func() { lastValidConfigFile = nil }()
+
+	tests := []struct {
+		name        string
+		body        interface{}
+		getError    error
+		expectedErr string
+	}{
+		{
+			name:        "download failed",
+			getError:    fmt.Errorf("access denied"),
+			expectedErr: "failed to download firehose/config.yaml from bucket config-bucket: access denied",
+		},
+		{
+			name:        "invalid file",
+			body:        "services: [rds, not-a-service]",
+			expectedErr: "unknown service 'not-a-service'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lastValidConfigFile = &configFile{Services: []string{"ecs"}}
+			envConfig.servicesValue = "lambda"
+			envConfig.configBucket, envConfig.configKey = "config-bucket", "firehose/config.yaml"
+			mockClient := new(mockS3Client)
+			mockClient.On("GetObject", &s3.GetObjectInput{Bucket: aws.String("config-bucket"), Key: aws.String("firehose/config.yaml")}).Return(test.body, test.getError)
+
+			err := envConfig.loadConfigFile(context.Background(), &S3Client{Client: mockClient})
+
+			assert.ErrorContains(t, err, test.expectedErr)
+			// nothing is replaced, and the last valid file is kept
+			assert.Equal(t, "lambda", envConfig.servicesValue)
+			assert.Equal(t, &configFile{Services: []string{"ecs"}}, lastValidConfigFile)
+		})
+	}
+}
+
+func TestUseLastValidConfigFile(t *testing.T) {
+	defer func() { lastValidConfigFile = nil }()
+	loadErr := fmt.Errorf("failed to download firehose/config.yaml from bucket config-bucket: access denied")
+
+	tests := []struct {
+		name             string
+		lastValid        *configFile
+		expectedServices string
+	}{
+		{
+			name:             "without a valid file",
+			expectedServices: "lambda",
+		},
+		{
+			name:             "with a valid file",
+			lastValid:        &configFile{Services: []string{"rds", "ecs"}},
+			expectedServices: "rds,ecs",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupSFTest()
+			defer setupSFTest()
+			envConfig.servicesValue = "lambda"
+			lastValidConfigFile = test.lastValid
+
+			envConfig.useLastValidConfigFile(loadErr)
+
+			assert.Equal(t, test.expectedServices, envConfig.servicesValue)
+			assert.Equal(t, loadErr, envConfig.configFileErr)
+		})
+	}
+}
+
+func TestObjectCreatedEventInvalidConfigFile(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.configBucket, envConfig.configKey = "config-bucket", "firehose/config.yaml"
+	envConfig.useLastValidConfigFile(fmt.Errorf("invalid configuration file: unknown service 'not-a-service'"))
+
+	event := objectCreatedEvent{Bucket: s3EventBucket{Name: "config-bucket"}, Object: s3EventObject{Key: "firehose/config.yaml"}}
+	_, err := event.handle(context.Background(), emptyString, emptyString)
+
+	assert.ErrorContains(t, err, "error while loading configuration file: invalid configuration file: unknown service 'not-a-service'")
+}
+
+func TestWithConfigFileSelection(t *testing.T) {
+	defer func() { lastValidConfigFile = nil }()
+	loadErr := fmt.Errorf("failed to download configuration file")
+
+	tests := []struct {
+		name                    string
+		lastValid               *configFile
+		expectedServices        []string
+		expectedCustomLogGroups []string
+	}{
+		{
+			name:                    "with the last applied file",
+			lastValid:               &configFile{Services: []string{"rds", "lambda"}, CustomLogGroups: json.RawMessage(`["/my/app/*"]`)},
+			expectedServices:        []string{"lambda", "rds"},
+			expectedCustomLogGroups: []string{"/stack/group", "/my/app/*"},
+		},
+		{
+			name:                    "without an applied file",
+			expectedServices:        []string{"lambda"},
+			expectedCustomLogGroups: []string{"/stack/group", "*"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupSFTest()
+			defer setupSFTest()
+			envConfig.configBucket, envConfig.configKey = "config-bucket", "firehose/config.yaml"
+			lastValidConfigFile = test.lastValid
+			envConfig.useLastValidConfigFile(loadErr)
+
+			services, customLogGroups, err := withConfigFileSelection([]string{"lambda"}, []string{"/stack/group"})
+
+			assert.Nil(t, err)
+			assert.ElementsMatch(t, test.expectedServices, services)
+			assert.ElementsMatch(t, test.expectedCustomLogGroups, customLogGroups)
+		})
+	}
+}
+
+func TestReconcileEventInvalidConfigFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle func(ctx context.Context) (Result, error)
+	}{
+		{
+			name: "reconcile",
+			handle: func(ctx context.Context) (Result, error) {
+				return handleReconcileEvent(ctx, common.RequestParameters{Action: common.ReconcileSF})
+			},
+		},
+		{
+			name: "status",
+			handle: func(ctx context.Context) (Result, error) {
+				return handleReconcileEvent(ctx, common.RequestParameters{Action: common.StatusSF})
+			},
+		},
+		{
+			name: "reconcile continuation",
+			handle: func(ctx context.Context) (Result, error) {
+				return handleContinuationEvent(ctx, common.RequestParameters{
+					Action:       common.ReconcileSF,
+					Continuation: &common.Continuation{Iteration: 1, LogGroupsToAdd: []string{"group1"}},
+				})
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupSFTest()
+			defer setupSFTest()
+			envConfig.configBucket, envConfig.configKey = "config-bucket", "firehose/config.yaml"
+			envConfig.useLastValidConfigFile(fmt.Errorf("invalid configuration file: unknown service 'not-a-service'"))
+
+			_, err := test.handle(context.Background())
+
+			assert.ErrorContains(t, err, "error while loading configuration file: invalid configuration file: unknown service 'not-a-service'")
+		})
+	}
+}
@@ -16,15 +16,58 @@ func InitConfigTest() {
 
 func TestNewConfigMissingEnv(t *testing.T) {
 	InitConfigTest()
-	conf := NewConfig()
+	// other tests of the package may have set the required env variables
+	t.Setenv(envFirehoseArn, "")
+	conf, err := NewConfig()
 	assert.Nil(t, conf)
+	assert.ErrorContains(t, err, "destination ARN must be set")
+}
+
+func TestNewConfigInvalid(t *testing.T) {
+	InitConfigTest()
+	t.Setenv(envFirehoseArn, "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream")
+	t.Setenv(envPutSubscriptionFilterRole, "arn:aws:iam::123456789012:role/test-role")
+	t.Setenv(envAccountId, "aws-account-id")
+	t.Setenv(envAwsPartition, "test-partition")
+	t.Setenv(envStackName, "test-stack")
+	t.Setenv(common.EnvAwsRegion, "us-east-1")
+
+	tests := []struct {
+		name          string
+		key           string
+		value         string
+		expectedError string
+	}{
+		{name: "missing stack name", key: envStackName, value: "", expectedError: "STACK_NAME must be set"},
+		{name: "missing region", key: common.EnvAwsRegion, value: "", expectedError: "AWS_REGION must be set"},
+		{name: "unknown service", key: common.EnvServices, value: "lambda,not-a-service", expectedError: "unknown service 'not-a-service'"},
+		{name: "invalid role", key: envPutSubscriptionFilterRole, value: "arn:aws:iam::123456789012:user/test-user", expectedError: "invalid role ARN"},
+		{name: "invalid max concurrency", key: envMaxConcurrency, value: "abc", expectedError: "invalid MAX_CONCURRENCY 'abc', must be a positive integer"},
+		{name: "invalid dry run", key: envDryRun, value: "yes", expectedError: "invalid DRY_RUN 'yes', must be true or false"},
+		{name: "invalid destinations", key: envDestinations, value: `["stream"]`, expectedError: "invalid DESTINATIONS, must be a JSON object"},
+		{name: "invalid region", key: envRegions, value: "us-west-2,west", expectedError: "invalid region 'west'"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(test.key, test.value)
+			conf, err := NewConfig()
+			assert.Nil(t, conf)
+			assert.ErrorContains(t, err, test.expectedError)
+		})
+	}
 }
 
 func TestNewConfigValidRequired(t *testing.T) {
 	InitConfigTest()
 
 	/* Setup required env variable */
-	err := os.Setenv(envFirehoseArn, "test-arn")
+	err := os.Setenv(envFirehoseArn, "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream")
+	if err != nil {
+		return
+	}
+
+	err = os.Setenv(envPutSubscriptionFilterRole, "arn:aws:iam::123456789012:role/test-role")
 	if err != nil {
 		return
 	}
@@ -39,11 +82,23 @@ func TestNewConfigValidRequired(t *testing.T) {
 		return
 	}
 
-	conf := NewConfig()
+	err = os.Setenv(envStackName, "test-stack")
+	if err != nil {
+		return
+	}
+
+	err = os.Setenv(common.EnvAwsRegion, "us-east-1")
+	if err != nil {
+		return
+	}
+
+	conf, err := NewConfig()
+	assert.Nil(t, err)
 	assert.NotNil(t, conf)
-	assert.Equal(t, "test-arn", conf.destinationArn)
+	assert.Equal(t, "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream", conf.destinationArn)
 	assert.Equal(t, "aws-account-id", conf.accountId)
-	assert.Equal(t, "", conf.region)
+	assert.Equal(t, "us-east-1", conf.region)
+	assert.Equal(t, "test-stack_"+subscriptionFilterName, conf.filterName)
 	assert.Equal(t, "/aws/lambda/", conf.thisFunctionLogGroup)
 	assert.Equal(t, "", conf.thisFunctionName)
 	assert.Equal(t, "", conf.customGroupsValue)
@@ -54,7 +109,12 @@ func TestNewConfigValid(t *testing.T) {
 	InitConfigTest()
 
 	/* Setup env variable */
-	err := os.Setenv(envFirehoseArn, "test-arn")
+	err := os.Setenv(envFirehoseArn, "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream")
+	if err != nil {
+		return
+	}
+
+	err = os.Setenv(envPutSubscriptionFilterRole, "arn:aws:iam::123456789012:role/test-role")
 	if err != nil {
 		return
 	}
@@ -69,6 +129,16 @@ func TestNewConfigValid(t *testing.T) {
 		return
 	}
 
+	err = os.Setenv(envStackName, "test-stack")
+	if err != nil {
+		return
+	}
+
+	err = os.Setenv(common.EnvAwsRegion, "us-east-1")
+	if err != nil {
+		return
+	}
+
 	err = os.Setenv(envFunctionName, "g2")
 	if err != nil {
 		return
@@ -76,15 +146,19 @@ func TestNewConfigValid(t *testing.T) {
 
 	fmt.Println("test3")
 
-	conf := NewConfig()
+	conf, err := NewConfig()
+	assert.Nil(t, err)
 	assert.NotNil(t, conf)
-	assert.Equal(t, "test-arn", conf.destinationArn)
+	assert.Equal(t, "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream", conf.destinationArn)
 	assert.Equal(t, "aws-account-id", conf.accountId)
 	assert.Equal(t, "/aws/lambda/g2", conf.thisFunctionLogGroup)
 	assert.Equal(t, "g2", conf.thisFunctionName)
 	assert.Equal(t, "", conf.customGroupsValue)
 	assert.Equal(t, "", conf.servicesValue)
-	assert.Equal(t, "", conf.region)
+	assert.Equal(t, "us-east-1", conf.region)
+	assert.Equal(t, defaultMaxConcurrency, conf.maxConcurrency)
+	assert.Equal(t, float64(defaultApiRateLimit), conf.apiRateLimit)
+	assert.False(t, conf.dryRun)
 }
 
 func TestValidateRequired(t *testing.T) {
@@ -105,7 +179,7 @@ func TestValidateRequired(t *testing.T) {
 				accountId:      "",
 			},
 			expectedError: true,
-			errorStr:      "destination ARN must be set",
+			errorStr:      "aws partition must be set",
 		},
 		{
 			name: "missing 2 required",
@@ -128,12 +202,65 @@ func TestValidateRequired(t *testing.T) {
 			errorStr:      "account id must be set",
 		},
 		{
-			name: "valid",
+			name: "invalid mode",
+			conf: Config{
+				awsPartition:   "partition",
+				destinationArn: "some-arn",
+				accountId:      "accountId",
+				mode:           "everything",
+			},
+			expectedError: true,
+			errorStr:      "invalid mode 'everything', must be one of [log-groups account-policy]",
+		},
+		{
+			name: "invalid distribution",
+			conf: Config{
+				awsPartition:   "partition",
+				destinationArn: "some-arn",
+				accountId:      "accountId",
+				distribution:   "Everywhere",
+			},
+			expectedError: true,
+			errorStr:      "invalid distribution 'Everywhere', must be one of [Random ByLogStream]",
+		},
+		{
+			name: "invalid destination",
 			conf: Config{
 				awsPartition:   "partition",
 				destinationArn: "some-arn",
 				accountId:      "accountId",
 			},
+			expectedError: true,
+			errorStr:      "invalid destination ARN 'some-arn': arn: invalid prefix",
+		},
+		{
+			name: "missing role",
+			conf: Config{
+				awsPartition:   "partition",
+				destinationArn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream",
+				accountId:      "accountId",
+			},
+			expectedError: true,
+			errorStr:      "role ARN must be set for firehose destinations",
+		},
+		{
+			name: "every problem is listed",
+			conf: Config{
+				awsPartition:   "partition",
+				destinationArn: "some-arn",
+				mode:           "everything",
+			},
+			expectedError: true,
+			errorStr:      "3 errors occurred",
+		},
+		{
+			name: "valid",
+			conf: Config{
+				awsPartition:   "partition",
+				destinationArn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream",
+				roleArn:        "arn:aws:iam::123456789012:role/test-role",
+				accountId:      "accountId",
+			},
 			expectedError: false,
 			errorStr:      "",
 		},
@@ -144,7 +271,7 @@ func TestValidateRequired(t *testing.T) {
 			result := test.conf.validateRequired()
 			if test.expectedError {
 				assert.NotNil(t, result)
-				assert.Equal(t, test.errorStr, result.Error())
+				assert.ErrorContains(t, result, test.errorStr)
 			} else {
 				assert.Nil(t, result)
 			}
@@ -237,3 +364,76 @@ func TestValidateFilterPattern(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDistributionRules(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expectedRules []distributionRule
+		errorExpected bool
+	}{
+		{
+			name:          "empty",
+			value:         "",
+			expectedRules: []distributionRule{},
+		},
+		{
+			name:  "service and log group prefix",
+			value: "lambda:Random, /custom/high-volume/:Random,/custom/:ByLogStream",
+			expectedRules: []distributionRule{
+				{prefix: "/aws/lambda/", distribution: "Random"},
+				{prefix: "/custom/high-volume/", distribution: "Random"},
+				{prefix: "/custom/", distribution: "ByLogStream"},
+			},
+		},
+		{
+			name:          "missing distribution",
+			value:         "lambda",
+			errorExpected: true,
+		},
+		{
+			name:          "invalid distribution",
+			value:         "lambda:Everywhere",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := parseDistributionRules(convertStrToArr(test.value))
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedRules, rules)
+			}
+		})
+	}
+}
+
+func TestDistributionOf(t *testing.T) {
+	conf := Config{
+		distributionRules: []distributionRule{
+			{prefix: "/custom/", distribution: "Random"},
+			{prefix: "/custom/ordered/", distribution: "ByLogStream"},
+		},
+	}
+
+	assert.Equal(t, defaultDistribution, conf.distributionOf("/aws/lambda/function1"))
+	assert.Equal(t, "Random", conf.distributionOf("/custom/group1"))
+	assert.Equal(t, "ByLogStream", conf.distributionOf("/custom/ordered/group1"))
+
+	conf.distribution = "Random"
+	assert.Equal(t, "Random", conf.distributionOf("/aws/lambda/function1"))
+}
+
+func TestGetAccountPolicyExclusions(t *testing.T) {
+	exclusions := getAccountPolicyExclusions("/aws/lambda/stack-log-group-events-lambda", "stack", []string{"/custom/group1", "/aws/lambda/stack-log-group-events-lambda"})
+
+	assert.Equal(t, []string{
+		"/aws/lambda/stack-log-group-events-lambda",
+		"/aws/lambda/stack-cfn-lambda",
+		"/custom/group1",
+	}, exclusions)
+}
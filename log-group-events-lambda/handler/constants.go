@@ -1,21 +1,126 @@
 package handler
 
+import (
+	"time"
+
+	"github.com/logzio/firehose-logs/config"
+)
+
 const (
-	envFunctionName              = "AWS_LAMBDA_FUNCTION_NAME" // reserved env
-	envAccountId                 = "ACCOUNT_ID"
-	envFirehoseArn               = "FIREHOSE_ARN"
-	envAwsPartition              = "AWS_PARTITION"
-	envPutSubscriptionFilterRole = "PUT_SF_ROLE"
-	envStackName                 = "STACK_NAME"
-	envFilterPattern             = "FILTER_PATTERN"
-	envTagEventsEnabled          = "TAG_EVENTS_ENABLED"
+	envFunctionName              = config.EnvFunctionName
+	envAccountId                 = config.EnvAccountId
+	envFirehoseArn               = config.EnvFirehoseArn
+	envDestinationArn            = config.EnvDestinationArn
+	envAwsPartition              = config.EnvAwsPartition
+	envPutSubscriptionFilterRole = config.EnvPutSubscriptionFilterRole
+	envStackName                 = config.EnvStackName
+	envFilterPattern             = config.EnvFilterPattern
+	envTagEventsEnabled          = config.EnvTagEventsEnabled
+	envMaxConcurrency            = config.EnvMaxConcurrency
+	envApiRateLimit              = config.EnvApiRateLimit
+	envDryRun                    = config.EnvDryRun
+	envDistribution              = config.EnvDistribution
+	envDistributionRules         = config.EnvDistributionRules
+	envMode                      = config.EnvMode
+	envAccountPolicyExclusions   = config.EnvAccountPolicyExclusions
+	envDestinations              = config.EnvDestinations
+	envRoutingRules              = config.EnvRoutingRules
+	envMemberAccounts            = config.EnvMemberAccounts
+	envMemberAccountRoleName     = config.EnvMemberAccountRoleName
+	envMemberAccountExternalId   = config.EnvMemberAccountExternalId
+	envRegions                   = config.EnvRegions
+	envMemberAccountSource       = config.EnvMemberAccountSource
+	envOrganizationUnits         = config.EnvOrganizationUnits
+	envOrganizationAccountTags   = config.EnvOrganizationAccountTags
+	envRegionDestinations        = config.EnvRegionDestinations
+	envReplayQueueArn            = config.EnvReplayQueueArn
+	envInventoryBucket           = config.EnvInventoryBucket
+	envConfigObject              = config.EnvConfigObject
 
 	logzioSecretKeyName    = "logzioCustomLogGroups"
 	valuesSeparator        = ","
 	emptyString            = ""
 	lambdaPrefix           = "/aws/lambda/"
 	subscriptionFilterName = "logzio_firehose"
-	maxRetries             = 10
+	// defaultDistribution is the distribution CloudWatch Logs uses when none is set on the subscription filter
+	defaultDistribution = "ByLogStream"
+	ruleSeparator       = ":"
+	// serviceRulePrefix and customRulePrefix prefix the rules which select the monitored log groups in the inventory
+	serviceRulePrefix = "service:"
+	customRulePrefix  = "custom:"
+	// otherService is the service of the log groups which are not under a prefix of a known service in the inventory
+	otherService = "other"
+	// maxSubscriptionFilters is the CloudWatch Logs quota of subscription filters of a log group
+	maxSubscriptionFilters = 2
+	// maxFilterPatternLength is the CloudWatch Logs limit of the length of a subscription filter pattern
+	maxFilterPatternLength = 1024
+	// s3UriScheme is the scheme of the S3 URI of the configuration file
+	s3UriScheme = "s3://"
+	// inventoryObjectsPrefix is the key prefix of the inventory reports in the inventory bucket
+	inventoryObjectsPrefix = "firehose-logs/inventory/"
+	// defaultDestinationName is the name of the destination of log groups which don't match any routing rule
+	defaultDestinationName = "default"
+
+	defaultApiRateLimit   = config.DefaultApiRateLimit
+	defaultMaxConcurrency = config.DefaultMaxConcurrency
+
+	// continuationTimeMargin is the time left before the function deadline, in which the remaining work is handed over to a new invocation
+	continuationTimeMargin     = 30 * time.Second
+	maxContinuations           = 50
+	maxContinuationPayloadSize = 256 * 1024
+
+	// modeLogGroups puts a subscription filter on every monitored log group, modeAccountPolicy manages a single
+	// account level subscription filter policy instead
+	modeLogGroups     = "log-groups"
+	modeAccountPolicy = "account-policy"
+	// maxSelectionCriteriaSize is the CloudWatch Logs limit of the account policy selection criteria, in bytes
+	maxSelectionCriteriaSize = 25 * 1024
+	cfnLambdaSuffix          = "-cfn-lambda"
+
+	// accountSourceList manages the explicitly listed member accounts, accountSourceOrganizations manages the accounts
+	// of the organization as well
+	accountSourceList          = "list"
+	accountSourceOrganizations = "organizations"
+	organizationRootPrefix     = "r-"
+	organizationsEventSource   = "aws.organizations"
+
+	// sources and detail types of the EventBridge events which the function handles
+	cloudTrailApiCallDetailType      = "AWS API Call via CloudTrail"
+	cloudTrailServiceEventDetailType = "AWS Service Event via CloudTrail"
+	scheduledEventSource             = "aws.events"
+	scheduledEventDetailType         = "Scheduled Event"
+	sqsEventSource                   = "aws:sqs"
+	s3EventSource                    = "aws.s3"
+	s3ObjectCreatedDetailType        = "Object Created"
+
+	// secretCurrentStage is the staging label of the current version of a secret
+	secretCurrentStage = "AWSCURRENT"
+	// secretPreviousStage is the staging label of the version of a secret which was current before the current one
+	secretPreviousStage = "AWSPREVIOUS"
+	// secretAppliedStage is the staging label of the version of the custom log groups secret which was applied last
+	secretAppliedStage = "LOGZIO_APPLIED"
+	// parameterAppliedLabel is the label of the version of the custom log groups parameter which was applied last
+	parameterAppliedLabel = "LOGZIO_APPLIED"
+	// parameterStringList is the type of an SSM parameter whose value is a comma-separated list
+	parameterStringList = "StringList"
+
+	// maxReceivedMessages is the maximum number of messages SQS returns in a single receive
+	maxReceivedMessages = 10
+	// maxReplayedEvents is the maximum number of failed events which a single replay action re-dispatches
+	maxReplayedEvents = 1000
+	// replayVisibilityTimeout is the number of seconds which the received messages are hidden for during a replay,
+	// the maximum timeout of a function
+	replayVisibilityTimeout = 900
+
+	// ARN resource prefixes of the resources which the function refers to
+	logGroupResourcePrefix  = "log-group:"
+	roleResourcePrefix      = "role/"
+	secretResourcePrefix    = "secret:"
+	parameterResourcePrefix = "parameter/"
+	functionResourcePrefix  = "function:"
+
+	// targetSeparator separates the account and the region in the label of a target
+	targetSeparator = "/"
 
 	monitoringTagKey   = "logzio:subscribe"
 	monitoringTagValue = "true"
@@ -0,0 +1,302 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/logzio/firehose-logs/common"
+)
+
+// job is the remaining work of a subscription filter action, which can span multiple invocations of the function
+type job struct {
+	action    common.ActionType
+	iteration int
+	// account is the member account which the job runs in, it's empty for the account of the function
+	account string
+	// region is the region which the job runs in, it's empty for the region of the function
+	region            string
+	logGroupsToAdd    []string
+	logGroupsToRemove []string
+	prefixesToAdd     []common.PrefixCursor
+	prefixesToRemove  []common.PrefixCursor
+	result            Result
+	dryRun            bool
+	// canContinue is false for actions which are invoked synchronously, and must finish within the invocation
+	canContinue bool
+	// monitored is set for reconcile jobs, whose removal keeps the subscription filters of the monitored log groups
+	monitored *monitoredLogGroups
+	// appliedVersion is the version of the custom log groups which the job marks as applied once it completes
+	appliedVersion *common.AppliedVersion
+}
+
+// unfinishedError reports a job whose work didn't finish, so the subscription filters of its target are not fully
+// applied
+type unfinishedError struct {
+	action common.ActionType
+	reason string
+}
+
+func (e *unfinishedError) Error() string {
+	return fmt.Sprintf("%s action %s", e.action, e.reason)
+}
+
+// subscriptionOp adds or removes the subscription filter of the given log groups, and returns the changes of the handled ones
+type subscriptionOp func(ctx context.Context, logGroups []string) ([]filterChange, error)
+
+// newJobFromContinuation restores the job of a continuation event
+func newJobFromContinuation(event common.RequestParameters) (*job, error) {
+	c := event.Continuation
+	j := &job{
+		action:            event.Action,
+		iteration:         c.Iteration,
+		account:           c.Account,
+		region:            c.Region,
+		logGroupsToAdd:    c.LogGroupsToAdd,
+		logGroupsToRemove: c.LogGroupsToRemove,
+		prefixesToAdd:     c.PrefixesToAdd,
+		prefixesToRemove:  c.PrefixesToRemove,
+		dryRun:            event.DryRun,
+		canContinue:       true,
+		appliedVersion:    c.AppliedVersion,
+	}
+
+	if len(c.Result) > 0 {
+		if err := json.Unmarshal(c.Result, &j.result); err != nil {
+			return nil, fmt.Errorf("invalid result in continuation event: %v", err)
+		}
+	}
+
+	if j.action == common.ReconcileSF || j.action == common.StatusSF {
+		monitored, err := newMonitoredLogGroups()
+		if err != nil {
+			return nil, err
+		}
+		j.monitored = monitored
+	}
+	return j, nil
+}
+
+// servicesPrefixes returns the discovery cursors of the log group prefixes of the given services
+func servicesPrefixes(services []string) []common.PrefixCursor {
+	serviceToPrefix := getServicesMap()
+	prefixes := make([]common.PrefixCursor, 0, len(services))
+	for _, service := range services {
+		if prefix, ok := serviceToPrefix[service]; ok {
+			prefixes = append(prefixes, common.PrefixCursor{Prefix: prefix})
+		}
+	}
+	return prefixes
+}
+
+// done checks if there is no remaining work in the job
+func (j *job) done() bool {
+	return len(j.logGroupsToAdd) == 0 && len(j.logGroupsToRemove) == 0 && len(j.prefixesToAdd) == 0 && len(j.prefixesToRemove) == 0
+}
+
+// continuation returns the checkpoint of the remaining work and the aggregated result
+func (j *job) continuation() (*common.Continuation, error) {
+	result, err := json.Marshal(j.result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.Continuation{
+		Iteration:         j.iteration + 1,
+		Account:           j.account,
+		Region:            j.region,
+		LogGroupsToAdd:    j.logGroupsToAdd,
+		LogGroupsToRemove: j.logGroupsToRemove,
+		PrefixesToAdd:     j.prefixesToAdd,
+		PrefixesToRemove:  j.prefixesToRemove,
+		Result:            result,
+		AppliedVersion:    j.appliedVersion,
+	}, nil
+}
+
+// run works on the job until it's done or ctx is done, and returns the errors which are not caused by running out of time
+func (j *job) run(ctx context.Context, cwLogsClient *CloudWatchLogsClient) error {
+	var errs *multierror.Error
+
+	added, err := j.runOp(ctx, cwLogsClient, cwLogsClient.addSubscriptionFilter, &j.logGroupsToAdd, &j.prefixesToAdd)
+	j.result.record(added)
+	errs = multierror.Append(errs, err)
+
+	removed, err := j.runOp(ctx, cwLogsClient, j.removeOp(cwLogsClient), &j.logGroupsToRemove, &j.prefixesToRemove)
+	j.result.record(removed)
+	errs = multierror.Append(errs, err)
+
+	return errs.ErrorOrNil()
+}
+
+// removeOp returns the op which removes the subscription filter of the job, which skips the monitored log groups and
+// the log groups without the filter in a reconcile job
+func (j *job) removeOp(cwLogsClient *CloudWatchLogsClient) subscriptionOp {
+	if j.monitored == nil {
+		return cwLogsClient.removeSubscriptionFilter
+	}
+	return func(ctx context.Context, logGroups []string) ([]filterChange, error) {
+		return cwLogsClient.removeStaleSubscriptionFilter(ctx, j.monitored.unmonitored(logGroups))
+	}
+}
+
+// runOp applies op to the pending log groups, and then to the log groups under the prefixes page by page, so the
+// work that remains when ctx is done is kept as pending log groups and prefix cursors
+func (j *job) runOp(ctx context.Context, cwLogsClient *CloudWatchLogsClient, op subscriptionOp, logGroups *[]string, prefixes *[]common.PrefixCursor) ([]filterChange, error) {
+	var errs *multierror.Error
+
+	handled, pending, err := applyOp(ctx, op, *logGroups)
+	*logGroups = pending
+	errs = multierror.Append(errs, err)
+
+	for len(*prefixes) > 0 && ctx.Err() == nil {
+		cursor := &(*prefixes)[0]
+		page, nextToken, err := cwLogsClient.getLogGroupsPage(ctx, cursor.Prefix, cursor.NextToken)
+		if err != nil {
+			if isOutOfTimeError(err) {
+				break
+			}
+			sugLog.Error("Failed to get log groups with prefix: ", cursor.Prefix)
+			errs = multierror.Append(errs, fmt.Errorf("failed to get log groups with prefix %s: %w", cursor.Prefix, err))
+			*prefixes = (*prefixes)[1:]
+			continue
+		}
+
+		if nextToken == emptyString {
+			*prefixes = (*prefixes)[1:]
+		} else {
+			cursor.NextToken = nextToken
+		}
+
+		pageHandled, pending, err := applyOp(ctx, op, page)
+		handled = append(handled, pageHandled...)
+		*logGroups = append(*logGroups, pending...)
+		errs = multierror.Append(errs, err)
+	}
+
+	return handled, errs.ErrorOrNil()
+}
+
+// applyOp applies op to the log groups, and returns the changes of the handled log groups, the ones left pending since ctx is done, and the errors
+func applyOp(ctx context.Context, op subscriptionOp, logGroups []string) ([]filterChange, []string, error) {
+	if len(logGroups) == 0 {
+		return nil, nil, nil
+	}
+
+	handled, err := op(ctx, logGroups)
+	pending, err := splitPending(err)
+	return handled, pending, err
+}
+
+// withTimeMargin returns a context which is done the given margin before the deadline of ctx
+func withTimeMargin(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+// executeJob runs the job until it's done, or re-invokes the function with a continuation event when the invocation
+// is about to time out. The invocation which finishes the job returns the aggregated result of all invocations.
+func executeJob(ctx context.Context, j *job) (Result, error) {
+	cwClient, err := getCloudWatchLogsClientFor(j.account, j.region)
+	if err != nil {
+		sugLog.Error("Failed to get cloudwatch logs client")
+		return Result{}, err
+	}
+
+	j.dryRun = j.dryRun || cwClient.dryRun
+	cwClient.dryRun = j.dryRun
+	j.result.DryRun = j.dryRun
+
+	workCtx, cancel := withTimeMargin(ctx, continuationTimeMargin)
+	defer cancel()
+
+	// errors which are not related to a specific log group fail the invocation, so lambda retries the same event
+	err = j.run(workCtx, cwClient)
+	if err = j.result.collectFailures(err); err != nil {
+		return j.result, err
+	}
+
+	if !j.done() {
+		if !j.canContinue {
+			return j.result, &unfinishedError{action: j.action, reason: "didn't finish before the function deadline"}
+		}
+		if j.iteration+1 >= maxContinuations {
+			return j.result, &unfinishedError{action: j.action, reason: fmt.Sprintf("didn't finish after %d invocations", maxContinuations)}
+		}
+
+		lambdaClient, err := getLambdaClient()
+		if err != nil {
+			return j.result, err
+		}
+		err = j.continueIn(ctx, lambdaClient)
+		return j.result, err
+	}
+
+	sugLog.Infow("Finished handling action",
+		"action", j.action,
+		"account", cwClient.account(),
+		"region", cwClient.awsRegion(),
+		"dryRun", j.dryRun,
+		"invocations", j.iteration+1,
+		"added", len(j.result.Added),
+		"updated", len(j.result.Updated),
+		"unchanged", len(j.result.Unchanged),
+		"removed", len(j.result.Removed),
+		"failed", len(j.result.Failed))
+	if j.marksAppliedVersion() {
+		markVersionApplied(ctx, j.appliedVersion, j.result)
+	}
+	return j.result, nil
+}
+
+// marksAppliedVersion checks if the job marks the version of the custom log groups which it applies once it finishes.
+// The first invocation of a job which fans out to other targets leaves it to the fan out, which marks the version once
+// all of them finish, while a target which continued marks it when its last invocation finishes.
+func (j *job) marksAppliedVersion() bool {
+	return j.appliedVersion != nil && (j.iteration > 0 || !envConfig.fansOut())
+}
+
+// continueIn invokes the function asynchronously with a continuation event of the remaining work
+func (j *job) continueIn(ctx context.Context, lambdaClient *LambdaClient) error {
+	payload, err := j.continuationPayload()
+	if err != nil {
+		return err
+	}
+
+	if len(payload) > maxContinuationPayloadSize {
+		// the handled log groups are logged instead of being carried to the final result, to fit the async invocation payload limit
+		sugLog.Warnf("Continuation event is too large, dropping handled log groups from the aggregated result. Added: %v, updated: %v, unchanged: %v, removed: %v",
+			j.result.Added, j.result.Updated, j.result.Unchanged, j.result.Removed)
+		j.result.Added, j.result.Updated, j.result.Unchanged, j.result.Removed = nil, nil, nil, nil
+		if payload, err = j.continuationPayload(); err != nil {
+			return err
+		}
+	}
+
+	sugLog.Infof("Not enough time left to finish %s action, continuing in invocation %d", j.action, j.iteration+2)
+	if err = lambdaClient.invokeSelfAsynchronously(ctx, payload); err != nil {
+		return fmt.Errorf("failed to invoke continuation of %s action: %w", j.action, err)
+	}
+
+	j.result.Continued = true
+	return nil
+}
+
+// continuationPayload returns the continuation event of the remaining work
+func (j *job) continuationPayload() ([]byte, error) {
+	continuation, err := j.continuation()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(common.NewSubscriptionFilterEvent(common.RequestParameters{
+		Action:       j.action,
+		DryRun:       j.dryRun,
+		Continuation: continuation,
+	}))
+}
@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/logzio/firehose-logs/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// pagingCloudWatchLogsClient returns the log groups of /aws/lambda/ in two pages
+type pagingCloudWatchLogsClient struct {
+	MockCloudWatchLogsClient
+}
+
+func (m *pagingCloudWatchLogsClient) DescribeLogGroupsWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogGroupsInput, opts ...request.Option) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	if aws.StringValue(input.NextToken) == "page2" {
+		return &cloudwatchlogs.DescribeLogGroupsOutput{
+			LogGroups: []*cloudwatchlogs.LogGroup{{LogGroupName: aws.String("/aws/lambda/function3")}},
+		}, nil
+	}
+	return &cloudwatchlogs.DescribeLogGroupsOutput{
+		LogGroups: []*cloudwatchlogs.LogGroup{{LogGroupName: aws.String("/aws/lambda/function1")}, {LogGroupName: aws.String("/aws/lambda/function2")}},
+		NextToken: aws.String("page2"),
+	}, nil
+}
+
+// accountCloudWatchLogsClient returns the log groups of /aws/lambda/, and every log group of the account without a prefix
+type accountCloudWatchLogsClient struct {
+	MockCloudWatchLogsClient
+}
+
+func (m *accountCloudWatchLogsClient) DescribeLogGroupsWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogGroupsInput, opts ...request.Option) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	logGroups := []*cloudwatchlogs.LogGroup{{LogGroupName: aws.String("/aws/lambda/function1")}}
+	if input.LogGroupNamePrefix == nil {
+		logGroups = append(logGroups, &cloudwatchlogs.LogGroup{LogGroupName: aws.String("unchangedGroup")}, &cloudwatchlogs.LogGroup{LogGroupName: aws.String("otherGroup")})
+	}
+	return &cloudwatchlogs.DescribeLogGroupsOutput{LogGroups: logGroups}, nil
+}
+
+func TestJobRun(t *testing.T) {
+	setupSFTest()
+
+	mockClient := new(pagingCloudWatchLogsClient)
+	mockClient.On("PutSubscriptionFilter", mock.Anything).Return(&cloudwatchlogs.PutSubscriptionFilterOutput{}, nil)
+	mockClient.On("DeleteSubscriptionFilter", mock.Anything).Return(&cloudwatchlogs.DeleteSubscriptionFilterOutput{}, nil)
+	cwClient := &CloudWatchLogsClient{Client: mockClient}
+
+	j := &job{
+		action:            common.UpdateSF,
+		logGroupsToAdd:    []string{"custom1"},
+		logGroupsToRemove: []string{"custom2"},
+		prefixesToAdd:     servicesPrefixes([]string{"lambda"}),
+	}
+	err := j.run(context.Background(), cwClient)
+	sort.Strings(j.result.Added)
+
+	assert.Nil(t, err)
+	assert.True(t, j.done())
+	assert.Equal(t, []string{"/aws/lambda/function1", "/aws/lambda/function2", "/aws/lambda/function3", "custom1"}, j.result.Added)
+	assert.Equal(t, []string{"custom2"}, j.result.Removed)
+}
+
+func TestReconcileJobRun(t *testing.T) {
+	setupSFTest()
+
+	tests := []struct {
+		name                   string
+		dryRun                 bool
+		expectedDeleteCalls    int
+		expectedPutFilterCalls int
+	}{
+		{
+			name:                   "reconcile",
+			expectedDeleteCalls:    1,
+			expectedPutFilterCalls: 1,
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockClient := new(accountCloudWatchLogsClient)
+			mockClient.On("PutSubscriptionFilter", mock.Anything).Return(&cloudwatchlogs.PutSubscriptionFilterOutput{}, nil)
+			mockClient.On("DeleteSubscriptionFilter", mock.Anything).Return(&cloudwatchlogs.DeleteSubscriptionFilterOutput{}, nil)
+			cwClient := &CloudWatchLogsClient{Client: mockClient, dryRun: test.dryRun}
+
+			j := &job{
+				action:           common.ReconcileSF,
+				prefixesToAdd:    servicesPrefixes([]string{"lambda"}),
+				prefixesToRemove: []common.PrefixCursor{{Prefix: emptyString}},
+				monitored:        &monitoredLogGroups{prefixes: []monitoredPrefix{{prefix: "/aws/lambda/", rule: "service:lambda"}}},
+			}
+			err := j.run(context.Background(), cwClient)
+
+			assert.Nil(t, err)
+			assert.True(t, j.done())
+			assert.Equal(t, []string{"/aws/lambda/function1"}, j.result.Added)
+			assert.Equal(t, []string{"unchangedGroup"}, j.result.Removed)
+			mockClient.AssertNumberOfCalls(t, "PutSubscriptionFilter", test.expectedPutFilterCalls)
+			mockClient.AssertNumberOfCalls(t, "DeleteSubscriptionFilter", test.expectedDeleteCalls)
+		})
+	}
+}
+
+func TestJobRunOutOfTime(t *testing.T) {
+	setupSFTest()
+
+	mockClient := new(pagingCloudWatchLogsClient)
+	cwClient := &CloudWatchLogsClient{Client: mockClient}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	j := &job{
+		action:         common.AddSF,
+		logGroupsToAdd: []string{"custom1", "custom2"},
+		prefixesToAdd:  servicesPrefixes([]string{"lambda"}),
+	}
+	err := j.run(ctx, cwClient)
+	sort.Strings(j.logGroupsToAdd)
+
+	assert.Nil(t, err)
+	assert.False(t, j.done())
+	assert.Empty(t, j.result.Added)
+	assert.Equal(t, []string{"custom1", "custom2"}, j.logGroupsToAdd)
+	assert.Equal(t, []common.PrefixCursor{{Prefix: "/aws/lambda/"}}, j.prefixesToAdd)
+	mockClient.AssertNotCalled(t, "PutSubscriptionFilter", mock.Anything)
+}
+
+func TestNewJobFromContinuation(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.secretEnabled = false
+	envConfig.servicesValue = "lambda"
+	envConfig.customGroupsValue = emptyString
+
+	tests := []struct {
+		name          string
+		action        common.ActionType
+		continuation  *common.Continuation
+		expectedJob   *job
+		errorExpected bool
+	}{
+		{
+			name: "with aggregated result",
+			continuation: &common.Continuation{
+				Iteration:      2,
+				LogGroupsToAdd: []string{"group1"},
+				PrefixesToAdd:  []common.PrefixCursor{{Prefix: "/aws/lambda/", NextToken: "token"}},
+				Result:         json.RawMessage(`{"message":"","added":["group0"],"removed":null,"failed":{"group2":"an error occurred"}}`),
+			},
+			expectedJob: &job{
+				action:         common.AddSF,
+				iteration:      2,
+				logGroupsToAdd: []string{"group1"},
+				prefixesToAdd:  []common.PrefixCursor{{Prefix: "/aws/lambda/", NextToken: "token"}},
+				result:         Result{Added: []string{"group0"}, Failed: map[string]string{"group2": "an error occurred"}},
+				canContinue:    true,
+			},
+		},
+		{
+			name:         "without result",
+			continuation: &common.Continuation{Iteration: 1},
+			expectedJob:  &job{action: common.AddSF, iteration: 1, canContinue: true},
+		},
+		{
+			name:   "with applied version",
+			action: common.UpdateSF,
+			continuation: &common.Continuation{
+				Iteration:      1,
+				LogGroupsToAdd: []string{"group1"},
+				AppliedVersion: &common.AppliedVersion{SecretId: "testSecretName", VersionId: "v2", PreviousVersionId: "v1"},
+			},
+			expectedJob: &job{
+				action:         common.UpdateSF,
+				iteration:      1,
+				logGroupsToAdd: []string{"group1"},
+				canContinue:    true,
+				appliedVersion: &common.AppliedVersion{SecretId: "testSecretName", VersionId: "v2", PreviousVersionId: "v1"},
+			},
+		},
+		{
+			name:         "reconcile",
+			action:       common.ReconcileSF,
+			continuation: &common.Continuation{Iteration: 1, PrefixesToRemove: []common.PrefixCursor{{Prefix: "", NextToken: "token"}}},
+			expectedJob: &job{
+				action:           common.ReconcileSF,
+				iteration:        1,
+				prefixesToRemove: []common.PrefixCursor{{Prefix: "", NextToken: "token"}},
+				canContinue:      true,
+				monitored: &monitoredLogGroups{
+					logGroups: map[string]string{},
+					prefixes:  []monitoredPrefix{{prefix: "/aws/lambda/", rule: "service:lambda"}},
+					excluded:  newCustomLogGroupsSpec(nil),
+				},
+			},
+		},
+		{
+			name:          "invalid result",
+			continuation:  &common.Continuation{Iteration: 1, Result: json.RawMessage(`"not a result"`)},
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action := test.action
+			if action == emptyString {
+				action = common.AddSF
+			}
+			j, err := newJobFromContinuation(common.RequestParameters{Action: action, Continuation: test.continuation})
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedJob, j)
+			}
+		})
+	}
+}
+
+func TestJobContinueIn(t *testing.T) {
+	setupSFTest()
+	envConfig.thisFunctionName = "this-function"
+
+	j := &job{
+		action:         common.AddSF,
+		iteration:      1,
+		account:        "111111111111",
+		logGroupsToAdd: []string{"group2"},
+		result:         Result{Added: []string{"group1"}},
+		dryRun:         true,
+		canContinue:    true,
+	}
+	payload, err := j.continuationPayload()
+	assert.Nil(t, err)
+
+	mockClient := new(mockLambdaClient)
+	mockClient.On("InvokeWithContext", mock.Anything, &lambda.InvokeInput{
+		FunctionName:   aws.String("this-function"),
+		InvocationType: aws.String("Event"),
+		Payload:        payload,
+	}).Return(&lambda.InvokeOutput{}, nil)
+
+	err = j.continueIn(context.Background(), &LambdaClient{Function: mockClient})
+
+	assert.Nil(t, err)
+	assert.True(t, j.result.Continued)
+	mockClient.AssertExpectations(t)
+
+	var event common.SubscriptionFilterEvent
+	assert.Nil(t, json.Unmarshal(payload, &event))
+	continuation := event.Detail.RequestParameters.Continuation
+	assert.Equal(t, 2, continuation.Iteration)
+	assert.Equal(t, []string{"group2"}, continuation.LogGroupsToAdd)
+
+	restored, err := newJobFromContinuation(event.Detail.RequestParameters)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"group1"}, restored.result.Added)
+	assert.True(t, restored.dryRun)
+	assert.Equal(t, "111111111111", restored.account)
+}
+
+// continuedJob returns the job which the continuation event of the job resumes
+func continuedJob(t *testing.T, j *job) *job {
+	payload, err := j.continuationPayload()
+	assert.Nil(t, err)
+	var event common.SubscriptionFilterEvent
+	assert.Nil(t, json.Unmarshal(payload, &event))
+	restored, err := newJobFromContinuation(event.Detail.RequestParameters)
+	assert.Nil(t, err)
+	return restored
+}
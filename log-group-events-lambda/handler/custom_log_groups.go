@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/logzio/firehose-logs/common"
+)
+
+// customLogGroup is a custom log group to monitor, or a prefix of log groups when it ends with a wildcard, along with
+// the options of its subscription filter which override the ones of the function
+type customLogGroup struct {
+	LogGroup string `json:"logGroup"`
+	// FilterPattern is the filter pattern of the subscription filter, the filter pattern of the function is used when
+	// it's nil
+	FilterPattern *string `json:"filterPattern,omitempty"`
+	// Destination is the name of the destination of the log group, the routing rules apply when it's empty
+	Destination string `json:"destination,omitempty"`
+}
+
+// customLogGroupsSpec are the custom log groups to monitor, and the log groups which are never monitored
+type customLogGroupsSpec struct {
+	include []customLogGroup
+	// exclude are log group names and prefixes, which are not subscribed even when they are of a monitored service
+	// or custom log group
+	exclude []string
+}
+
+// structuredCustomLogGroups is the structured form of the custom log groups of the secret
+type structuredCustomLogGroups struct {
+	Include []json.RawMessage `json:"include"`
+	Exclude []string          `json:"exclude"`
+}
+
+// newCustomLogGroupsSpec returns the spec of a list of custom log groups without options
+func newCustomLogGroupsSpec(logGroups []string) *customLogGroupsSpec {
+	spec := &customLogGroupsSpec{include: make([]customLogGroup, 0, len(logGroups))}
+	for _, logGroup := range logGroups {
+		spec.include = append(spec.include, customLogGroup{LogGroup: logGroup})
+	}
+	return spec
+}
+
+// customLogGroupsLock guards loading the custom log groups, since the jobs of the targets run concurrently
+var customLogGroupsLock sync.Mutex
+
+// customLogGroups returns the custom log groups of the function along with their options, and loads them from the
+// parameter or the secret on first use
+func (c *Config) customLogGroups() (*customLogGroupsSpec, error) {
+	customLogGroupsLock.Lock()
+	defer customLogGroupsLock.Unlock()
+	if c.customLogGroupsSpec == nil {
+		spec, err := getCustomLogGroupsSpec(c.secretEnabled, c.customGroupsValue)
+		if err != nil {
+			return nil, err
+		}
+		c.customLogGroupsSpec = spec
+	}
+	return c.customLogGroupsSpec, nil
+}
+
+// parseCustomLogGroupsSecret parses the custom log groups of a secret value
+func parseCustomLogGroupsSecret(secretId, value string, destinations map[string]*namedDestination) (*customLogGroupsSpec, error) {
+	return parseCustomLogGroupsJSON("secret "+secretId, value, destinations)
+}
+
+// parseCustomLogGroupsParameter parses the custom log groups of an SSM parameter value. The value of a StringList
+// parameter is a comma-separated list of log groups, and the value of a String or SecureString parameter is either a
+// comma-separated list of log groups or a JSON value of the custom log groups, as in a secret.
+func parseCustomLogGroupsParameter(parameterArn, parameterType, value string, destinations map[string]*namedDestination) (*customLogGroupsSpec, error) {
+	trimmed := strings.TrimSpace(value)
+	if parameterType == parameterStringList || !(strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{")) {
+		return newCustomLogGroupsSpec(convertStrToArr(trimmed)), nil
+	}
+	return parseCustomLogGroupsJSON("parameter "+parameterArn, trimmed, destinations)
+}
+
+// parseCustomLogGroupsJSON parses the custom log groups of a JSON value of the given source. The value is either a
+// JSON array of custom log groups, or a JSON object whose logzioCustomLogGroups key is a comma-separated list of log
+// groups, a JSON array of custom log groups, or an object of include and exclude lists. A custom log group of an array
+// is either a log group name or an object of its name, filter pattern and destination.
+func parseCustomLogGroupsJSON(source, value string, destinations map[string]*namedDestination) (*customLogGroupsSpec, error) {
+	trimmed := bytes.TrimSpace([]byte(value))
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		return parseCustomLogGroupsList(source, trimmed, destinations)
+	}
+
+	var secretValues map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &secretValues); err != nil {
+		return nil, fmt.Errorf("%s must be a JSON object or array: %v", source, err)
+	}
+	raw, ok := secretValues[logzioSecretKeyName]
+	if !ok {
+		return nil, fmt.Errorf("did not find logzioCustomLogGroups key in the %s", source)
+	}
+	return parseCustomLogGroupsField(source, logzioSecretKeyName, raw, destinations)
+}
+
+// parseCustomLogGroupsField parses the custom log groups of a JSON field of the given source, which is a
+// comma-separated list of log groups, a JSON array of custom log groups, or an object of include and exclude lists
+func parseCustomLogGroupsField(source, field string, raw []byte, destinations map[string]*namedDestination) (*customLogGroupsSpec, error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case bytes.HasPrefix(raw, []byte(`"`)):
+		// the comma-separated list is kept as it is for backward compatibility
+		var customLogGroups string
+		if err := json.Unmarshal(raw, &customLogGroups); err != nil {
+			return nil, fmt.Errorf("invalid %s in %s: %v", field, source, err)
+		}
+		return newCustomLogGroupsSpec(convertStrToArr(customLogGroups)), nil
+	case bytes.HasPrefix(raw, []byte("[")):
+		return parseCustomLogGroupsList(source, raw, destinations)
+	case bytes.HasPrefix(raw, []byte("{")):
+		return parseStructuredCustomLogGroups(source, raw, destinations)
+	default:
+		return nil, fmt.Errorf("%s in %s must be a comma-separated string, an array or an object of include and exclude lists, got %s", field, source, raw)
+	}
+}
+
+// parseCustomLogGroupsList parses a JSON array of custom log groups
+func parseCustomLogGroupsList(source string, raw []byte, destinations map[string]*namedDestination) (*customLogGroupsSpec, error) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("invalid custom log groups array in %s: %v", source, err)
+	}
+	return newValidatedCustomLogGroupsSpec(source, entries, nil, destinations)
+}
+
+// parseStructuredCustomLogGroups parses a JSON object of include and exclude lists of custom log groups
+func parseStructuredCustomLogGroups(source string, raw []byte, destinations map[string]*namedDestination) (*customLogGroupsSpec, error) {
+	var structured structuredCustomLogGroups
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&structured); err != nil {
+		return nil, fmt.Errorf("invalid custom log groups object in %s, must be {\"include\": [...], \"exclude\": [...]}: %v", source, err)
+	}
+	return newValidatedCustomLogGroupsSpec(source, structured.Include, structured.Exclude, destinations)
+}
+
+// newValidatedCustomLogGroupsSpec returns the spec of the include and exclude lists, and validates each of their entries
+func newValidatedCustomLogGroupsSpec(source string, include []json.RawMessage, exclude []string, destinations map[string]*namedDestination) (*customLogGroupsSpec, error) {
+	spec := &customLogGroupsSpec{include: make([]customLogGroup, 0, len(include)), exclude: make([]string, 0, len(exclude))}
+
+	seen := make(map[string]struct{}, len(include))
+	for i, raw := range include {
+		entry, err := parseCustomLogGroup(raw)
+		if err == nil {
+			err = entry.validate(destinations)
+		}
+		if err == nil {
+			if _, ok := seen[entry.LogGroup]; ok {
+				err = fmt.Errorf("duplicate log group '%s'", entry.LogGroup)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid custom log groups in %s: include[%d]: %w", source, i, err)
+		}
+		seen[entry.LogGroup] = struct{}{}
+		spec.include = append(spec.include, entry)
+	}
+
+	for i, logGroup := range exclude {
+		if err := validateCustomLogGroupName(logGroup); err != nil {
+			return nil, fmt.Errorf("invalid custom log groups in %s: exclude[%d]: %w", source, i, err)
+		}
+		spec.exclude = append(spec.exclude, logGroup)
+	}
+	return spec, nil
+}
+
+// parseCustomLogGroup parses a custom log group of an array, which is either a log group name or an object
+func parseCustomLogGroup(raw json.RawMessage) (customLogGroup, error) {
+	raw = bytes.TrimSpace(raw)
+	if bytes.HasPrefix(raw, []byte(`"`)) {
+		var logGroup string
+		err := json.Unmarshal(raw, &logGroup)
+		return customLogGroup{LogGroup: logGroup}, err
+	}
+	if !bytes.HasPrefix(raw, []byte("{")) {
+		return customLogGroup{}, fmt.Errorf("must be a log group name or an object of logGroup, filterPattern and destination, got %s", raw)
+	}
+
+	var entry customLogGroup
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&entry); err != nil {
+		return customLogGroup{}, err
+	}
+	return entry, nil
+}
+
+// validate checks the log group name of the custom log group, and that its options are valid
+func (g customLogGroup) validate(destinations map[string]*namedDestination) error {
+	if err := validateCustomLogGroupName(g.LogGroup); err != nil {
+		return err
+	}
+	if g.FilterPattern != nil && len(*g.FilterPattern) > maxFilterPatternLength {
+		return fmt.Errorf("filter pattern of '%s' exceeds %d characters", g.LogGroup, maxFilterPatternLength)
+	}
+	if _, ok := destinations[g.Destination]; !ok && g.Destination != emptyString && g.Destination != defaultDestinationName {
+		return fmt.Errorf("unknown destination '%s' of '%s'", g.Destination, g.LogGroup)
+	}
+	return nil
+}
+
+// validateCustomLogGroupName checks that the log group name is set, and that a wildcard is only at its end
+func validateCustomLogGroupName(logGroup string) error {
+	if strings.TrimSpace(logGroup) == emptyString {
+		return fmt.Errorf("log group name must be set")
+	}
+	if strings.TrimSpace(logGroup) != logGroup {
+		return fmt.Errorf("log group name '%s' must not have leading or trailing spaces", logGroup)
+	}
+	if strings.Contains(strings.TrimSuffix(logGroup, "*"), "*") {
+		return fmt.Errorf("log group name '%s' may only have a wildcard at its end", logGroup)
+	}
+	return nil
+}
+
+// names returns the custom log groups to monitor as they are defined, without their options
+func (s *customLogGroupsSpec) names() []string {
+	var names []string
+	for _, entry := range s.include {
+		names = append(names, entry.LogGroup)
+	}
+	return names
+}
+
+// excludes checks if the log group is one of the excluded log groups, or is under an excluded prefix
+func (s *customLogGroupsSpec) excludes(logGroup string) bool {
+	for _, excluded := range s.exclude {
+		if matchesCustomLogGroup(excluded, logGroup) {
+			return true
+		}
+	}
+	return false
+}
+
+// optionsOf returns the custom log group of the log group, which is either the log group itself or the custom log group
+// with the longest prefix of it, or an empty custom log group if there is none
+func (s *customLogGroupsSpec) optionsOf(logGroup string) customLogGroup {
+	var options customLogGroup
+	longest := -1
+	for _, entry := range s.include {
+		if entry.LogGroup == logGroup {
+			return entry
+		}
+		if prefix, ok := strings.CutSuffix(entry.LogGroup, "*"); ok && len(prefix) > longest && strings.HasPrefix(logGroup, prefix) {
+			options, longest = entry, len(prefix)
+		}
+	}
+	return options
+}
+
+// diff returns the custom log groups of the spec which were added or whose options changed since the old spec, and
+// the ones which were removed or excluded since then. Log groups which are no longer excluded are added when a custom
+// log group of the spec includes them.
+func (s *customLogGroupsSpec) diff(old *customLogGroupsSpec) (toAdd, toRemove []string) {
+	if old == nil {
+		old = &customLogGroupsSpec{}
+	}
+
+	oldEntries := make(map[string]customLogGroup, len(old.include))
+	for _, entry := range old.include {
+		oldEntries[entry.LogGroup] = entry
+	}
+	for _, entry := range s.include {
+		if oldEntry, ok := oldEntries[entry.LogGroup]; !ok || !reflect.DeepEqual(oldEntry, entry) {
+			toAdd = append(toAdd, entry.LogGroup)
+		}
+	}
+	_, toRemove = findDifferences(old.names(), s.names())
+
+	excludedToAdd, excludedToRemove := findDifferences(old.exclude, s.exclude)
+	toRemove = append(toRemove, excludedToAdd...)
+	for _, logGroup := range excludedToRemove {
+		if s.includes(logGroup) && !slices.Contains(toAdd, logGroup) {
+			toAdd = append(toAdd, logGroup)
+		}
+	}
+	return toAdd, toRemove
+}
+
+// customLogGroupsDiffJob returns the job which updates the subscription filters from the old custom log groups to
+// the current ones. All the current custom log groups are added when there are no old ones.
+func customLogGroupsDiffJob(old, current *customLogGroupsSpec) *job {
+	// the custom log groups with a wildcard are compared as they are defined, and discovered in every managed account
+	customGroupsToAdd, customGroupsToRemove := current.diff(old)
+	logGroupsToAdd, prefixesToAdd := splitCustomLogGroups(customGroupsToAdd)
+	logGroupsToRemove, prefixesToRemove := splitCustomLogGroups(customGroupsToRemove)
+
+	return &job{
+		action:            common.UpdateSF,
+		logGroupsToAdd:    logGroupsToAdd,
+		logGroupsToRemove: logGroupsToRemove,
+		prefixesToAdd:     prefixesToAdd,
+		prefixesToRemove:  prefixesToRemove,
+		canContinue:       true,
+	}
+}
+
+// applyCustomLogGroupsVersion executes the job which applies a version of the custom log groups, and marks the version
+// as applied once its result is complete. The job of every target carries the version. When every target finishes in
+// this invocation, the version is marked once their aggregated result is complete. A target which continues in a new
+// invocation marks the version when it finishes with a complete result. A version which isn't marked is applied again
+// by the next change, which is compared to the version that was applied before it.
+func applyCustomLogGroupsVersion(ctx context.Context, j *job, version *common.AppliedVersion) (Result, error) {
+	if err := ensureMemberAccounts(ctx); err != nil {
+		return Result{}, err
+	}
+	j.appliedVersion = version
+
+	result, err := fanOutJob(ctx, j)
+	if err == nil && envConfig.fansOut() {
+		markVersionApplied(ctx, version, result)
+	}
+	return result, err
+}
+
+// markVersionApplied marks the version of the custom log groups as applied, if the result of applying it is complete
+func markVersionApplied(ctx context.Context, version *common.AppliedVersion, result Result) {
+	if version.ParameterName != emptyString {
+		ssmClient, err := getSSMClient()
+		if err != nil {
+			sugLog.Warnf("Failed to label version %d of parameter %s as applied: %v", version.ParameterVersion, version.ParameterName, err)
+			return
+		}
+		ssmClient.markApplied(ctx, version, result)
+		return
+	}
+
+	svc, err := getSecretManagerClient(ctx)
+	if err != nil {
+		sugLog.Warnf("Failed to mark version %s of secret %s as applied: %v", version.VersionId, version.SecretId, err)
+		return
+	}
+	svc.markApplied(ctx, version, result)
+}
+
+// includes checks if the log group, or the prefix when it ends with a wildcard, is one of the custom log groups or is
+// under the prefix of one
+func (s *customLogGroupsSpec) includes(logGroup string) bool {
+	for _, entry := range s.include {
+		if matchesCustomLogGroup(entry.LogGroup, strings.TrimSuffix(logGroup, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesCustomLogGroup checks if the log group is the custom log group, or is under its prefix when it's defined with
+// a wildcard
+func matchesCustomLogGroup(customLogGroup, logGroup string) bool {
+	if prefix, ok := strings.CutSuffix(customLogGroup, "*"); ok {
+		return strings.HasPrefix(logGroup, prefix)
+	}
+	return customLogGroup == logGroup
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCustomLogGroupsSpecOptionsOf(t *testing.T) {
+	errorPattern := "ERROR"
+	spec := &customLogGroupsSpec{include: []customLogGroup{
+		{LogGroup: "/log/*", FilterPattern: &errorPattern},
+		{LogGroup: "/log/group1/*", Destination: "security"},
+		{LogGroup: "/log/group1/a", Destination: "audit"},
+	}}
+
+	tests := []struct {
+		name     string
+		logGroup string
+		expected customLogGroup
+	}{
+		{
+			name:     "log group",
+			logGroup: "/log/group1/a",
+			expected: customLogGroup{LogGroup: "/log/group1/a", Destination: "audit"},
+		},
+		{
+			name:     "longest prefix",
+			logGroup: "/log/group1/b",
+			expected: customLogGroup{LogGroup: "/log/group1/*", Destination: "security"},
+		},
+		{
+			name:     "prefix",
+			logGroup: "/log/group2/a",
+			expected: customLogGroup{LogGroup: "/log/*", FilterPattern: &errorPattern},
+		},
+		{
+			name:     "not a custom log group",
+			logGroup: "/aws/lambda/function1",
+			expected: customLogGroup{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, spec.optionsOf(test.logGroup))
+		})
+	}
+}
+
+func TestCustomLogGroupsSpecExcludes(t *testing.T) {
+	spec := &customLogGroupsSpec{exclude: []string{"/log/group1/debug*", "/aws/lambda/noisy"}}
+
+	assert.True(t, spec.excludes("/log/group1/debug"))
+	assert.True(t, spec.excludes("/log/group1/debug-a"))
+	assert.True(t, spec.excludes("/aws/lambda/noisy"))
+	assert.False(t, spec.excludes("/aws/lambda/noisy2"))
+	assert.False(t, spec.excludes("/log/group1/a"))
+}
+
+func TestCustomLogGroupsSpecDiff(t *testing.T) {
+	errorPattern := "ERROR"
+
+	tests := []struct {
+		name             string
+		old              *customLogGroupsSpec
+		new              *customLogGroupsSpec
+		expectedToAdd    []string
+		expectedToRemove []string
+	}{
+		{
+			name:          "no old spec",
+			new:           &customLogGroupsSpec{include: []customLogGroup{{LogGroup: "g1"}, {LogGroup: "/log/group1/*"}}},
+			expectedToAdd: []string{"g1", "/log/group1/*"},
+		},
+		{
+			name:             "added and removed log groups",
+			old:              newCustomLogGroupsSpec([]string{"g1", "g2"}),
+			new:              newCustomLogGroupsSpec([]string{"g1", "g3"}),
+			expectedToAdd:    []string{"g3"},
+			expectedToRemove: []string{"g2"},
+		},
+		{
+			name:          "changed options",
+			old:           newCustomLogGroupsSpec([]string{"g1", "g2"}),
+			new:           &customLogGroupsSpec{include: []customLogGroup{{LogGroup: "g1"}, {LogGroup: "g2", FilterPattern: &errorPattern}}},
+			expectedToAdd: []string{"g2"},
+		},
+		{
+			name:             "excluded log groups",
+			old:              &customLogGroupsSpec{include: []customLogGroup{{LogGroup: "/log/*"}}, exclude: []string{"/log/debug*"}},
+			new:              &customLogGroupsSpec{include: []customLogGroup{{LogGroup: "/log/*"}}, exclude: []string{"/log/audit", "/other/*"}},
+			expectedToAdd:    []string{"/log/debug*"},
+			expectedToRemove: []string{"/log/audit", "/other/*"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			toAdd, toRemove := test.new.diff(test.old)
+
+			assert.ElementsMatch(t, test.expectedToAdd, toAdd)
+			assert.ElementsMatch(t, test.expectedToRemove, toRemove)
+		})
+	}
+}
+
+func TestParseCustomLogGroupsParameter(t *testing.T) {
+	parameterArn := "arn:aws:ssm:us-east-1:486140753397:parameter/custom-groups"
+
+	tests := []struct {
+		name           string
+		parameterType  string
+		value          string
+		expectedOutput *customLogGroupsSpec
+		expectedError  bool
+	}{
+		{
+			name:           "string list",
+			parameterType:  "StringList",
+			value:          "g1,/log/group1/*",
+			expectedOutput: newCustomLogGroupsSpec([]string{"g1", "/log/group1/*"}),
+		},
+		{
+			name:           "comma-separated string",
+			parameterType:  "String",
+			value:          "g1, g2",
+			expectedOutput: newCustomLogGroupsSpec([]string{"g1", "g2"}),
+		},
+		{
+			name:           "secure string of a JSON array",
+			parameterType:  "SecureString",
+			value:          ` ["g1", {"logGroup": "g2", "destination": "default"}]`,
+			expectedOutput: &customLogGroupsSpec{include: []customLogGroup{{LogGroup: "g1"}, {LogGroup: "g2", Destination: "default"}}, exclude: []string{}},
+		},
+		{
+			name:          "invalid JSON object",
+			parameterType: "String",
+			value:         `{"logzioCustomLogGroups": {"include": ["g1"], "exclude": [""]}}`,
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec, err := parseCustomLogGroupsParameter(parameterArn, test.parameterType, test.value, nil)
+
+			assert.Equal(t, test.expectedOutput, spec)
+			if test.expectedError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
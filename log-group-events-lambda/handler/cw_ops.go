@@ -1,21 +1,45 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"sync"
-	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	"github.com/hashicorp/go-multierror"
 	"github.com/logzio/firehose-logs/common"
+	"golang.org/x/time/rate"
 )
 
+// retryPolicy is the retry policy of CloudWatch Logs API calls
+var retryPolicy = common.DefaultRetryPolicy
+
+// rateLimiters are the limiters of the subscription filter API calls by account and region, which every client of the
+// account and region shares, so the rate limit holds across targets and continuations in the same container
+var rateLimiters = struct {
+	sync.Mutex
+	byTarget map[string]*rate.Limiter
+}{byTarget: make(map[string]*rate.Limiter)}
+
+// errNoTimeLeft is returned when there isn't enough time left to call the CloudWatch Logs API
+var errNoTimeLeft = errors.New("not enough time left to call the CloudWatch Logs API")
+
 type CloudWatchLogsClient struct {
 	Client cloudwatchlogsiface.CloudWatchLogsAPI
-	Mutex  sync.Mutex
+	// limiter rate limits the subscription filter API calls, no limit is applied when it's nil
+	limiter *rate.Limiter
+	// dryRun skips the subscription filter API calls, and reports the log groups as if they were handled
+	dryRun bool
+	// accountId is the account of the log groups, it's the account of the function when it's empty
+	accountId string
+	// region is the region of the log groups, it's the region of the function when it's empty
+	region string
 }
 
 func getCloudWatchLogsClient() (*CloudWatchLogsClient, error) {
@@ -23,210 +47,439 @@ func getCloudWatchLogsClient() (*CloudWatchLogsClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &CloudWatchLogsClient{Client: cloudwatchlogs.New(sess)}, nil
+	return newCloudWatchLogsClient(sess, emptyString, emptyString), nil
+}
+
+// newCloudWatchLogsClient returns a client of the log groups of the given account and region
+func newCloudWatchLogsClient(sess *session.Session, accountId, region string) *CloudWatchLogsClient {
+	// the config is not set yet while it's being validated
+	apiRateLimit := float64(defaultApiRateLimit)
+	dryRun := false
+	if envConfig != nil {
+		apiRateLimit = envConfig.apiRateLimit
+		dryRun = envConfig.dryRun
+	}
+	return &CloudWatchLogsClient{
+		Client:    cloudwatchlogs.New(sess, common.WithoutSDKRetries()),
+		limiter:   rateLimiterFor(accountId, region, apiRateLimit),
+		dryRun:    dryRun,
+		accountId: accountId,
+		region:    region,
+	}
+}
+
+// account returns the account of the log groups of the client
+func (cwLogsClient *CloudWatchLogsClient) account() string {
+	if cwLogsClient.accountId == emptyString {
+		return envConfig.accountId
+	}
+	return cwLogsClient.accountId
+}
+
+// awsRegion returns the region of the log groups of the client
+func (cwLogsClient *CloudWatchLogsClient) awsRegion() string {
+	if cwLogsClient.region == emptyString {
+		return envConfig.region
+	}
+	return cwLogsClient.region
+}
+
+// newRateLimiter returns a limiter of the given requests per second, bursting up to the same amount
+func newRateLimiter(requestsPerSecond float64) *rate.Limiter {
+	if requestsPerSecond <= 0 {
+		requestsPerSecond = defaultApiRateLimit
+	}
+	return rate.NewLimiter(rate.Limit(requestsPerSecond), int(math.Max(1, requestsPerSecond)))
 }
 
-func (cwLogsClient *CloudWatchLogsClient) addSubscriptionFilter(logGroups []string) ([]string, error) {
+// rateLimiterFor returns the limiter of the given account and region, where an empty account or region is the one of
+// the function. The limit of an existing limiter is updated to the given one.
+func rateLimiterFor(accountId, region string, requestsPerSecond float64) *rate.Limiter {
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+
+	key := accountId + targetSeparator + region
+	limiter, ok := rateLimiters.byTarget[key]
+	if !ok {
+		limiter = newRateLimiter(requestsPerSecond)
+		rateLimiters.byTarget[key] = limiter
+		return limiter
+	}
+
+	updated := newRateLimiter(requestsPerSecond)
+	if limiter.Limit() != updated.Limit() {
+		limiter.SetLimit(updated.Limit())
+		limiter.SetBurst(updated.Burst())
+	}
+	return limiter
+}
+
+// wait blocks until the rate limiter allows another subscription filter API call
+func (cwLogsClient *CloudWatchLogsClient) wait(ctx context.Context) error {
+	if cwLogsClient.limiter == nil {
+		return nil
+	}
+	if err := cwLogsClient.limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("%w: %v", errNoTimeLeft, err)
+	}
+	return nil
+}
+
+// addSubscriptionFilter puts our subscription filter on the given log groups. Log groups which already have an identical
+// filter are skipped and reported as unchanged, and drifted filters are overwritten and reported as updated.
+func (cwLogsClient *CloudWatchLogsClient) addSubscriptionFilter(ctx context.Context, logGroups []string) ([]filterChange, error) {
 	if cwLogsClient == nil {
 		return nil, fmt.Errorf("CloudWatch Logs client is nil")
 	}
 
-	destinationArn := envConfig.destinationArn
-	roleArn := envConfig.roleArn
-	filterPattern := envConfig.filterPattern
 	filterName := envConfig.filterName
-	added := make([]string, 0, len(logGroups))
-	if filterPattern != "" {
-		sugLog.Debugf("Applying filter pattern '%s' to log groups %s", filterPattern, logGroups)
+	if envConfig.filterPattern != "" {
+		sugLog.Debugf("Applying filter pattern '%s' to log groups %s", envConfig.filterPattern, logGroups)
 	}
-	var result *multierror.Error
 
-	var wg sync.WaitGroup
+	customLogGroups, err := envConfig.customLogGroups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the options of the custom log groups: %w", err)
+	}
 
+	// Prevent a situation where we put subscription filter on the trigger function
+	toAdd := make([]string, 0, len(logGroups))
 	for _, logGroup := range logGroups {
-		// Prevent a situation where we put subscription filter on the trigger function
 		if logGroup == envConfig.thisFunctionLogGroup {
 			continue
 		}
+		if customLogGroups.excludes(logGroup) {
+			sugLog.Debugf("Log group %s is excluded, skipping", logGroup)
+			continue
+		}
+		toAdd = append(toAdd, logGroup)
+	}
+
+	return newWorkerPool[filterChange](envConfig.maxConcurrency).run(ctx, toAdd, func(ctx context.Context, logGroup string) ([]filterChange, error) {
+		options := customLogGroups.optionsOf(logGroup)
+		destination, err := cwLogsClient.routeCustomLogGroup(ctx, logGroup, options)
+		if isOutOfTimeError(err) {
+			return nil, err
+		}
+		if err != nil {
+			sugLog.Errorf("Error while trying to route %s: %v", logGroup, err.Error())
+			return nil, &logGroupError{logGroup: logGroup, err: err}
+		}
+
+		filterPattern := envConfig.filterPattern
+		if options.FilterPattern != nil {
+			filterPattern = *options.FilterPattern
+		}
+
+		filterInput := newPutSubscriptionFilterInput(logGroup, filterName, filterPattern, destination)
+
+		existing, err := cwLogsClient.getSubscriptionFilter(ctx, logGroup, filterName)
+		if isOutOfTimeError(err) {
+			return nil, fmt.Errorf("failed to get subscription filter of %s: %w", logGroup, err)
+		}
+		if err != nil {
+			sugLog.Errorf("Error while trying to get subscription filter of %s: %v", logGroup, err.Error())
+			return nil, &logGroupError{logGroup: logGroup, err: err}
+		}
 
-		wg.Add(1)
-		go func(logGroup string) {
-			defer wg.Done()
-
-			retries := 0
-			for {
-				filterInput := &cloudwatchlogs.PutSubscriptionFilterInput{
-					DestinationArn: &destinationArn,
-					FilterName:     &filterName,
-					LogGroupName:   &logGroup,
-					FilterPattern:  &filterPattern,
-					RoleArn:        &roleArn,
-				}
-				_, err := cwLogsClient.Client.PutSubscriptionFilter(filterInput)
-
-				// retry mechanism
-				if err != nil {
-					var awsErr awserr.Error
-					ok := errors.As(err, &awsErr)
-					if ok && awsErr.Code() == "ThrottlingException" && retries < maxRetries {
-						time.Sleep(time.Second * time.Duration(retries*retries))
-						retries++
-						continue
-					} else if ok && awsErr.Code() == "LimitExceededException" {
-						sugLog.Warnf("Limit exceeded while trying to add subscription filter for %s: %v", logGroup, err.Error())
-						return
-					} else {
-						sugLog.Errorf("Error while trying to add subscription filter for %s: %v", logGroup, err.Error())
-						result = multierror.Append(result, err)
-						return
-					}
-				}
-				cwLogsClient.Mutex.Lock()
-				added = append(added, logGroup)
-				cwLogsClient.Mutex.Unlock()
-				return
+		status := filterAdded
+		if existing != nil {
+			if !isFilterDrifted(existing, filterInput) {
+				sugLog.Debugf("Subscription filter of %s is up to date, skipping", logGroup)
+				return []filterChange{{logGroup: logGroup, status: filterUnchanged}}, nil
 			}
-		}(logGroup)
-	}
-	wg.Wait()
+			sugLog.Infof("Subscription filter of %s drifted, overwriting it with destination %s", logGroup, destination.name)
+			status = filterUpdated
+		}
+
+		if cwLogsClient.dryRun {
+			sugLog.Infof("Dry run, planned putting subscription filter on %s (%s)", logGroup, status)
+			return []filterChange{{logGroup: logGroup, status: status}}, nil
+		}
 
-	return added, result.ErrorOrNil()
+		err = retryPolicy.Do(ctx, func() error {
+			if err := cwLogsClient.wait(ctx); err != nil {
+				return err
+			}
+			_, err := cwLogsClient.Client.PutSubscriptionFilterWithContext(ctx, filterInput)
+			return err
+		})
+
+		if isOutOfTimeError(err) {
+			// the log group wasn't handled, this is not a failure of the log group itself
+			return nil, fmt.Errorf("failed to add subscription filter for %s: %w", logGroup, err)
+		}
+		if err != nil {
+			var awsErr awserr.Error
+			if errors.As(err, &awsErr) && awsErr.Code() == cloudwatchlogs.ErrCodeLimitExceededException {
+				sugLog.Warnf("Limit exceeded while trying to add subscription filter for %s: %v", logGroup, err.Error())
+			} else {
+				sugLog.Errorf("Error while trying to add subscription filter for %s: %v", logGroup, err.Error())
+			}
+			return nil, &logGroupError{logGroup: logGroup, err: err}
+		}
+		return []filterChange{{logGroup: logGroup, status: status}}, nil
+	})
 }
 
-func (cwLogsClient *CloudWatchLogsClient) updateSubscriptionFilters(servicesToAdd, servicesToRemove, customGroupsToAdd, customGroupsToRemove []string) error {
+// newPutSubscriptionFilterInput returns the input which puts the subscription filter of the log group with the given
+// destination. The role is only set for destinations which require one, since CloudWatch Logs rejects an empty role.
+func newPutSubscriptionFilterInput(logGroup, filterName, filterPattern string, destination *namedDestination) *cloudwatchlogs.PutSubscriptionFilterInput {
+	input := &cloudwatchlogs.PutSubscriptionFilterInput{
+		DestinationArn: aws.String(destination.arn),
+		FilterName:     aws.String(filterName),
+		LogGroupName:   aws.String(logGroup),
+		FilterPattern:  aws.String(filterPattern),
+		Distribution:   aws.String(envConfig.distributionOf(logGroup)),
+	}
+	if destination.destinationType.requiresRole() {
+		input.RoleArn = aws.String(destination.roleArn)
+	}
+	return input
+}
+
+// updateSubscriptionFilters adds and removes subscription filters according to the given differences, and returns the changes of the log groups
+func (cwLogsClient *CloudWatchLogsClient) updateSubscriptionFilters(ctx context.Context, servicesToAdd, servicesToRemove, customGroupsToAdd, customGroupsToRemove []string) ([]filterChange, error) {
 	var result *multierror.Error
+	var changes []filterChange
 
-	logGroupsToMonitor := getServicesLogGroups(servicesToAdd, cwLogsClient)
+	logGroupsToMonitor, err := getServicesLogGroups(ctx, servicesToAdd, cwLogsClient)
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
 	logGroupsToMonitor = append(logGroupsToMonitor, customGroupsToAdd...)
 
 	if len(logGroupsToMonitor) > 0 {
-		added, err := cwLogsClient.addSubscriptionFilter(logGroupsToMonitor)
+		added, err := cwLogsClient.addSubscriptionFilter(ctx, logGroupsToMonitor)
 		if err != nil {
 			result = multierror.Append(result, err)
 		}
 		sugLog.Info("Added subscription filters for the following log groups: ", added)
+		changes = append(changes, added...)
 	} else {
 		sugLog.Debug("No new log groups to monitor")
 	}
 
-	logGroupsToUnMonitor := getServicesLogGroups(servicesToRemove, cwLogsClient)
+	logGroupsToUnMonitor, err := getServicesLogGroups(ctx, servicesToRemove, cwLogsClient)
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
 	logGroupsToUnMonitor = append(logGroupsToUnMonitor, customGroupsToRemove...)
 
 	if len(logGroupsToUnMonitor) > 0 {
-		deleted, err := cwLogsClient.removeSubscriptionFilter(logGroupsToUnMonitor)
+		deleted, err := cwLogsClient.removeSubscriptionFilter(ctx, logGroupsToUnMonitor)
 		if err != nil {
 			result = multierror.Append(result, err)
 		}
 		sugLog.Info("Deleted subscription filters for the following log groups: ", deleted)
+		changes = append(changes, deleted...)
 	} else {
 		sugLog.Debug("No log groups to stop monitoring")
 	}
 
-	return result.ErrorOrNil()
+	return changes, result.ErrorOrNil()
 }
 
-func (cwLogsClient *CloudWatchLogsClient) removeSubscriptionFilter(logGroups []string) ([]string, error) {
+func (cwLogsClient *CloudWatchLogsClient) removeSubscriptionFilter(ctx context.Context, logGroups []string) ([]filterChange, error) {
 	if cwLogsClient == nil {
 		return nil, fmt.Errorf("CloudWatch Logs client is nil")
 	}
 
 	filterName := envConfig.filterName
-	deleted := make([]string, 0, len(logGroups))
-	var result *multierror.Error
 
-	var wg sync.WaitGroup
+	return newWorkerPool[filterChange](envConfig.maxConcurrency).run(ctx, logGroups, func(ctx context.Context, logGroup string) ([]filterChange, error) {
+		if cwLogsClient.dryRun {
+			// only the log groups which have the subscription filter would be changed
+			existing, err := cwLogsClient.getSubscriptionFilter(ctx, logGroup, filterName)
+			if isOutOfTimeError(err) {
+				return nil, fmt.Errorf("failed to get subscription filter of %s: %w", logGroup, err)
+			}
+			if err != nil {
+				sugLog.Errorf("Error while trying to get subscription filter of %s: %v", logGroup, err.Error())
+				return nil, &logGroupError{logGroup: logGroup, err: err}
+			}
+			if existing == nil {
+				return nil, nil
+			}
+			sugLog.Infof("Dry run, planned deleting subscription filter of %s", logGroup)
+			return []filterChange{{logGroup: logGroup, status: filterRemoved}}, nil
+		}
 
-	for _, logGroup := range logGroups {
-		wg.Add(1)
-		go func(logGroup string) {
-			defer wg.Done()
-
-			retries := 0
-			for {
-				_, err := cwLogsClient.Client.DeleteSubscriptionFilter(&cloudwatchlogs.DeleteSubscriptionFilterInput{
-					FilterName:   &filterName,
-					LogGroupName: &logGroup,
-				})
-
-				// retry mechanism
-				if err != nil {
-					var awsErr awserr.Error
-					ok := errors.As(err, &awsErr)
-					if ok && awsErr.Code() == "ThrottlingException" && retries < maxRetries {
-						time.Sleep(time.Second * time.Duration(retries*retries))
-						retries++
-						continue
-					} else {
-						sugLog.Errorf("Error while trying to delete subscription filter for %s: %v", logGroup, err.Error())
-						result = multierror.Append(result, err)
-						return
-					}
-				}
-				cwLogsClient.Mutex.Lock()
-				deleted = append(deleted, logGroup)
-				cwLogsClient.Mutex.Unlock()
-				return
+		err := retryPolicy.Do(ctx, func() error {
+			if err := cwLogsClient.wait(ctx); err != nil {
+				return err
 			}
-		}(logGroup)
-	}
-	wg.Wait()
+			_, err := cwLogsClient.Client.DeleteSubscriptionFilterWithContext(ctx, &cloudwatchlogs.DeleteSubscriptionFilterInput{
+				FilterName:   &filterName,
+				LogGroupName: &logGroup,
+			})
+			return err
+		})
 
-	return deleted, result.ErrorOrNil()
+		if isOutOfTimeError(err) {
+			// the log group wasn't handled, this is not a failure of the log group itself
+			return nil, fmt.Errorf("failed to delete subscription filter for %s: %w", logGroup, err)
+		}
+		if err != nil {
+			sugLog.Errorf("Error while trying to delete subscription filter for %s: %v", logGroup, err.Error())
+			return nil, &logGroupError{logGroup: logGroup, err: err}
+		}
+		return []filterChange{{logGroup: logGroup, status: filterRemoved}}, nil
+	})
 }
 
-// hasSubscriptionFilter checks if our subscription filter already exists on a log group
-func (cwLogsClient *CloudWatchLogsClient) hasSubscriptionFilter(logGroup string) bool {
+// removeStaleSubscriptionFilter removes the subscription filter from the given log groups which have it, and skips the others
+func (cwLogsClient *CloudWatchLogsClient) removeStaleSubscriptionFilter(ctx context.Context, logGroups []string) ([]filterChange, error) {
 	if cwLogsClient == nil {
-		return false
+		return nil, fmt.Errorf("CloudWatch Logs client is nil")
 	}
 
-	filterName := envConfig.filterName
-	output, err := cwLogsClient.Client.DescribeSubscriptionFilters(&cloudwatchlogs.DescribeSubscriptionFiltersInput{
-		LogGroupName:     &logGroup,
-		FilterNamePrefix: &filterName,
+	subscribed, err := newWorkerPool[string](envConfig.maxConcurrency).run(ctx, logGroups, func(ctx context.Context, logGroup string) ([]string, error) {
+		existing, err := cwLogsClient.getSubscriptionFilter(ctx, logGroup, envConfig.filterName)
+		if isOutOfTimeError(err) {
+			return nil, fmt.Errorf("failed to get subscription filter of %s: %w", logGroup, err)
+		}
+		if err != nil {
+			sugLog.Errorf("Error while trying to get subscription filter of %s: %v", logGroup, err.Error())
+			return nil, &logGroupError{logGroup: logGroup, err: err}
+		}
+		if existing == nil {
+			return nil, nil
+		}
+		return []string{logGroup}, nil
 	})
+	if len(subscribed) == 0 {
+		return nil, err
+	}
+
+	sugLog.Infof("Found stale subscription filters of %d log groups which are not monitored", len(subscribed))
+	removed, removeErr := cwLogsClient.removeSubscriptionFilter(ctx, subscribed)
+	if removeErr != nil {
+		err = multierror.Append(err, removeErr)
+	}
+	return removed, err
+}
 
+// getSubscriptionFilter returns the subscription filter of a log group with the given name, or nil if it doesn't exist
+func (cwLogsClient *CloudWatchLogsClient) getSubscriptionFilter(ctx context.Context, logGroup, filterName string) (*cloudwatchlogs.SubscriptionFilter, error) {
+	var output *cloudwatchlogs.DescribeSubscriptionFiltersOutput
+	err := retryPolicy.Do(ctx, func() error {
+		if err := cwLogsClient.wait(ctx); err != nil {
+			return err
+		}
+		var err error
+		output, err = cwLogsClient.Client.DescribeSubscriptionFiltersWithContext(ctx, &cloudwatchlogs.DescribeSubscriptionFiltersInput{
+			LogGroupName:     &logGroup,
+			FilterNamePrefix: &filterName,
+		})
+		return err
+	})
 	if err != nil {
-		sugLog.Debugf("Error checking subscription filter for %s: %v", logGroup, err)
-		return false
+		return nil, err
 	}
 
 	for _, filter := range output.SubscriptionFilters {
-		if filter.FilterName != nil && *filter.FilterName == filterName {
-			return true
+		if aws.StringValue(filter.FilterName) == filterName {
+			return filter, nil
 		}
 	}
+	return nil, nil
+}
 
-	return false
+// getSubscriptionFilters returns all the subscription filters of a log group
+func (cwLogsClient *CloudWatchLogsClient) getSubscriptionFilters(ctx context.Context, logGroup string) ([]*cloudwatchlogs.SubscriptionFilter, error) {
+	var output *cloudwatchlogs.DescribeSubscriptionFiltersOutput
+	err := retryPolicy.Do(ctx, func() error {
+		if err := cwLogsClient.wait(ctx); err != nil {
+			return err
+		}
+		var err error
+		output, err = cwLogsClient.Client.DescribeSubscriptionFiltersWithContext(ctx, &cloudwatchlogs.DescribeSubscriptionFiltersInput{
+			LogGroupName: &logGroup,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.SubscriptionFilters, nil
+}
+
+// isFilterDrifted checks if the existing subscription filter differs from the desired one. A missing role and an
+// empty role are the same, since filters of destinations which don't require a role have neither.
+func isFilterDrifted(existing *cloudwatchlogs.SubscriptionFilter, desired *cloudwatchlogs.PutSubscriptionFilterInput) bool {
+	existingDistribution := aws.StringValue(existing.Distribution)
+	if existingDistribution == emptyString {
+		existingDistribution = defaultDistribution
+	}
+
+	return aws.StringValue(existing.DestinationArn) != aws.StringValue(desired.DestinationArn) ||
+		aws.StringValue(existing.RoleArn) != aws.StringValue(desired.RoleArn) ||
+		aws.StringValue(existing.FilterPattern) != aws.StringValue(desired.FilterPattern) ||
+		existingDistribution != aws.StringValue(desired.Distribution)
 }
 
 // getLogGroupsWithPrefix returns a list of log groups with the given prefix from cw client
-func (cwLogsClient *CloudWatchLogsClient) getLogGroupsWithPrefix(prefix string) ([]string, error) {
-	var nextToken *string
+func (cwLogsClient *CloudWatchLogsClient) getLogGroupsWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var nextToken string
 	logGroups := make([]string, 0)
 	for {
-		describeOutput, err := cwLogsClient.Client.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{
-			LogGroupNamePrefix: &prefix,
-			NextToken:          nextToken,
-		})
-
+		page, token, err := cwLogsClient.getLogGroupsPage(ctx, prefix, nextToken)
 		if err != nil {
 			return nil, err
 		}
-		if describeOutput != nil {
-			nextToken = describeOutput.NextToken
-			for _, logGroup := range describeOutput.LogGroups {
-				// Prevent a situation where we put subscription filter on the trigger and shipper function
-				if *logGroup.LogGroupName != envConfig.thisFunctionLogGroup {
-					logGroups = append(logGroups, *logGroup.LogGroupName)
-				}
-			}
-		}
+		logGroups = append(logGroups, page...)
 
-		if nextToken == nil {
+		nextToken = token
+		if nextToken == emptyString {
 			break
 		}
 	}
 
 	return logGroups, nil
 }
+
+// getLogGroupsPage returns a single page of log groups with the given prefix, and the token of the next page or an empty string if it's the last one
+func (cwLogsClient *CloudWatchLogsClient) getLogGroupsPage(ctx context.Context, prefix, nextToken string) ([]string, string, error) {
+	page, nextToken, err := cwLogsClient.describeLogGroupsPage(ctx, prefix, nextToken)
+	if err != nil {
+		return nil, emptyString, err
+	}
+
+	logGroups := make([]string, 0, len(page))
+	for _, logGroup := range page {
+		// Prevent a situation where we put subscription filter on the trigger and shipper function
+		if *logGroup.LogGroupName != envConfig.thisFunctionLogGroup {
+			logGroups = append(logGroups, *logGroup.LogGroupName)
+		}
+	}
+
+	return logGroups, nextToken, nil
+}
+
+// describeLogGroupsPage returns a single page of the log groups with the given prefix, or of all the log groups when
+// the prefix is empty, along with the token of the next page
+func (cwLogsClient *CloudWatchLogsClient) describeLogGroupsPage(ctx context.Context, prefix, nextToken string) ([]*cloudwatchlogs.LogGroup, string, error) {
+	input := &cloudwatchlogs.DescribeLogGroupsInput{}
+	if prefix != emptyString {
+		input.LogGroupNamePrefix = &prefix
+	}
+	if nextToken != emptyString {
+		input.NextToken = &nextToken
+	}
+
+	var describeOutput *cloudwatchlogs.DescribeLogGroupsOutput
+	err := retryPolicy.Do(ctx, func() error {
+		var err error
+		describeOutput, err = cwLogsClient.Client.DescribeLogGroupsWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, emptyString, err
+	}
+
+	if describeOutput == nil {
+		return nil, emptyString, nil
+	}
+	return describeOutput.LogGroups, aws.StringValue(describeOutput.NextToken), nil
+}
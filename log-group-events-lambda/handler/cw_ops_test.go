@@ -1,16 +1,27 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/logzio/firehose-logs/common"
 	lp "github.com/logzio/firehose-logs/logger"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/time/rate"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type MockCloudWatchLogsClient struct {
@@ -27,6 +38,10 @@ func (m *MockCloudWatchLogsClient) PutSubscriptionFilter(input *cloudwatchlogs.P
 	return args.Get(0).(*cloudwatchlogs.PutSubscriptionFilterOutput), args.Error(1)
 }
 
+func (m *MockCloudWatchLogsClient) PutSubscriptionFilterWithContext(ctx aws.Context, input *cloudwatchlogs.PutSubscriptionFilterInput, opts ...request.Option) (*cloudwatchlogs.PutSubscriptionFilterOutput, error) {
+	return m.PutSubscriptionFilter(input)
+}
+
 func (m *MockCloudWatchLogsClient) DeleteSubscriptionFilter(input *cloudwatchlogs.DeleteSubscriptionFilterInput) (*cloudwatchlogs.DeleteSubscriptionFilterOutput, error) {
 	if *input.LogGroupName == "errorGroup" {
 		return nil, fmt.Errorf("an error occurred")
@@ -36,8 +51,38 @@ func (m *MockCloudWatchLogsClient) DeleteSubscriptionFilter(input *cloudwatchlog
 	return args.Get(0).(*cloudwatchlogs.DeleteSubscriptionFilterOutput), args.Error(1)
 }
 
+func (m *MockCloudWatchLogsClient) DeleteSubscriptionFilterWithContext(ctx aws.Context, input *cloudwatchlogs.DeleteSubscriptionFilterInput, opts ...request.Option) (*cloudwatchlogs.DeleteSubscriptionFilterOutput, error) {
+	return m.DeleteSubscriptionFilter(input)
+}
+
+// DescribeSubscriptionFiltersWithContext returns an up to date filter for unchangedGroup, a drifted filter for driftedGroup, and no filter for any other log group
+func (m *MockCloudWatchLogsClient) DescribeSubscriptionFiltersWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeSubscriptionFiltersInput, opts ...request.Option) (*cloudwatchlogs.DescribeSubscriptionFiltersOutput, error) {
+	filter := &cloudwatchlogs.SubscriptionFilter{
+		DestinationArn: aws.String(envConfig.destinationArn),
+		FilterName:     aws.String(envConfig.filterName),
+		FilterPattern:  aws.String(envConfig.filterPattern),
+		LogGroupName:   input.LogGroupName,
+		RoleArn:        aws.String(envConfig.roleArn),
+		Distribution:   aws.String(defaultDistribution),
+	}
+
+	switch *input.LogGroupName {
+	case "unchangedGroup":
+		return &cloudwatchlogs.DescribeSubscriptionFiltersOutput{SubscriptionFilters: []*cloudwatchlogs.SubscriptionFilter{filter}}, nil
+	case "driftedGroup":
+		filter.DestinationArn = aws.String("other-arn")
+		return &cloudwatchlogs.DescribeSubscriptionFiltersOutput{SubscriptionFilters: []*cloudwatchlogs.SubscriptionFilter{filter}}, nil
+	default:
+		return &cloudwatchlogs.DescribeSubscriptionFiltersOutput{}, nil
+	}
+}
+
+func (m *MockCloudWatchLogsClient) DescribeLogGroupsWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogGroupsInput, opts ...request.Option) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	return m.DescribeLogGroups(input)
+}
+
 func (m *MockCloudWatchLogsClient) DescribeLogGroups(input *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
-	switch *input.LogGroupNamePrefix {
+	switch aws.StringValue(input.LogGroupNamePrefix) {
 	case "/aws/apigateway/":
 		return &cloudwatchlogs.DescribeLogGroupsOutput{
 			LogGroups: []*cloudwatchlogs.LogGroup{
@@ -87,8 +132,25 @@ func (m *MockCloudWatchLogsClient) DescribeLogGroups(input *cloudwatchlogs.Descr
 	}
 }
 
+// logGroupsWithStatus returns the sorted log groups of the changes with the given status
+func logGroupsWithStatus(changes []filterChange, status filterStatus) []string {
+	logGroups := make([]string, 0, len(changes))
+	for _, change := range changes {
+		if change.status == status {
+			logGroups = append(logGroups, change.logGroup)
+		}
+	}
+	sort.Strings(logGroups)
+	return logGroups
+}
+
 func setupSFTest() {
-	err := os.Setenv(envFirehoseArn, "test-arn")
+	err := os.Setenv(envFirehoseArn, "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream")
+	if err != nil {
+		return
+	}
+
+	err = os.Setenv(envPutSubscriptionFilterRole, "arn:aws:iam::123456789012:role/test-role")
 	if err != nil {
 		return
 	}
@@ -103,8 +165,18 @@ func setupSFTest() {
 		return
 	}
 
+	err = os.Setenv(envStackName, "test-stack")
+	if err != nil {
+		return
+	}
+
+	err = os.Setenv(common.EnvAwsRegion, "us-east-1")
+	if err != nil {
+		return
+	}
+
 	/* Setup config */
-	envConfig = NewConfig()
+	envConfig, _ = NewConfig()
 
 	/* Setup logger */
 	sugLog = lp.GetSugaredLogger()
@@ -114,22 +186,36 @@ func TestAddSubscriptionFilter(t *testing.T) {
 	setupSFTest()
 
 	tests := []struct {
-		name          string
-		logGroups     []string
-		expectedAdded []string
-		errorExpected bool
+		name              string
+		logGroups         []string
+		expectedAdded     []string
+		expectedUpdated   []string
+		expectedUnchanged []string
+		errorExpected     bool
 	}{
 		{
-			name:          "All successful",
-			logGroups:     []string{"group1", "group2"},
-			expectedAdded: []string{"group1", "group2"},
-			errorExpected: false,
+			name:              "All successful",
+			logGroups:         []string{"group1", "group2"},
+			expectedAdded:     []string{"group1", "group2"},
+			expectedUpdated:   []string{},
+			expectedUnchanged: []string{},
+			errorExpected:     false,
+		},
+		{
+			name:              "Error on one group",
+			logGroups:         []string{"group1", "errorGroup"},
+			expectedAdded:     []string{"group1"},
+			expectedUpdated:   []string{},
+			expectedUnchanged: []string{},
+			errorExpected:     true,
 		},
 		{
-			name:          "Error on one group",
-			logGroups:     []string{"group1", "errorGroup"},
-			expectedAdded: []string{"group1"},
-			errorExpected: true,
+			name:              "Existing filters",
+			logGroups:         []string{"group1", "unchangedGroup", "driftedGroup"},
+			expectedAdded:     []string{"group1"},
+			expectedUpdated:   []string{"driftedGroup"},
+			expectedUnchanged: []string{"unchangedGroup"},
+			errorExpected:     false,
 		},
 	}
 
@@ -142,10 +228,15 @@ func TestAddSubscriptionFilter(t *testing.T) {
 			})).Return(nil, fmt.Errorf("an error occurred"))
 
 			cwClient := &CloudWatchLogsClient{Client: mockClient}
-			added, err := cwClient.addSubscriptionFilter(test.logGroups)
-			sort.Strings(added)
+			changes, err := cwClient.addSubscriptionFilter(context.Background(), test.logGroups)
+			added := logGroupsWithStatus(changes, filterAdded)
 
 			assert.Equal(t, test.expectedAdded, added, "Expected log groups to be added %v but got %v", test.expectedAdded, added)
+			assert.Equal(t, test.expectedUpdated, logGroupsWithStatus(changes, filterUpdated))
+			assert.Equal(t, test.expectedUnchanged, logGroupsWithStatus(changes, filterUnchanged))
+			mockClient.AssertNotCalled(t, "PutSubscriptionFilter", mock.MatchedBy(func(input *cloudwatchlogs.PutSubscriptionFilterInput) bool {
+				return *input.LogGroupName == "unchangedGroup"
+			}))
 
 			if test.errorExpected {
 				assert.NotNil(t, err, "Expected an error but got nil")
@@ -156,6 +247,44 @@ func TestAddSubscriptionFilter(t *testing.T) {
 	}
 }
 
+func TestAddSubscriptionFilterWithCustomLogGroupOptions(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	errorPattern := "ERROR"
+	security := &namedDestination{name: "security", arn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/security", roleArn: "security-role", destinationType: destinationFirehose}
+	envConfig.destinations = map[string]*namedDestination{"security": security}
+	envConfig.customLogGroupsSpec = &customLogGroupsSpec{
+		include: []customLogGroup{
+			{LogGroup: "/log/group1/*", FilterPattern: &errorPattern},
+			{LogGroup: "/log/group1/audit", Destination: "security"},
+		},
+		exclude: []string{"/log/group1/debug*"},
+	}
+
+	mockClient := new(MockCloudWatchLogsClient)
+	puts := make(map[string]*cloudwatchlogs.PutSubscriptionFilterInput)
+	var mu sync.Mutex
+	mockClient.On("PutSubscriptionFilter", mock.Anything).Run(func(args mock.Arguments) {
+		input := args.Get(0).(*cloudwatchlogs.PutSubscriptionFilterInput)
+		mu.Lock()
+		defer mu.Unlock()
+		puts[*input.LogGroupName] = input
+	}).Return(&cloudwatchlogs.PutSubscriptionFilterOutput{}, nil)
+
+	cwClient := &CloudWatchLogsClient{Client: mockClient}
+	changes, err := cwClient.addSubscriptionFilter(context.Background(), []string{"/log/group1/a", "/log/group1/audit", "/log/group1/debug-a", "group2"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/log/group1/a", "/log/group1/audit", "group2"}, logGroupsWithStatus(changes, filterAdded))
+	assert.Equal(t, "ERROR", *puts["/log/group1/a"].FilterPattern)
+	assert.Equal(t, envConfig.destinationArn, *puts["/log/group1/a"].DestinationArn)
+	assert.Equal(t, emptyString, *puts["/log/group1/audit"].FilterPattern)
+	assert.Equal(t, security.arn, *puts["/log/group1/audit"].DestinationArn)
+	assert.Equal(t, security.roleArn, *puts["/log/group1/audit"].RoleArn)
+	assert.Equal(t, emptyString, *puts["group2"].FilterPattern)
+	assert.NotContains(t, puts, "/log/group1/debug-a")
+}
+
 func TestUpdateSubscriptionFilters(t *testing.T) {
 	setupSFTest()
 
@@ -223,7 +352,7 @@ func TestUpdateSubscriptionFilters(t *testing.T) {
 			})).Return(nil, fmt.Errorf("an error occurred"))
 
 			cwClient := &CloudWatchLogsClient{Client: mockClient}
-			err := cwClient.updateSubscriptionFilters(test.servicesToAdd, test.servicesToRemove, test.customGroupsToAdd, test.customGroupsToRemove)
+			_, err := cwClient.updateSubscriptionFilters(context.Background(), test.servicesToAdd, test.servicesToRemove, test.customGroupsToAdd, test.customGroupsToRemove)
 
 			if test.errorExpected {
 				assert.NotNil(t, err, "Expected an error but got nil")
@@ -266,8 +395,8 @@ func TestDeleteSubscriptionFilters(t *testing.T) {
 			})).Return(nil, fmt.Errorf("an error occurred"))
 
 			cwClient := &CloudWatchLogsClient{Client: mockClient}
-			removed, err := cwClient.removeSubscriptionFilter(test.logGroups)
-			sort.Strings(removed)
+			changes, err := cwClient.removeSubscriptionFilter(context.Background(), test.logGroups)
+			removed := logGroupsWithStatus(changes, filterRemoved)
 
 			assert.Equal(t, test.expectedRemove, removed, "Expected log groups to be removed %v but got %v", test.expectedRemove, removed)
 
@@ -280,6 +409,27 @@ func TestDeleteSubscriptionFilters(t *testing.T) {
 	}
 }
 
+func TestDryRunSubscriptionFilters(t *testing.T) {
+	setupSFTest()
+
+	mockClient := new(MockCloudWatchLogsClient)
+	cwClient := &CloudWatchLogsClient{Client: mockClient, dryRun: true}
+
+	changes, err := cwClient.addSubscriptionFilter(context.Background(), []string{"group1", "driftedGroup", "unchangedGroup"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"group1"}, logGroupsWithStatus(changes, filterAdded))
+	assert.Equal(t, []string{"driftedGroup"}, logGroupsWithStatus(changes, filterUpdated))
+	assert.Equal(t, []string{"unchangedGroup"}, logGroupsWithStatus(changes, filterUnchanged))
+
+	// only the log groups which have the subscription filter are planned to be removed
+	changes, err = cwClient.removeSubscriptionFilter(context.Background(), []string{"group3", "unchangedGroup"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"unchangedGroup"}, logGroupsWithStatus(changes, filterRemoved))
+
+	mockClient.AssertNotCalled(t, "PutSubscriptionFilter", mock.Anything)
+	mockClient.AssertNotCalled(t, "DeleteSubscriptionFilter", mock.Anything)
+}
+
 func TestGetLogGroupsWithPrefix(t *testing.T) {
 	cwClient, _ := setupLGTest()
 
@@ -317,7 +467,7 @@ func TestGetLogGroupsWithPrefix(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			result, err := cwClient.getLogGroupsWithPrefix(test.prefix)
+			result, err := cwClient.getLogGroupsWithPrefix(context.Background(), test.prefix)
 			sort.Strings(result)
 			assert.Equal(t, test.expectedGroups, result)
 
@@ -329,3 +479,168 @@ func TestGetLogGroupsWithPrefix(t *testing.T) {
 		})
 	}
 }
+
+func TestIsFilterDrifted(t *testing.T) {
+	desired := &cloudwatchlogs.PutSubscriptionFilterInput{
+		DestinationArn: aws.String("destination-arn"),
+		RoleArn:        aws.String("role-arn"),
+		FilterPattern:  aws.String(""),
+		Distribution:   aws.String(defaultDistribution),
+	}
+
+	tests := []struct {
+		name     string
+		existing *cloudwatchlogs.SubscriptionFilter
+		expected bool
+	}{
+		{
+			name: "identical",
+			existing: &cloudwatchlogs.SubscriptionFilter{
+				DestinationArn: aws.String("destination-arn"),
+				RoleArn:        aws.String("role-arn"),
+				FilterPattern:  aws.String(""),
+				Distribution:   aws.String(defaultDistribution),
+			},
+			expected: false,
+		},
+		{
+			name: "identical without distribution",
+			existing: &cloudwatchlogs.SubscriptionFilter{
+				DestinationArn: aws.String("destination-arn"),
+				RoleArn:        aws.String("role-arn"),
+			},
+			expected: false,
+		},
+		{
+			name: "different destination",
+			existing: &cloudwatchlogs.SubscriptionFilter{
+				DestinationArn: aws.String("other-arn"),
+				RoleArn:        aws.String("role-arn"),
+			},
+			expected: true,
+		},
+		{
+			name: "different role",
+			existing: &cloudwatchlogs.SubscriptionFilter{
+				DestinationArn: aws.String("destination-arn"),
+				RoleArn:        aws.String("other-role"),
+			},
+			expected: true,
+		},
+		{
+			name: "different filter pattern",
+			existing: &cloudwatchlogs.SubscriptionFilter{
+				DestinationArn: aws.String("destination-arn"),
+				RoleArn:        aws.String("role-arn"),
+				FilterPattern:  aws.String("ERROR"),
+			},
+			expected: true,
+		},
+		{
+			name: "different distribution",
+			existing: &cloudwatchlogs.SubscriptionFilter{
+				DestinationArn: aws.String("destination-arn"),
+				RoleArn:        aws.String("role-arn"),
+				Distribution:   aws.String("Random"),
+			},
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, isFilterDrifted(test.existing, desired))
+		})
+	}
+
+	withoutRole := &cloudwatchlogs.PutSubscriptionFilterInput{DestinationArn: aws.String("destination-arn"), FilterPattern: aws.String(""), Distribution: aws.String(defaultDistribution)}
+	assert.False(t, isFilterDrifted(&cloudwatchlogs.SubscriptionFilter{DestinationArn: aws.String("destination-arn"), RoleArn: aws.String("")}, withoutRole))
+	assert.False(t, isFilterDrifted(&cloudwatchlogs.SubscriptionFilter{DestinationArn: aws.String("destination-arn")}, withoutRole))
+}
+
+func TestNewPutSubscriptionFilterInput(t *testing.T) {
+	setupSFTest()
+
+	tests := []struct {
+		name         string
+		destination  *namedDestination
+		expectedRole *string
+	}{
+		{
+			name:         "firehose",
+			destination:  &namedDestination{name: "firehose", arn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/stream", roleArn: "arn:aws:iam::123456789012:role/role", destinationType: destinationFirehose},
+			expectedRole: aws.String("arn:aws:iam::123456789012:role/role"),
+		},
+		{
+			name:        "lambda",
+			destination: &namedDestination{name: "lambda", arn: "arn:aws:lambda:us-east-1:123456789012:function:shipper", destinationType: destinationLambda},
+		},
+		{
+			name:        "logs",
+			destination: &namedDestination{name: "logs", arn: "arn:aws:logs:us-east-1:123456789012:destination:central", destinationType: destinationLogs},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := newPutSubscriptionFilterInput("group1", envConfig.filterName, emptyString, test.destination)
+			assert.Nil(t, input.Validate())
+			assert.Equal(t, test.expectedRole, input.RoleArn)
+			assert.Equal(t, test.destination.arn, *input.DestinationArn)
+		})
+	}
+}
+
+func TestRetryPolicyAttemptsAreSingleCalls(t *testing.T) {
+	setupSFTest()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"__type": "ServiceUnavailableException", "message": "unavailable"}`))
+	}))
+	defer server.Close()
+
+	policy := retryPolicy
+	retryPolicy = common.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	defer func() { retryPolicy = policy }()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	assert.Nil(t, err)
+	cwClient := newCloudWatchLogsClient(sess, emptyString, emptyString)
+
+	_, err = cwClient.getSubscriptionFilter(context.Background(), "group1", envConfig.filterName)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestRateLimiterFor(t *testing.T) {
+	first := rateLimiterFor("111111111111", "us-west-2", 5)
+
+	assert.Same(t, first, rateLimiterFor("111111111111", "us-west-2", 5))
+	assert.NotSame(t, first, rateLimiterFor("111111111111", emptyString, 5))
+	assert.NotSame(t, first, rateLimiterFor("222222222222", "us-west-2", 5))
+
+	// the clients of the target share the limiter, so a new limit applies to all of them
+	assert.Same(t, first, rateLimiterFor("111111111111", "us-west-2", 2))
+	assert.Equal(t, rate.Limit(2), first.Limit())
+	assert.Equal(t, 2, first.Burst())
+}
+
+func TestClientsOfTargetShareRateLimiter(t *testing.T) {
+	setupSFTest()
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	assert.Nil(t, err)
+
+	first := newCloudWatchLogsClient(sess, "333333333333", "eu-west-1")
+	second := newCloudWatchLogsClient(sess, "333333333333", "eu-west-1")
+
+	assert.Same(t, first.limiter, second.limiter)
+	assert.NotSame(t, first.limiter, newCloudWatchLogsClient(sess, "333333333333", emptyString).limiter)
+}
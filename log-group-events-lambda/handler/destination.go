@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+// destinationType is the kind of resource which receives the logs of the subscription filters
+type destinationType string
+
+const (
+	destinationFirehose destinationType = "firehose"
+	destinationKinesis  destinationType = "kinesis"
+	destinationLambda   destinationType = "lambda"
+	// destinationLogs is a CloudWatch Logs destination, usually of another account
+	destinationLogs destinationType = "logs"
+)
+
+// destinationResourcePrefixes are the ARN resource prefixes of each destination type, the ARN service is the type itself
+var destinationResourcePrefixes = map[destinationType]string{
+	destinationFirehose: "deliverystream/",
+	destinationKinesis:  "stream/",
+	destinationLambda:   "function:",
+	destinationLogs:     "destination:",
+}
+
+// parseDestinationType validates the destination ARN, and returns its type according to the ARN service
+func parseDestinationType(destinationArn string) (destinationType, error) {
+	parsed, err := arn.Parse(destinationArn)
+	if err != nil {
+		return emptyString, fmt.Errorf("invalid destination ARN '%s': %v", destinationArn, err)
+	}
+
+	destType := destinationType(parsed.Service)
+	resourcePrefix, ok := destinationResourcePrefixes[destType]
+	if !ok {
+		return emptyString, fmt.Errorf("unsupported destination service '%s' in ARN '%s', must be one of firehose, kinesis, lambda or logs", parsed.Service, destinationArn)
+	}
+
+	if !strings.HasPrefix(parsed.Resource, resourcePrefix) || len(parsed.Resource) == len(resourcePrefix) {
+		return emptyString, fmt.Errorf("invalid %s destination ARN '%s', the resource must be of the form %s<name>", destType, destinationArn, resourcePrefix)
+	}
+
+	return destType, nil
+}
+
+// requiresRole checks if CloudWatch Logs needs a role to deliver the logs to the destination. Lambda functions are
+// invoked through their resource policy, and CloudWatch Logs destinations use the role of the destination itself.
+func (t destinationType) requiresRole() bool {
+	return t == destinationFirehose || t == destinationKinesis
+}
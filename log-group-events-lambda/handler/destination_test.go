@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDestinationType(t *testing.T) {
+	tests := []struct {
+		name           string
+		destinationArn string
+		expectedType   destinationType
+		requiresRole   bool
+		errorExpected  bool
+	}{
+		{
+			name:           "firehose",
+			destinationArn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/stream1",
+			expectedType:   destinationFirehose,
+			requiresRole:   true,
+		},
+		{
+			name:           "kinesis",
+			destinationArn: "arn:aws:kinesis:us-east-1:123456789012:stream/stream1",
+			expectedType:   destinationKinesis,
+			requiresRole:   true,
+		},
+		{
+			name:           "lambda",
+			destinationArn: "arn:aws:lambda:us-east-1:123456789012:function:function1",
+			expectedType:   destinationLambda,
+			requiresRole:   false,
+		},
+		{
+			name:           "cross account logs destination",
+			destinationArn: "arn:aws:logs:us-east-1:210987654321:destination:destination1",
+			expectedType:   destinationLogs,
+			requiresRole:   false,
+		},
+		{
+			name:           "not an arn",
+			destinationArn: "some-arn",
+			errorExpected:  true,
+		},
+		{
+			name:           "unsupported service",
+			destinationArn: "arn:aws:sqs:us-east-1:123456789012:queue1",
+			errorExpected:  true,
+		},
+		{
+			name:           "wrong resource type",
+			destinationArn: "arn:aws:kinesis:us-east-1:123456789012:deliverystream/stream1",
+			errorExpected:  true,
+		},
+		{
+			name:           "missing resource name",
+			destinationArn: "arn:aws:lambda:us-east-1:123456789012:function:",
+			errorExpected:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destType, err := parseDestinationType(test.destinationArn)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedType, destType)
+				assert.Equal(t, test.requiresRole, destType.requiresRole())
+			}
+		})
+	}
+}
+
+func TestValidateDestination(t *testing.T) {
+	InitConfigTest()
+	roleArn := "arn:aws:iam::123456789012:role/role1"
+
+	tests := []struct {
+		name            string
+		conf            Config
+		expectedRoleArn string
+		errorExpected   bool
+	}{
+		{
+			name:            "kinesis with role",
+			conf:            Config{destinationArn: "arn:aws:kinesis:us-east-1:123456789012:stream/stream1", roleArn: roleArn},
+			expectedRoleArn: roleArn,
+		},
+		{
+			name:          "kinesis without role",
+			conf:          Config{destinationArn: "arn:aws:kinesis:us-east-1:123456789012:stream/stream1"},
+			errorExpected: true,
+		},
+		{
+			name:          "firehose with invalid role",
+			conf:          Config{destinationArn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/stream1", roleArn: "role1"},
+			errorExpected: true,
+		},
+		{
+			name:            "lambda ignores role",
+			conf:            Config{destinationArn: "arn:aws:lambda:us-east-1:123456789012:function:function1", roleArn: roleArn},
+			expectedRoleArn: "",
+		},
+		{
+			name:            "logs destination without role",
+			conf:            Config{destinationArn: "arn:aws:logs:us-east-1:210987654321:destination:destination1"},
+			expectedRoleArn: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.conf.validateDestination()
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedRoleArn, test.conf.roleArn)
+			}
+		})
+	}
+}
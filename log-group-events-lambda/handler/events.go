@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/logzio/firehose-logs/common"
+)
+
+// Event is the envelope of the events which invoke the function. EventBridge events of CloudTrail and of schedules
+// set all the fields, while the internal subscription filter events only set the detail.
+type Event struct {
+	Source     string          `json:"source,omitempty"`
+	DetailType string          `json:"detail-type,omitempty"`
+	Account    string          `json:"account,omitempty"`
+	Region     string          `json:"region,omitempty"`
+	Detail     json.RawMessage `json:"detail,omitempty"`
+}
+
+// cloudTrailDetail is the detail of an EventBridge event of an API call or a service event recorded by CloudTrail
+type cloudTrailDetail struct {
+	EventSource         string          `json:"eventSource"`
+	EventName           string          `json:"eventName"`
+	RequestParameters   json.RawMessage `json:"requestParameters"`
+	ResponseElements    json.RawMessage `json:"responseElements"`
+	ServiceEventDetails json.RawMessage `json:"serviceEventDetails"`
+	AdditionalEventData json.RawMessage `json:"additionalEventData"`
+}
+
+// typedEvent is an event which was parsed and validated, and can be handled
+type typedEvent interface {
+	// name is the name of the event, which the messages of the result refer to
+	name() string
+	// handle handles the event, which was sent from the given account and region. A result with a message and without
+	// an error means the event was skipped.
+	handle(ctx context.Context, account, region string) (Result, error)
+}
+
+type createLogGroupEvent struct {
+	LogGroupName string `json:"logGroupName"`
+}
+
+// secretChangedEvent is an event which changes the current value of a secret: PutSecretValue and UpdateSecret, whose
+// secret is in the request parameters, RestoreSecret, which cancels the deletion of a secret, and the
+// RotationSucceeded service event, whose secret is in the additional event data
+type secretChangedEvent struct {
+	eventName string
+	SecretId  string `json:"secretId"`
+	// VersionStages are the staging labels of the new version of PutSecretValue, which default to AWSCURRENT
+	VersionStages []string `json:"versionStages"`
+}
+
+// parameterChangedEvent is a PutParameter event of SSM, which creates a parameter or a new version of it
+type parameterChangedEvent struct {
+	Name string `json:"name"`
+}
+
+// tagResourceEvent is a TagResource event of CloudWatch Logs, or a TagResource20170331v2 event of Lambda
+type tagResourceEvent struct {
+	eventName   string
+	ResourceArn string            `json:"resourceArn"`
+	Resource    string            `json:"resource"`
+	Tags        map[string]string `json:"tags"`
+}
+
+// createAccountEvent is a CreateAccount event, whose status is in the response elements, or a CreateAccountResult
+// event, whose status is in the service event details
+type createAccountEvent struct {
+	eventName           string
+	CreateAccountStatus *createAccountStatus `json:"createAccountStatus"`
+}
+
+type createAccountStatus struct {
+	State     string `json:"state"`
+	AccountId string `json:"accountId"`
+}
+
+type moveAccountEvent struct {
+	AccountId      string `json:"accountId"`
+	SourceParentId string `json:"sourceParentId"`
+}
+
+// objectCreatedEvent is an Object Created event of S3, which a bucket with EventBridge notifications sends
+type objectCreatedEvent struct {
+	Bucket s3EventBucket `json:"bucket"`
+	Object s3EventObject `json:"object"`
+}
+
+type s3EventBucket struct {
+	Name string `json:"name"`
+}
+
+type s3EventObject struct {
+	Key string `json:"key"`
+}
+
+// scheduledEvent is an EventBridge scheduled event, which reconciles the subscription filters of the monitored log groups
+type scheduledEvent struct{}
+
+type subscriptionFilterEvent struct {
+	params common.RequestParameters
+}
+
+// parseEvent routes the event by its source and detail type, and parses and validates its detail
+func parseEvent(event Event) (typedEvent, error) {
+	if len(event.Detail) == 0 || string(event.Detail) == "null" {
+		return nil, fmt.Errorf("`detail` is missing from the event")
+	}
+
+	switch {
+	case event.DetailType == cloudTrailApiCallDetailType || event.DetailType == cloudTrailServiceEventDetailType:
+		var detail cloudTrailDetail
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return nil, fmt.Errorf("invalid `detail` of %s event: %v", event.DetailType, err)
+		}
+		return parseCloudTrailEvent(detail)
+
+	case event.Source == scheduledEventSource && event.DetailType == scheduledEventDetailType:
+		return scheduledEvent{}, nil
+
+	case event.Source == s3EventSource && event.DetailType == s3ObjectCreatedDetailType:
+		var created objectCreatedEvent
+		if err := decodeEventField(event.DetailType, "detail", event.Detail, &created); err != nil {
+			return nil, err
+		}
+		if created.Bucket.Name == emptyString || created.Object.Key == emptyString {
+			return nil, fmt.Errorf("bucket name or object key is missing from %s event", event.DetailType)
+		}
+		return created, nil
+
+	case event.Source == emptyString && event.DetailType == emptyString:
+		var detail common.Detail
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return nil, fmt.Errorf("invalid `detail` of internal event: %v", err)
+		}
+		if detail.EventName != common.SubscriptionFilterEventName {
+			return nil, fmt.Errorf("unsupported internal event %q", detail.EventName)
+		}
+		return parseSubscriptionFilterEvent(detail.RequestParameters)
+
+	default:
+		return nil, fmt.Errorf("unsupported event of source %q and detail type %q", event.Source, event.DetailType)
+	}
+}
+
+// parseCloudTrailEvent routes the CloudTrail event by its name, and parses and validates its parameters
+func parseCloudTrailEvent(detail cloudTrailDetail) (typedEvent, error) {
+	switch detail.EventName {
+	case "CreateLogGroup":
+		var event createLogGroupEvent
+		if err := decodeEventField(detail.EventName, "requestParameters", detail.RequestParameters, &event); err != nil {
+			return nil, err
+		}
+		if event.LogGroupName == emptyString {
+			return nil, fmt.Errorf("`logGroupName` is missing from %s event", detail.EventName)
+		}
+		return event, nil
+
+	case "PutSecretValue", "UpdateSecret", "RestoreSecret":
+		event := secretChangedEvent{eventName: detail.EventName}
+		if err := decodeEventField(detail.EventName, "requestParameters", detail.RequestParameters, &event); err != nil {
+			return nil, err
+		}
+		if event.SecretId == emptyString {
+			return nil, fmt.Errorf("`secretId` is missing from %s event", detail.EventName)
+		}
+		return event, nil
+
+	case "RotationSucceeded":
+		event := secretChangedEvent{eventName: detail.EventName}
+		if err := decodeEventField(detail.EventName, "additionalEventData", detail.AdditionalEventData, &event); err != nil {
+			return nil, err
+		}
+		if event.SecretId == emptyString {
+			return nil, fmt.Errorf("`SecretId` is missing from %s event", detail.EventName)
+		}
+		return event, nil
+
+	case "PutParameter":
+		var event parameterChangedEvent
+		if err := decodeEventField(detail.EventName, "requestParameters", detail.RequestParameters, &event); err != nil {
+			return nil, err
+		}
+		if event.Name == emptyString {
+			return nil, fmt.Errorf("`name` is missing from %s event", detail.EventName)
+		}
+		return event, nil
+
+	case "TagResource", "TagResource20170331v2":
+		event := tagResourceEvent{eventName: detail.EventName}
+		if err := decodeEventField(detail.EventName, "requestParameters", detail.RequestParameters, &event); err != nil {
+			return nil, err
+		}
+		if event.resourceArn() == emptyString {
+			return nil, fmt.Errorf("resource ARN is missing from %s event", detail.EventName)
+		}
+		return event, nil
+
+	case "CreateAccount", "CreateAccountResult":
+		// CreateAccount usually returns before the account is created, CreateAccountResult is sent once it is
+		field, value := "serviceEventDetails", detail.ServiceEventDetails
+		if detail.EventName == "CreateAccount" {
+			field, value = "responseElements", detail.ResponseElements
+		}
+		event := createAccountEvent{eventName: detail.EventName}
+		if err := decodeEventField(detail.EventName, field, value, &event); err != nil {
+			return nil, err
+		}
+		if event.CreateAccountStatus == nil {
+			return nil, fmt.Errorf("`createAccountStatus` is missing from %s event", detail.EventName)
+		}
+		return event, nil
+
+	case "MoveAccount":
+		var event moveAccountEvent
+		if err := decodeEventField(detail.EventName, "requestParameters", detail.RequestParameters, &event); err != nil {
+			return nil, err
+		}
+		if event.AccountId == emptyString {
+			return nil, fmt.Errorf("`accountId` is missing from %s event", detail.EventName)
+		}
+		if event.SourceParentId == emptyString {
+			return nil, fmt.Errorf("`sourceParentId` is missing from %s event", detail.EventName)
+		}
+		return event, nil
+
+	case emptyString:
+		return nil, fmt.Errorf("`eventName` is missing from the event")
+
+	default:
+		return nil, fmt.Errorf("unsupported event %q", detail.EventName)
+	}
+}
+
+// parseSubscriptionFilterEvent validates the parameters of a subscription filter event
+func parseSubscriptionFilterEvent(params common.RequestParameters) (typedEvent, error) {
+	switch params.Action {
+	case common.AddSF, common.UpdateSF, common.DeleteSF, common.ReconcileSF, common.StatusSF:
+	case common.ReplaySF, common.InventorySF:
+		if params.Continuation != nil {
+			return nil, fmt.Errorf("%s action of %s event can't be continued", params.Action, common.SubscriptionFilterEventName)
+		}
+	case emptyString:
+		return nil, fmt.Errorf("`action` is missing from %s event", common.SubscriptionFilterEventName)
+	default:
+		return nil, fmt.Errorf("unsupported action %q of %s event", params.Action, common.SubscriptionFilterEventName)
+	}
+
+	if c := params.Continuation; c != nil && c.Iteration < 1 {
+		return nil, fmt.Errorf("invalid iteration %d of the continuation of %s event", c.Iteration, common.SubscriptionFilterEventName)
+	}
+	return subscriptionFilterEvent{params: params}, nil
+}
+
+// decodeEventField decodes a field of the detail of the event into v
+func decodeEventField(eventName, field string, value json.RawMessage, v interface{}) error {
+	if len(value) == 0 || string(value) == "null" {
+		return fmt.Errorf("`%s` is missing from %s event", field, eventName)
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return fmt.Errorf("invalid `%s` of %s event: %v", field, eventName, err)
+	}
+	return nil
+}
+
+func (e createLogGroupEvent) name() string { return "CreateLogGroup" }
+
+func (e secretChangedEvent) name() string { return e.eventName }
+
+func (e parameterChangedEvent) name() string { return "PutParameter" }
+
+func (e tagResourceEvent) name() string { return e.eventName }
+
+func (e createAccountEvent) name() string { return e.eventName }
+
+func (e moveAccountEvent) name() string { return "MoveAccount" }
+
+func (e objectCreatedEvent) name() string { return s3ObjectCreatedDetailType }
+
+func (e scheduledEvent) name() string { return scheduledEventDetailType }
+
+func (e subscriptionFilterEvent) name() string { return common.SubscriptionFilterEventName }
+
+// changesCurrentVersion checks if the event changes the current version of the secret, where a rotation puts its new
+// version with the AWSPENDING staging label before it becomes current
+func (e secretChangedEvent) changesCurrentVersion() bool {
+	return len(e.VersionStages) == 0 || slices.Contains(e.VersionStages, secretCurrentStage)
+}
+
+// resourceArn returns the ARN of the tagged resource, which CloudWatch Logs and Lambda set in different parameters
+func (e tagResourceEvent) resourceArn() string {
+	if e.eventName == "TagResource" {
+		return e.ResourceArn
+	}
+	return e.Resource
+}
+
+// hasMonitoringTag checks if the tags of the event contain the monitoring tag (logzio:monitor=true)
+func (e tagResourceEvent) hasMonitoringTag() bool {
+	for key, value := range e.Tags {
+		if strings.EqualFold(key, monitoringTagKey) && strings.EqualFold(value, monitoringTagValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// createdAccount returns the ID of the created account, or an empty string if its creation didn't succeed yet
+func (e createAccountEvent) createdAccount() string {
+	if e.CreateAccountStatus.State != organizations.CreateAccountStateSucceeded {
+		return emptyString
+	}
+	return e.CreateAccountStatus.AccountId
+}
@@ -0,0 +1,333 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/logzio/firehose-logs/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		name          string
+		event         Event
+		expectedEvent typedEvent
+		expectedError string
+	}{
+		{
+			name: "CreateLogGroup event",
+			event: Event{
+				Source:     "aws.logs",
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventSource": "logs.amazonaws.com", "eventName": "CreateLogGroup", "requestParameters": {"logGroupName": "/aws/lambda/function1"}}`),
+			},
+			expectedEvent: createLogGroupEvent{LogGroupName: "/aws/lambda/function1"},
+		},
+		{
+			name: "PutSecretValue event",
+			event: Event{
+				Source:     "aws.secretsmanager",
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "PutSecretValue", "requestParameters": {"secretId": "secret1"}}`),
+			},
+			expectedEvent: secretChangedEvent{eventName: "PutSecretValue", SecretId: "secret1"},
+		},
+		{
+			name: "PutSecretValue event of a rotation",
+			event: Event{
+				Source:     "aws.secretsmanager",
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "PutSecretValue", "requestParameters": {"secretId": "secret1", "versionStages": ["AWSPENDING"]}}`),
+			},
+			expectedEvent: secretChangedEvent{eventName: "PutSecretValue", SecretId: "secret1", VersionStages: []string{"AWSPENDING"}},
+		},
+		{
+			name: "UpdateSecret event",
+			event: Event{
+				Source:     "aws.secretsmanager",
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "UpdateSecret", "requestParameters": {"secretId": "secret1", "description": "custom log groups"}}`),
+			},
+			expectedEvent: secretChangedEvent{eventName: "UpdateSecret", SecretId: "secret1"},
+		},
+		{
+			name: "RestoreSecret event",
+			event: Event{
+				Source:     "aws.secretsmanager",
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "RestoreSecret", "requestParameters": {"secretId": "secret1"}}`),
+			},
+			expectedEvent: secretChangedEvent{eventName: "RestoreSecret", SecretId: "secret1"},
+		},
+		{
+			name: "RotationSucceeded event",
+			event: Event{
+				Source:     "aws.secretsmanager",
+				DetailType: cloudTrailServiceEventDetailType,
+				Detail:     json.RawMessage(`{"eventName": "RotationSucceeded", "additionalEventData": {"SecretId": "arn:aws:secretsmanager:us-east-1:123456789012:secret:secret1-a1b2c3"}}`),
+			},
+			expectedEvent: secretChangedEvent{eventName: "RotationSucceeded", SecretId: "arn:aws:secretsmanager:us-east-1:123456789012:secret:secret1-a1b2c3"},
+		},
+		{
+			name: "PutParameter event",
+			event: Event{
+				Source:     "aws.ssm",
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "PutParameter", "requestParameters": {"name": "/logzio/custom-groups", "type": "StringList", "overwrite": true}}`),
+			},
+			expectedEvent: parameterChangedEvent{Name: "/logzio/custom-groups"},
+		},
+		{
+			name: "TagResource event of lambda",
+			event: Event{
+				Source:     "aws.lambda",
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "TagResource20170331v2", "requestParameters": {"resource": "arn:aws:lambda:us-east-1:123456789012:function:function1", "tags": {"logzio:subscribe": "true"}}}`),
+			},
+			expectedEvent: tagResourceEvent{
+				eventName: "TagResource20170331v2",
+				Resource:  "arn:aws:lambda:us-east-1:123456789012:function:function1",
+				Tags:      map[string]string{"logzio:subscribe": "true"},
+			},
+		},
+		{
+			name: "CreateAccountResult event",
+			event: Event{
+				Source:     organizationsEventSource,
+				DetailType: cloudTrailServiceEventDetailType,
+				Detail:     json.RawMessage(`{"eventName": "CreateAccountResult", "serviceEventDetails": {"createAccountStatus": {"state": "SUCCEEDED", "accountId": "555555555555"}}}`),
+			},
+			expectedEvent: createAccountEvent{
+				eventName:           "CreateAccountResult",
+				CreateAccountStatus: &createAccountStatus{State: "SUCCEEDED", AccountId: "555555555555"},
+			},
+		},
+		{
+			name: "MoveAccount event",
+			event: Event{
+				Source:     organizationsEventSource,
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "MoveAccount", "requestParameters": {"accountId": "555555555555", "sourceParentId": "ou-1", "destinationParentId": "ou-2"}}`),
+			},
+			expectedEvent: moveAccountEvent{AccountId: "555555555555", SourceParentId: "ou-1"},
+		},
+		{
+			name: "scheduled event",
+			event: Event{
+				Source:     scheduledEventSource,
+				DetailType: scheduledEventDetailType,
+				Detail:     json.RawMessage(`{}`),
+			},
+			expectedEvent: scheduledEvent{},
+		},
+		{
+			name: "S3 Object Created event",
+			event: Event{
+				Source:     "aws.s3",
+				DetailType: "Object Created",
+				Detail:     json.RawMessage(`{"version": "0", "bucket": {"name": "config-bucket"}, "object": {"key": "firehose/config.yaml", "size": 120, "etag": "d41d8cd9"}, "reason": "PutObject"}`),
+			},
+			expectedEvent: objectCreatedEvent{Bucket: s3EventBucket{Name: "config-bucket"}, Object: s3EventObject{Key: "firehose/config.yaml"}},
+		},
+		{
+			name: "subscription filter event",
+			event: Event{
+				Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "update", "newServices": "lambda", "dryRun": true}}`),
+			},
+			expectedEvent: subscriptionFilterEvent{params: common.RequestParameters{Action: common.UpdateSF, NewServices: "lambda", DryRun: true}},
+		},
+		{
+			name: "continuation event",
+			event: Event{
+				Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "add", "continuation": {"iteration": 1, "logGroupsToAdd": ["group1"]}}}`),
+			},
+			expectedEvent: subscriptionFilterEvent{params: common.RequestParameters{
+				Action:       common.AddSF,
+				Continuation: &common.Continuation{Iteration: 1, LogGroupsToAdd: []string{"group1"}},
+			}},
+		},
+		{
+			name: "replay event",
+			event: Event{
+				Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "replay", "dryRun": true}}`),
+			},
+			expectedEvent: subscriptionFilterEvent{params: common.RequestParameters{Action: common.ReplaySF, DryRun: true}},
+		},
+		{
+			name: "reconcile event",
+			event: Event{
+				Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "reconcile"}}`),
+			},
+			expectedEvent: subscriptionFilterEvent{params: common.RequestParameters{Action: common.ReconcileSF}},
+		},
+		{
+			name: "status event",
+			event: Event{
+				Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "status"}}`),
+			},
+			expectedEvent: subscriptionFilterEvent{params: common.RequestParameters{Action: common.StatusSF}},
+		},
+		{
+			name: "inventory event",
+			event: Event{
+				Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "inventory"}}`),
+			},
+			expectedEvent: subscriptionFilterEvent{params: common.RequestParameters{Action: common.InventorySF}},
+		},
+		{
+			name:          "missing detail",
+			event:         Event{Source: "aws.logs", DetailType: cloudTrailApiCallDetailType},
+			expectedError: "`detail` is missing from the event",
+		},
+		{
+			name:          "detail of wrong type",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`"CreateLogGroup"`)},
+			expectedError: "invalid `detail` of AWS API Call via CloudTrail event",
+		},
+		{
+			name:          "missing event name",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`{"requestParameters": {}}`)},
+			expectedError: "`eventName` is missing from the event",
+		},
+		{
+			name:          "unsupported CloudTrail event",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`{"eventName": "DeleteLogGroup", "requestParameters": {}}`)},
+			expectedError: `unsupported event "DeleteLogGroup"`,
+		},
+		{
+			name:          "missing request parameters",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`{"eventName": "CreateLogGroup"}`)},
+			expectedError: "`requestParameters` is missing from CreateLogGroup event",
+		},
+		{
+			name:          "request parameters of wrong type",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`{"eventName": "CreateLogGroup", "requestParameters": {"logGroupName": 1}}`)},
+			expectedError: "invalid `requestParameters` of CreateLogGroup event",
+		},
+		{
+			name:          "missing log group name",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`{"eventName": "CreateLogGroup", "requestParameters": {}}`)},
+			expectedError: "`logGroupName` is missing from CreateLogGroup event",
+		},
+		{
+			name:          "missing rotated secret",
+			event:         Event{DetailType: cloudTrailServiceEventDetailType, Detail: json.RawMessage(`{"eventName": "RotationSucceeded"}`)},
+			expectedError: "`additionalEventData` is missing from RotationSucceeded event",
+		},
+		{
+			name:          "missing parameter name",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`{"eventName": "PutParameter", "requestParameters": {"type": "String"}}`)},
+			expectedError: "`name` is missing from PutParameter event",
+		},
+		{
+			name:          "missing object key",
+			event:         Event{Source: "aws.s3", DetailType: "Object Created", Detail: json.RawMessage(`{"bucket": {"name": "config-bucket"}, "object": {"size": 10}}`)},
+			expectedError: "bucket name or object key is missing from Object Created event",
+		},
+		{
+			name:          "missing resource ARN",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`{"eventName": "TagResource", "requestParameters": {"resource": "arn:aws:lambda:us-east-1:123456789012:function:function1"}}`)},
+			expectedError: "resource ARN is missing from TagResource event",
+		},
+		{
+			name:          "missing account creation status",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`{"eventName": "CreateAccount", "responseElements": {}}`)},
+			expectedError: "`createAccountStatus` is missing from CreateAccount event",
+		},
+		{
+			name:          "missing source parent",
+			event:         Event{DetailType: cloudTrailApiCallDetailType, Detail: json.RawMessage(`{"eventName": "MoveAccount", "requestParameters": {"accountId": "555555555555"}}`)},
+			expectedError: "`sourceParentId` is missing from MoveAccount event",
+		},
+		{
+			name:          "unsupported internal event",
+			event:         Event{Detail: json.RawMessage(`{"eventName": "CreateLogGroup", "requestParameters": {}}`)},
+			expectedError: `unsupported internal event "CreateLogGroup"`,
+		},
+		{
+			name:          "missing action",
+			event:         Event{Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {}}`)},
+			expectedError: "`action` is missing from SubscriptionFilterEvent event",
+		},
+		{
+			name:          "unsupported action",
+			event:         Event{Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "move"}}`)},
+			expectedError: `unsupported action "move" of SubscriptionFilterEvent event`,
+		},
+		{
+			name:          "invalid continuation",
+			event:         Event{Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "add", "continuation": {"iteration": 0}}}`)},
+			expectedError: "invalid iteration 0 of the continuation of SubscriptionFilterEvent event",
+		},
+		{
+			name:          "continued replay",
+			event:         Event{Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "replay", "continuation": {"iteration": 1}}}`)},
+			expectedError: "replay action of SubscriptionFilterEvent event can't be continued",
+		},
+		{
+			name:          "continued inventory",
+			event:         Event{Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "inventory", "continuation": {"iteration": 1}}}`)},
+			expectedError: "inventory action of SubscriptionFilterEvent event can't be continued",
+		},
+		{
+			name:          "unsupported source",
+			event:         Event{Source: "aws.s3", DetailType: "Object Deleted", Detail: json.RawMessage(`{}`)},
+			expectedError: `unsupported event of source "aws.s3" and detail type "Object Deleted"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, err := parseEvent(test.event)
+
+			if test.expectedError != "" {
+				assert.NotNil(t, err)
+				assert.ErrorContains(t, err, test.expectedError)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedEvent, event)
+			}
+		})
+	}
+}
+
+func TestTagResourceEventHasMonitoringTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     map[string]string
+		expected bool
+	}{
+		{
+			name:     "monitoring tag",
+			tags:     map[string]string{monitoringTagKey: monitoringTagValue},
+			expected: true,
+		},
+		{
+			name:     "monitoring tag in other case",
+			tags:     map[string]string{"Logzio:Subscribe": "TRUE"},
+			expected: true,
+		},
+		{
+			name:     "monitoring tag of other value",
+			tags:     map[string]string{monitoringTagKey: "false"},
+			expected: false,
+		},
+		{
+			name:     "without tags",
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, tagResourceEvent{Tags: test.tags}.hasMonitoringTag())
+		})
+	}
+}
+
+func TestSecretChangedEventChangesCurrentVersion(t *testing.T) {
+	assert.True(t, secretChangedEvent{}.changesCurrentVersion())
+	assert.True(t, secretChangedEvent{VersionStages: []string{"AWSCURRENT", "custom"}}.changesCurrentVersion())
+	assert.False(t, secretChangedEvent{VersionStages: []string{"AWSPENDING"}}.changesCurrentVersion())
+}
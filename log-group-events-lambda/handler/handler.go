@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/logzio/firehose-logs/common"
 	"github.com/logzio/firehose-logs/logger"
 	"go.uber.org/zap"
@@ -14,327 +13,551 @@ import (
 var sugLog *zap.SugaredLogger
 var envConfig *Config
 
-func HandleRequest(ctx context.Context, event map[string]interface{}) (string, error) {
+func HandleRequest(ctx context.Context, event Event) (Result, error) {
+	if err := setupHandler(ctx); err != nil {
+		return Result{Message: "Lambda finished with error"}, err
+	}
+	return handleEvent(ctx, event)
+}
+
+// setupHandler initializes the logger and the configuration of an invocation. The events keep running on the last
+// valid configuration when the configuration file can't be loaded, and only the event of its new version fails.
+func setupHandler(ctx context.Context) error {
 	sugLog = logger.GetSugaredLogger()
 
-	envConfig = NewConfig()
-	if envConfig == nil {
-		return "Lambda finished with error", fmt.Errorf("error while validating required environment variables")
+	var err error
+	if envConfig, err = NewConfig(); err != nil {
+		return err
+	}
+
+	if envConfig.configKey != emptyString {
+		s3Client, err := getS3Client()
+		if err == nil {
+			err = envConfig.loadConfigFile(ctx, s3Client)
+		}
+		if err != nil {
+			envConfig.useLastValidConfigFile(err)
+		}
 	}
+	return nil
+}
 
+// handleEvent handles a single event, which was received directly or in an SQS batch
+func handleEvent(ctx context.Context, event Event) (Result, error) {
 	sugLog.Info("Starting handling event...")
-	sugLog.Debug("Handling event: ", event)
+	sugLog.Debugf("Handling event of source %s and detail type %s: %s", event.Source, event.DetailType, event.Detail)
 
-	detail, ok := event["detail"].(map[string]interface{})
-	if !ok {
-		sugLog.Error("`detail` is not of type map[string]interface{} or missing from the event.")
+	typed, err := parseEvent(event)
+	if err != nil {
+		sugLog.Error("Invalid event: ", err.Error())
+		return Result{}, err
 	}
+	eventName := typed.name()
+	sugLog.Debugf("Detected %s event", eventName)
 
-	eventName, ok := detail["eventName"].(string)
-	if !ok {
-		sugLog.Error("`eventName` is not of type string or missing from the event.")
+	account, region := event.Account, event.Region
+	if skipped, ok, err := skipUnmanagedTarget(ctx, event, eventName); err != nil || ok {
+		return skipped, err
 	}
 
-	requestParameters, ok := detail["requestParameters"].(map[string]interface{})
-	if !ok {
-		sugLog.Error("`requestParameters` is not of type map[string]interface{} or missing from the event.")
+	result, err := typed.handle(ctx, account, region)
+	if err == nil && result.Message != emptyString {
+		// the event was skipped
+		return result, nil
 	}
 
-	switch eventName {
-	case "CreateLogGroup":
-		sugLog.Debug("Detected EventBridge CreateLogGroup event")
-
-		logGroup, ok := requestParameters["logGroupName"].(string)
-		if !ok {
-			sugLog.Error("`logGroupName` is not of type string or missing from EventBridge event")
-			return "", fmt.Errorf("`logGroupName` is not of type string or missing from EventBridge event")
-		}
-		handleNewLogGroupEvent(ctx, logGroup)
+	if err != nil {
+		sugLog.Error("Error while handling event: ", err.Error())
+		result.Message = fmt.Sprintf("%s event failed", eventName)
+		return result, err
+	}
 
-	case "PutSecretValue":
-		sugLog.Debug("Detected EventBridge PutSecretValue event")
+	if result.Continued {
+		result.Message = fmt.Sprintf("%s event continues in a new invocation", eventName)
+		return result, nil
+	}
 
-		secretId, ok := requestParameters["secretId"].(string)
-		if !ok {
-			sugLog.Error("`secretId` is not of type string or missing from EventBridge event")
-			return "", fmt.Errorf("`secretId` is not of type string or missing from EventBridge event")
+	if result.Replayed != nil {
+		result.Message = fmt.Sprintf("%s event replayed %d events, %d failed again", eventName, len(result.Replayed), result.failedReplaysCount())
+		if result.DryRun {
+			result.Message = fmt.Sprintf("%s event planned replaying %d events in dry run mode, %d failed", eventName, len(result.Replayed), result.failedReplaysCount())
 		}
-		err := handleSecretChangedEvent(ctx, secretId)
-		if err != nil {
-			return "", err
+		return result, nil
+	}
+
+	if result.Inventory != nil {
+		result.Message = fmt.Sprintf("%s event reported inventory of %d log groups", eventName, result.Inventory.LogGroupsCount)
+		if !result.Inventory.Complete {
+			result.Message = fmt.Sprintf("%s event reported partial inventory of %d log groups before the function deadline", eventName, result.Inventory.LogGroupsCount)
 		}
+		return result, nil
+	}
 
-	case "SubscriptionFilterEvent":
-		sugLog.Debug("Detected SubscriptionFilterEvent event")
+	result.Message = outcomeMessage(eventName, result)
+	return result, nil
+}
 
-		var reqParams common.RequestParameters
-		reqParams, err := common.ConvertToRequestParameters(requestParameters)
-		if err != nil {
-			sugLog.Error("Error converting request parameters: ", err.Error())
-			return "", err
-		}
+// outcomeMessage logs the failures of the subscription filter changes of an event, and returns the message of its
+// result. The failures of a dry run are reported too, since they would fail the changes as well.
+func outcomeMessage(eventName string, result Result) string {
+	handled := "handled"
+	if result.DryRun {
+		sugLog.Infof("Dry run, planned adding %d, updating %d and removing %d subscription filters", len(result.Added), len(result.Updated), len(result.Removed))
+		handled = "planned in dry run mode"
+	}
 
-		actionType := reqParams.Action
-		switch actionType {
-		case common.AddSF:
-			sugLog.Debug("Detected Add Subscription Filter event")
-			handleCreateEvent(ctx, reqParams)
-		case common.UpdateSF:
-			sugLog.Debug("Detected Update Subscription Filter event")
-			handleUpdateEvent(ctx, reqParams)
-		case common.DeleteSF:
-			sugLog.Debug("Detected Delete Subscription Filter event")
-			return handleDeleteEvent(ctx, reqParams)
-		default:
-			sugLog.Debug("Detected unsupported Subscription Filter event")
-			return "", fmt.Errorf("unsupported Subscription Filter event")
-		}
+	if failedTargets := result.failedTargets(); len(failedTargets) > 0 {
+		sugLog.Warnf("Failed to handle %d accounts or regions: %v", len(failedTargets), failedTargets)
+		return fmt.Sprintf("%s event %s with %d failed accounts or regions", eventName, handled, len(failedTargets))
+	}
 
-	case "TagResource", "TagResource20170331v2":
-		sugLog.Debugf("Detected EventBridge %s event", eventName)
+	if failedCount := result.failedLogGroupsCount(); failedCount > 0 {
+		sugLog.Warnf("Failed to handle %d log groups: %v", failedCount, result.Failed)
+		return fmt.Sprintf("%s event %s with %d failed log groups", eventName, handled, failedCount)
+	}
 
-		if !envConfig.tagEventsEnabled {
-			sugLog.Debug("Tag events feature is disabled, skipping")
-			return fmt.Sprintf("%s event skipped - feature disabled", eventName), nil
-		}
+	if result.DryRun {
+		return fmt.Sprintf("%s event planned in dry run mode", eventName)
+	}
+	return fmt.Sprintf("%s event handled successfully", eventName)
+}
 
-		if !hasMonitoringTag(requestParameters) {
-			sugLog.Debug("Monitoring tag not present, skipping")
-			return fmt.Sprintf("%s event skipped - monitoring tag not present", eventName), nil
-		}
+// skipUnmanagedTarget returns the result of an event of an account or region which is not managed, and whether the
+// event was skipped. Events of member accounts and other regions are forwarded to the event bus of this account and
+// region, and are handled in their account and region. Organizations events are of the management account, and are
+// about other accounts.
+func skipUnmanagedTarget(ctx context.Context, event Event, eventName string) (Result, bool, error) {
+	if event.Source == organizationsEventSource {
+		return Result{}, false, nil
+	}
 
-		var resourceArn string
-		if eventName == "TagResource" {
-			resourceArn, ok = requestParameters["resourceArn"].(string)
-		} else {
-			resourceArn, ok = requestParameters["resource"].(string)
-		}
-		if !ok || resourceArn == "" {
-			sugLog.Error("Resource ARN is missing from the event")
-			return "", fmt.Errorf("resource ARN is missing from %s event", eventName)
+	account, region := event.Account, event.Region
+	if !envConfig.isThisAccount(account) {
+		if err := ensureMemberAccounts(ctx); err != nil {
+			sugLog.Error("Error while listing member accounts: ", err.Error())
+			return Result{}, false, err
 		}
+	}
+	if !envConfig.isManagedAccount(account) {
+		sugLog.Debugf("Account %s is not managed, skipping the event", account)
+		return Result{Message: fmt.Sprintf("%s event skipped - account %s is not managed", eventName, account)}, true, nil
+	}
+	if !envConfig.isManagedRegion(region) {
+		sugLog.Debugf("Region %s is not managed, skipping the event", region)
+		return Result{Message: fmt.Sprintf("%s event skipped - region %s is not managed", eventName, region)}, true, nil
+	}
+	return Result{}, false, nil
+}
 
-		logGroup, err := getLogGroupFromArn(resourceArn)
-		if err != nil {
-			sugLog.Errorf("Failed to extract log group from ARN: %v", err)
-			return "", err
-		}
+// skipInAccountPolicyMode returns the result of an event which is covered by the account policy
+func skipInAccountPolicyMode(eventName string) Result {
+	sugLog.Debugf("%s event is covered by the account policy, skipping", eventName)
+	return Result{Message: fmt.Sprintf("%s event skipped - account policy mode", eventName)}
+}
 
-		cwClient, err := getCloudWatchLogsClient()
-		if err != nil {
-			sugLog.Error("Failed to get CloudWatch Logs client")
-			return "", err
-		}
+func (e createLogGroupEvent) handle(ctx context.Context, account, region string) (Result, error) {
+	if envConfig.mode == modeAccountPolicy {
+		return skipInAccountPolicyMode(e.name()), nil
+	}
+	return handleNewLogGroupEvent(ctx, account, region, e.LogGroupName)
+}
 
-		if cwClient.hasSubscriptionFilter(logGroup) {
-			sugLog.Debugf("Subscription filter already exists for %s, skipping", logGroup)
-			return fmt.Sprintf("%s event skipped - subscription filter already exists", eventName), nil
-		}
+func (e secretChangedEvent) handle(ctx context.Context, _, _ string) (Result, error) {
+	if envConfig.mode == modeAccountPolicy {
+		return skipInAccountPolicyMode(e.name()), nil
+	}
+	if !e.changesCurrentVersion() {
+		sugLog.Debugf("New version of secret %s is not current, skipping", e.SecretId)
+		return Result{Message: fmt.Sprintf("%s event skipped - not the current version", e.name())}, nil
+	}
+	return handleSecretChangedEvent(ctx, e.name(), e.SecretId)
+}
 
-		added, err := cwClient.addSubscriptionFilter([]string{logGroup})
-		if err != nil {
-			sugLog.Errorf("Failed to add subscription filter: %v", err)
-			return "", err
-		}
-		if len(added) > 0 {
-			sugLog.Infof("Added subscription filter to log group: %s", logGroup)
-		}
+func (e parameterChangedEvent) handle(ctx context.Context, _, _ string) (Result, error) {
+	if envConfig.mode == modeAccountPolicy {
+		return skipInAccountPolicyMode(e.name()), nil
+	}
+	return handleParameterChangedEvent(ctx, e.name(), e.Name)
+}
 
-	default:
-		sugLog.Debug("Detected unsupported event")
-		return "", fmt.Errorf("unsupported event")
+func (e tagResourceEvent) handle(ctx context.Context, account, region string) (Result, error) {
+	if envConfig.mode == modeAccountPolicy {
+		return skipInAccountPolicyMode(e.name()), nil
+	}
+
+	if !envConfig.tagEventsEnabled {
+		sugLog.Debug("Tag events feature is disabled, skipping")
+		return Result{Message: fmt.Sprintf("%s event skipped - feature disabled", e.name())}, nil
+	}
+
+	if !e.hasMonitoringTag() {
+		sugLog.Debug("Monitoring tag not present, skipping")
+		return Result{Message: fmt.Sprintf("%s event skipped - monitoring tag not present", e.name())}, nil
+	}
+
+	logGroup, err := getLogGroupFromArn(e.resourceArn())
+	if err != nil {
+		sugLog.Errorf("Failed to extract log group from ARN: %v", err)
+		return Result{}, err
+	}
+
+	cwClient, err := getCloudWatchLogsClientFor(account, region)
+	if err != nil {
+		sugLog.Error("Failed to get CloudWatch Logs client")
+		return Result{}, err
+	}
+
+	changes, addErr := cwClient.addSubscriptionFilter(ctx, []string{logGroup})
+	tagResult := Result{DryRun: cwClient.dryRun}
+	tagResult.record(changes)
+	err = tagResult.collectFailures(addErr)
+	if addErr != nil {
+		sugLog.Errorf("Failed to add subscription filter: %v", addErr)
+	}
+	result := tagResult.inTarget(account, region)
+	if len(tagResult.Unchanged) > 0 {
+		sugLog.Debugf("Subscription filter already exists for %s, skipping", logGroup)
+		result.Message = fmt.Sprintf("%s event skipped - subscription filter already exists", e.name())
+		return result, nil
+	}
+	if len(changes) > 0 {
+		sugLog.Infof("Put subscription filter on log group: %s", logGroup)
+	}
+	return result, err
+}
+
+func (e createAccountEvent) handle(ctx context.Context, _, _ string) (Result, error) {
+	newAccount := e.createdAccount()
+	if newAccount == emptyString {
+		sugLog.Debugf("Account creation is in state %s, skipping", e.CreateAccountStatus.State)
+		return Result{Message: fmt.Sprintf("%s event skipped - account is not created yet", e.name())}, nil
+	}
+	return handleOrganizationAccountEvent(ctx, e.name(), newAccount, emptyString)
+}
+
+func (e moveAccountEvent) handle(ctx context.Context, _, _ string) (Result, error) {
+	return handleOrganizationAccountEvent(ctx, e.name(), e.AccountId, e.SourceParentId)
+}
+
+// handle reconciles the subscription filters with a new version of the configuration file. The file was loaded when
+// the invocation was set up, so an invalid file fails the event before any subscription filter changes.
+func (e objectCreatedEvent) handle(ctx context.Context, _, _ string) (Result, error) {
+	if !envConfig.isConfigObject(e.Bucket.Name, e.Object.Key) {
+		sugLog.Debugf("Object %s of bucket %s is not the configuration file, skipping", e.Object.Key, e.Bucket.Name)
+		return Result{Message: fmt.Sprintf("%s event skipped - not the configuration file", e.name())}, nil
+	}
+	if envConfig.mode == modeAccountPolicy {
+		return skipInAccountPolicyMode(e.name()), nil
+	}
+	if err := envConfig.configFileError(); err != nil {
+		return Result{}, err
+	}
+
+	sugLog.Infof("Configuration file %s changed, reconciling the subscription filters", e.Object.Key)
+	return handleReconcileEvent(ctx, common.RequestParameters{Action: common.ReconcileSF})
+}
+
+// handle reconciles the subscription filters of the monitored log groups, so filters which were removed or changed
+// outside of the function are restored
+func (e scheduledEvent) handle(ctx context.Context, _, _ string) (Result, error) {
+	if envConfig.mode == modeAccountPolicy {
+		return handleAccountPolicyEvent(ctx, common.AddSF, false)
 	}
 
-	return fmt.Sprintf("%s event handled successfully", eventName), nil
+	j, err := newSetupJob(common.AddSF)
+	if err != nil {
+		return Result{}, err
+	}
+	return fanOutJob(ctx, j)
+}
+
+func (e subscriptionFilterEvent) handle(ctx context.Context, _, _ string) (Result, error) {
+	params := e.params
+	switch {
+	case params.Action == common.ReplaySF:
+		sugLog.Debug("Detected Replay event")
+		return handleReplayEvent(ctx, params.DryRun)
+	case params.Action == common.InventorySF:
+		sugLog.Debug("Detected Inventory event")
+		return handleInventoryEvent(ctx)
+	case envConfig.mode == modeAccountPolicy:
+		sugLog.Debug("Detected Subscription Filter event in account policy mode")
+		return handleAccountPolicyEvent(ctx, params.Action, params.DryRun)
+	case params.Continuation != nil:
+		sugLog.Debug("Detected continuation of Subscription Filter event")
+		return handleContinuationEvent(ctx, params)
+	case params.Action == common.ReconcileSF, params.Action == common.StatusSF:
+		sugLog.Debugf("Detected %s Subscription Filter event", params.Action)
+		return handleReconcileEvent(ctx, params)
+	case params.Action == common.AddSF:
+		sugLog.Debug("Detected Add Subscription Filter event")
+		return handleCreateEvent(ctx, params)
+	case params.Action == common.UpdateSF:
+		sugLog.Debug("Detected Update Subscription Filter event")
+		return handleUpdateEvent(ctx, params)
+	default:
+		sugLog.Debug("Detected Delete Subscription Filter event")
+		return handleDeleteEvent(ctx, params)
+	}
 }
 
-func handleNewLogGroupEvent(ctx context.Context, newLogGroup string) {
+func handleNewLogGroupEvent(ctx context.Context, account, region, newLogGroup string) (Result, error) {
 	// Prevent a situation where we put subscription filter on the trigger function
-	if newLogGroup == envConfig.thisFunctionLogGroup {
-		return
+	if envConfig.isThisAccount(account) && envConfig.isThisRegion(region) && newLogGroup == envConfig.thisFunctionLogGroup {
+		return Result{}, nil
 	}
 
-	// Check if the log group is of a monitored service
-	currMonitoredServices := getServices()
-	var added []string
-	if currMonitoredServices != nil {
-		serviceToPrefix := getServicesMap()
+	if !isMonitoredLogGroup(newLogGroup) {
+		sugLog.Debug("Log group is not of a monitored service or custom prefix, skipping: ", newLogGroup)
+		return Result{}, nil
+	}
 
-		cwClient, err := getCloudWatchLogsClient()
-		if err != nil {
-			sugLog.Error("Failed to get cloudwatch logs client")
-		}
+	cwClient, err := getCloudWatchLogsClientFor(account, region)
+	if err != nil {
+		sugLog.Error("Failed to get cloudwatch logs client")
+		return Result{}, err
+	}
 
-		for _, service := range currMonitoredServices {
-			if prefix, ok := serviceToPrefix[service]; ok {
-				if strings.Contains(newLogGroup, prefix) {
-					added, _ = cwClient.addSubscriptionFilter([]string{newLogGroup})
-					if len(added) > 0 {
-						sugLog.Info("Added subscription filter to log group: ", newLogGroup)
-						return
-					}
-				}
-			}
-		}
+	changes, err := cwClient.addSubscriptionFilter(ctx, []string{newLogGroup})
+	if len(changes) > 0 {
+		sugLog.Info("Handled subscription filter of log group: ", changes[0])
 	}
 
-	// Check if the log group is of a monitored custom prefix
-	currCustomGroupsPrefixes := getCustomGroupsPrefixes()
-	if len(currCustomGroupsPrefixes) > 0 {
-		cwClient, err := getCloudWatchLogsClient()
-		if err != nil {
-			sugLog.Error("Failed to get cloudwatch logs client")
+	result := Result{DryRun: cwClient.dryRun}
+	result.record(changes)
+	err = result.collectFailures(err)
+	return result.inTarget(account, region), err
+}
+
+// isMonitoredLogGroup checks if the log group is of a monitored service or of a monitored custom prefix
+func isMonitoredLogGroup(logGroup string) bool {
+	serviceToPrefix := getServicesMap()
+	for _, service := range getServices() {
+		if prefix, ok := serviceToPrefix[service]; ok && strings.Contains(logGroup, prefix) {
+			return true
 		}
+	}
 
-		for _, prefix := range currCustomGroupsPrefixes {
-			if strings.Contains(newLogGroup, prefix) {
-				added, _ = cwClient.addSubscriptionFilter([]string{newLogGroup})
-				if len(added) > 0 {
-					sugLog.Info("Added subscription filter to log group: ", newLogGroup)
-					return
-				}
-			}
+	for _, prefix := range getCustomGroupsPrefixes() {
+		if strings.Contains(logGroup, prefix) {
+			return true
 		}
 	}
-}
 
-func handleSecretChangedEvent(ctx context.Context, secretId string) error {
-	secretName := envConfig.customGroupsValue
+	return false
+}
 
+func handleSecretChangedEvent(ctx context.Context, eventName, secretId string) (Result, error) {
 	// make sure that the secret which changed is the relevant secret
-	if strings.Contains(secretId, secretName) {
-		err := updateSecretCustomLogGroups(ctx, secretId)
-		if err != nil {
-			sugLog.Error("Error while updating secret custom log groups: ", err.Error())
-			return err
-		}
-	} else {
+	if !envConfig.secretEnabled || !isCustomLogGroupsSecret(secretId) {
 		sugLog.Debug("The EventBridge event secretId is not the secret that has custom log groups in it. Skipping it.")
+		return Result{Message: fmt.Sprintf("%s event skipped - not the custom log groups secret", eventName)}, nil
 	}
-	return nil
-}
 
-func handleCreateEvent(ctx context.Context, event common.RequestParameters) {
-	cwClient, err := getCloudWatchLogsClient()
+	svc, err := getSecretManagerClient(ctx)
 	if err != nil {
-		sugLog.Error("Failed to get cloudwatch logs client")
-		return
+		return Result{}, err
 	}
 
-	servicesToMonitor := convertStrToArr(event.NewServices)
-	logGroupsToMonitor := getServicesLogGroups(servicesToMonitor, cwClient)
-
-	customLogGroupsToMonitor, err := getCustomLogGroups(event.NewIsSecret, event.NewCustom)
+	// the secret is referred to by the configured ARN, since the event may refer to it by name
+	secretArn := envConfig.customGroupsValue
+	var result Result
+	if eventName == "RestoreSecret" {
+		result, err = restoreSecretCustomLogGroups(ctx, svc, secretArn)
+	} else {
+		result, err = updateSecretCustomLogGroups(ctx, svc, eventName, secretArn)
+	}
 	if err != nil {
-		sugLog.Error("Error while getting custom log groups: ", err.Error())
+		sugLog.Error("Error while updating secret custom log groups: ", err.Error())
 	}
-	logGroupsToMonitor = append(logGroupsToMonitor, customLogGroupsToMonitor...)
+	return result, err
+}
 
-	added, _ := cwClient.addSubscriptionFilter(logGroupsToMonitor)
+func handleParameterChangedEvent(ctx context.Context, eventName, parameterName string) (Result, error) {
+	// make sure that the parameter which changed is the parameter of the custom log groups
+	if envConfig.secretEnabled || !isParameterArn(envConfig.customGroupsValue) || !isCustomLogGroupsParameter(parameterName) {
+		sugLog.Debug("The parameter of the event is not the parameter that has custom log groups in it. Skipping it.")
+		return Result{Message: fmt.Sprintf("%s event skipped - not the custom log groups parameter", eventName)}, nil
+	}
 
-	sugLog.Info("Added subscription filters for the following log groups: ", added)
+	ssmClient, err := getSSMClient()
+	if err != nil {
+		return Result{}, err
+	}
+
+	// the parameter is referred to by the configured ARN, since the event refers to it by name
+	result, err := updateParameterCustomLogGroups(ctx, ssmClient, eventName, envConfig.customGroupsValue)
+	if err != nil {
+		sugLog.Error("Error while updating parameter custom log groups: ", err.Error())
+	}
+	return result, err
 }
 
-func handleUpdateEvent(ctx context.Context, event common.RequestParameters) {
-	cwClient, err := getCloudWatchLogsClient()
+func handleCreateEvent(ctx context.Context, event common.RequestParameters) (Result, error) {
+	customLogGroupsToMonitor, err := getCustomLogGroupsValues(event.NewIsSecret, event.NewCustom)
 	if err != nil {
-		sugLog.Error("Failed to get cloudwatch logs client")
+		sugLog.Error("Error while getting custom log groups: ", err.Error())
+		return Result{}, err
+	}
+	logGroupsToAdd, customPrefixesToAdd := splitCustomLogGroups(customLogGroupsToMonitor)
+
+	j := &job{
+		action:         event.Action,
+		logGroupsToAdd: logGroupsToAdd,
+		prefixesToAdd:  append(servicesPrefixes(convertStrToArr(event.NewServices)), customPrefixesToAdd...),
+		dryRun:         event.DryRun,
+		canContinue:    true,
 	}
+	return fanOutJob(ctx, j)
+}
 
+func handleUpdateEvent(ctx context.Context, event common.RequestParameters) (Result, error) {
 	oldServices := convertStrToArr(event.OldServices)
 	newServices := convertStrToArr(event.NewServices)
 
-	oldCustomGroups, err := getCustomLogGroups(event.OldIsSecret, event.OldCustom)
+	oldCustomGroups, err := getCustomLogGroupsValues(event.OldIsSecret, event.OldCustom)
 	if err != nil {
 		sugLog.Error("Error while getting old custom log groups: ", err.Error())
+		return Result{}, err
 	}
-	newCustomGroups, err := getCustomLogGroups(event.NewIsSecret, event.NewCustom)
+	newCustomGroups, err := getCustomLogGroupsValues(event.NewIsSecret, event.NewCustom)
 	if err != nil {
 		sugLog.Error("Error while getting new custom log groups: ", err.Error())
+		return Result{}, err
 	}
 
-	servicesToAdd, servicesToRemove := findDifferences(oldServices, newServices)
-	customGroupsToAdd, customGroupsToRemove := findDifferences(oldCustomGroups, newCustomGroups)
+	// all the monitored log groups are reconciled, so the ones whose route, destination or distribution changed are
+	// updated, while the ones which are up to date are skipped
+	_, servicesToRemove := findDifferences(oldServices, newServices)
+	_, customGroupsToRemove := findDifferences(oldCustomGroups, newCustomGroups)
+	logGroupsToAdd, customPrefixesToAdd := splitCustomLogGroups(newCustomGroups)
+	logGroupsToRemove, customPrefixesToRemove := splitCustomLogGroups(customGroupsToRemove)
+
+	j := &job{
+		action:            event.Action,
+		logGroupsToAdd:    logGroupsToAdd,
+		logGroupsToRemove: logGroupsToRemove,
+		prefixesToAdd:     append(servicesPrefixes(newServices), customPrefixesToAdd...),
+		prefixesToRemove:  append(servicesPrefixes(servicesToRemove), customPrefixesToRemove...),
+		dryRun:            event.DryRun,
+		canContinue:       true,
+	}
+	return fanOutJob(ctx, j)
+}
 
-	err = cwClient.updateSubscriptionFilters(servicesToAdd, servicesToRemove, customGroupsToAdd, customGroupsToRemove)
+func handleDeleteEvent(ctx context.Context, event common.RequestParameters) (Result, error) {
+	customLogGroupsToUnMonitor, err := getCustomLogGroupsValues(event.NewIsSecret, event.NewCustom)
 	if err != nil {
-		sugLog.Error("Error while updating subscription filters: ", err.Error())
+		sugLog.Error("Error while getting custom log groups: ", err.Error())
+		return Result{}, err
+	}
+	services := convertStrToArr(event.NewServices)
+
+	// the configuration file selects log groups which the parameters of the stack may not, so they're removed too
+	if envConfig.configKey != emptyString {
+		if services, customLogGroupsToUnMonitor, err = withConfigFileSelection(services, customLogGroupsToUnMonitor); err != nil {
+			sugLog.Error("Error while getting the log groups of the configuration file: ", err.Error())
+			return Result{}, err
+		}
 	}
+	logGroupsToRemove, customPrefixesToRemove := splitCustomLogGroups(customLogGroupsToUnMonitor)
+
+	// the stack deletion waits for this invocation, so the filters must be removed before it ends
+	j := &job{
+		action:            event.Action,
+		logGroupsToRemove: logGroupsToRemove,
+		prefixesToRemove:  append(servicesPrefixes(services), customPrefixesToRemove...),
+		dryRun:            event.DryRun,
+		canContinue:       false,
+	}
+	return fanOutJob(ctx, j)
 }
 
-func handleDeleteEvent(ctx context.Context, event common.RequestParameters) (string, error) {
-	cwClient, err := getCloudWatchLogsClient()
+// withConfigFileSelection adds the services and custom log groups of the last applied configuration file to the given
+// ones. When no configuration file was applied since it can't be loaded, its selection is unknown, so every log group
+// is selected and only the ones with the subscription filter of the function are changed.
+func withConfigFileSelection(services, customLogGroups []string) ([]string, []string, error) {
+	if envConfig.configFileErr != nil && lastValidConfigFile == nil {
+		sugLog.Warn("Configuration file was not loaded, selecting every log group: ", envConfig.configFileErr.Error())
+		return services, append(customLogGroups, "*"), nil
+	}
+
+	fileCustomLogGroups, err := envConfig.customLogGroups()
 	if err != nil {
-		sugLog.Error("Failed to get cloudwatch logs client")
-		return "", err
+		return nil, nil, err
 	}
+	fileServices, _ := findDifferences(services, getServices())
+	fileCustom, _ := findDifferences(customLogGroups, fileCustomLogGroups.names())
+	return append(services, fileServices...), append(customLogGroups, fileCustom...), nil
+}
 
-	servicesToUnMonitor := convertStrToArr(event.NewServices)
-	logGroupsToUnMonitor := getServicesLogGroups(servicesToUnMonitor, cwClient)
+// handleReconcileEvent converges the subscription filters of every target to the configuration of the function. The
+// status action plans the same changes in dry run mode, so its result is an inventory of the subscription filters.
+func handleReconcileEvent(ctx context.Context, event common.RequestParameters) (Result, error) {
+	if err := envConfig.configFileError(); err != nil {
+		return Result{}, err
+	}
 
-	customLogGroupsToUnMonitor, err := getCustomLogGroups(event.NewIsSecret, event.NewCustom)
+	j, err := newReconcileJob(event.Action)
 	if err != nil {
-		sugLog.Error("Error while getting custom log groups: ", err.Error())
-		return "", err
+		sugLog.Error("Error while getting monitored log groups: ", err.Error())
+		return Result{}, err
 	}
+	j.dryRun = event.DryRun || event.Action == common.StatusSF
+	return fanOutJob(ctx, j)
+}
 
-	logGroupsToUnMonitor = append(logGroupsToUnMonitor, customLogGroupsToUnMonitor...)
-	deleted, err := cwClient.removeSubscriptionFilter(logGroupsToUnMonitor)
+// handleContinuationEvent resumes an action which didn't finish in a previous invocation
+func handleContinuationEvent(ctx context.Context, event common.RequestParameters) (Result, error) {
+	j, err := newJobFromContinuation(event)
 	if err != nil {
-		sugLog.Error("Error while removing subscription filters: ", err.Error())
-		return "", err
+		return Result{}, err
+	}
+	if j.action == common.ReconcileSF || j.action == common.StatusSF {
+		if err = envConfig.configFileError(); err != nil {
+			return Result{}, err
+		}
 	}
 
-	sugLog.Info("Deleted subscription filters for the following log groups: ", deleted)
-	return "Event handled successfully", nil
-}
-
-// hasMonitoringTag checks if the request parameters contain the monitoring tag (logzio:monitor=true)
-func hasMonitoringTag(requestParameters map[string]interface{}) bool {
-	tags, ok := requestParameters["tags"].(map[string]interface{})
-	if !ok {
-		return false
+	if err = ensureMemberAccounts(ctx); err != nil {
+		return Result{}, err
 	}
 
-	for key, value := range tags {
-		if strings.EqualFold(key, monitoringTagKey) {
-			if val, ok := value.(string); ok && strings.EqualFold(val, monitoringTagValue) {
-				return true
-			}
-		}
+	sugLog.Infof("Resuming %s action, invocation %d", j.action, j.iteration+1)
+	if !envConfig.isThisAccount(j.account) || !envConfig.isThisRegion(j.region) {
+		return executeTargetJob(ctx, j).inTarget(j.account, j.region), nil
 	}
-	return false
+	return executeJob(ctx, j)
 }
 
-// getLogGroupFromArn extracts the log group name from a CloudWatch Logs or Lambda ARN
+// getLogGroupFromArn extracts the log group name from a CloudWatch Logs or Lambda ARN in the partition of the function
 func getLogGroupFromArn(resourceArn string) (string, error) {
-	parsed, err := arn.Parse(resourceArn)
+	parsed, err := parseArn(resourceArn)
 	if err != nil {
-		return "", fmt.Errorf("invalid ARN format: %v", err)
+		return "", err
 	}
 
 	switch parsed.Service {
 	case "logs":
-		// CloudWatch Logs ARN format: arn:aws:logs:region:account:log-group:/path/to/log-group
+		// CloudWatch Logs ARN format: arn:<partition>:logs:region:account:log-group:/path/to/log-group
 		// Resource format: log-group:/aws/lambda/function-name
-		if strings.HasPrefix(parsed.Resource, "log-group:") {
-			logGroupName := strings.TrimPrefix(parsed.Resource, "log-group:")
+		if strings.HasPrefix(parsed.Resource, logGroupResourcePrefix) {
+			logGroupName := strings.TrimPrefix(parsed.Resource, logGroupResourcePrefix)
 			return logGroupName, nil
 		}
 		return "", fmt.Errorf("unexpected CloudWatch Logs ARN resource format: %s", parsed.Resource)
 
 	case "lambda":
-		// Lambda ARN format: arn:aws:lambda:region:account:function:function-name
+		// Lambda ARN format: arn:<partition>:lambda:region:account:function:function-name
 		// Resource format: function:my-function or function:my-function:alias
-		if strings.HasPrefix(parsed.Resource, "function:") {
-			parts := strings.SplitN(parsed.Resource, ":", 2)
-			if len(parts) < 2 {
-				return "", fmt.Errorf("unexpected Lambda ARN resource format: %s", parsed.Resource)
-			}
-			functionName := parts[1]
+		if strings.HasPrefix(parsed.Resource, functionResourcePrefix) {
+			functionName := strings.TrimPrefix(parsed.Resource, functionResourcePrefix)
 			if colonIdx := strings.Index(functionName, ":"); colonIdx != -1 {
 				functionName = functionName[:colonIdx]
 			}
+			if functionName == emptyString {
+				return "", fmt.Errorf("unexpected Lambda ARN resource format: %s", parsed.Resource)
+			}
 			return lambdaPrefix + functionName, nil
 		}
 		return "", fmt.Errorf("unexpected Lambda ARN resource format: %s", parsed.Resource)
@@ -2,14 +2,21 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"github.com/logzio/firehose-logs/common"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
+	"time"
 )
 
 func setupHandlerTest() (ctx context.Context) {
 	/* Setup needed env variables */
-	err := os.Setenv("FIREHOSE_ARN", "test-arn")
+	err := os.Setenv("FIREHOSE_ARN", "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream")
+	if err != nil {
+		return
+	}
+	err = os.Setenv("PUT_SF_ROLE", "arn:aws:iam::123456789012:role/test-role")
 	if err != nil {
 		return
 	}
@@ -21,6 +28,14 @@ func setupHandlerTest() (ctx context.Context) {
 	if err != nil {
 		return
 	}
+	err = os.Setenv("STACK_NAME", "test-stack")
+	if err != nil {
+		return
+	}
+	err = os.Setenv("AWS_REGION", "us-east-1")
+	if err != nil {
+		return
+	}
 
 	ctx = context.Background()
 
@@ -32,69 +47,67 @@ func TestUnsupportedEventHandling(t *testing.T) {
 
 	tests := []struct {
 		name              string
-		event             map[string]interface{}
+		event             Event
 		expectedOutputMsg string
 		expectedError     bool
 	}{
 		{
 			name: "Unsupported event with all required fields",
-			event: map[string]interface{}{
-				"detail": map[string]interface{}{
-					"eventName": "MyCustomEvent",
-					"requestParameters": map[string]interface{}{
-						"logGroupName": "my-log-group",
-					},
-				},
+			event: Event{
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "MyCustomEvent", "requestParameters": {"logGroupName": "my-log-group"}}`),
 			},
 			expectedOutputMsg: "",
 			expectedError:     true,
 		},
 		{
 			name:              "Unsupported event with missing detail field",
-			event:             map[string]interface{}{},
+			event:             Event{},
 			expectedOutputMsg: "",
 			expectedError:     true,
 		},
 		{
 			name: "Unsupported event with missing eventName field",
-			event: map[string]interface{}{
-				"detail": map[string]interface{}{
-					"requestParameters": map[string]interface{}{
-						"logGroupName": "my-log-group",
-					},
-				},
+			event: Event{
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"requestParameters": {"logGroupName": "my-log-group"}}`),
 			},
 			expectedOutputMsg: "",
 			expectedError:     true,
 		},
 		{
 			name: "Unsupported event with missing requestParameters field",
-			event: map[string]interface{}{
-				"detail": map[string]interface{}{
-					"eventName": "MyCustomEvent",
-				},
+			event: Event{
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "MyCustomEvent"}`),
 			},
 			expectedOutputMsg: "",
 			expectedError:     true,
 		},
 		{
 			name: "CreateLogGroup event with missing logGroup field",
-			event: map[string]interface{}{
-				"detail": map[string]interface{}{
-					"eventName":         "CreateLogGroup",
-					"requestParameters": map[string]interface{}{},
-				},
+			event: Event{
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "CreateLogGroup", "requestParameters": {}}`),
 			},
 			expectedOutputMsg: "",
 			expectedError:     true,
 		},
 		{
 			name: "PutSecretValue event with missing secretId field",
-			event: map[string]interface{}{
-				"detail": map[string]interface{}{
-					"eventName":         "PutSecretValue",
-					"requestParameters": map[string]interface{}{},
-				},
+			event: Event{
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "PutSecretValue", "requestParameters": {}}`),
+			},
+			expectedOutputMsg: "",
+			expectedError:     true,
+		},
+		{
+			name: "Unsupported event source",
+			event: Event{
+				Source:     "aws.s3",
+				DetailType: "Object Created",
+				Detail:     json.RawMessage(`{"bucket": {"name": "bucket1"}}`),
 			},
 			expectedOutputMsg: "",
 			expectedError:     true,
@@ -106,7 +119,106 @@ func TestUnsupportedEventHandling(t *testing.T) {
 			res, err := HandleRequest(ctx, test.event)
 
 			assert.NotNil(t, err)
-			assert.Equal(t, test.expectedOutputMsg, res)
+			assert.Equal(t, test.expectedOutputMsg, res.Message)
+		})
+	}
+}
+
+func TestHandleRequestFailedJob(t *testing.T) {
+	ctx := setupHandlerTest()
+	t.Setenv(envTagEventsEnabled, "true")
+	deleteEvent, err := json.Marshal(common.NewSubscriptionFilterEvent(common.RequestParameters{
+		Action:    common.DeleteSF,
+		NewCustom: "group1,group2",
+	}).Detail)
+	assert.Nil(t, err)
+
+	// the deadline is within the continuation margin, so the synchronous delete action can't finish
+	deadlineCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		event         Event
+		expectedError string
+	}{
+		{
+			name:          "delete action didn't finish",
+			ctx:           deadlineCtx,
+			event:         Event{Detail: json.RawMessage(deleteEvent)},
+			expectedError: "delete action didn't finish before the function deadline",
+		},
+		{
+			name: "tagged resource is not a log group",
+			ctx:  ctx,
+			event: Event{
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "TagResource", "requestParameters": {"resourceArn": "arn:test-partition:s3:::bucket1", "tags": {"logzio:subscribe": "true"}}}`),
+			},
+			expectedError: "unsupported service type: s3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := HandleRequest(test.ctx, test.event)
+
+			assert.ErrorContains(t, err, test.expectedError)
+		})
+	}
+}
+
+func TestHandleRequestInvalidConfig(t *testing.T) {
+	ctx := setupHandlerTest()
+	t.Setenv(envMaxConcurrency, "abc")
+	t.Setenv(envRegions, "west")
+
+	res, err := HandleRequest(ctx, Event{DetailType: "unsupported", Detail: json.RawMessage(`{}`)})
+
+	assert.Equal(t, "Lambda finished with error", res.Message)
+	assert.ErrorContains(t, err, "invalid MAX_CONCURRENCY 'abc', must be a positive integer")
+	assert.ErrorContains(t, err, "invalid region 'west'")
+}
+
+func TestOutcomeMessage(t *testing.T) {
+	setupSFTest()
+
+	tests := []struct {
+		name        string
+		result      Result
+		expectedMsg string
+	}{
+		{
+			name:        "handled",
+			result:      Result{Added: []string{"group1"}},
+			expectedMsg: "SubscriptionFilterEvent event handled successfully",
+		},
+		{
+			name:        "failed log groups",
+			result:      Result{Failed: map[string]string{"group1": "access denied"}},
+			expectedMsg: "SubscriptionFilterEvent event handled with 1 failed log groups",
+		},
+		{
+			name:        "dry run",
+			result:      Result{DryRun: true, Added: []string{"group1"}},
+			expectedMsg: "SubscriptionFilterEvent event planned in dry run mode",
+		},
+		{
+			name:        "dry run with failed log groups",
+			result:      Result{DryRun: true, Failed: map[string]string{"group1": "access denied"}},
+			expectedMsg: "SubscriptionFilterEvent event planned in dry run mode with 1 failed log groups",
+		},
+		{
+			name:        "dry run with failed targets",
+			result:      Result{DryRun: true, Accounts: map[string]*Result{"111111111111": {DryRun: true, Error: "access denied"}}},
+			expectedMsg: "SubscriptionFilterEvent event planned in dry run mode with 1 failed accounts or regions",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expectedMsg, outcomeMessage("SubscriptionFilterEvent", test.result))
 		})
 	}
 }
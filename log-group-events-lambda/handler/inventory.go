@@ -0,0 +1,330 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// inventoryFilter is another subscription filter, which occupies a subscription filter slot of a log group
+type inventoryFilter struct {
+	Name           string `json:"name"`
+	DestinationArn string `json:"destinationArn"`
+}
+
+// inventoryEntry is the subscription state of a single log group
+type inventoryEntry struct {
+	LogGroup string `json:"logGroup"`
+	// Subscribed is set when the subscription filter of the function is attached to the log group
+	Subscribed bool `json:"subscribed"`
+	// Rule is the rule of the configuration which selects the log group, it's empty when the log group isn't monitored
+	Rule string `json:"rule,omitempty"`
+	// OtherFilters are the subscription filters of the log group which are not of the function
+	OtherFilters []inventoryFilter `json:"otherFilters,omitempty"`
+	FreeSlots    int               `json:"freeSlots"`
+	Class        string            `json:"class,omitempty"`
+	StoredBytes  int64             `json:"storedBytes"`
+	// Error is set when the subscription filters of the log group couldn't be described
+	Error string `json:"error,omitempty"`
+}
+
+// serviceCoverage is the share of the log groups of a service which are subscribed
+type serviceCoverage struct {
+	Service    string `json:"service"`
+	LogGroups  int    `json:"logGroups"`
+	Subscribed int    `json:"subscribed"`
+	// Coverage is the percentage of the log groups which are subscribed
+	Coverage float64 `json:"coverage"`
+}
+
+// inventoryReport is the subscription state of every log group of the account and region of the function
+type inventoryReport struct {
+	Account     string    `json:"account"`
+	Region      string    `json:"region"`
+	GeneratedAt time.Time `json:"generatedAt"`
+	// Complete is false when the invocation ran out of time before every log group was inventoried
+	Complete bool `json:"complete"`
+	// LogGroupsCount is the number of log groups which were inventoried
+	LogGroupsCount int               `json:"logGroupsCount"`
+	Services       []serviceCoverage `json:"services"`
+	// LogGroups are left out of the returned report when it's written to the inventory bucket
+	LogGroups []inventoryEntry `json:"logGroups,omitempty"`
+	// CSV and ServicesCSV are the log groups and the coverage of the services in CSV format
+	CSV         string `json:"csv,omitempty"`
+	ServicesCSV string `json:"servicesCsv,omitempty"`
+	// Objects are the S3 URIs of the reports, when an inventory bucket is configured
+	Objects []string `json:"objects,omitempty"`
+}
+
+// parseInventoryBucket validates the name of the bucket which the inventory reports are written to
+func parseInventoryBucket(value string) (string, error) {
+	bucket := strings.TrimSpace(value)
+	if strings.ContainsAny(bucket, ":/") {
+		return emptyString, fmt.Errorf("invalid inventory bucket %q, expected the name of a bucket", value)
+	}
+	return bucket, nil
+}
+
+// handleInventoryEvent reports the subscription state of every log group of the account and region of the function,
+// and writes the report to the inventory bucket when it's configured
+func handleInventoryEvent(ctx context.Context) (Result, error) {
+	cwClient, err := getCloudWatchLogsClient()
+	if err != nil {
+		sugLog.Error("Failed to get cloudwatch logs client")
+		return Result{}, err
+	}
+
+	monitored, err := newMonitoredLogGroups()
+	if err != nil {
+		sugLog.Error("Error while getting monitored log groups: ", err.Error())
+		return Result{}, err
+	}
+
+	workCtx, cancel := withTimeMargin(ctx, continuationTimeMargin)
+	defer cancel()
+
+	report, err := buildInventory(workCtx, cwClient, monitored)
+	if err != nil {
+		return Result{}, err
+	}
+	report.Account, report.Region, report.GeneratedAt = envConfig.accountId, envConfig.region, time.Now().UTC()
+	if err = report.encodeCSV(); err != nil {
+		return Result{}, err
+	}
+
+	if envConfig.inventoryBucket != emptyString {
+		s3Client, err := getS3Client()
+		if err != nil {
+			return Result{}, err
+		}
+		if err = report.upload(ctx, s3Client, envConfig.inventoryBucket); err != nil {
+			return Result{}, err
+		}
+		sugLog.Infof("Inventoried %d log groups to %s, complete: %t", report.LogGroupsCount, envConfig.inventoryBucket, report.Complete)
+		return Result{Inventory: report.summary()}, nil
+	}
+
+	sugLog.Infof("Inventoried %d log groups, complete: %t", report.LogGroupsCount, report.Complete)
+	return Result{Inventory: report}, nil
+}
+
+// buildInventory describes the log groups page by page along with their subscription filters, until all of them are
+// described or ctx is done
+func buildInventory(ctx context.Context, cwClient *CloudWatchLogsClient, monitored *monitoredLogGroups) (*inventoryReport, error) {
+	report := &inventoryReport{Complete: true, LogGroups: make([]inventoryEntry, 0)}
+
+	var nextToken string
+	for {
+		page, token, err := cwClient.describeLogGroupsPage(ctx, emptyString, nextToken)
+		if isOutOfTimeError(err) {
+			report.Complete = false
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe log groups: %w", err)
+		}
+
+		entries, complete := inventoryPage(ctx, cwClient, monitored, page)
+		report.LogGroups = append(report.LogGroups, entries...)
+		if !complete {
+			report.Complete = false
+			break
+		}
+		if token == emptyString {
+			break
+		}
+		nextToken = token
+	}
+
+	sort.Slice(report.LogGroups, func(i, j int) bool { return report.LogGroups[i].LogGroup < report.LogGroups[j].LogGroup })
+	report.Services = servicesCoverage(report.LogGroups)
+	report.LogGroupsCount = len(report.LogGroups)
+	return report, nil
+}
+
+// inventoryPage returns the entries of a page of log groups, and whether all of them were described before ctx is done
+func inventoryPage(ctx context.Context, cwClient *CloudWatchLogsClient, monitored *monitoredLogGroups, page []*cloudwatchlogs.LogGroup) ([]inventoryEntry, bool) {
+	logGroups := make(map[string]*cloudwatchlogs.LogGroup, len(page))
+	names := make([]string, 0, len(page))
+	for _, logGroup := range page {
+		name := aws.StringValue(logGroup.LogGroupName)
+		logGroups[name] = logGroup
+		names = append(names, name)
+	}
+
+	entries, err := newWorkerPool[inventoryEntry](envConfig.maxConcurrency).run(ctx, names, func(ctx context.Context, name string) ([]inventoryEntry, error) {
+		entry := inventoryEntry{
+			LogGroup:    name,
+			Rule:        monitored.ruleOf(name),
+			FreeSlots:   maxSubscriptionFilters,
+			Class:       aws.StringValue(logGroups[name].LogGroupClass),
+			StoredBytes: aws.Int64Value(logGroups[name].StoredBytes),
+		}
+
+		filters, err := cwClient.getSubscriptionFilters(ctx, name)
+		if isOutOfTimeError(err) {
+			return nil, fmt.Errorf("failed to get subscription filters of %s: %w", name, err)
+		}
+		if err != nil {
+			sugLog.Errorf("Error while trying to get subscription filters of %s: %v", name, err.Error())
+			entry.Error = err.Error()
+			return []inventoryEntry{entry}, nil
+		}
+
+		for _, filter := range filters {
+			entry.FreeSlots--
+			if aws.StringValue(filter.FilterName) == envConfig.filterName {
+				entry.Subscribed = true
+				continue
+			}
+			entry.OtherFilters = append(entry.OtherFilters, inventoryFilter{
+				Name:           aws.StringValue(filter.FilterName),
+				DestinationArn: aws.StringValue(filter.DestinationArn),
+			})
+		}
+		entry.FreeSlots = max(entry.FreeSlots, 0)
+		return []inventoryEntry{entry}, nil
+	})
+
+	pending, _ := splitPending(err)
+	return entries, len(pending) == 0
+}
+
+// servicesCoverage returns the coverage of every service which has log groups. The log groups which are not under a
+// prefix of a known service are of otherService.
+func servicesCoverage(entries []inventoryEntry) []serviceCoverage {
+	serviceToPrefix := getServicesMap()
+	byService := make(map[string]*serviceCoverage)
+	for _, entry := range entries {
+		service := serviceOf(entry.LogGroup, serviceToPrefix)
+		coverage, ok := byService[service]
+		if !ok {
+			coverage = &serviceCoverage{Service: service}
+			byService[service] = coverage
+		}
+		coverage.LogGroups++
+		if entry.Subscribed {
+			coverage.Subscribed++
+		}
+	}
+
+	services := make([]serviceCoverage, 0, len(byService))
+	for _, coverage := range byService {
+		coverage.Coverage = math.Round(float64(coverage.Subscribed)*10000/float64(coverage.LogGroups)) / 100
+		services = append(services, *coverage)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Service < services[j].Service })
+	return services
+}
+
+// serviceOf returns the service whose prefix is the longest prefix of the log group, or otherService if there is none
+func serviceOf(logGroup string, serviceToPrefix map[string]string) string {
+	service, longest := otherService, 0
+	for name, prefix := range serviceToPrefix {
+		prefix = strings.TrimSuffix(prefix, "*")
+		if len(prefix) > longest && strings.HasPrefix(logGroup, prefix) {
+			service, longest = name, len(prefix)
+		}
+	}
+	return service
+}
+
+// encodeCSV sets the CSV reports of the log groups and of the coverage of the services
+func (r *inventoryReport) encodeCSV() error {
+	logGroups := make([][]string, 0, len(r.LogGroups)+1)
+	logGroups = append(logGroups, []string{"log_group", "subscribed", "rule", "other_filters", "free_slots", "class", "stored_bytes", "error"})
+	for _, entry := range r.LogGroups {
+		otherFilters := make([]string, 0, len(entry.OtherFilters))
+		for _, filter := range entry.OtherFilters {
+			otherFilters = append(otherFilters, filter.Name+"="+filter.DestinationArn)
+		}
+		logGroups = append(logGroups, []string{
+			entry.LogGroup,
+			strconv.FormatBool(entry.Subscribed),
+			entry.Rule,
+			strings.Join(otherFilters, ";"),
+			strconv.Itoa(entry.FreeSlots),
+			entry.Class,
+			strconv.FormatInt(entry.StoredBytes, 10),
+			entry.Error,
+		})
+	}
+
+	services := make([][]string, 0, len(r.Services)+1)
+	services = append(services, []string{"service", "log_groups", "subscribed", "coverage"})
+	for _, coverage := range r.Services {
+		services = append(services, []string{
+			coverage.Service,
+			strconv.Itoa(coverage.LogGroups),
+			strconv.Itoa(coverage.Subscribed),
+			strconv.FormatFloat(coverage.Coverage, 'f', 2, 64),
+		})
+	}
+
+	var err error
+	if r.CSV, err = encodeRecords(logGroups); err != nil {
+		return fmt.Errorf("failed to encode inventory of log groups: %v", err)
+	}
+	if r.ServicesCSV, err = encodeRecords(services); err != nil {
+		return fmt.Errorf("failed to encode inventory of services: %v", err)
+	}
+	return nil
+}
+
+// encodeRecords returns the records in CSV format
+func encodeRecords(records [][]string) (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(records); err != nil {
+		return emptyString, err
+	}
+	return buf.String(), nil
+}
+
+// summary returns the report without the log groups and the CSV reports, which are only in the objects of the inventory
+// bucket, so the response of the function stays small however many log groups there are
+func (r *inventoryReport) summary() *inventoryReport {
+	summary := *r
+	summary.LogGroups, summary.CSV, summary.ServicesCSV = nil, emptyString, emptyString
+	return &summary
+}
+
+// upload writes the JSON and CSV reports to the bucket, under a key prefix of the account, the region and the time of
+// the report, and adds their URIs to the report
+func (r *inventoryReport) upload(ctx context.Context, s3Client *S3Client, bucket string) error {
+	jsonReport := *r
+	jsonReport.CSV, jsonReport.ServicesCSV = emptyString, emptyString
+	body, err := json.Marshal(jsonReport)
+	if err != nil {
+		return fmt.Errorf("failed to encode inventory: %v", err)
+	}
+
+	keyPrefix := fmt.Sprintf("%s%s/%s/%s/", inventoryObjectsPrefix, r.Account, r.Region, r.GeneratedAt.Format("2006-01-02T15-04-05Z"))
+	objects := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{name: "inventory.json", contentType: "application/json", body: body},
+		{name: "log-groups.csv", contentType: "text/csv", body: []byte(r.CSV)},
+		{name: "services.csv", contentType: "text/csv", body: []byte(r.ServicesCSV)},
+	}
+	for _, object := range objects {
+		uri, err := s3Client.putObject(ctx, bucket, keyPrefix+object.name, object.contentType, object.body)
+		if err != nil {
+			return err
+		}
+		r.Objects = append(r.Objects, uri)
+	}
+	return nil
+}
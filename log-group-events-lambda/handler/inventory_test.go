@@ -0,0 +1,286 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// inventoryCloudWatchLogsClient returns the log groups of the account in two pages, where subscribedGroup has the
+// subscription filter of the function and another filter, fullGroup has two other filters and errorGroup fails
+type inventoryCloudWatchLogsClient struct {
+	MockCloudWatchLogsClient
+}
+
+func (m *inventoryCloudWatchLogsClient) DescribeLogGroupsWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogGroupsInput, opts ...request.Option) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	if aws.StringValue(input.NextToken) == "page2" {
+		return &cloudwatchlogs.DescribeLogGroupsOutput{
+			LogGroups: []*cloudwatchlogs.LogGroup{{LogGroupName: aws.String("errorGroup")}},
+		}, nil
+	}
+	return &cloudwatchlogs.DescribeLogGroupsOutput{
+		LogGroups: []*cloudwatchlogs.LogGroup{
+			{LogGroupName: aws.String("/aws/lambda/subscribedGroup"), LogGroupClass: aws.String("STANDARD"), StoredBytes: aws.Int64(2048)},
+			{LogGroupName: aws.String("/aws/lambda/fullGroup"), LogGroupClass: aws.String("INFREQUENT_ACCESS"), StoredBytes: aws.Int64(0)},
+		},
+		NextToken: aws.String("page2"),
+	}, nil
+}
+
+func (m *inventoryCloudWatchLogsClient) DescribeSubscriptionFiltersWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeSubscriptionFiltersInput, opts ...request.Option) (*cloudwatchlogs.DescribeSubscriptionFiltersOutput, error) {
+	otherFilter := &cloudwatchlogs.SubscriptionFilter{FilterName: aws.String("other1"), DestinationArn: aws.String("other-arn1")}
+	switch *input.LogGroupName {
+	case "/aws/lambda/subscribedGroup":
+		return &cloudwatchlogs.DescribeSubscriptionFiltersOutput{SubscriptionFilters: []*cloudwatchlogs.SubscriptionFilter{
+			{FilterName: aws.String(envConfig.filterName), DestinationArn: aws.String(envConfig.destinationArn)},
+			otherFilter,
+		}}, nil
+	case "/aws/lambda/fullGroup":
+		return &cloudwatchlogs.DescribeSubscriptionFiltersOutput{SubscriptionFilters: []*cloudwatchlogs.SubscriptionFilter{
+			otherFilter,
+			{FilterName: aws.String("other2"), DestinationArn: aws.String("other-arn2")},
+		}}, nil
+	default:
+		return nil, fmt.Errorf("an error occurred")
+	}
+}
+
+type mockS3Client struct {
+	mock.Mock
+	s3iface.S3API
+}
+
+func (m *mockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	args := m.Called(input)
+	return &s3.PutObjectOutput{}, args.Error(0)
+}
+
+func (m *mockS3Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	return m.PutObject(input)
+}
+
+func (m *mockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(args.String(0)))}, args.Error(1)
+}
+
+func (m *mockS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return m.GetObject(input)
+}
+
+func TestParseInventoryBucket(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expected      string
+		errorExpected bool
+	}{
+		{
+			name:     "not configured",
+			value:    "",
+			expected: "",
+		},
+		{
+			name:     "bucket",
+			value:    " inventory-bucket ",
+			expected: "inventory-bucket",
+		},
+		{
+			name:          "bucket ARN",
+			value:         "arn:aws:s3:::inventory-bucket",
+			errorExpected: true,
+		},
+		{
+			name:          "bucket with key prefix",
+			value:         "inventory-bucket/reports",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket, err := parseInventoryBucket(test.value)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, bucket)
+			}
+		})
+	}
+}
+
+func TestBuildInventory(t *testing.T) {
+	setupSFTest()
+
+	cwClient := &CloudWatchLogsClient{Client: new(inventoryCloudWatchLogsClient)}
+	monitored := &monitoredLogGroups{prefixes: []monitoredPrefix{{prefix: "/aws/lambda/", rule: "service:lambda"}}}
+
+	report, err := buildInventory(context.Background(), cwClient, monitored)
+
+	assert.Nil(t, err)
+	assert.True(t, report.Complete)
+	assert.Equal(t, len(report.LogGroups), report.LogGroupsCount)
+	assert.Equal(t, []inventoryEntry{
+		{
+			LogGroup:     "/aws/lambda/fullGroup",
+			Rule:         "service:lambda",
+			OtherFilters: []inventoryFilter{{Name: "other1", DestinationArn: "other-arn1"}, {Name: "other2", DestinationArn: "other-arn2"}},
+			Class:        "INFREQUENT_ACCESS",
+		},
+		{
+			LogGroup:     "/aws/lambda/subscribedGroup",
+			Subscribed:   true,
+			Rule:         "service:lambda",
+			OtherFilters: []inventoryFilter{{Name: "other1", DestinationArn: "other-arn1"}},
+			Class:        "STANDARD",
+			StoredBytes:  2048,
+		},
+		{
+			LogGroup:  "errorGroup",
+			FreeSlots: maxSubscriptionFilters,
+			Error:     "an error occurred",
+		},
+	}, report.LogGroups)
+	assert.Equal(t, []serviceCoverage{
+		{Service: "lambda", LogGroups: 2, Subscribed: 1, Coverage: 50},
+		{Service: otherService, LogGroups: 1},
+	}, report.Services)
+}
+
+func TestBuildInventoryOutOfTime(t *testing.T) {
+	setupSFTest()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := buildInventory(ctx, &CloudWatchLogsClient{Client: new(inventoryCloudWatchLogsClient)}, &monitoredLogGroups{})
+
+	assert.Nil(t, err)
+	assert.False(t, report.Complete)
+	assert.Empty(t, report.LogGroups)
+}
+
+func TestServiceOf(t *testing.T) {
+	serviceToPrefix := getServicesMap()
+
+	assert.Equal(t, "lambda", serviceOf("/aws/lambda/function1", serviceToPrefix))
+	assert.Equal(t, "ecs", serviceOf("/aws/ecs/containerinsights/cluster1", serviceToPrefix))
+	assert.Equal(t, "apigateway-rest", serviceOf("API-Gateway-Execution-Logs_api1/prod", serviceToPrefix))
+	assert.Equal(t, otherService, serviceOf("/custom/group1", serviceToPrefix))
+}
+
+func TestInventoryEncodeCSV(t *testing.T) {
+	report := &inventoryReport{
+		LogGroups: []inventoryEntry{
+			{
+				LogGroup:     "/aws/lambda/function1",
+				Subscribed:   true,
+				Rule:         "service:lambda",
+				OtherFilters: []inventoryFilter{{Name: "other1", DestinationArn: "other-arn1"}},
+				Class:        "STANDARD",
+				StoredBytes:  2048,
+			},
+			{LogGroup: "group, with comma", FreeSlots: 2, Error: "an error occurred"},
+		},
+		Services: []serviceCoverage{{Service: "lambda", LogGroups: 3, Subscribed: 1, Coverage: 33.33}},
+	}
+
+	err := report.encodeCSV()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "log_group,subscribed,rule,other_filters,free_slots,class,stored_bytes,error\n"+
+		"/aws/lambda/function1,true,service:lambda,other1=other-arn1,0,STANDARD,2048,\n"+
+		"\"group, with comma\",false,,,2,,0,an error occurred\n", report.CSV)
+	assert.Equal(t, "service,log_groups,subscribed,coverage\nlambda,3,1,33.33\n", report.ServicesCSV)
+}
+
+func TestInventoryUpload(t *testing.T) {
+	tests := []struct {
+		name            string
+		putError        error
+		expectedObjects []string
+		errorExpected   bool
+	}{
+		{
+			name: "uploaded",
+			expectedObjects: []string{
+				"s3://inventory-bucket/firehose-logs/inventory/123456789012/us-east-1/2026-01-02T03-04-05Z/inventory.json",
+				"s3://inventory-bucket/firehose-logs/inventory/123456789012/us-east-1/2026-01-02T03-04-05Z/log-groups.csv",
+				"s3://inventory-bucket/firehose-logs/inventory/123456789012/us-east-1/2026-01-02T03-04-05Z/services.csv",
+			},
+		},
+		{
+			name:          "upload failed",
+			putError:      fmt.Errorf("an error occurred"),
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockClient := new(mockS3Client)
+			mockClient.On("PutObject", mock.Anything).Return(test.putError)
+			report := &inventoryReport{
+				Account:     "123456789012",
+				Region:      "us-east-1",
+				GeneratedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+				CSV:         "log_group\n",
+			}
+
+			err := report.upload(context.Background(), &S3Client{Client: mockClient}, "inventory-bucket")
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedObjects, report.Objects)
+				mockClient.AssertNumberOfCalls(t, "PutObject", 3)
+			}
+		})
+	}
+}
+
+func TestInventorySummary(t *testing.T) {
+	report := &inventoryReport{
+		Account:        "123456789012",
+		Region:         "us-east-1",
+		Complete:       true,
+		LogGroupsCount: 1,
+		Services:       []serviceCoverage{{Service: "lambda", LogGroups: 1, Subscribed: 1, Coverage: 100}},
+		LogGroups:      []inventoryEntry{{LogGroup: "/aws/lambda/function1", Subscribed: true, Rule: "service:lambda"}},
+		CSV:            "log_group\n/aws/lambda/function1\n",
+		ServicesCSV:    "service\nlambda\n",
+		Objects:        []string{"s3://inventory-bucket/firehose-logs/inventory/123456789012/us-east-1/2026-01-02T03-04-05Z/inventory.json"},
+	}
+
+	summary := report.summary()
+	body, err := json.Marshal(summary)
+	assert.Nil(t, err)
+	var fields map[string]json.RawMessage
+	assert.Nil(t, json.Unmarshal(body, &fields))
+
+	assert.Equal(t, report.Services, summary.Services)
+	assert.Equal(t, report.Objects, summary.Objects)
+	assert.Equal(t, 1, summary.LogGroupsCount)
+	assert.NotContains(t, fields, "logGroups")
+	assert.NotContains(t, fields, "csv")
+	assert.NotContains(t, fields, "servicesCsv")
+	assert.Len(t, report.LogGroups, 1)
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/logzio/firehose-logs/common"
+)
+
+type LambdaClient struct {
+	Function lambdaiface.LambdaAPI
+}
+
+func getLambdaClient() (*LambdaClient, error) {
+	sess, err := common.GetSession()
+	if err != nil {
+		sugLog.Error("Error while creating session: ", err.Error())
+		return nil, err
+	}
+	return &LambdaClient{Function: lambda.New(sess)}, nil
+}
+
+// invokeSelfAsynchronously invokes this function with the given payload, without waiting for it to finish
+func (client *LambdaClient) invokeSelfAsynchronously(ctx context.Context, payload []byte) error {
+	sugLog.Debugf("Invoking lambda %s asynchronously", envConfig.thisFunctionName)
+
+	_, err := client.Function.InvokeWithContext(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(envConfig.thisFunctionName),
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	if err != nil {
+		sugLog.Error("Error while invoking lambda: ", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+type mockLambdaClient struct {
+	mock.Mock
+	lambdaiface.LambdaAPI
+}
+
+func (m *mockLambdaClient) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	args := m.Called(ctx, input)
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(202)}, args.Error(1)
+}
+
+func TestInvokeSelfAsynchronously(t *testing.T) {
+	setupSFTest()
+	envConfig.thisFunctionName = "this-function"
+
+	tests := []struct {
+		name          string
+		invokeErr     error
+		errorExpected bool
+	}{
+		{
+			name:          "success",
+			invokeErr:     nil,
+			errorExpected: false,
+		},
+		{
+			name:          "invoke error",
+			invokeErr:     fmt.Errorf("an error occurred"),
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			payload := []byte(`{"detail":{}}`)
+
+			mockClient := new(mockLambdaClient)
+			mockClient.On("InvokeWithContext", ctx, &lambda.InvokeInput{
+				FunctionName:   aws.String("this-function"),
+				InvocationType: aws.String("Event"),
+				Payload:        payload,
+			}).Return(&lambda.InvokeOutput{}, test.invokeErr)
+
+			lambdaClient := &LambdaClient{Function: mockClient}
+			err := lambdaClient.invokeSelfAsynchronously(ctx, payload)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+			mockClient.AssertExpectations(t)
+		})
+	}
+}
@@ -1,11 +1,29 @@
 package handler
 
 import (
+	"context"
+	"fmt"
 	"github.com/hashicorp/go-multierror"
+	"github.com/logzio/firehose-logs/common"
 	"strings"
-	"sync"
 )
 
+// monitoredLogGroups matches the log groups which the configuration of the function monitors, along with the rule
+// of the configuration which selects them
+type monitoredLogGroups struct {
+	// logGroups are the rules of the custom log groups, by log group
+	logGroups map[string]string
+	prefixes  []monitoredPrefix
+	// excluded are the excluded custom log groups, which are not monitored even when a rule selects them
+	excluded *customLogGroupsSpec
+}
+
+// monitoredPrefix is a log group prefix of a monitored service or of a custom log group with a wildcard
+type monitoredPrefix struct {
+	prefix string
+	rule   string
+}
+
 // getServices returns a list of services to monitor
 func getServices() []string {
 	servicesStr := envConfig.servicesValue
@@ -15,52 +33,104 @@ func getServices() []string {
 	return convertStrToArr(servicesStr)
 }
 
-// getCustomGroupsPrefixes returns list of custom log groups which were defined with a wildcard, meaning as prefixes
+// getCustomGroupsPrefixes returns list of custom log groups which were defined with a wildcard, meaning as prefixes.
+// The custom log groups of the configuration file replace the ones of the parameter.
 func getCustomGroupsPrefixes() []string {
-	customGroupsStr := envConfig.customGroupsValue
-	if customGroupsStr == emptyString {
+	customGroups := convertStrToArr(envConfig.customGroupsValue)
+	if envConfig.configKey != emptyString && envConfig.customLogGroupsSpec != nil {
+		customGroups = envConfig.customLogGroupsSpec.names()
+	}
+	if len(customGroups) == 0 {
 		return nil
 	}
-	customGroups := convertStrToArr(customGroupsStr)
-	var wg sync.WaitGroup
-	var mu sync.Mutex
 
 	prefixes := make([]string, 0)
 	for _, logGroup := range customGroups {
-		wg.Add(1)
-		go func(logGroup string) {
-			defer wg.Done()
-
-			if strings.HasSuffix(logGroup, "*") {
-				mu.Lock()
-				prefixes = append(prefixes, strings.TrimSuffix(logGroup, "*"))
-				mu.Unlock()
-			}
-		}(logGroup)
+		if strings.HasSuffix(logGroup, "*") {
+			prefixes = append(prefixes, strings.TrimSuffix(logGroup, "*"))
+		}
 	}
-	wg.Wait()
 
 	return prefixes
 }
 
+// newMonitoredLogGroups returns the matcher of the configured services and custom log groups
+func newMonitoredLogGroups() (*monitoredLogGroups, error) {
+	spec, err := envConfig.customLogGroups()
+	if err != nil {
+		return nil, err
+	}
+	logGroups, customPrefixes := splitCustomLogGroups(spec.names())
+
+	m := &monitoredLogGroups{logGroups: make(map[string]string, len(logGroups)), excluded: spec}
+	for _, logGroup := range logGroups {
+		m.logGroups[logGroup] = customRulePrefix + logGroup
+	}
+	serviceToPrefix := getServicesMap()
+	for _, service := range getServices() {
+		if prefix, ok := serviceToPrefix[service]; ok {
+			m.prefixes = append(m.prefixes, monitoredPrefix{prefix: strings.TrimSuffix(prefix, "*"), rule: serviceRulePrefix + service})
+		}
+	}
+	for _, cursor := range customPrefixes {
+		m.prefixes = append(m.prefixes, monitoredPrefix{prefix: cursor.Prefix, rule: customRulePrefix + cursor.Prefix + "*"})
+	}
+	return m, nil
+}
+
+// ruleOf returns the rule which selects the log group, which is a custom log group or a prefix of a service or of a
+// custom log group, or an empty string if the log group is not monitored
+func (m *monitoredLogGroups) ruleOf(logGroup string) string {
+	if m.excluded != nil && m.excluded.excludes(logGroup) {
+		return emptyString
+	}
+	if rule, ok := m.logGroups[logGroup]; ok {
+		return rule
+	}
+	for _, p := range m.prefixes {
+		if strings.HasPrefix(logGroup, p.prefix) {
+			return p.rule
+		}
+	}
+	return emptyString
+}
+
+// contains checks if the log group is one of the custom log groups, or is under a prefix of a service or a custom log group
+func (m *monitoredLogGroups) contains(logGroup string) bool {
+	return m.ruleOf(logGroup) != emptyString
+}
+
+// unmonitored returns the given log groups which are not monitored
+func (m *monitoredLogGroups) unmonitored(logGroups []string) []string {
+	result := make([]string, 0, len(logGroups))
+	for _, logGroup := range logGroups {
+		if !m.contains(logGroup) {
+			result = append(result, logGroup)
+		}
+	}
+	return result
+}
+
 // getServicesLogGroups returns a list of log groups to monitor based on the services
-func getServicesLogGroups(services []string, cwLogsClient *CloudWatchLogsClient) []string {
+func getServicesLogGroups(ctx context.Context, services []string, cwLogsClient *CloudWatchLogsClient) ([]string, error) {
 	servicesLogGroups := make([]string, 0)
 	serviceToPrefix := getServicesMap()
+	var result *multierror.Error
 	for _, service := range services {
 		if prefix, ok := serviceToPrefix[service]; ok {
-			currServiceLG, err := cwLogsClient.getLogGroupsWithPrefix(prefix)
+			currServiceLG, err := cwLogsClient.getLogGroupsWithPrefix(ctx, prefix)
 			if err != nil {
 				sugLog.Error("Failed to get log groups with prefix: ", prefix)
+				result = multierror.Append(result, fmt.Errorf("failed to get log groups of service %s: %w", service, err))
 			}
 			servicesLogGroups = append(servicesLogGroups, currServiceLG...)
 		}
 	}
-	return servicesLogGroups
+	return servicesLogGroups, result.ErrorOrNil()
 }
 
 // getCustomLogGroups returns a list of custom log groups to monitor
-func getCustomLogGroups(secretEnabled, customLogGroupsPrmVal string) ([]string, error) {
+func getCustomLogGroups(ctx context.Context, secretEnabled, customLogGroupsPrmVal string) ([]string, error) {
 	cwLogsClient, err := getCloudWatchLogsClient()
 	if err != nil {
 		sugLog.Error("Failed to get cloudwatch logs client")
@@ -72,14 +142,60 @@ func getCustomLogGroups(secretEnabled, customLogGroupsPrmVal string) ([]string,
 			sugLog.Error("Failed to get secret cache client")
 			return nil, err
 		}
-		return getCustomLogGroupsFromSecret(customLogGroupsPrmVal, secretCache, cwLogsClient)
+		return getCustomLogGroupsFromSecret(ctx, customLogGroupsPrmVal, secretCache, cwLogsClient)
 	}
 
-	return getCustomLogGroupsFromParam(convertStrToArr(customLogGroupsPrmVal), cwLogsClient)
+	if isParameterArn(customLogGroupsPrmVal) {
+		spec, err := getCustomLogGroupsSpecFromParameter(ctx, customLogGroupsPrmVal)
+		if err != nil {
+			return nil, err
+		}
+		return getCustomLogGroupsFromParam(ctx, spec.names(), cwLogsClient)
+	}
+
+	return getCustomLogGroupsFromParam(ctx, convertStrToArr(customLogGroupsPrmVal), cwLogsClient)
 }
 
-// getCustomLogGroupsFromSecret helper function of getCustomLogGroups, returns a list of custom log groups to monitor from secret value
-func getCustomLogGroupsFromSecret(secretArn string, secretCache *SecretCacheClient, cwLogsClient *CloudWatchLogsClient) ([]string, error) {
+// getCustomLogGroupsValues returns the custom log groups to monitor as they are defined, without expanding the ones
+// with a wildcard, so they can be discovered in every managed account
+func getCustomLogGroupsValues(secretEnabled, customLogGroupsPrmVal string) ([]string, error) {
+	spec, err := getCustomLogGroupsSpec(secretEnabled == "true", customLogGroupsPrmVal)
+	if err != nil {
+		return nil, err
+	}
+	return spec.names(), nil
+}
+
+// getCustomLogGroupsSpec returns the custom log groups of the parameter, or of the secret or the SSM parameter along
+// with their options and the excluded log groups
+func getCustomLogGroupsSpec(secretEnabled bool, customLogGroupsPrmVal string) (*customLogGroupsSpec, error) {
+	if !secretEnabled {
+		if isParameterArn(customLogGroupsPrmVal) {
+			return getCustomLogGroupsSpecFromParameter(context.Background(), customLogGroupsPrmVal)
+		}
+		return newCustomLogGroupsSpec(convertStrToArr(customLogGroupsPrmVal)), nil
+	}
+
+	secretCache, err := getSecretCacheClient()
+	if err != nil {
+		sugLog.Error("Failed to get secret cache client")
+		return nil, err
+	}
+	return getCustomLogGroupsSpecFromSecret(customLogGroupsPrmVal, secretCache)
+}
+
+// getCustomLogGroupsValuesFromSecret returns the custom log groups in the secret value, without expanding the ones with a wildcard
+func getCustomLogGroupsValuesFromSecret(secretArn string, secretCache *SecretCacheClient) ([]string, error) {
+	spec, err := getCustomLogGroupsSpecFromSecret(secretArn, secretCache)
+	if err != nil {
+		return nil, err
+	}
+	return spec.names(), nil
+}
+
+// getCustomLogGroupsSpecFromSecret returns the custom log groups in the secret value along with their options and the
+// excluded log groups
+func getCustomLogGroupsSpecFromSecret(secretArn string, secretCache *SecretCacheClient) (*customLogGroupsSpec, error) {
 	secretName := getSecretNameFromArn(secretArn)
 
 	secretStruct, err := secretCache.Client.GetSecretString(secretName)
@@ -88,54 +204,59 @@ func getCustomLogGroupsFromSecret(secretArn string, secretCache *SecretCacheClie
 		return nil, err
 	}
 
-	customLogGroups, err := extractCustomGroupsFromSecret(secretArn, secretStruct)
+	spec, err := parseCustomLogGroupsSecret(secretArn, secretStruct, envConfig.destinations)
 	if err != nil {
 		sugLog.Error("Error while extracting custom log groups from secret: ", err.Error())
 		return nil, err
 	}
+	return spec, nil
+}
+
+// splitCustomLogGroups splits the custom log groups to the log group names, and the discovery cursors of the ones defined with a wildcard
+func splitCustomLogGroups(customLogGroups []string) ([]string, []common.PrefixCursor) {
+	logGroups := make([]string, 0, len(customLogGroups))
+	prefixes := make([]common.PrefixCursor, 0)
+	for _, logGroup := range customLogGroups {
+		if strings.HasSuffix(logGroup, "*") {
+			prefixes = append(prefixes, common.PrefixCursor{Prefix: strings.TrimSuffix(logGroup, "*")})
+			continue
+		}
+		logGroups = append(logGroups, logGroup)
+	}
+	return logGroups, prefixes
+}
+
+// getCustomLogGroupsFromSecret helper function of getCustomLogGroups, returns a list of custom log groups to monitor from secret value
+func getCustomLogGroupsFromSecret(ctx context.Context, secretArn string, secretCache *SecretCacheClient, cwLogsClient *CloudWatchLogsClient) ([]string, error) {
+	customLogGroups, err := getCustomLogGroupsValuesFromSecret(secretArn, secretCache)
+	if err != nil {
+		return nil, err
+	}
 
 	if cwLogsClient != nil {
 		sugLog.Warn("Missing CloudWatch logs client, will not handle custom log group names with wildcards.")
-		return getCustomLogGroupsFromParam(convertStrToArr(customLogGroups), cwLogsClient)
+		return getCustomLogGroupsFromParam(ctx, customLogGroups, cwLogsClient)
 	}
-	return convertStrToArr(customLogGroups), nil
+	return customLogGroups, nil
 }
 
 // getCustomLogGroupsFromParam helper function of getCustomLogGroups, returns a list of custom log groups to monitor from parameter
-func getCustomLogGroupsFromParam(logGroups []string, cwLogsClient *CloudWatchLogsClient) ([]string, error) {
-	customLogGroups := make([]string, 0, len(logGroups))
-	var result *multierror.Error
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-
+func getCustomLogGroupsFromParam(ctx context.Context, logGroups []string, cwLogsClient *CloudWatchLogsClient) ([]string, error) {
 	if cwLogsClient == nil {
 		// we shouldn't fail the entire process only if the cwLogsClient failed to get created
 		return logGroups, nil
 	}
 
-	for i, logGroup := range logGroups {
-		wg.Add(1)
-		go func(i int, logGroup string) {
-			defer wg.Done()
-
-			if strings.HasSuffix(logGroup, "*") {
-				newLogGroups, err := cwLogsClient.getLogGroupsWithPrefix(strings.TrimSuffix(logGroup, "*"))
-				if err != nil {
-					sugLog.Error("Failed to get log groups with prefix: ", logGroup)
-					result = multierror.Append(result, err)
-					return
-				}
-				mu.Lock()
-				customLogGroups = append(customLogGroups, newLogGroups...)
-				mu.Unlock()
-
-			} else {
-				mu.Lock()
-				customLogGroups = append(customLogGroups, logGroup)
-				mu.Unlock()
-			}
-		}(i, logGroup)
-	}
-	wg.Wait()
-	return customLogGroups, result.ErrorOrNil()
+	return newWorkerPool[string](envConfig.maxConcurrency).run(ctx, logGroups, func(ctx context.Context, logGroup string) ([]string, error) {
+		if !strings.HasSuffix(logGroup, "*") {
+			return []string{logGroup}, nil
+		}
+
+		newLogGroups, err := cwLogsClient.getLogGroupsWithPrefix(ctx, strings.TrimSuffix(logGroup, "*"))
+		if err != nil {
+			sugLog.Error("Failed to get log groups with prefix: ", logGroup)
+			return nil, err
+		}
+		return newLogGroups, nil
+	})
 }
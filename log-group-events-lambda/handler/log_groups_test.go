@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sort"
@@ -26,7 +27,12 @@ func (m *MockSecretCacheClient) GetSecretString(secretName string) (string, erro
 }
 
 func setupLGTest() (cwClient *CloudWatchLogsClient, secretCacheClient *MockSecretCacheClient) {
-	err := os.Setenv(envFirehoseArn, "test-arn")
+	err := os.Setenv(envFirehoseArn, "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream")
+	if err != nil {
+		return
+	}
+
+	err = os.Setenv(envPutSubscriptionFilterRole, "arn:aws:iam::123456789012:role/test-role")
 	if err != nil {
 		return
 	}
@@ -46,8 +52,18 @@ func setupLGTest() (cwClient *CloudWatchLogsClient, secretCacheClient *MockSecre
 		return
 	}
 
+	err = os.Setenv(envStackName, "test-stack")
+	if err != nil {
+		return
+	}
+
+	err = os.Setenv(common.EnvAwsRegion, "us-east-1")
+	if err != nil {
+		return
+	}
+
 	/* Setup config */
-	envConfig = NewConfig()
+	envConfig, _ = NewConfig()
 
 	/* Setup logger */
 	sugLog = lp.GetSugaredLogger()
@@ -70,14 +86,14 @@ func TestGetServices(t *testing.T) {
 	assert.Nil(t, result)
 
 	/* Has services */
-	err = os.Setenv(common.EnvServices, "rds, cloudwatch, custom")
+	err = os.Setenv(common.EnvServices, "rds, lambda, vpc")
 	if err != nil {
 		return
 	}
 	setupLGTest()
 
 	result = getServices()
-	assert.Equal(t, []string{"rds", "cloudwatch", "custom"}, result)
+	assert.Equal(t, []string{"rds", "lambda", "vpc"}, result)
 }
 
 func TestGetServicesLogGroups(t *testing.T) {
@@ -112,9 +128,10 @@ func TestGetServicesLogGroups(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			result := getServicesLogGroups(test.services, cwClient)
+			result, err := getServicesLogGroups(context.Background(), test.services, cwClient)
 			sort.Strings(result)
 			assert.Equal(t, test.expectedLogGroups, result)
+			assert.Nil(t, err)
 		})
 	}
 }
@@ -143,7 +160,7 @@ func TestGetCustomLogGroups(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			result, err := getCustomLogGroups(test.secretEnabled, test.customLogGroupsPrmVal)
+			result, err := getCustomLogGroups(context.Background(), test.secretEnabled, test.customLogGroupsPrmVal)
 			sort.Strings(result)
 			assert.Equal(t, test.expectedGroups, result)
 			assert.Nil(t, err)
@@ -210,7 +227,7 @@ func TestGetCustomLogGroupsFromSecret(t *testing.T) {
 			mockSecretCacheClient.On("GetSecretString", mock.Anything).Return(test.secretData, nil).Once()
 			secretCacheClient := &SecretCacheClient{Client: mockSecretCacheClient}
 
-			result, err := getCustomLogGroupsFromSecret(test.secretArn, secretCacheClient, nil)
+			result, err := getCustomLogGroupsFromSecret(context.Background(), test.secretArn, secretCacheClient, nil)
 			sort.Strings(result)
 			assert.Equal(t, test.expectedData, result)
 
@@ -264,7 +281,7 @@ func TestGetCustomLogGroupsFromParam(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			result, err := getCustomLogGroupsFromParam(test.logGroups, cwClient)
+			result, err := getCustomLogGroupsFromParam(context.Background(), test.logGroups, cwClient)
 			sort.Strings(result)
 			assert.Equal(t, test.expectedGroups, result)
 
@@ -276,3 +293,32 @@ func TestGetCustomLogGroupsFromParam(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitCustomLogGroups(t *testing.T) {
+	logGroups, prefixes := splitCustomLogGroups([]string{"/log/group1/*", "g1", "/log/group2/*"})
+
+	assert.Equal(t, []string{"g1"}, logGroups)
+	assert.Equal(t, []common.PrefixCursor{{Prefix: "/log/group1/"}, {Prefix: "/log/group2/"}}, prefixes)
+}
+
+func TestMonitoredLogGroups(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.secretEnabled = false
+	envConfig.servicesValue = "lambda"
+	envConfig.customGroupsValue = "/log/group1/*, g1"
+
+	monitored, err := newMonitoredLogGroups()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "service:lambda", monitored.ruleOf("/aws/lambda/function1"))
+	assert.Equal(t, "custom:/log/group1/*", monitored.ruleOf("/log/group1/a"))
+	assert.Equal(t, "custom:g1", monitored.ruleOf("g1"))
+	assert.Empty(t, monitored.ruleOf("g12"))
+	assert.True(t, monitored.contains("/aws/lambda/function1"))
+	assert.True(t, monitored.contains("/log/group1/a"))
+	assert.True(t, monitored.contains("g1"))
+	assert.False(t, monitored.contains("g12"))
+	assert.False(t, monitored.contains("/custom/aws/lambda/function1"))
+	assert.Equal(t, []string{"g12", "/log/group2/a"}, monitored.unmonitored([]string{"/aws/lambda/function1", "g12", "g1", "/log/group2/a"}))
+}
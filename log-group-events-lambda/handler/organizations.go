@@ -0,0 +1,324 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/logzio/firehose-logs/common"
+)
+
+// organizationUnitPattern matches the id of an organization root or organizational unit
+var organizationUnitPattern = regexp.MustCompile(`^(r-[0-9a-z]{4,32}|ou-[0-9a-z]{4,32}-[a-z0-9]{8,32})$`)
+
+type OrganizationsClient struct {
+	Client organizationsiface.OrganizationsAPI
+}
+
+func getOrganizationsClient() (*OrganizationsClient, error) {
+	sess, err := common.GetSession()
+	if err != nil {
+		sugLog.Error("Error while creating session: ", err.Error())
+		return nil, err
+	}
+	return &OrganizationsClient{Client: organizations.New(sess)}, nil
+}
+
+// parseOrganizationUnits validates the organization root and organizational unit ids
+func parseOrganizationUnits(values []string) ([]string, error) {
+	units := make([]string, 0)
+	for _, unit := range values {
+		if unit == emptyString {
+			continue
+		}
+		if !organizationUnitPattern.MatchString(unit) {
+			return nil, fmt.Errorf("invalid organizational unit id '%s'", unit)
+		}
+		units = append(units, unit)
+	}
+	return units, nil
+}
+
+// validateMemberAccountSource validates the source of the member accounts
+func (c *Config) validateMemberAccountSource() error {
+	if c.memberAccountSource != accountSourceList && c.memberAccountSource != accountSourceOrganizations {
+		return fmt.Errorf("invalid member account source '%s', must be one of [%s %s]", c.memberAccountSource, accountSourceList, accountSourceOrganizations)
+	}
+	if c.memberAccountSource == accountSourceList && (len(c.organizationUnits) > 0 || len(c.organizationAccountTags) > 0) {
+		return fmt.Errorf("organizational units and account tags can only be set with the %s member account source", accountSourceOrganizations)
+	}
+	return nil
+}
+
+// usesOrganizations checks if the member accounts are listed from AWS Organizations
+func (c *Config) usesOrganizations() bool {
+	return c.memberAccountSource == accountSourceOrganizations
+}
+
+// ensureMemberAccounts adds the accounts of the organization to the member accounts, once per invocation
+func ensureMemberAccounts(ctx context.Context) error {
+	if !envConfig.usesOrganizations() || envConfig.memberAccountsListed {
+		return nil
+	}
+
+	orgClient, err := getOrganizationsClient()
+	if err != nil {
+		return err
+	}
+	accounts, err := orgClient.selectedAccounts(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the member accounts of the organization: %w", err)
+	}
+
+	for _, account := range accounts {
+		envConfig.addMemberAccount(account)
+	}
+	envConfig.memberAccountsListed = true
+	sugLog.Debugf("Found %d member accounts in the organization", len(accounts))
+	return nil
+}
+
+// addMemberAccount adds the account to the member accounts, unless it's this account or it's already a member
+func (c *Config) addMemberAccount(account string) {
+	if c.isThisAccount(account) || slices.Contains(c.memberAccounts, account) {
+		return
+	}
+	c.memberAccounts = append(c.memberAccounts, account)
+}
+
+// selectedAccounts returns the active accounts of the organizational units, or of the whole organization when no
+// unit is set, which have all the account tags
+func (orgClient *OrganizationsClient) selectedAccounts(ctx context.Context) ([]string, error) {
+	var accounts []*organizations.Account
+	var err error
+	if len(envConfig.organizationUnits) == 0 {
+		err = orgClient.Client.ListAccountsPagesWithContext(ctx, &organizations.ListAccountsInput{}, func(page *organizations.ListAccountsOutput, lastPage bool) bool {
+			accounts = append(accounts, page.Accounts...)
+			return true
+		})
+	} else {
+		for _, unit := range envConfig.organizationUnits {
+			var unitAccounts []*organizations.Account
+			if unitAccounts, err = orgClient.listUnitAccounts(ctx, unit); err != nil {
+				break
+			}
+			accounts = append(accounts, unitAccounts...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		accountId := aws.StringValue(account.Id)
+		if aws.StringValue(account.Status) != organizations.AccountStatusActive || slices.Contains(selected, accountId) {
+			continue
+		}
+
+		hasTags, err := orgClient.hasAccountTags(ctx, accountId)
+		if err != nil {
+			return nil, err
+		}
+		if hasTags {
+			selected = append(selected, accountId)
+		}
+	}
+	return selected, nil
+}
+
+// listUnitAccounts returns the accounts of the organizational unit and of its nested units
+func (orgClient *OrganizationsClient) listUnitAccounts(ctx context.Context, unit string) ([]*organizations.Account, error) {
+	var accounts []*organizations.Account
+	err := orgClient.Client.ListAccountsForParentPagesWithContext(ctx, &organizations.ListAccountsForParentInput{ParentId: aws.String(unit)}, func(page *organizations.ListAccountsForParentOutput, lastPage bool) bool {
+		accounts = append(accounts, page.Accounts...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	err = orgClient.Client.ListOrganizationalUnitsForParentPagesWithContext(ctx, &organizations.ListOrganizationalUnitsForParentInput{ParentId: aws.String(unit)}, func(page *organizations.ListOrganizationalUnitsForParentOutput, lastPage bool) bool {
+		for _, child := range page.OrganizationalUnits {
+			children = append(children, aws.StringValue(child.Id))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+		childAccounts, err := orgClient.listUnitAccounts(ctx, child)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, childAccounts...)
+	}
+	return accounts, nil
+}
+
+// hasAccountTags checks if the account has all the account tags
+func (orgClient *OrganizationsClient) hasAccountTags(ctx context.Context, account string) (bool, error) {
+	if len(envConfig.organizationAccountTags) == 0 {
+		return true, nil
+	}
+
+	tags := make(map[string]string)
+	err := orgClient.Client.ListTagsForResourcePagesWithContext(ctx, &organizations.ListTagsForResourceInput{ResourceId: aws.String(account)}, func(page *organizations.ListTagsForResourceOutput, lastPage bool) bool {
+		for _, tag := range page.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		return true
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list the tags of account %s: %w", account, err)
+	}
+
+	for key, value := range envConfig.organizationAccountTags {
+		if tagValue, ok := tags[key]; !ok || tagValue != value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isUnderOrganizationUnits checks if the account or organizational unit is in one of the organizational units,
+// directly or through its parents. Everything is under the organizational units when none is set.
+func (orgClient *OrganizationsClient) isUnderOrganizationUnits(ctx context.Context, id string) (bool, error) {
+	if len(envConfig.organizationUnits) == 0 {
+		return true, nil
+	}
+
+	for {
+		if slices.Contains(envConfig.organizationUnits, id) {
+			return true, nil
+		}
+		// the root has no parents
+		if strings.HasPrefix(id, organizationRootPrefix) {
+			return false, nil
+		}
+
+		output, err := orgClient.Client.ListParentsWithContext(ctx, &organizations.ListParentsInput{ChildId: aws.String(id)})
+		if err != nil {
+			return false, fmt.Errorf("failed to list the parents of %s: %w", id, err)
+		}
+		// an account or unit has a single parent
+		if len(output.Parents) == 0 {
+			return false, nil
+		}
+		id = aws.StringValue(output.Parents[0].Id)
+	}
+}
+
+// isSelectedAccount checks if the account is an active account under the organizational units with all the account tags
+func (orgClient *OrganizationsClient) isSelectedAccount(ctx context.Context, account string) (bool, error) {
+	output, err := orgClient.Client.DescribeAccountWithContext(ctx, &organizations.DescribeAccountInput{AccountId: aws.String(account)})
+	if err != nil {
+		return false, fmt.Errorf("failed to describe account %s: %w", account, err)
+	}
+	if aws.StringValue(output.Account.Status) != organizations.AccountStatusActive {
+		return false, nil
+	}
+
+	underUnits, err := orgClient.isUnderOrganizationUnits(ctx, account)
+	if err != nil || !underUnits {
+		return false, err
+	}
+	return orgClient.hasAccountTags(ctx, account)
+}
+
+// wasSelectedAccount checks if the account was selected before it moved from the source parent, its status and tags
+// are not changed by the move
+func (orgClient *OrganizationsClient) wasSelectedAccount(ctx context.Context, account, sourceParent string) (bool, error) {
+	underUnits, err := orgClient.isUnderOrganizationUnits(ctx, sourceParent)
+	if err != nil || !underUnits {
+		return false, err
+	}
+	return orgClient.hasAccountTags(ctx, account)
+}
+
+// newSetupJob returns a job which applies the subscription filters of the configured services and custom log groups
+func newSetupJob(action common.ActionType) (*job, error) {
+	customLogGroups, err := envConfig.customLogGroups()
+	if err != nil {
+		return nil, err
+	}
+	logGroups, customPrefixes := splitCustomLogGroups(customLogGroups.names())
+	prefixes := append(servicesPrefixes(getServices()), customPrefixes...)
+
+	j := &job{action: action, canContinue: true}
+	if action == common.DeleteSF {
+		j.logGroupsToRemove, j.prefixesToRemove = logGroups, prefixes
+	} else {
+		j.logGroupsToAdd, j.prefixesToAdd = logGroups, prefixes
+	}
+	return j, nil
+}
+
+// newReconcileJob returns a job which applies the subscription filters of the configured services and custom log
+// groups, and removes the subscription filter from every other log group which still has it
+func newReconcileJob(action common.ActionType) (*job, error) {
+	j, err := newSetupJob(action)
+	if err != nil {
+		return nil, err
+	}
+	if j.monitored, err = newMonitoredLogGroups(); err != nil {
+		return nil, err
+	}
+	j.prefixesToRemove = []common.PrefixCursor{{Prefix: emptyString}}
+	return j, nil
+}
+
+// handleOrganizationAccountEvent sets up the subscription filters of an account which joined the selected accounts,
+// and removes the subscription filters of an account which moved out of them. sourceParent is empty for a new account.
+func handleOrganizationAccountEvent(ctx context.Context, eventName, account, sourceParent string) (Result, error) {
+	if !envConfig.usesOrganizations() {
+		sugLog.Debug("Member accounts are not listed from AWS Organizations, skipping")
+		return Result{Message: fmt.Sprintf("%s event skipped - organizations account source is disabled", eventName)}, nil
+	}
+	if envConfig.isThisAccount(account) {
+		return Result{Message: fmt.Sprintf("%s event skipped - account of the function", eventName)}, nil
+	}
+
+	orgClient, err := getOrganizationsClient()
+	if err != nil {
+		return Result{}, err
+	}
+	isSelected, err := orgClient.isSelectedAccount(ctx, account)
+	if err != nil {
+		return Result{}, err
+	}
+	wasSelected := false
+	if sourceParent != emptyString {
+		if wasSelected, err = orgClient.wasSelectedAccount(ctx, account, sourceParent); err != nil {
+			return Result{}, err
+		}
+	}
+
+	action := common.AddSF
+	switch {
+	case isSelected && !wasSelected:
+		sugLog.Infof("Account %s joined the member accounts, setting up its subscription filters", account)
+	case wasSelected && !isSelected:
+		sugLog.Infof("Account %s left the member accounts, removing its subscription filters", account)
+		action = common.DeleteSF
+	default:
+		sugLog.Debugf("Account %s didn't join or leave the member accounts, skipping", account)
+		return Result{Message: fmt.Sprintf("%s event skipped - member accounts didn't change", eventName)}, nil
+	}
+
+	j, err := newSetupJob(action)
+	if err != nil {
+		return Result{}, err
+	}
+	envConfig.addMemberAccount(account)
+
+	return fanOutJobToAccount(ctx, j, account)
+}
@@ -0,0 +1,283 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/logzio/firehose-logs/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testOrganizationRoot = "r-abcd"
+	testUnit             = "ou-abcd-11111111"
+	testNestedUnit       = "ou-abcd-22222222"
+)
+
+// fakeOrganizationsClient is an organization with 111111111111 under the root, 222222222222 and a suspended
+// 333333333333 under testUnit, and 444444444444 under testNestedUnit, which is nested in testUnit
+type fakeOrganizationsClient struct {
+	organizationsiface.OrganizationsAPI
+}
+
+var testOrganizationAccounts = map[string][]*organizations.Account{
+	testOrganizationRoot: {{Id: aws.String("111111111111"), Status: aws.String(organizations.AccountStatusActive)}},
+	testUnit: {
+		{Id: aws.String("222222222222"), Status: aws.String(organizations.AccountStatusActive)},
+		{Id: aws.String("333333333333"), Status: aws.String(organizations.AccountStatusSuspended)},
+	},
+	testNestedUnit: {{Id: aws.String("444444444444"), Status: aws.String(organizations.AccountStatusActive)}},
+}
+
+var testOrganizationParents = map[string]string{
+	"111111111111": testOrganizationRoot,
+	"222222222222": testUnit,
+	"333333333333": testUnit,
+	"444444444444": testNestedUnit,
+	testUnit:       testOrganizationRoot,
+	testNestedUnit: testUnit,
+}
+
+var testOrganizationTags = map[string]map[string]string{
+	"222222222222": {"team": "a"},
+	"444444444444": {"team": "b"},
+}
+
+func (m *fakeOrganizationsClient) ListAccountsPagesWithContext(ctx aws.Context, input *organizations.ListAccountsInput, fn func(*organizations.ListAccountsOutput, bool) bool, opts ...request.Option) error {
+	for _, accounts := range testOrganizationAccounts {
+		fn(&organizations.ListAccountsOutput{Accounts: accounts}, false)
+	}
+	return nil
+}
+
+func (m *fakeOrganizationsClient) ListAccountsForParentPagesWithContext(ctx aws.Context, input *organizations.ListAccountsForParentInput, fn func(*organizations.ListAccountsForParentOutput, bool) bool, opts ...request.Option) error {
+	fn(&organizations.ListAccountsForParentOutput{Accounts: testOrganizationAccounts[*input.ParentId]}, true)
+	return nil
+}
+
+func (m *fakeOrganizationsClient) ListOrganizationalUnitsForParentPagesWithContext(ctx aws.Context, input *organizations.ListOrganizationalUnitsForParentInput, fn func(*organizations.ListOrganizationalUnitsForParentOutput, bool) bool, opts ...request.Option) error {
+	var units []*organizations.OrganizationalUnit
+	for child, parent := range testOrganizationParents {
+		if _, ok := testOrganizationAccounts[child]; ok && parent == *input.ParentId {
+			units = append(units, &organizations.OrganizationalUnit{Id: aws.String(child)})
+		}
+	}
+	fn(&organizations.ListOrganizationalUnitsForParentOutput{OrganizationalUnits: units}, true)
+	return nil
+}
+
+func (m *fakeOrganizationsClient) ListTagsForResourcePagesWithContext(ctx aws.Context, input *organizations.ListTagsForResourceInput, fn func(*organizations.ListTagsForResourceOutput, bool) bool, opts ...request.Option) error {
+	var tags []*organizations.Tag
+	for key, value := range testOrganizationTags[*input.ResourceId] {
+		tags = append(tags, &organizations.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	fn(&organizations.ListTagsForResourceOutput{Tags: tags}, true)
+	return nil
+}
+
+func (m *fakeOrganizationsClient) ListParentsWithContext(ctx aws.Context, input *organizations.ListParentsInput, opts ...request.Option) (*organizations.ListParentsOutput, error) {
+	parent, ok := testOrganizationParents[*input.ChildId]
+	if !ok {
+		return nil, fmt.Errorf("child not found")
+	}
+	return &organizations.ListParentsOutput{Parents: []*organizations.Parent{{Id: aws.String(parent)}}}, nil
+}
+
+func (m *fakeOrganizationsClient) DescribeAccountWithContext(ctx aws.Context, input *organizations.DescribeAccountInput, opts ...request.Option) (*organizations.DescribeAccountOutput, error) {
+	for _, accounts := range testOrganizationAccounts {
+		for _, account := range accounts {
+			if *account.Id == *input.AccountId {
+				return &organizations.DescribeAccountOutput{Account: account}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("account not found")
+}
+
+func TestSelectedAccounts(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	orgClient := &OrganizationsClient{Client: &fakeOrganizationsClient{}}
+
+	tests := []struct {
+		name     string
+		units    []string
+		tags     map[string]string
+		expected []string
+	}{
+		{
+			name:     "whole organization",
+			expected: []string{"111111111111", "222222222222", "444444444444"},
+		},
+		{
+			name:     "unit with nested units",
+			units:    []string{testUnit},
+			expected: []string{"222222222222", "444444444444"},
+		},
+		{
+			name:     "nested unit",
+			units:    []string{testNestedUnit},
+			expected: []string{"444444444444"},
+		},
+		{
+			name:     "account tags",
+			units:    []string{testOrganizationRoot},
+			tags:     map[string]string{"team": "a"},
+			expected: []string{"222222222222"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envConfig.organizationUnits = test.units
+			envConfig.organizationAccountTags = test.tags
+
+			accounts, err := orgClient.selectedAccounts(context.Background())
+			sort.Strings(accounts)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, accounts)
+		})
+	}
+}
+
+func TestIsSelectedAccount(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.organizationUnits = []string{testUnit}
+	envConfig.organizationAccountTags = map[string]string{"team": "b"}
+	orgClient := &OrganizationsClient{Client: &fakeOrganizationsClient{}}
+
+	tests := []struct {
+		name     string
+		account  string
+		expected bool
+	}{
+		{name: "in a nested unit with the tags", account: "444444444444", expected: true},
+		{name: "without the tags", account: "222222222222", expected: false},
+		{name: "suspended", account: "333333333333", expected: false},
+		{name: "outside the units", account: "111111111111", expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected, err := orgClient.isSelectedAccount(context.Background(), test.account)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, selected)
+		})
+	}
+
+	wasSelected, err := orgClient.wasSelectedAccount(context.Background(), "444444444444", testOrganizationRoot)
+	assert.Nil(t, err)
+	assert.False(t, wasSelected)
+}
+
+func TestParseOrganizationUnits(t *testing.T) {
+	units, err := parseOrganizationUnits([]string{testOrganizationRoot, testUnit})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testOrganizationRoot, testUnit}, units)
+
+	_, err = parseOrganizationUnits([]string{"not-a-unit"})
+	assert.NotNil(t, err)
+}
+
+func TestValidateMemberAccountSource(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        Config
+		errorExpected bool
+	}{
+		{
+			name:   "list",
+			config: Config{memberAccountSource: accountSourceList},
+		},
+		{
+			name:   "organizations with units and tags",
+			config: Config{memberAccountSource: accountSourceOrganizations, organizationUnits: []string{testUnit}, organizationAccountTags: map[string]string{"team": "a"}},
+		},
+		{
+			name:          "invalid source",
+			config:        Config{memberAccountSource: "other"},
+			errorExpected: true,
+		},
+		{
+			name:          "units without organizations",
+			config:        Config{memberAccountSource: accountSourceList, organizationUnits: []string{testUnit}},
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.validateMemberAccountSource()
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestNewSetupJob(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.servicesValue = "lambda"
+	envConfig.customGroupsValue = "custom1,/custom/prefix/*"
+	envConfig.secretEnabled = false
+
+	j, err := newSetupJob(common.DeleteSF)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"custom1"}, j.logGroupsToRemove)
+	assert.Equal(t, []common.PrefixCursor{{Prefix: "/aws/lambda/"}, {Prefix: "/custom/prefix/"}}, j.prefixesToRemove)
+	assert.Empty(t, j.logGroupsToAdd)
+	assert.Empty(t, j.prefixesToAdd)
+}
+
+func TestOrganizationAccountEventsSkipped(t *testing.T) {
+	ctx := setupHandlerTest()
+
+	tests := []struct {
+		name              string
+		event             Event
+		expectedOutputMsg string
+	}{
+		{
+			name: "account creation in progress",
+			event: Event{
+				Source:     organizationsEventSource,
+				DetailType: cloudTrailApiCallDetailType,
+				Detail:     json.RawMessage(`{"eventName": "CreateAccount", "responseElements": {"createAccountStatus": {"state": "IN_PROGRESS"}}}`),
+			},
+			expectedOutputMsg: "CreateAccount event skipped - account is not created yet",
+		},
+		{
+			name: "organizations account source disabled",
+			event: Event{
+				Source:     organizationsEventSource,
+				DetailType: cloudTrailServiceEventDetailType,
+				Detail:     json.RawMessage(`{"eventName": "CreateAccountResult", "serviceEventDetails": {"createAccountStatus": {"state": "SUCCEEDED", "accountId": "555555555555"}}}`),
+			},
+			expectedOutputMsg: "CreateAccountResult event skipped - organizations account source is disabled",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := HandleRequest(ctx, test.event)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedOutputMsg, result.Message)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+// regionPattern matches the name of an AWS region
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// parseRegions validates the regions, skipping the region of the function and duplicates
+func parseRegions(values []string, thisRegion string) ([]string, error) {
+	regions := make([]string, 0)
+	for _, region := range values {
+		if region == emptyString {
+			continue
+		}
+		if !regionPattern.MatchString(region) {
+			return nil, fmt.Errorf("invalid region '%s'", region)
+		}
+		if region == thisRegion || slices.Contains(regions, region) {
+			continue
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+// newRegionDestinations validates the default destination of each region, and returns them by region. The role of a
+// destination which requires one defaults to the role of the default destination, since roles are global.
+func newRegionDestinations(configs map[string]destinationConfig, regions []string, defaultRoleArn string) (map[string]*namedDestination, error) {
+	destinations := make(map[string]*namedDestination, len(configs))
+	for region, conf := range configs {
+		if !slices.Contains(regions, region) {
+			return nil, fmt.Errorf("destination of region %s is set, but the region is not in the regions list", region)
+		}
+
+		destType, err := parseDestinationType(conf.Arn)
+		if err != nil {
+			return nil, fmt.Errorf("destination of region %s: %w", region, err)
+		}
+		if !destType.requiresRole() {
+			conf.RoleArn = emptyString
+		} else if conf.RoleArn == emptyString {
+			conf.RoleArn = defaultRoleArn
+		}
+
+		destinations[region] = &namedDestination{name: defaultDestinationName, arn: conf.Arn, roleArn: conf.RoleArn, destinationType: destType}
+	}
+	return destinations, nil
+}
+
+// validateRegions validates that other regions can be managed with the config
+func (c *Config) validateRegions() error {
+	if len(c.regions) > 0 && c.mode == modeAccountPolicy {
+		return fmt.Errorf("regions are not supported in %s mode", modeAccountPolicy)
+	}
+	return nil
+}
+
+// isThisRegion checks if the region is the region of the function, an empty region is this region
+func (c *Config) isThisRegion(region string) bool {
+	return region == emptyString || region == c.region
+}
+
+// isManagedRegion checks if the subscription filters of the region are managed by the function
+func (c *Config) isManagedRegion(region string) bool {
+	return c.isThisRegion(region) || slices.Contains(c.regions, region)
+}
+
+// destinationInRegion returns the destination of the log groups of the region. The default destination of a region
+// can be set explicitly, otherwise the destination is found by the naming convention, where a destination of the
+// same name and account exists in every region.
+func (c *Config) destinationInRegion(destination *namedDestination, region string) *namedDestination {
+	if c.isThisRegion(region) {
+		return destination
+	}
+	if regional, ok := c.regionDestinations[region]; ok && destination.name == defaultDestinationName {
+		return regional
+	}
+
+	parsed, err := arn.Parse(destination.arn)
+	if err != nil {
+		// the destinations are validated when the config is created
+		return destination
+	}
+	parsed.Region = region
+	regional := *destination
+	regional.arn = parsed.String()
+	return &regional
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRegions(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expected      []string
+		errorExpected bool
+	}{
+		{
+			name:     "empty",
+			value:    "",
+			expected: []string{},
+		},
+		{
+			name:     "skips this region and duplicates",
+			value:    "us-west-2, eu-central-1,us-east-1,us-west-2,us-gov-west-1",
+			expected: []string{"us-west-2", "eu-central-1", "us-gov-west-1"},
+		},
+		{
+			name:          "invalid region",
+			value:         "us-west-2,not a region",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			regions, err := parseRegions(convertStrToArr(test.value), "us-east-1")
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, regions)
+			}
+		})
+	}
+}
+
+func TestNewRegionDestinations(t *testing.T) {
+	regions := []string{"us-west-2", "eu-central-1"}
+	defaultRole := "arn:aws:iam::123456789012:role/test-role"
+
+	tests := []struct {
+		name          string
+		configs       map[string]destinationConfig
+		expected      map[string]*namedDestination
+		errorExpected bool
+	}{
+		{
+			name:     "empty",
+			expected: map[string]*namedDestination{},
+		},
+		{
+			name: "valid",
+			configs: map[string]destinationConfig{
+				"us-west-2":    {Arn: "arn:aws:firehose:us-west-2:123456789012:deliverystream/west"},
+				"eu-central-1": {Arn: "arn:aws:lambda:eu-central-1:123456789012:function:eu", RoleArn: "ignored"},
+			},
+			expected: map[string]*namedDestination{
+				"us-west-2":    {name: defaultDestinationName, arn: "arn:aws:firehose:us-west-2:123456789012:deliverystream/west", roleArn: defaultRole, destinationType: destinationFirehose},
+				"eu-central-1": {name: defaultDestinationName, arn: "arn:aws:lambda:eu-central-1:123456789012:function:eu", destinationType: destinationLambda},
+			},
+		},
+		{
+			name:          "region not in the regions list",
+			configs:       map[string]destinationConfig{"eu-west-1": {Arn: "arn:aws:lambda:eu-west-1:123456789012:function:eu"}},
+			errorExpected: true,
+		},
+		{
+			name:          "invalid destination",
+			configs:       map[string]destinationConfig{"us-west-2": {Arn: "not-an-arn"}},
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destinations, err := newRegionDestinations(test.configs, regions, defaultRole)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, destinations)
+			}
+		})
+	}
+}
+
+func TestDestinationInRegion(t *testing.T) {
+	westDestination := &namedDestination{name: defaultDestinationName, arn: "arn:aws:firehose:us-west-2:123456789012:deliverystream/west", destinationType: destinationFirehose}
+	c := &Config{
+		region:             "us-east-1",
+		regions:            []string{"us-west-2", "eu-central-1"},
+		regionDestinations: map[string]*namedDestination{"us-west-2": westDestination},
+	}
+	defaultDestination := &namedDestination{name: defaultDestinationName, arn: "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream", destinationType: destinationFirehose}
+	function := &namedDestination{name: "function", arn: testLambdaArn, destinationType: destinationLambda}
+
+	tests := []struct {
+		name        string
+		destination *namedDestination
+		region      string
+		expectedArn string
+	}{
+		{
+			name:        "this region",
+			destination: defaultDestination,
+			region:      "",
+			expectedArn: defaultDestination.arn,
+		},
+		{
+			name:        "explicit region destination",
+			destination: defaultDestination,
+			region:      "us-west-2",
+			expectedArn: westDestination.arn,
+		},
+		{
+			name:        "default destination by naming convention",
+			destination: defaultDestination,
+			region:      "eu-central-1",
+			expectedArn: "arn:aws:firehose:eu-central-1:123456789012:deliverystream/test-stream",
+		},
+		{
+			name:        "named destination by naming convention",
+			destination: function,
+			region:      "us-west-2",
+			expectedArn: "arn:aws:lambda:us-west-2:123456789012:function:test-function",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expectedArn, c.destinationInRegion(test.destination, test.region).arn)
+		})
+	}
+}
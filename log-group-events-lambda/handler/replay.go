@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/hashicorp/go-multierror"
+	"github.com/logzio/firehose-logs/common"
+)
+
+// replayedEvent is the outcome of a failed event which was replayed
+type replayedEvent struct {
+	MessageId string `json:"messageId"`
+	EventName string `json:"eventName,omitempty"`
+	// Error is set when the event failed again, the message is kept in the queue then
+	Error  string  `json:"error,omitempty"`
+	Result *Result `json:"result,omitempty"`
+}
+
+// onFailureRecord is the record which Lambda sends to the on-failure destination of a failed asynchronous invocation
+type onFailureRecord struct {
+	RequestContext json.RawMessage `json:"requestContext"`
+	RequestPayload json.RawMessage `json:"requestPayload"`
+}
+
+// parseReplayQueueArn validates the ARN of the queue which the failed events are replayed from
+func parseReplayQueueArn(value, partition string) (string, error) {
+	if value == emptyString {
+		return emptyString, nil
+	}
+
+	parsed, err := arn.Parse(value)
+	if err != nil {
+		return emptyString, fmt.Errorf("invalid replay queue ARN %s: %v", value, err)
+	}
+	if parsed.Service != "sqs" {
+		return emptyString, fmt.Errorf("replay queue ARN %s is not of an SQS queue", value)
+	}
+	if parsed.Partition != partition {
+		return emptyString, fmt.Errorf("replay queue %s is not in partition %s", value, partition)
+	}
+	return value, nil
+}
+
+// failedEventOf returns the event of a message of the replay queue. The message is either the event itself, as sent
+// to a dead-letter queue, or an on-failure destination record whose request payload is the event.
+func failedEventOf(body string) (Event, error) {
+	payload := []byte(body)
+
+	var record onFailureRecord
+	if err := json.Unmarshal(payload, &record); err == nil && len(record.RequestContext) > 0 && len(record.RequestPayload) > 0 {
+		payload = record.RequestPayload
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return Event{}, fmt.Errorf("invalid failed event: %v", err)
+	}
+	return event, nil
+}
+
+// handleReplayEvent re-dispatches the failed events of the replay queue. The messages of the events which succeed are
+// deleted, unless it's a dry run, where the events are only planned and all the messages are kept.
+func handleReplayEvent(ctx context.Context, dryRun bool) (Result, error) {
+	if envConfig.replayQueueArn == emptyString {
+		return Result{}, fmt.Errorf("replay queue is not configured")
+	}
+
+	sqsClient, err := getSQSClient(envConfig.replayQueueArn)
+	if err != nil {
+		return Result{}, err
+	}
+	return replayQueue(ctx, sqsClient, dryRun)
+}
+
+// replayQueue replays the messages of the replay queue until it's empty, the replay limit is reached or the
+// invocation is about to time out
+func replayQueue(ctx context.Context, sqsClient *SQSClient, dryRun bool) (Result, error) {
+	queueUrl, err := sqsClient.queueUrl(ctx, envConfig.replayQueueArn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// the replayed events are handled with the dry run setting of the replay
+	dryRun = dryRun || envConfig.dryRun
+	configDryRun := envConfig.dryRun
+	envConfig.dryRun = dryRun
+	defer func() { envConfig.dryRun = configDryRun }()
+
+	workCtx, cancel := withTimeMargin(ctx, continuationTimeMargin)
+	defer cancel()
+
+	result := Result{DryRun: dryRun, Replayed: make([]replayedEvent, 0)}
+	// the received messages are hidden until the replay ends, so every message is replayed once
+	var toRelease []*sqs.Message
+	var errs *multierror.Error
+	for len(result.Replayed) < maxReplayedEvents && workCtx.Err() == nil {
+		messages, err := sqsClient.receiveMessages(workCtx, queueUrl, replayVisibilityTimeout)
+		if err != nil {
+			if !isOutOfTimeError(err) {
+				errs = multierror.Append(errs, err)
+			}
+			break
+		}
+		if len(messages) == 0 {
+			break
+		}
+
+		for _, message := range messages {
+			replayed := replayMessage(workCtx, message)
+			result.Replayed = append(result.Replayed, replayed)
+
+			if dryRun || replayed.Error != emptyString {
+				toRelease = append(toRelease, message)
+				continue
+			}
+			if err = sqsClient.deleteMessage(ctx, queueUrl, message); err != nil {
+				sugLog.Warnf("Replayed event %s, but failed to delete its message: %v", replayed.MessageId, err)
+			}
+		}
+	}
+
+	for _, message := range toRelease {
+		if err = sqsClient.releaseMessage(ctx, queueUrl, message); err != nil {
+			sugLog.Warnf("Failed to release message of a failed event: %v", err)
+		}
+	}
+
+	sugLog.Infof("Replayed %d failed events, %d failed again", len(result.Replayed), result.failedReplaysCount())
+	return result, errs.ErrorOrNil()
+}
+
+// replayMessage dispatches the event of a message of the replay queue
+func replayMessage(ctx context.Context, message *sqs.Message) replayedEvent {
+	replayed := replayedEvent{MessageId: aws.StringValue(message.MessageId)}
+
+	event, err := failedEventOf(aws.StringValue(message.Body))
+	if err == nil {
+		var typed typedEvent
+		if typed, err = parseEvent(event); err == nil {
+			replayed.EventName = typed.name()
+			if sfEvent, ok := typed.(subscriptionFilterEvent); ok && sfEvent.params.Action == common.ReplaySF {
+				err = fmt.Errorf("replay events are not replayed")
+			}
+		}
+	}
+	if err != nil {
+		sugLog.Errorf("Failed to replay message %s: %v", replayed.MessageId, err)
+		replayed.Error = err.Error()
+		return replayed
+	}
+
+	result, err := handleEvent(ctx, event)
+	replayed.Result = &result
+	if err != nil {
+		sugLog.Errorf("Replayed event of message %s failed again: %v", replayed.MessageId, err)
+		replayed.Error = err.Error()
+	}
+	return replayed
+}
+
+// failedReplaysCount returns the number of replayed events which failed again
+func (r *Result) failedReplaysCount() int {
+	count := 0
+	for _, replayed := range r.Replayed {
+		if replayed.Error != emptyString {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testReplayQueueArn = "arn:aws:sqs:us-east-1:123456789012:events-dlq"
+
+type mockSQSClient struct {
+	mock.Mock
+	sqsiface.SQSAPI
+}
+
+func (m *mockSQSClient) GetQueueUrl(input *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*sqs.GetQueueUrlOutput), args.Error(1)
+}
+
+func (m *mockSQSClient) GetQueueUrlWithContext(ctx aws.Context, input *sqs.GetQueueUrlInput, opts ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	return m.GetQueueUrl(input)
+}
+
+func (m *mockSQSClient) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*sqs.ReceiveMessageOutput), args.Error(1)
+}
+
+func (m *mockSQSClient) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	return m.ReceiveMessage(input)
+}
+
+func (m *mockSQSClient) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	args := m.Called(input)
+	return &sqs.DeleteMessageOutput{}, args.Error(0)
+}
+
+func (m *mockSQSClient) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	return m.DeleteMessage(input)
+}
+
+func (m *mockSQSClient) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	args := m.Called(input)
+	return &sqs.ChangeMessageVisibilityOutput{}, args.Error(0)
+}
+
+func (m *mockSQSClient) ChangeMessageVisibilityWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	return m.ChangeMessageVisibility(input)
+}
+
+func TestParseReplayQueueArn(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		partition     string
+		expected      string
+		errorExpected bool
+	}{
+		{
+			name:      "not configured",
+			value:     "",
+			partition: "aws",
+			expected:  "",
+		},
+		{
+			name:      "queue",
+			value:     testReplayQueueArn,
+			partition: "aws",
+			expected:  testReplayQueueArn,
+		},
+		{
+			name:      "queue in aws-cn partition",
+			value:     "arn:aws-cn:sqs:cn-north-1:123456789012:events-dlq",
+			partition: "aws-cn",
+			expected:  "arn:aws-cn:sqs:cn-north-1:123456789012:events-dlq",
+		},
+		{
+			name:          "queue in other partition",
+			value:         testReplayQueueArn,
+			partition:     "aws-us-gov",
+			errorExpected: true,
+		},
+		{
+			name:          "not a queue",
+			value:         "arn:aws:sns:us-east-1:123456789012:topic1",
+			partition:     "aws",
+			errorExpected: true,
+		},
+		{
+			name:          "not an ARN",
+			value:         "events-dlq",
+			partition:     "aws",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queueArn, err := parseReplayQueueArn(test.value, test.partition)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, queueArn)
+			}
+		})
+	}
+}
+
+func TestFailedEventOf(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		expectedSource string
+		errorExpected  bool
+	}{
+		{
+			name:           "dead-letter queue message",
+			body:           `{"source": "aws.logs", "detail-type": "AWS API Call via CloudTrail", "detail": {"eventName": "CreateLogGroup"}}`,
+			expectedSource: "aws.logs",
+		},
+		{
+			name:           "on-failure destination record",
+			body:           `{"version": "1.0", "requestContext": {"condition": "RetriesExhausted"}, "requestPayload": {"source": "aws.logs", "detail-type": "AWS API Call via CloudTrail", "detail": {"eventName": "CreateLogGroup"}}}`,
+			expectedSource: "aws.logs",
+		},
+		{
+			name:          "invalid message",
+			body:          "not an event",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, err := failedEventOf(test.body)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedSource, event.Source)
+				assert.NotEmpty(t, event.Detail)
+			}
+		})
+	}
+}
+
+func TestReplayQueue(t *testing.T) {
+	messages := []*sqs.Message{
+		{
+			MessageId:     aws.String("unsupported"),
+			ReceiptHandle: aws.String("receipt1"),
+			Body:          aws.String(`{"source": "aws.s3", "detail-type": "Object Created", "detail": {}}`),
+		},
+		{
+			MessageId:     aws.String("not-monitored"),
+			ReceiptHandle: aws.String("receipt2"),
+			Body:          aws.String(`{"requestContext": {"condition": "RetriesExhausted"}, "requestPayload": {"source": "aws.logs", "detail-type": "AWS API Call via CloudTrail", "detail": {"eventName": "CreateLogGroup", "requestParameters": {"logGroupName": "/aws/lambda/function1"}}}}`),
+		},
+		{
+			MessageId:     aws.String("replay"),
+			ReceiptHandle: aws.String("receipt3"),
+			Body:          aws.String(`{"detail": {"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "replay"}}}`),
+		},
+	}
+
+	tests := []struct {
+		name             string
+		dryRun           bool
+		expectedDeleted  []string
+		expectedReleased []string
+	}{
+		{
+			name:             "apply",
+			dryRun:           false,
+			expectedDeleted:  []string{"receipt2"},
+			expectedReleased: []string{"receipt1", "receipt3"},
+		},
+		{
+			name:             "dry run",
+			dryRun:           true,
+			expectedReleased: []string{"receipt1", "receipt2", "receipt3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupSFTest()
+			defer setupSFTest()
+			envConfig.servicesValue = emptyString
+			envConfig.replayQueueArn = testReplayQueueArn
+
+			mockClient := new(mockSQSClient)
+			mockClient.On("GetQueueUrl", &sqs.GetQueueUrlInput{
+				QueueName:              aws.String("events-dlq"),
+				QueueOwnerAWSAccountId: aws.String("123456789012"),
+			}).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String("queue-url")}, nil)
+			mockClient.On("ReceiveMessage", mock.Anything).Return(&sqs.ReceiveMessageOutput{Messages: messages}, nil).Once()
+			mockClient.On("ReceiveMessage", mock.Anything).Return(&sqs.ReceiveMessageOutput{}, nil).Once()
+			var deleted, released []string
+			mockClient.On("DeleteMessage", mock.Anything).Run(func(args mock.Arguments) {
+				deleted = append(deleted, aws.StringValue(args.Get(0).(*sqs.DeleteMessageInput).ReceiptHandle))
+			}).Return(nil)
+			mockClient.On("ChangeMessageVisibility", mock.Anything).Run(func(args mock.Arguments) {
+				released = append(released, aws.StringValue(args.Get(0).(*sqs.ChangeMessageVisibilityInput).ReceiptHandle))
+			}).Return(nil)
+
+			result, err := replayQueue(context.Background(), &SQSClient{Queue: mockClient}, test.dryRun)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.dryRun, result.DryRun)
+			assert.Len(t, result.Replayed, 3)
+			assert.Equal(t, 2, result.failedReplaysCount())
+			assert.Equal(t, "not-monitored", result.Replayed[1].MessageId)
+			assert.Equal(t, "CreateLogGroup", result.Replayed[1].EventName)
+			assert.Empty(t, result.Replayed[1].Error)
+			assert.Equal(t, "SubscriptionFilterEvent", result.Replayed[2].EventName)
+			assert.Equal(t, test.expectedDeleted, deleted)
+			assert.Equal(t, test.expectedReleased, released)
+			assert.False(t, envConfig.dryRun)
+			mockClient.AssertNumberOfCalls(t, "ReceiveMessage", 2)
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/logzio/firehose-logs/common"
+)
+
+// Result is the structured outcome of a handled event, returned as the lambda response
+type Result struct {
+	Message   string            `json:"message"`
+	Added     []string          `json:"added,omitempty"`
+	Updated   []string          `json:"updated,omitempty"`
+	Unchanged []string          `json:"unchanged,omitempty"`
+	Removed   []string          `json:"removed,omitempty"`
+	Failed    map[string]string `json:"failed,omitempty"`
+	// AccountPolicy is the outcome of the account level subscription filter policy operation
+	AccountPolicy filterStatus `json:"accountPolicy,omitempty"`
+	// Continued is set when the remaining work was handed over to a new invocation
+	Continued bool `json:"continued,omitempty"`
+	// DryRun is set when no subscription filter was changed, Added, Updated and Removed are the planned operations
+	DryRun bool `json:"dryRun,omitempty"`
+	// Error is the error of a member account or region which failed to be handled
+	Error string `json:"error,omitempty"`
+	// Accounts are the results of the member accounts, by account id
+	Accounts map[string]*Result `json:"accounts,omitempty"`
+	// Regions are the results of the other regions of the account, by region
+	Regions map[string]*Result `json:"regions,omitempty"`
+	// Replayed are the outcomes of the failed events which were replayed
+	Replayed []replayedEvent `json:"replayed,omitempty"`
+	// Inventory is the subscription state of the log groups which the inventory action reported
+	Inventory *inventoryReport `json:"inventory,omitempty"`
+}
+
+// filterStatus is the outcome of a subscription filter operation on a log group
+type filterStatus string
+
+const (
+	filterAdded     filterStatus = "added"
+	filterUpdated   filterStatus = "updated"
+	filterUnchanged filterStatus = "unchanged"
+	filterRemoved   filterStatus = "removed"
+)
+
+// filterChange is the outcome of a subscription filter operation on a single log group
+type filterChange struct {
+	logGroup string
+	status   filterStatus
+}
+
+func (c filterChange) String() string {
+	return fmt.Sprintf("%s (%s)", c.logGroup, c.status)
+}
+
+// record adds the given changes to the result by their status
+func (r *Result) record(changes []filterChange) {
+	for _, change := range changes {
+		switch change.status {
+		case filterAdded:
+			r.Added = append(r.Added, change.logGroup)
+		case filterUpdated:
+			r.Updated = append(r.Updated, change.logGroup)
+		case filterUnchanged:
+			r.Unchanged = append(r.Unchanged, change.logGroup)
+		case filterRemoved:
+			r.Removed = append(r.Removed, change.logGroup)
+		}
+	}
+}
+
+// addTarget adds the result of a member account or of another region, where an empty account or region is the one of the function
+func (r *Result) addTarget(account, region string, targetResult Result) {
+	r.DryRun = r.DryRun || targetResult.DryRun
+
+	parent := r
+	if !envConfig.isThisAccount(account) {
+		if r.Accounts == nil {
+			r.Accounts = make(map[string]*Result)
+		}
+		if r.Accounts[account] == nil {
+			r.Accounts[account] = &Result{}
+		}
+		parent = r.Accounts[account]
+	}
+
+	if envConfig.isThisRegion(region) {
+		// the result of the member account itself, keeping the results of its other regions
+		regions := parent.Regions
+		*parent = targetResult
+		parent.Regions = regions
+		return
+	}
+
+	if parent.Regions == nil {
+		parent.Regions = make(map[string]*Result)
+	}
+	parent.DryRun = parent.DryRun || targetResult.DryRun
+	parent.Regions[region] = &targetResult
+}
+
+// inTarget returns the result as the result of the given account and region, which is kept as is when it's the
+// account and region of the function
+func (r Result) inTarget(account, region string) Result {
+	if envConfig.isThisAccount(account) && envConfig.isThisRegion(region) {
+		return r
+	}
+	result := Result{}
+	result.addTarget(account, region, r)
+	return result
+}
+
+// forEachTarget calls fn with the label and the result of every target in the result, starting with the result itself
+func (r *Result) forEachTarget(label string, fn func(label string, result *Result)) {
+	fn(label, r)
+	for region, regionResult := range r.Regions {
+		regionResult.forEachTarget(joinTargetLabel(label, region), fn)
+	}
+	for account, accountResult := range r.Accounts {
+		accountResult.forEachTarget(joinTargetLabel(label, account), fn)
+	}
+}
+
+// joinTargetLabel returns the label of a nested target
+func joinTargetLabel(parent, child string) string {
+	if parent == emptyString {
+		return child
+	}
+	return parent + targetSeparator + child
+}
+
+// failedLogGroupsCount returns the number of failed log groups in all the targets
+func (r *Result) failedLogGroupsCount() int {
+	count := 0
+	r.forEachTarget(emptyString, func(_ string, result *Result) {
+		count += len(result.Failed)
+	})
+	return count
+}
+
+// failedTargets returns the labels of the member accounts and regions which failed to be handled
+func (r *Result) failedTargets() []string {
+	targets := make([]string, 0)
+	r.forEachTarget(emptyString, func(label string, result *Result) {
+		if result.Error != emptyString {
+			targets = append(targets, label)
+		}
+	})
+	sort.Strings(targets)
+	return targets
+}
+
+// complete checks if the action finished in every target, without continuing in another invocation, failed log
+// groups or failed targets
+func (r *Result) complete() bool {
+	complete := true
+	r.forEachTarget(emptyString, func(_ string, result *Result) {
+		if result.Continued || len(result.Failed) > 0 || result.Error != emptyString {
+			complete = false
+		}
+	})
+	return complete
+}
+
+// logGroupError is an error of a subscription filter operation on a specific log group
+type logGroupError struct {
+	logGroup string
+	err      error
+}
+
+func (e *logGroupError) Error() string {
+	return fmt.Sprintf("%s: %v", e.logGroup, e.err)
+}
+
+func (e *logGroupError) Unwrap() error {
+	return e.err
+}
+
+// collectFailures records the permanent per log group failures of err in the result, and returns the remaining
+// errors (retryable failures, or failures which are not related to a specific log group) that should fail the invocation
+func (r *Result) collectFailures(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var errs []error
+	var merr *multierror.Error
+	if errors.As(err, &merr) {
+		errs = merr.Errors
+	} else {
+		errs = []error{err}
+	}
+
+	var result *multierror.Error
+	for _, e := range errs {
+		var lgErr *logGroupError
+		if errors.As(e, &lgErr) && !common.IsRetryableError(lgErr.err) {
+			if r.Failed == nil {
+				r.Failed = make(map[string]string)
+			}
+			r.Failed[lgErr.logGroup] = lgErr.err.Error()
+			continue
+		}
+		result = multierror.Append(result, e)
+	}
+
+	return result.ErrorOrNil()
+}
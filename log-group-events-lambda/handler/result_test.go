@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectFailures(t *testing.T) {
+	throttlingErr := awserr.New("ThrottlingException", "Rate exceeded", nil)
+	notFoundErr := awserr.New("ResourceNotFoundException", "The specified log group does not exist", nil)
+
+	tests := []struct {
+		name           string
+		err            error
+		expectedFailed map[string]string
+		expectedError  bool
+	}{
+		{
+			name:           "no error",
+			err:            nil,
+			expectedFailed: nil,
+			expectedError:  false,
+		},
+		{
+			name: "permanent log group failures",
+			err: multierror.Append(nil,
+				&logGroupError{logGroup: "group1", err: notFoundErr},
+				&logGroupError{logGroup: "group2", err: fmt.Errorf("an error occurred")}),
+			expectedFailed: map[string]string{
+				"group1": notFoundErr.Error(),
+				"group2": "an error occurred",
+			},
+			expectedError: false,
+		},
+		{
+			name: "retryable log group failure",
+			err: multierror.Append(nil,
+				&logGroupError{logGroup: "group1", err: notFoundErr},
+				&logGroupError{logGroup: "group2", err: throttlingErr}),
+			expectedFailed: map[string]string{
+				"group1": notFoundErr.Error(),
+			},
+			expectedError: true,
+		},
+		{
+			name:           "failure not related to a log group",
+			err:            fmt.Errorf("failed to get log groups of service lambda: %w", notFoundErr),
+			expectedFailed: nil,
+			expectedError:  true,
+		},
+		{
+			name: "nested multierror",
+			err: multierror.Append(fmt.Errorf("discovery failed"),
+				multierror.Append(nil, &logGroupError{logGroup: "group1", err: notFoundErr})),
+			expectedFailed: map[string]string{
+				"group1": notFoundErr.Error(),
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := Result{}
+			err := result.collectFailures(test.err)
+
+			assert.Equal(t, test.expectedFailed, result.Failed)
+			if test.expectedError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestRecord(t *testing.T) {
+	result := Result{Added: []string{"group0"}}
+	result.record([]filterChange{
+		{logGroup: "group1", status: filterAdded},
+		{logGroup: "group2", status: filterUpdated},
+		{logGroup: "group3", status: filterUnchanged},
+		{logGroup: "group4", status: filterRemoved},
+	})
+
+	assert.Equal(t, []string{"group0", "group1"}, result.Added)
+	assert.Equal(t, []string{"group2"}, result.Updated)
+	assert.Equal(t, []string{"group3"}, result.Unchanged)
+	assert.Equal(t, []string{"group4"}, result.Removed)
+}
+
+func TestTargetResults(t *testing.T) {
+	setupSFTest()
+	envConfig.region = "us-east-1"
+
+	result := Result{Failed: map[string]string{"group1": "an error occurred"}}
+	result.addTarget("", "us-west-2", Result{Error: "region disabled"})
+	result.addTarget("111111111111", "us-west-2", Result{Failed: map[string]string{"group2": "an error occurred"}})
+	result.addTarget("111111111111", "", Result{Added: []string{"group3"}, DryRun: true})
+	result.addTarget("222222222222", "", Result{Error: "access denied"})
+
+	assert.True(t, result.DryRun)
+	assert.Equal(t, []string{"group3"}, result.Accounts["111111111111"].Added)
+	assert.Equal(t, map[string]string{"group2": "an error occurred"}, result.Accounts["111111111111"].Regions["us-west-2"].Failed)
+	assert.Equal(t, 2, result.failedLogGroupsCount())
+	assert.Equal(t, []string{"222222222222", "us-west-2"}, result.failedTargets())
+
+	assert.Equal(t, Result{Added: []string{"group1"}}, Result{Added: []string{"group1"}}.inTarget("", "us-east-1"))
+	assert.Equal(t, Result{Accounts: map[string]*Result{"111111111111": {Regions: map[string]*Result{"us-west-2": {Added: []string{"group1"}}}}}},
+		Result{Added: []string{"group1"}}.inTarget("111111111111", "us-west-2"))
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/logzio/firehose-logs/config"
+)
+
+// namedDestination is a destination which routing rules refer to by its name
+type namedDestination struct {
+	name            string
+	arn             string
+	roleArn         string
+	destinationType destinationType
+}
+
+// destinationConfig is a named destination as it's set in the DESTINATIONS env variable
+type destinationConfig = config.Destination
+
+// routingRule routes the log groups of services, prefixes or tags to a named destination. A log group matches the
+// rule if it's of one of the services or prefixes, or if it has all the tags.
+type routingRule config.RoutingRule
+
+// newNamedDestinations validates each destination of the destination names, and returns the named destinations
+func newNamedDestinations(configs map[string]destinationConfig) (map[string]*namedDestination, error) {
+	destinations := make(map[string]*namedDestination, len(configs))
+	for name, conf := range configs {
+		if name == defaultDestinationName {
+			return nil, fmt.Errorf("destination name '%s' is reserved for the default destination", defaultDestinationName)
+		}
+
+		destType, err := parseDestinationType(conf.Arn)
+		if err != nil {
+			return nil, fmt.Errorf("destination '%s': %w", name, err)
+		}
+		if destType.requiresRole() && conf.RoleArn == emptyString {
+			return nil, fmt.Errorf("destination '%s': role ARN must be set for %s destinations", name, destType)
+		}
+		if !destType.requiresRole() {
+			conf.RoleArn = emptyString
+		}
+
+		destinations[name] = &namedDestination{name: name, arn: conf.Arn, roleArn: conf.RoleArn, destinationType: destType}
+	}
+	return destinations, nil
+}
+
+// newRoutingRules returns the routing rules of the ROUTING_RULES env variable, and validates that they refer to known
+// destinations
+func newRoutingRules(configs []config.RoutingRule, destinations map[string]*namedDestination) ([]routingRule, error) {
+	rules := make([]routingRule, 0, len(configs))
+	for _, rule := range configs {
+		rules = append(rules, routingRule(rule))
+	}
+	if err := validateRoutingRules(rules, destinations); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// validateRoutingRules validates that the routing rules refer to known destinations and services
+func validateRoutingRules(rules []routingRule, destinations map[string]*namedDestination) error {
+	serviceToPrefix := getServicesMap()
+	for i, rule := range rules {
+		if _, ok := destinations[rule.Destination]; !ok && rule.Destination != defaultDestinationName {
+			return fmt.Errorf("routing rule %d: unknown destination '%s'", i, rule.Destination)
+		}
+		if len(rule.Services) == 0 && len(rule.Prefixes) == 0 && len(rule.Tags) == 0 {
+			return fmt.Errorf("routing rule %d: at least one of services, prefixes or tags must be set", i)
+		}
+		for _, service := range rule.Services {
+			if _, ok := serviceToPrefix[service]; !ok {
+				return fmt.Errorf("routing rule %d: unknown service '%s'", i, service)
+			}
+		}
+	}
+	return nil
+}
+
+// matches checks if the log group with the given tags matches the rule
+func (r routingRule) matches(logGroup string, tags map[string]string) bool {
+	serviceToPrefix := getServicesMap()
+	for _, service := range r.Services {
+		if strings.HasPrefix(logGroup, serviceToPrefix[service]) {
+			return true
+		}
+	}
+
+	for _, prefix := range r.Prefixes {
+		if strings.HasPrefix(logGroup, prefix) {
+			return true
+		}
+	}
+
+	if len(r.Tags) == 0 {
+		return false
+	}
+	for key, value := range r.Tags {
+		if tagValue, ok := tags[key]; !ok || tagValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// routingUsesTags checks if any routing rule needs the tags of the log groups
+func (c *Config) routingUsesTags() bool {
+	for _, rule := range c.routingRules {
+		if len(rule.Tags) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultDestination returns the destination of the log groups which don't match any routing rule
+func (c *Config) defaultDestination() *namedDestination {
+	return &namedDestination{
+		name:            defaultDestinationName,
+		arn:             c.destinationArn,
+		roleArn:         c.roleArn,
+		destinationType: c.destinationType,
+	}
+}
+
+// routeOf returns the destination of the first routing rule which matches the log group, or the default destination
+func (c *Config) routeOf(logGroup string, tags map[string]string) *namedDestination {
+	for _, rule := range c.routingRules {
+		if rule.matches(logGroup, tags) {
+			if destination, ok := c.destinations[rule.Destination]; ok {
+				return destination
+			}
+			break
+		}
+	}
+	return c.defaultDestination()
+}
+
+// getLogGroupTags returns the tags of the log group
+func (cwLogsClient *CloudWatchLogsClient) getLogGroupTags(ctx context.Context, logGroup string) (map[string]string, error) {
+	var output *cloudwatchlogs.ListTagsForResourceOutput
+	err := retryPolicy.Do(ctx, func() error {
+		var err error
+		output, err = cwLogsClient.Client.ListTagsForResourceWithContext(ctx, &cloudwatchlogs.ListTagsForResourceInput{
+			ResourceArn: aws.String(logGroupArn(cwLogsClient.awsRegion(), cwLogsClient.account(), logGroup)),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aws.StringValueMap(output.Tags), nil
+}
+
+// routeLogGroup returns the destination of the log group in the region of the client, getting its tags only when a
+// routing rule needs them
+func (cwLogsClient *CloudWatchLogsClient) routeLogGroup(ctx context.Context, logGroup string) (*namedDestination, error) {
+	var tags map[string]string
+	if envConfig.routingUsesTags() {
+		var err error
+		if tags, err = cwLogsClient.getLogGroupTags(ctx, logGroup); err != nil {
+			return nil, fmt.Errorf("failed to get tags of %s: %w", logGroup, err)
+		}
+	}
+	return envConfig.destinationInRegion(envConfig.routeOf(logGroup, tags), cwLogsClient.region), nil
+}
+
+// routeCustomLogGroup returns the destination of the log group in the region of the client, which is the destination of
+// its custom log group when it's set, and is routed otherwise
+func (cwLogsClient *CloudWatchLogsClient) routeCustomLogGroup(ctx context.Context, logGroup string, options customLogGroup) (*namedDestination, error) {
+	switch {
+	case options.Destination == emptyString:
+		return cwLogsClient.routeLogGroup(ctx, logGroup)
+	case options.Destination == defaultDestinationName:
+		return envConfig.destinationInRegion(envConfig.defaultDestination(), cwLogsClient.region), nil
+	}
+
+	destination, ok := envConfig.destinations[options.Destination]
+	if !ok {
+		return nil, fmt.Errorf("unknown destination '%s' of custom log group %s", options.Destination, options.LogGroup)
+	}
+	return envConfig.destinationInRegion(destination, cwLogsClient.region), nil
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/logzio/firehose-logs/common"
+	"github.com/logzio/firehose-logs/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func (m *MockCloudWatchLogsClient) ListTagsForResourceWithContext(ctx aws.Context, input *cloudwatchlogs.ListTagsForResourceInput, opts ...request.Option) (*cloudwatchlogs.ListTagsForResourceOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*cloudwatchlogs.ListTagsForResourceOutput), args.Error(1)
+}
+
+const (
+	testStreamArn = "arn:aws:kinesis:us-east-1:123456789012:stream/test-stream"
+	testLambdaArn = "arn:aws:lambda:us-east-1:123456789012:function:test-function"
+)
+
+func TestNewNamedDestinations(t *testing.T) {
+	tests := []struct {
+		name          string
+		configs       map[string]destinationConfig
+		expected      map[string]*namedDestination
+		errorExpected bool
+	}{
+		{
+			name:     "empty",
+			expected: map[string]*namedDestination{},
+		},
+		{
+			name: "valid",
+			configs: map[string]destinationConfig{
+				"stream":   {Arn: testStreamArn, RoleArn: "arn:aws:iam::123456789012:role/test-role"},
+				"function": {Arn: testLambdaArn, RoleArn: "ignored"},
+			},
+			expected: map[string]*namedDestination{
+				"stream":   {name: "stream", arn: testStreamArn, roleArn: "arn:aws:iam::123456789012:role/test-role", destinationType: destinationKinesis},
+				"function": {name: "function", arn: testLambdaArn, destinationType: destinationLambda},
+			},
+		},
+		{
+			name:          "invalid ARN",
+			configs:       map[string]destinationConfig{"stream": {Arn: "not-an-arn"}},
+			errorExpected: true,
+		},
+		{
+			name:          "missing role",
+			configs:       map[string]destinationConfig{"stream": {Arn: testStreamArn}},
+			errorExpected: true,
+		},
+		{
+			name:          "reserved name",
+			configs:       map[string]destinationConfig{"default": {Arn: testLambdaArn}},
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destinations, err := newNamedDestinations(test.configs)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, destinations)
+			}
+		})
+	}
+}
+
+func TestNewRoutingRules(t *testing.T) {
+	destinations := map[string]*namedDestination{"function": {name: "function", arn: testLambdaArn, destinationType: destinationLambda}}
+
+	tests := []struct {
+		name          string
+		configs       []config.RoutingRule
+		expected      []routingRule
+		errorExpected bool
+	}{
+		{
+			name:     "empty",
+			expected: []routingRule{},
+		},
+		{
+			name: "valid",
+			configs: []config.RoutingRule{
+				{Destination: "function", Services: []string{"lambda"}, Tags: map[string]string{"team": "a"}},
+				{Destination: defaultDestinationName, Prefixes: []string{"/custom/"}},
+			},
+			expected: []routingRule{
+				{Destination: "function", Services: []string{"lambda"}, Tags: map[string]string{"team": "a"}},
+				{Destination: defaultDestinationName, Prefixes: []string{"/custom/"}},
+			},
+		},
+		{
+			name:          "unknown destination",
+			configs:       []config.RoutingRule{{Destination: "other", Prefixes: []string{"/custom/"}}},
+			errorExpected: true,
+		},
+		{
+			name:          "unknown service",
+			configs:       []config.RoutingRule{{Destination: "function", Services: []string{"not-a-service"}}},
+			errorExpected: true,
+		},
+		{
+			name:          "no selector",
+			configs:       []config.RoutingRule{{Destination: "function"}},
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := newRoutingRules(test.configs, destinations)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, rules)
+			}
+		})
+	}
+}
+
+func TestRouteOf(t *testing.T) {
+	function := &namedDestination{name: "function", arn: testLambdaArn, destinationType: destinationLambda}
+	c := &Config{
+		destinationArn:  "arn:aws:firehose:us-east-1:123456789012:deliverystream/test-stream",
+		roleArn:         "arn:aws:iam::123456789012:role/test-role",
+		destinationType: destinationFirehose,
+		destinations:    map[string]*namedDestination{"function": function},
+		routingRules: []routingRule{
+			{Destination: defaultDestinationName, Prefixes: []string{"/aws/lambda/pinned"}},
+			{Destination: "function", Services: []string{"lambda"}},
+			{Destination: "function", Tags: map[string]string{"team": "a", "env": "prod"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		logGroup string
+		tags     map[string]string
+		expected *namedDestination
+	}{
+		{
+			name:     "service",
+			logGroup: "/aws/lambda/function1",
+			expected: function,
+		},
+		{
+			name:     "first matching rule",
+			logGroup: "/aws/lambda/pinned-function",
+			expected: c.defaultDestination(),
+		},
+		{
+			name:     "all tags",
+			logGroup: "custom",
+			tags:     map[string]string{"team": "a", "env": "prod", "other": "value"},
+			expected: function,
+		},
+		{
+			name:     "some tags",
+			logGroup: "custom",
+			tags:     map[string]string{"team": "a"},
+			expected: c.defaultDestination(),
+		},
+		{
+			name:     "no matching rule",
+			logGroup: "custom",
+			expected: c.defaultDestination(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, c.routeOf(test.logGroup, test.tags))
+		})
+	}
+}
+
+func TestAddSubscriptionFilterWithRouting(t *testing.T) {
+	setupSFTest()
+	t.Setenv(common.EnvAwsRegion, "us-east-1")
+	t.Setenv(envDestinations, `{"function":{"arn":"`+testLambdaArn+`"}}`)
+	t.Setenv(envRoutingRules, `[{"destination":"function","tags":{"team":"a"}}]`)
+	envConfig, _ = NewConfig()
+	defer setupSFTest()
+
+	mockClient := new(MockCloudWatchLogsClient)
+	mockClient.On("ListTagsForResourceWithContext", &cloudwatchlogs.ListTagsForResourceInput{
+		ResourceArn: aws.String("arn:test-partition:logs:us-east-1:aws-account-id:log-group:teamGroup"),
+	}).Return(&cloudwatchlogs.ListTagsForResourceOutput{Tags: map[string]*string{"team": aws.String("a")}}, nil)
+	mockClient.On("ListTagsForResourceWithContext", mock.Anything).Return(&cloudwatchlogs.ListTagsForResourceOutput{}, nil)
+	mockClient.On("PutSubscriptionFilter", mock.Anything).Return(&cloudwatchlogs.PutSubscriptionFilterOutput{}, nil)
+	cwClient := &CloudWatchLogsClient{Client: mockClient}
+
+	changes, err := cwClient.addSubscriptionFilter(context.Background(), []string{"teamGroup", "unchangedGroup"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"teamGroup"}, logGroupsWithStatus(changes, filterAdded))
+	assert.Equal(t, []string{"unchangedGroup"}, logGroupsWithStatus(changes, filterUnchanged))
+	mockClient.AssertCalled(t, "PutSubscriptionFilter", mock.MatchedBy(func(input *cloudwatchlogs.PutSubscriptionFilterInput) bool {
+		return *input.LogGroupName == "teamGroup" && *input.DestinationArn == testLambdaArn && input.RoleArn == nil
+	}))
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/logzio/firehose-logs/common"
+)
+
+type S3Client struct {
+	Client s3iface.S3API
+}
+
+func getS3Client() (*S3Client, error) {
+	sess, err := common.GetSession()
+	if err != nil {
+		sugLog.Error("Error while creating session: ", err.Error())
+		return nil, err
+	}
+	return &S3Client{Client: s3.New(sess)}, nil
+}
+
+// putObject uploads the body to the key of the bucket, and returns the S3 URI of the object
+func (client *S3Client) putObject(ctx context.Context, bucket, key, contentType string, body []byte) (string, error) {
+	_, err := client.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+		Body:        bytes.NewReader(body),
+	})
+	if err != nil {
+		return emptyString, fmt.Errorf("failed to upload %s to bucket %s: %w", key, bucket, err)
+	}
+	return fmt.Sprintf("s3://%s/%s", bucket, key), nil
+}
+
+// getObject downloads the object of the key of the bucket
+func (client *S3Client) getObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	output, err := client.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from bucket %s: %w", key, bucket, err)
+	}
+	defer output.Body.Close()
+
+	body, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from bucket %s: %w", key, bucket, err)
+	}
+	return body, nil
+}
@@ -2,19 +2,21 @@ package handler
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-secretsmanager-caching-go/secretcache"
-	"regexp"
-	"sort"
+	"github.com/logzio/firehose-logs/common"
+	"strings"
 )
 
 // SecretsManagerAPIInterface AWS SDK v2 doesn't provide an interface for each service client like v1
 type SecretsManagerAPIInterface interface {
 	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
-	ListSecretVersionIds(ctx context.Context, params *secretsmanager.ListSecretVersionIdsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretVersionIdsOutput, error)
+	UpdateSecretVersionStage(ctx context.Context, params *secretsmanager.UpdateSecretVersionStageInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.UpdateSecretVersionStageOutput, error)
 }
 
 // SecretManagerClient is a client for AWS Secrets Manager API
@@ -49,127 +51,172 @@ func getSecretCacheClient() (*SecretCacheClient, error) {
 	return &SecretCacheClient{Client: secretCache}, err
 }
 
-// updateSecretCustomLogGroups updates the custom log groups to monitor based on comparing the old secret value to the new one (helper of handleSecretChangedEvent)
-func updateSecretCustomLogGroups(ctx context.Context, secretId string) error {
-	svc, err := getSecretManagerClient(ctx)
-	if err != nil {
-		return err
-	}
+// secretVersion is a version of the custom log groups secret
+type secretVersion struct {
+	versionId string
+	// stage is the staging label which the version was found by
+	stage           string
+	customLogGroups *customLogGroupsSpec
+}
 
-	oldSecretValue, err := svc.getOldSecretValue(ctx, secretId)
+// updateSecretCustomLogGroups updates the custom log groups to monitor based on comparing the value of the secret
+// which was applied last to its current value (helper of handleSecretChangedEvent). The current version is marked as
+// applied once the subscription filters of every target were updated.
+func updateSecretCustomLogGroups(ctx context.Context, svc *SecretManagerClient, eventName, secretId string) (Result, error) {
+	current, err := svc.getSecretVersion(ctx, secretId, secretCurrentStage)
 	if err != nil {
-		sugLog.Error("Failed to get the old custom log group secret version's value.")
-		return err
+		sugLog.Error("Failed to get the new custom log group from secret")
+		return Result{}, err
+	}
+	if current == nil {
+		return Result{}, fmt.Errorf("secret %s doesn't have a current version", secretId)
 	}
 
-	newSecretValue, err := getCustomLogGroups("true", secretId)
+	lastApplied, err := svc.getLastAppliedVersion(ctx, secretId)
 	if err != nil {
-		sugLog.Error("Failed to get the new custom log group from secret")
-		return err
+		sugLog.Error("Failed to get the last applied custom log group secret version's value.")
+		return Result{}, err
+	}
+	if lastApplied != nil && lastApplied.stage == secretAppliedStage && lastApplied.versionId == current.versionId {
+		sugLog.Debugf("Version %s of secret %s was applied already, skipping", current.versionId, secretId)
+		return Result{Message: fmt.Sprintf("%s event skipped - the current version was applied already", eventName)}, nil
 	}
 
-	customGroupsToAdd, customGroupsToRemove := findDifferences(oldSecretValue, newSecretValue)
+	// the subscription filters are put with the options of the current version, which the secret cache may not return yet
+	envConfig.customLogGroupsSpec = current.customLogGroups
+	return applyCustomLogGroupsVersion(ctx, secretDiffJob(lastApplied, current), current.appliedVersion(secretId, lastApplied))
+}
 
-	cwLogClient, err := getCloudWatchLogsClient()
+// restoreSecretCustomLogGroups adds the subscription filter to all the custom log groups of a restored secret, since
+// the changes of the secret before its deletion was canceled may have failed while it was scheduled for deletion
+func restoreSecretCustomLogGroups(ctx context.Context, svc *SecretManagerClient, secretId string) (Result, error) {
+	current, err := svc.getSecretVersion(ctx, secretId, secretCurrentStage)
 	if err != nil {
-		sugLog.Error("Failed to get the old custom log group secret version's value.")
-		return err
+		sugLog.Error("Failed to get the custom log groups from the restored secret")
+		return Result{}, err
 	}
-
-	if err := cwLogClient.updateSubscriptionFilters([]string{}, []string{}, customGroupsToAdd, customGroupsToRemove); err != nil {
-		return err
+	if current == nil {
+		return Result{}, fmt.Errorf("secret %s doesn't have a current version", secretId)
+	}
+	lastApplied, err := svc.getSecretVersion(ctx, secretId, secretAppliedStage)
+	if err != nil {
+		return Result{}, err
 	}
-	return nil
+
+	envConfig.customLogGroupsSpec = current.customLogGroups
+	return applyCustomLogGroupsVersion(ctx, secretDiffJob(nil, current), current.appliedVersion(secretId, lastApplied))
 }
 
-// getSecretNameFromArn extracts a secret name from the given secret ARN
-func getSecretNameFromArn(secretArn string) string {
-	var secretName string
+// secretDiffJob returns the job which updates the subscription filters from the custom log groups of the last applied
+// version of the secret to the ones of its current version. All the custom log groups are added when no version was
+// applied, and the ones whose options changed are put again.
+func secretDiffJob(lastApplied, current *secretVersion) *job {
+	var oldCustomLogGroups *customLogGroupsSpec
+	if lastApplied != nil {
+		oldCustomLogGroups = lastApplied.customLogGroups
+	}
+	return customLogGroupsDiffJob(oldCustomLogGroups, current.customLogGroups)
+}
 
-	getSecretName := regexp.MustCompile(fmt.Sprintf(`^arn:aws:secretsmanager:%s:%s:secret:(?P<secretName>\S+)-`, envConfig.region, envConfig.accountId))
-	match := getSecretName.FindStringSubmatch(secretArn)
+// isCustomLogGroupsSecret checks if the secret id of an event refers to the configured secret of the custom log
+// groups. The secret id is either the ARN of the secret, its partial ARN without the random suffix, or its name.
+func isCustomLogGroupsSecret(secretId string) bool {
+	secretArn := envConfig.customGroupsValue
+	if secretId == secretArn {
+		return true
+	}
 
-	for i, key := range getSecretName.SubexpNames() {
-		if key == "secretName" && len(match) > i {
-			secretName = match[i]
-			break
-		}
+	secretName := getSecretNameFromArn(secretArn)
+	if secretName == emptyString {
+		return false
 	}
-	sugLog.Debugf("Found secret name %s, from secret ARN %s", secretName, secretArn)
-	return secretName
+	partialArn := secretArn[:strings.LastIndex(secretArn, "-")]
+	return secretId == partialArn || secretId == secretName
 }
 
-// getOldSecretValue gets custom log groups value from the previous secret version
-func (svc *SecretManagerClient) getOldSecretValue(ctx context.Context, secretId string) ([]string, error) {
-	// get the old version id
-	oldVersionId, err := svc.getPreviousSecretVersion(ctx, secretId)
+// getSecretNameFromArn extracts a secret name from the given secret ARN, or returns an empty string if it's not an ARN
+// of a secret of the account, region and partition of the function
+func getSecretNameFromArn(secretArn string) string {
+	secretName, err := secretNameFromArn(secretArn)
 	if err != nil {
-		sugLog.Error("Failed to get the older custom log group secret version.")
-		return []string{}, err
+		sugLog.Debugf("Failed to get the secret name from ARN %s: %v", secretArn, err)
+		return emptyString
 	}
+	sugLog.Debugf("Found secret name %s, from secret ARN %s", secretName, secretArn)
+	return secretName
+}
 
-	// get the old version value
-	getOldSecretValueInput := &secretsmanager.GetSecretValueInput{
-		SecretId:  &secretId,
-		VersionId: oldVersionId,
+// getSecretVersion returns the version of the secret with the given staging label, or nil if no version has it
+func (svc *SecretManagerClient) getSecretVersion(ctx context.Context, secretId, stage string) (*secretVersion, error) {
+	output, err := svc.Client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId:     &secretId,
+		VersionStage: &stage,
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		sugLog.Debugf("Secret %s doesn't have a version with staging label %s", secretId, stage)
+		return nil, nil
 	}
-
-	oldSecret, err := svc.Client.GetSecretValue(ctx, getOldSecretValueInput)
 	if err != nil {
-		sugLog.Error("Failed to get the old value of the secret")
-		return []string{}, err
+		return nil, fmt.Errorf("failed to get %s version of secret %s: %w", stage, secretId, err)
 	}
-	oldSecretValueJson := oldSecret.SecretString
 
-	oldSecretValue, err := extractCustomGroupsFromSecret(secretId, *oldSecretValueJson)
+	customLogGroups, err := parseCustomLogGroupsSecret(secretId, aws.StringValue(output.SecretString), envConfig.destinations)
 	if err != nil {
-		sugLog.Error("Failed to get the old value of the custom log groups from secret")
-		return []string{}, err
+		return nil, fmt.Errorf("invalid %s version of secret %s: %w", stage, secretId, err)
 	}
-
-	return convertStrToArr(oldSecretValue), nil
-
+	return &secretVersion{versionId: aws.StringValue(output.VersionId), stage: stage, customLogGroups: customLogGroups}, nil
 }
 
-// getPreviousSecretVersion returns the previous version id of the given secret
-func (svc *SecretManagerClient) getPreviousSecretVersion(ctx context.Context, secretId string) (*string, error) {
-	var previousVersionId *string
-
-	listSecretVersionsInput := &secretsmanager.ListSecretVersionIdsInput{
-		SecretId: &secretId,
+// getLastAppliedVersion returns the version of the secret whose custom log groups were applied last. It falls back to
+// the previous version of the secret before any version was applied, and it's nil when the secret has neither.
+func (svc *SecretManagerClient) getLastAppliedVersion(ctx context.Context, secretId string) (*secretVersion, error) {
+	for _, stage := range []string{secretAppliedStage, secretPreviousStage} {
+		version, err := svc.getSecretVersion(ctx, secretId, stage)
+		if err != nil || version != nil {
+			return version, err
+		}
 	}
+	return nil, nil
+}
 
-	secretInfo, err := svc.Client.ListSecretVersionIds(ctx, listSecretVersionsInput)
-	if err != nil {
-		sugLog.Error("Failed to list secret versions")
-		return nil, err
+// appliedVersion returns the version to mark as applied, whose applied staging label is moved from the last applied
+// version if it has it
+func (v *secretVersion) appliedVersion(secretId string, lastApplied *secretVersion) *common.AppliedVersion {
+	version := &common.AppliedVersion{SecretId: secretId, VersionId: v.versionId}
+	if lastApplied != nil && lastApplied.stage == secretAppliedStage {
+		version.PreviousVersionId = lastApplied.versionId
 	}
+	return version
+}
 
-	// Sort the versions based on created date
-	sort.Slice(secretInfo.Versions, func(i, j int) bool {
-		return secretInfo.Versions[i].CreatedDate.After(*secretInfo.Versions[j].CreatedDate)
-	})
-
-	if len(secretInfo.Versions) > 1 {
-		previousVersionId = secretInfo.Versions[1].VersionId
-	} else {
-		return nil, fmt.Errorf("secret %s doesn't have an older version", secretId)
+// markApplied moves the applied staging label of the secret from the version it's attached to, if any, to the given
+// version, once the result of applying it is complete. A version which continued in another invocation, or whose log
+// groups or targets failed, is not marked. A failure is only logged, since the next change of the secret is then
+// compared to an older version, whose changes were applied already.
+func (svc *SecretManagerClient) markApplied(ctx context.Context, version *common.AppliedVersion, result Result) {
+	if envConfig.dryRun || result.DryRun {
+		sugLog.Debugf("Dry run, not marking version %s of secret %s as applied", version.VersionId, version.SecretId)
+		return
+	}
+	if !result.complete() {
+		sugLog.Warnf("Not marking version %s of secret %s as applied, since its changes were not fully applied", version.VersionId, version.SecretId)
+		return
+	}
+	if version.PreviousVersionId == version.VersionId {
+		return
 	}
 
-	return previousVersionId, nil
-}
-
-// extractCustomGroupsFromSecret extracts the custom log groups to monitor from the given secret value
-func extractCustomGroupsFromSecret(secretId, result string) (string, error) {
-	var secretValues map[string]string
-	err := json.Unmarshal([]byte(result), &secretValues)
-	if err != nil {
-		return "", err
+	input := &secretsmanager.UpdateSecretVersionStageInput{
+		SecretId:        aws.String(version.SecretId),
+		VersionStage:    aws.String(secretAppliedStage),
+		MoveToVersionId: aws.String(version.VersionId),
+	}
+	if version.PreviousVersionId != emptyString {
+		input.RemoveFromVersionId = aws.String(version.PreviousVersionId)
 	}
 
-	customLogGroups, ok := secretValues[logzioSecretKeyName]
-	if !ok {
-		return "", fmt.Errorf("did not find logzioCustomLogGroups key in the secret %s", secretId)
+	if _, err := svc.Client.UpdateSecretVersionStage(ctx, input); err != nil {
+		sugLog.Warnf("Failed to mark version %s of secret %s as applied: %v", version.VersionId, version.SecretId, err)
 	}
-	return customLogGroups, nil
 }
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"context"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
 	"github.com/logzio/firehose-logs/common"
@@ -10,7 +11,6 @@ import (
 	"github.com/stretchr/testify/mock"
 	"os"
 	"testing"
-	"time"
 )
 
 func stringPtr(s string) *string {
@@ -18,11 +18,6 @@ func stringPtr(s string) *string {
 	return &s
 }
 
-func timePtr(t time.Time) *time.Time {
-	/* helper function */
-	return &t
-}
-
 type MockSecretManagerClient struct {
 	mock.Mock
 	SecretsManagerAPIInterface
@@ -34,9 +29,24 @@ func (m *MockSecretManagerClient) GetSecretValue(ctx context.Context, params *se
 
 }
 
-func (m *MockSecretManagerClient) ListSecretVersionIds(ctx context.Context, params *secretsmanager.ListSecretVersionIdsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretVersionIdsOutput, error) {
+func (m *MockSecretManagerClient) UpdateSecretVersionStage(ctx context.Context, params *secretsmanager.UpdateSecretVersionStageInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.UpdateSecretVersionStageOutput, error) {
 	args := m.Called(params)
-	return args.Get(0).(*secretsmanager.ListSecretVersionIdsOutput), args.Error(1)
+	return &secretsmanager.UpdateSecretVersionStageOutput{}, args.Error(0)
+}
+
+// secretVersionOutput returns the output of GetSecretValue of a version of the custom log groups secret
+func secretVersionOutput(versionId, customLogGroups string) *secretsmanager.GetSecretValueOutput {
+	return &secretsmanager.GetSecretValueOutput{
+		VersionId:    stringPtr(versionId),
+		SecretString: stringPtr(fmt.Sprintf(`{"logzioCustomLogGroups": "%s"}`, customLogGroups)),
+	}
+}
+
+// secretStageMatcher matches the GetSecretValue input of the version with the given staging label
+func secretStageMatcher(stage string) interface{} {
+	return mock.MatchedBy(func(input *secretsmanager.GetSecretValueInput) bool {
+		return *input.VersionStage == stage
+	})
 }
 
 func setupSecretTest() (ctx context.Context, mockClient *MockSecretManagerClient) {
@@ -48,9 +58,17 @@ func setupSecretTest() (ctx context.Context, mockClient *MockSecretManagerClient
 	if err != nil {
 		return
 	}
+	err = os.Setenv(envAwsPartition, "aws")
+	if err != nil {
+		return
+	}
+	err = os.Setenv(envStackName, "test-stack")
+	if err != nil {
+		return
+	}
 
 	/* Setup config */
-	envConfig = NewConfig()
+	envConfig, _ = NewConfig()
 
 	/* Setup logger */
 	sugLog = lp.GetSugaredLogger()
@@ -94,197 +112,399 @@ func TestGetSecretNameFromArn(t *testing.T) {
 	}
 }
 
-func TestGetOldSecretValue(t *testing.T) {
-	ctx, mockClient := setupSecretTest()
+func TestIsCustomLogGroupsSecret(t *testing.T) {
+	setupSecretTest()
+	envConfig.customGroupsValue = "arn:aws:secretsmanager:us-east-1:486140753397:secret:custom-groups-56y7ud"
 
 	tests := []struct {
-		name           string
-		SecretString   string
-		versions       []types.SecretVersionsListEntry
-		expectedOutput []string
-		expectedError  bool
+		name     string
+		secretId string
+		expected bool
 	}{
 		{
-			name:         "valid secret with history",
-			SecretString: `{"logzioCustomLogGroups": "g1, g2, g3"}`,
-			versions: []types.SecretVersionsListEntry{
-				{
-					VersionId:   stringPtr("v2"),
-					CreatedDate: timePtr(time.Date(2023, 10, 8, 12, 0, 0, 0, time.UTC)),
-				},
-				{
-					VersionId:   stringPtr("v1"),
-					CreatedDate: timePtr(time.Date(2023, 5, 8, 12, 0, 0, 0, time.UTC)),
-				},
-			},
-			expectedOutput: []string{"g1", "g2", "g3"},
-			expectedError:  false,
+			name:     "secret ARN",
+			secretId: "arn:aws:secretsmanager:us-east-1:486140753397:secret:custom-groups-56y7ud",
+			expected: true,
 		},
 		{
-			name:         "valid secret with no history",
-			SecretString: "",
-			versions: []types.SecretVersionsListEntry{
-				{
-					VersionId:   stringPtr("v1"),
-					CreatedDate: timePtr(time.Date(2023, 5, 8, 12, 0, 0, 0, time.UTC)),
-				},
-			},
-			expectedOutput: []string{},
-			expectedError:  true,
+			name:     "partial secret ARN",
+			secretId: "arn:aws:secretsmanager:us-east-1:486140753397:secret:custom-groups",
+			expected: true,
 		},
 		{
-			name:         "invalid last secret",
-			SecretString: `{"someKey": "g1, g2, g3"}`,
-			versions: []types.SecretVersionsListEntry{
-				{
-					VersionId:   stringPtr("v2"),
-					CreatedDate: timePtr(time.Date(2023, 10, 8, 12, 0, 0, 0, time.UTC)),
-				},
-				{
-					VersionId:   stringPtr("v1"),
-					CreatedDate: timePtr(time.Date(2023, 5, 8, 12, 0, 0, 0, time.UTC)),
-				},
-			},
-			expectedOutput: []string{},
-			expectedError:  true,
+			name:     "secret name",
+			secretId: "custom-groups",
+			expected: true,
+		},
+		{
+			name:     "secret whose name contains the secret name",
+			secretId: "arn:aws:secretsmanager:us-east-1:486140753397:secret:custom-groups-old-a1b2c3",
+			expected: false,
+		},
+		{
+			name:     "secret name which contains the secret name",
+			secretId: "custom",
+			expected: false,
 		},
 	}
 
-	arn := "arn:aws:secretsmanager:us-east-1:486140753397:secret:testSecretName-56y7ud"
-	secretName := "testSecretName"
-	oldVer := "v1"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, isCustomLogGroupsSecret(test.secretId))
+		})
+	}
+}
+
+func TestSecretChangedEventSkipped(t *testing.T) {
+	ctx, _ := setupSecretTest()
+	envConfig.secretEnabled = true
+	envConfig.customGroupsValue = "arn:aws:secretsmanager:us-east-1:486140753397:secret:custom-groups-56y7ud"
+
+	tests := []struct {
+		name        string
+		event       secretChangedEvent
+		expectedMsg string
+	}{
+		{
+			name:        "pending version of a rotation",
+			event:       secretChangedEvent{eventName: "PutSecretValue", SecretId: "custom-groups", VersionStages: []string{"AWSPENDING"}},
+			expectedMsg: "PutSecretValue event skipped - not the current version",
+		},
+		{
+			name:        "other secret",
+			event:       secretChangedEvent{eventName: "UpdateSecret", SecretId: "custom-groups-old"},
+			expectedMsg: "UpdateSecret event skipped - not the custom log groups secret",
+		},
+	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			mockClient.On("GetSecretValue", mock.Anything).Return(
-				&secretsmanager.GetSecretValueOutput{
-					ARN:          stringPtr(arn),
-					Name:         stringPtr(secretName),
-					VersionId:    stringPtr(oldVer),
-					SecretString: stringPtr(test.SecretString),
-				}, nil).Once()
-			mockClient.On("ListSecretVersionIds", mock.Anything).Return(
-				&secretsmanager.ListSecretVersionIdsOutput{
-					ARN:      stringPtr(arn),
-					Name:     stringPtr(secretName),
-					Versions: test.versions,
-				}, nil).Once()
+			result, err := test.event.handle(ctx, emptyString, emptyString)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedMsg, result.Message)
+		})
+	}
+}
+
+func TestGetLastAppliedVersion(t *testing.T) {
+	ctx, _ := setupSecretTest()
+	notFound := &types.ResourceNotFoundException{Message: stringPtr("version not found")}
+
+	tests := []struct {
+		name            string
+		appliedVersion  *secretsmanager.GetSecretValueOutput
+		appliedError    error
+		previousVersion *secretsmanager.GetSecretValueOutput
+		previousError   error
+		expectedVersion *secretVersion
+		expectedError   bool
+	}{
+		{
+			name:            "applied version",
+			appliedVersion:  secretVersionOutput("v1", "g1, g2"),
+			expectedVersion: &secretVersion{versionId: "v1", stage: secretAppliedStage, customLogGroups: newCustomLogGroupsSpec([]string{"g1", "g2"})},
+		},
+		{
+			name:            "previous version before any version was applied",
+			appliedError:    notFound,
+			previousVersion: secretVersionOutput("v2", "g1"),
+			expectedVersion: &secretVersion{versionId: "v2", stage: secretPreviousStage, customLogGroups: newCustomLogGroupsSpec([]string{"g1"})},
+		},
+		{
+			name:          "first version",
+			appliedError:  notFound,
+			previousError: notFound,
+		},
+		{
+			name:          "failed getting the applied version",
+			appliedError:  fmt.Errorf("an error occurred"),
+			expectedError: true,
+		},
+		{
+			name:           "invalid applied version",
+			appliedVersion: &secretsmanager.GetSecretValueOutput{VersionId: stringPtr("v1"), SecretString: stringPtr(`{"someKey": "g1"}`)},
+			expectedError:  true,
+		},
+	}
 
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockClient := new(MockSecretManagerClient)
+			mockClient.On("GetSecretValue", secretStageMatcher(secretAppliedStage)).Return(test.appliedVersion, test.appliedError)
+			mockClient.On("GetSecretValue", secretStageMatcher(secretPreviousStage)).Return(test.previousVersion, test.previousError)
 			secretClient := &SecretManagerClient{Client: mockClient}
-			result, err := secretClient.getOldSecretValue(ctx, secretName)
 
-			assert.Equal(t, test.expectedOutput, result)
+			version, err := secretClient.getLastAppliedVersion(ctx, "testSecretName")
+
 			if test.expectedError {
 				assert.NotNil(t, err)
 			} else {
 				assert.Nil(t, err)
+				assert.Equal(t, test.expectedVersion, version)
 			}
 		})
 	}
 }
 
-func TestGetPreviousSecretVersion(t *testing.T) {
-	ctx, mockClient := setupSecretTest()
+func TestMarkApplied(t *testing.T) {
+	ctx, _ := setupSecretTest()
+	current := &secretVersion{versionId: "v3", stage: secretCurrentStage}
 
 	tests := []struct {
-		name           string
-		versions       []types.SecretVersionsListEntry
-		expectedOutput *string
-		expectedError  bool
+		name                      string
+		lastApplied               *secretVersion
+		result                    Result
+		dryRun                    bool
+		expectedRemoveFromVersion *string
+		expectedCalls             int
 	}{
 		{
-			name: "secret with history",
-			versions: []types.SecretVersionsListEntry{
-				{
-					VersionId:   stringPtr("v2"),
-					CreatedDate: timePtr(time.Date(2023, 10, 8, 12, 0, 0, 0, time.UTC)),
-				},
-				{
-					VersionId:   stringPtr("v1"),
-					CreatedDate: timePtr(time.Date(2023, 5, 8, 12, 0, 0, 0, time.UTC)),
-				},
+			name:          "first applied version",
+			expectedCalls: 1,
+		},
+		{
+			name:          "previous version",
+			lastApplied:   &secretVersion{versionId: "v2", stage: secretPreviousStage},
+			expectedCalls: 1,
+		},
+		{
+			name:                      "applied version",
+			lastApplied:               &secretVersion{versionId: "v1", stage: secretAppliedStage},
+			expectedRemoveFromVersion: stringPtr("v1"),
+			expectedCalls:             1,
+		},
+		{
+			name:        "current version is applied",
+			lastApplied: &secretVersion{versionId: "v3", stage: secretAppliedStage},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+		},
+		{
+			name:   "continued in another invocation",
+			result: Result{Added: []string{"group1"}, Continued: true},
+		},
+		{
+			name:   "failed log groups",
+			result: Result{Added: []string{"group1"}, Failed: map[string]string{"group2": "access denied"}},
+		},
+		{
+			name: "failed target",
+			result: Result{
+				Added:   []string{"group1"},
+				Regions: map[string]*Result{"us-west-2": {Error: "failed to get cloudwatch logs client"}},
 			},
-			expectedOutput: stringPtr("v1"),
-			expectedError:  false,
 		},
 		{
-			name: "secret with no history",
-			versions: []types.SecretVersionsListEntry{
-				{
-					VersionId:   stringPtr("v1"),
-					CreatedDate: timePtr(time.Date(2023, 5, 8, 12, 0, 0, 0, time.UTC)),
-				},
+			name: "target continued in another invocation",
+			result: Result{
+				Accounts: map[string]*Result{"111111111111": {Added: []string{"group1"}, Continued: true}},
 			},
-			expectedOutput: nil,
-			expectedError:  true,
 		},
 	}
 
-	arn := "arn:aws:secretsmanager:us-east-1:486140753397:secret:testSecretName-56y7ud"
-	secretName := "testSecretName"
-
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			mockClient.On("ListSecretVersionIds", mock.Anything).Return(
-				&secretsmanager.ListSecretVersionIdsOutput{
-					ARN:      stringPtr(arn),
-					Name:     stringPtr(secretName),
-					Versions: test.versions,
-				}, nil).Once()
+			envConfig.dryRun = test.dryRun
+			defer func() { envConfig.dryRun = false }()
+
+			mockClient := new(MockSecretManagerClient)
+			mockClient.On("UpdateSecretVersionStage", &secretsmanager.UpdateSecretVersionStageInput{
+				SecretId:            stringPtr("testSecretName"),
+				VersionStage:        stringPtr(secretAppliedStage),
+				MoveToVersionId:     stringPtr("v3"),
+				RemoveFromVersionId: test.expectedRemoveFromVersion,
+			}).Return(nil)
 			secretClient := &SecretManagerClient{Client: mockClient}
-			result, err := secretClient.getPreviousSecretVersion(ctx, secretName)
 
-			assert.Equal(t, test.expectedOutput, result)
-			if test.expectedError {
-				assert.NotNil(t, err)
-			} else {
-				assert.Nil(t, err)
-			}
+			secretClient.markApplied(ctx, current.appliedVersion("testSecretName", test.lastApplied), test.result)
+
+			mockClient.AssertNumberOfCalls(t, "UpdateSecretVersionStage", test.expectedCalls)
+		})
+	}
+}
+
+func TestMarkAppliedAfterTargetContinues(t *testing.T) {
+	ctx, _ := setupSecretTest()
+	defer setupSFTest()
+	envConfig.memberAccounts = []string{"111111111111"}
+	current := &secretVersion{versionId: "v2", stage: secretCurrentStage}
+	lastApplied := &secretVersion{versionId: "v1", stage: secretAppliedStage}
+	j := &job{action: common.AddSF, logGroupsToAdd: []string{"group1", "group2"}, canContinue: true, appliedVersion: current.appliedVersion("testSecretName", lastApplied)}
+
+	// the target runs out of time in the first invocation, which leaves marking the version to the fan out
+	targetJob := j.forTarget("111111111111", emptyString)
+	assert.False(t, targetJob.marksAppliedVersion())
+	targetJob.logGroupsToAdd, targetJob.result = []string{"group2"}, Result{Added: []string{"group1"}}
+
+	// the target finishes in its continuation, which marks the version
+	continued := continuedJob(t, targetJob)
+	assert.True(t, continued.marksAppliedVersion())
+	continued.logGroupsToAdd = nil
+	continued.result.Added = append(continued.result.Added, "group2")
+
+	mockClient := new(MockSecretManagerClient)
+	mockClient.On("UpdateSecretVersionStage", &secretsmanager.UpdateSecretVersionStageInput{
+		SecretId:            stringPtr("testSecretName"),
+		VersionStage:        stringPtr(secretAppliedStage),
+		MoveToVersionId:     stringPtr("v2"),
+		RemoveFromVersionId: stringPtr("v1"),
+	}).Return(nil)
+	(&SecretManagerClient{Client: mockClient}).markApplied(ctx, continued.appliedVersion, continued.result)
+
+	mockClient.AssertNumberOfCalls(t, "UpdateSecretVersionStage", 1)
+}
+
+func TestSecretDiffJob(t *testing.T) {
+	current := &secretVersion{versionId: "v2", customLogGroups: newCustomLogGroupsSpec([]string{"g1", "g3", "/log/group2/*"})}
+
+	tests := []struct {
+		name        string
+		lastApplied *secretVersion
+		expectedJob *job
+	}{
+		{
+			name:        "changed custom log groups",
+			lastApplied: &secretVersion{versionId: "v1", customLogGroups: newCustomLogGroupsSpec([]string{"g1", "g2", "/log/group1/*"})},
+			expectedJob: &job{
+				action:            common.UpdateSF,
+				logGroupsToAdd:    []string{"g3"},
+				logGroupsToRemove: []string{"g2"},
+				prefixesToAdd:     []common.PrefixCursor{{Prefix: "/log/group2/"}},
+				prefixesToRemove:  []common.PrefixCursor{{Prefix: "/log/group1/"}},
+				canContinue:       true,
+			},
+		},
+		{
+			name: "no applied version",
+			expectedJob: &job{
+				action:            common.UpdateSF,
+				logGroupsToAdd:    []string{"g1", "g3"},
+				logGroupsToRemove: []string{},
+				prefixesToAdd:     []common.PrefixCursor{{Prefix: "/log/group2/"}},
+				prefixesToRemove:  []common.PrefixCursor{},
+				canContinue:       true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expectedJob, secretDiffJob(test.lastApplied, current))
 		})
 	}
 }
 
-func TestExtractCustomGroupsFromSecret(t *testing.T) {
+func TestParseCustomLogGroupsSecret(t *testing.T) {
+	sugLog = lp.GetSugaredLogger()
+	destinations := map[string]*namedDestination{"security": {name: "security"}}
+	errorPattern := "ERROR"
+
 	tests := []struct {
 		name           string
 		secretId       string
 		result         string
-		expectedOutput string
+		expectedOutput *customLogGroupsSpec
 		expectedError  bool
 	}{
 		{
 			name:           "valid secret",
 			secretId:       "testSecret",
 			result:         `{"logzioCustomLogGroups": "g1, g2, g3"}`,
-			expectedOutput: "g1, g2, g3",
+			expectedOutput: newCustomLogGroupsSpec([]string{"g1", "g2", "g3"}),
 			expectedError:  false,
 		},
 		{
-			name:           "empty secret",
-			secretId:       "testSecret",
-			result:         ``,
-			expectedOutput: "",
-			expectedError:  true,
+			name:          "empty secret",
+			secretId:      "testSecret",
+			result:        ``,
+			expectedError: true,
 		},
 		{
-			name:           "missing `logzioSecretKeyName` as key",
-			secretId:       "testSecret",
-			result:         `{"someKey": "g1, g2"}`,
-			expectedOutput: "",
-			expectedError:  true,
+			name:          "missing `logzioSecretKeyName` as key",
+			secretId:      "testSecret",
+			result:        `{"someKey": "g1, g2"}`,
+			expectedError: true,
 		},
 		{
-			name:           "edge case, invalid json",
+			name:          "edge case, invalid json",
+			secretId:      "testSecret",
+			result:        `{""someKey": "g1, g2"}`,
+			expectedError: true,
+		},
+		{
+			name:           "array",
 			secretId:       "testSecret",
-			result:         `{""someKey": "g1, g2"}`,
-			expectedOutput: "",
-			expectedError:  true,
+			result:         `["g1", "/log/group1/*"]`,
+			expectedOutput: &customLogGroupsSpec{include: []customLogGroup{{LogGroup: "g1"}, {LogGroup: "/log/group1/*"}}, exclude: []string{}},
+		},
+		{
+			name:     "array with options",
+			secretId: "testSecret",
+			result:   `{"logzioCustomLogGroups": ["g1", {"logGroup": "g2", "filterPattern": "ERROR", "destination": "security"}]}`,
+			expectedOutput: &customLogGroupsSpec{
+				include: []customLogGroup{{LogGroup: "g1"}, {LogGroup: "g2", FilterPattern: &errorPattern, Destination: "security"}},
+				exclude: []string{},
+			},
+		},
+		{
+			name:     "include and exclude",
+			secretId: "testSecret",
+			result:   `{"logzioCustomLogGroups": {"include": ["/log/group1/*"], "exclude": ["/log/group1/debug*"]}}`,
+			expectedOutput: &customLogGroupsSpec{
+				include: []customLogGroup{{LogGroup: "/log/group1/*"}},
+				exclude: []string{"/log/group1/debug*"},
+			},
+		},
+		{
+			name:          "unknown key of include and exclude",
+			secretId:      "testSecret",
+			result:        `{"logzioCustomLogGroups": {"includes": ["g1"]}}`,
+			expectedError: true,
+		},
+		{
+			name:          "unknown option",
+			secretId:      "testSecret",
+			result:        `[{"logGroup": "g1", "pattern": "ERROR"}]`,
+			expectedError: true,
+		},
+		{
+			name:          "unknown destination",
+			secretId:      "testSecret",
+			result:        `[{"logGroup": "g1", "destination": "other"}]`,
+			expectedError: true,
+		},
+		{
+			name:          "missing log group name",
+			secretId:      "testSecret",
+			result:        `[{"filterPattern": "ERROR"}]`,
+			expectedError: true,
+		},
+		{
+			name:          "wildcard in the middle",
+			secretId:      "testSecret",
+			result:        `{"logzioCustomLogGroups": {"include": ["g1"], "exclude": ["/log/*/debug"]}}`,
+			expectedError: true,
+		},
+		{
+			name:          "duplicate log group",
+			secretId:      "testSecret",
+			result:        `["g1", {"logGroup": "g1", "filterPattern": "ERROR"}]`,
+			expectedError: true,
+		},
+		{
+			name:          "number",
+			secretId:      "testSecret",
+			result:        `{"logzioCustomLogGroups": 5}`,
+			expectedError: true,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			result, err := extractCustomGroupsFromSecret(test.secretId, test.result)
+			result, err := parseCustomLogGroupsSecret(test.secretId, test.result, destinations)
 			assert.Equal(t, test.expectedOutput, result)
 			if test.expectedError {
 				assert.NotNil(t, err)
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// accountRegion is an account and a region which the function manages subscription filters in
+type accountRegion struct {
+	account string
+	region  string
+}
+
+// newLogGroupsBatch is the new log groups of the CreateLogGroup events of an SQS batch, by the account and region
+// they were created in, along with the messages of every log group
+type newLogGroupsBatch struct {
+	targets   []accountRegion
+	logGroups map[accountRegion][]string
+	messages  map[accountRegion]map[string][]string
+}
+
+// HandleInvocation handles an invocation of the function, which is an SQS batch of EventBridge events when the events
+// are buffered in a queue, or a single event otherwise
+func HandleInvocation(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var batch events.SQSEvent
+	if err := json.Unmarshal(payload, &batch); err == nil && isSQSBatch(batch) {
+		return HandleSQSEvent(ctx, batch)
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return Result{}, fmt.Errorf("invalid event: %v", err)
+	}
+	return HandleRequest(ctx, event)
+}
+
+// isSQSBatch checks if the invocation is a batch of SQS messages
+func isSQSBatch(batch events.SQSEvent) bool {
+	return len(batch.Records) > 0 && batch.Records[0].EventSource == sqsEventSource
+}
+
+// HandleSQSEvent handles a batch of EventBridge events which were buffered in an SQS queue. The new log groups of the
+// CreateLogGroup events are subscribed together, and the other events are handled one by one. The messages which
+// failed are reported, so only they are retried.
+func HandleSQSEvent(ctx context.Context, batch events.SQSEvent) (events.SQSEventResponse, error) {
+	if err := setupHandler(ctx); err != nil {
+		return events.SQSEventResponse{}, err
+	}
+	return handleSQSBatch(ctx, batch), nil
+}
+
+// handleSQSBatch handles the messages of an SQS batch, and returns the messages which failed
+func handleSQSBatch(ctx context.Context, batch events.SQSEvent) events.SQSEventResponse {
+	sugLog.Infof("Starting handling batch of %d messages...", len(batch.Records))
+
+	response := events.SQSEventResponse{BatchItemFailures: make([]events.SQSBatchItemFailure, 0)}
+	failMessages := func(messageIds ...string) {
+		for _, messageId := range messageIds {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: messageId})
+		}
+	}
+
+	newLogGroups := &newLogGroupsBatch{
+		logGroups: make(map[accountRegion][]string),
+		messages:  make(map[accountRegion]map[string][]string),
+	}
+	for _, message := range batch.Records {
+		var event Event
+		if err := json.Unmarshal([]byte(message.Body), &event); err != nil {
+			sugLog.Errorf("Invalid event in message %s: %v", message.MessageId, err)
+			failMessages(message.MessageId)
+			continue
+		}
+
+		coalesced, err := newLogGroups.add(ctx, event, message.MessageId)
+		if err != nil {
+			sugLog.Errorf("Failed to handle message %s: %v", message.MessageId, err)
+			failMessages(message.MessageId)
+			continue
+		}
+		if coalesced {
+			continue
+		}
+
+		if _, err = handleEvent(ctx, event); err != nil {
+			sugLog.Errorf("Failed to handle message %s: %v", message.MessageId, err)
+			failMessages(message.MessageId)
+		}
+	}
+
+	for _, t := range newLogGroups.targets {
+		logGroups := newLogGroups.logGroups[t]
+		cwClient, err := getCloudWatchLogsClientFor(t.account, t.region)
+		if err != nil {
+			sugLog.Errorf("Failed to get CloudWatch Logs client of account %s and region %s: %v", t.account, t.region, err)
+			failMessages(newLogGroups.messagesOf(t, logGroups)...)
+			continue
+		}
+		failMessages(newLogGroups.messagesOf(t, addNewLogGroups(ctx, cwClient, logGroups))...)
+	}
+
+	sugLog.Infof("Handled batch of %d messages with %d failed messages", len(batch.Records), len(response.BatchItemFailures))
+	return response
+}
+
+// add adds the log group of a CreateLogGroup event to the batch, and returns false for the other events, which should
+// be handled on their own. Log groups which are skipped, such as excluded ones, are treated as added.
+func (b *newLogGroupsBatch) add(ctx context.Context, event Event, messageId string) (bool, error) {
+	typed, err := parseEvent(event)
+	if err != nil {
+		return false, err
+	}
+	created, ok := typed.(createLogGroupEvent)
+	if !ok || envConfig.mode == modeAccountPolicy {
+		return false, nil
+	}
+
+	if _, skipped, err := skipUnmanagedTarget(ctx, event, created.name()); err != nil || skipped {
+		return true, err
+	}
+
+	t := accountRegion{account: event.Account, region: event.Region}
+	logGroup := created.LogGroupName
+	if envConfig.isThisAccount(t.account) && envConfig.isThisRegion(t.region) && logGroup == envConfig.thisFunctionLogGroup {
+		return true, nil
+	}
+	if !isMonitoredLogGroup(logGroup) {
+		sugLog.Debug("Log group is not of a monitored service or custom prefix, skipping: ", logGroup)
+		return true, nil
+	}
+	customLogGroups, err := envConfig.customLogGroups()
+	if err != nil {
+		return true, fmt.Errorf("failed to get the options of the custom log groups: %w", err)
+	}
+	if customLogGroups.excludes(logGroup) {
+		sugLog.Debugf("Log group %s is excluded, skipping", logGroup)
+		return true, nil
+	}
+
+	if _, ok = b.messages[t]; !ok {
+		b.targets = append(b.targets, t)
+		b.messages[t] = make(map[string][]string)
+	}
+	if _, ok = b.messages[t][logGroup]; !ok {
+		b.logGroups[t] = append(b.logGroups[t], logGroup)
+	}
+	b.messages[t][logGroup] = append(b.messages[t][logGroup], messageId)
+	return true, nil
+}
+
+// messagesOf returns the messages of the given new log groups of the account and region
+func (b *newLogGroupsBatch) messagesOf(t accountRegion, logGroups []string) []string {
+	var messageIds []string
+	for _, logGroup := range logGroups {
+		messageIds = append(messageIds, b.messages[t][logGroup]...)
+	}
+	return messageIds
+}
+
+// addNewLogGroups adds the subscription filter to the new log groups of an account and region with a single call, and
+// returns the log groups which should be retried. Log groups which failed permanently are not retried.
+func addNewLogGroups(ctx context.Context, cwClient *CloudWatchLogsClient, logGroups []string) []string {
+	changes, err := cwClient.addSubscriptionFilter(ctx, logGroups)
+	result := Result{DryRun: cwClient.dryRun}
+	result.record(changes)
+	if err = result.collectFailures(err); err != nil {
+		sugLog.Warnf("Failed to add subscription filter to some of the new log groups: %v", err)
+	}
+	if len(result.Failed) > 0 {
+		sugLog.Warnf("Failed to add subscription filter to %d new log groups: %v", len(result.Failed), result.Failed)
+	}
+	sugLog.Infof("Handled subscription filters of %d new log groups, added %d, updated %d", len(logGroups), len(result.Added), len(result.Updated))
+
+	handled := make(map[string]bool, len(changes))
+	for _, change := range changes {
+		handled[change.logGroup] = true
+	}
+	var toRetry []string
+	for _, logGroup := range logGroups {
+		if _, failed := result.Failed[logGroup]; !handled[logGroup] && !failed && logGroup != envConfig.thisFunctionLogGroup {
+			toRetry = append(toRetry, logGroup)
+		}
+	}
+	return toRetry
+}
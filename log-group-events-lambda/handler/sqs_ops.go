@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/logzio/firehose-logs/common"
+)
+
+type SQSClient struct {
+	Queue sqsiface.SQSAPI
+}
+
+// getSQSClient returns a client in the region of the given queue
+func getSQSClient(queueArn string) (*SQSClient, error) {
+	parsed, err := arn.Parse(queueArn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue ARN %s: %v", queueArn, err)
+	}
+
+	sess, err := common.GetSessionInRegion(parsed.Region)
+	if err != nil {
+		sugLog.Error("Error while creating session: ", err.Error())
+		return nil, err
+	}
+	return &SQSClient{Queue: sqs.New(sess)}, nil
+}
+
+// queueUrl returns the URL of the queue of the given ARN
+func (client *SQSClient) queueUrl(ctx context.Context, queueArn string) (string, error) {
+	parsed, err := arn.Parse(queueArn)
+	if err != nil {
+		return emptyString, fmt.Errorf("invalid queue ARN %s: %v", queueArn, err)
+	}
+
+	output, err := client.Queue.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName:              aws.String(parsed.Resource),
+		QueueOwnerAWSAccountId: aws.String(parsed.AccountID),
+	})
+	if err != nil {
+		return emptyString, fmt.Errorf("failed to get the URL of queue %s: %w", queueArn, err)
+	}
+	return aws.StringValue(output.QueueUrl), nil
+}
+
+// receiveMessages receives the next batch of messages of the queue, which are hidden from other receivers for the
+// given visibility timeout. It returns no messages once the queue is empty.
+func (client *SQSClient) receiveMessages(ctx context.Context, queueUrl string, visibilityTimeout int64) ([]*sqs.Message, error) {
+	output, err := client.Queue.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueUrl),
+		MaxNumberOfMessages: aws.Int64(maxReceivedMessages),
+		VisibilityTimeout:   aws.Int64(visibilityTimeout),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive messages of queue %s: %w", queueUrl, err)
+	}
+	return output.Messages, nil
+}
+
+// deleteMessage deletes a message which was handled from the queue
+func (client *SQSClient) deleteMessage(ctx context.Context, queueUrl string, message *sqs.Message) error {
+	_, err := client.Queue.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueUrl),
+		ReceiptHandle: message.ReceiptHandle,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete message %s: %w", aws.StringValue(message.MessageId), err)
+	}
+	return nil
+}
+
+// releaseMessage makes a received message visible to other receivers right away
+func (client *SQSClient) releaseMessage(ctx context.Context, queueUrl string, message *sqs.Message) error {
+	_, err := client.Queue.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueUrl),
+		ReceiptHandle:     message.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release message %s: %w", aws.StringValue(message.MessageId), err)
+	}
+	return nil
+}
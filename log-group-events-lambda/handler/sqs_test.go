@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/logzio/firehose-logs/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// createLogGroupMessage returns an SQS message of a CreateLogGroup event of the given account
+func createLogGroupMessage(messageId, account, logGroup string) events.SQSMessage {
+	body, _ := json.Marshal(map[string]interface{}{
+		"source":      "aws.logs",
+		"detail-type": cloudTrailApiCallDetailType,
+		"account":     account,
+		"detail": map[string]interface{}{
+			"eventName":         "CreateLogGroup",
+			"requestParameters": map[string]string{"logGroupName": logGroup},
+		},
+	})
+	return events.SQSMessage{MessageId: messageId, EventSource: sqsEventSource, Body: string(body)}
+}
+
+func TestIsSQSBatch(t *testing.T) {
+	assert.True(t, isSQSBatch(events.SQSEvent{Records: []events.SQSMessage{{EventSource: sqsEventSource}}}))
+	assert.False(t, isSQSBatch(events.SQSEvent{}))
+	assert.False(t, isSQSBatch(events.SQSEvent{Records: []events.SQSMessage{{EventSource: "aws:kinesis"}}}))
+}
+
+func TestHandleSQSEvent(t *testing.T) {
+	ctx := setupHandlerTest()
+	defer setupSFTest()
+	t.Setenv(common.EnvServices, emptyString)
+
+	batch := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "invalid-json", EventSource: sqsEventSource, Body: "not an event"},
+		{MessageId: "unsupported-event", EventSource: sqsEventSource, Body: `{"source": "aws.s3", "detail-type": "Object Created", "detail": {}}`},
+		{MessageId: "missing-log-group", EventSource: sqsEventSource, Body: `{"source": "aws.logs", "detail-type": "AWS API Call via CloudTrail", "detail": {"eventName": "CreateLogGroup", "requestParameters": {}}}`},
+		createLogGroupMessage("not-monitored", emptyString, "/aws/lambda/function1"),
+		createLogGroupMessage("not-managed-account", "999999999999", "/aws/lambda/function1"),
+	}}
+
+	response, err := HandleSQSEvent(ctx, batch)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []events.SQSBatchItemFailure{
+		{ItemIdentifier: "invalid-json"},
+		{ItemIdentifier: "unsupported-event"},
+		{ItemIdentifier: "missing-log-group"},
+	}, response.BatchItemFailures)
+}
+
+func TestHandleSQSBatchWithExcludedLogGroups(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.servicesValue = "lambda"
+	envConfig.customLogGroupsSpec = &customLogGroupsSpec{exclude: []string{"/aws/lambda/noisy*"}}
+
+	batch := events.SQSEvent{Records: []events.SQSMessage{
+		createLogGroupMessage("excluded", emptyString, "/aws/lambda/noisy-function"),
+		createLogGroupMessage("excluded-again", emptyString, "/aws/lambda/noisy-function"),
+		createLogGroupMessage("not-monitored", emptyString, "/aws/rds/instance1"),
+	}}
+
+	response := handleSQSBatch(context.Background(), batch)
+
+	assert.Empty(t, response.BatchItemFailures)
+}
+
+func TestNewLogGroupsBatchAdd(t *testing.T) {
+	setupSFTest()
+	defer setupSFTest()
+	envConfig.servicesValue = "lambda"
+	envConfig.memberAccounts = []string{"111111111111"}
+
+	batch := &newLogGroupsBatch{
+		logGroups: make(map[accountRegion][]string),
+		messages:  make(map[accountRegion]map[string][]string),
+	}
+	for _, message := range []events.SQSMessage{
+		createLogGroupMessage("1", emptyString, "/aws/lambda/function1"),
+		createLogGroupMessage("2", emptyString, "/aws/lambda/function2"),
+		createLogGroupMessage("3", emptyString, "/aws/lambda/function1"),
+		createLogGroupMessage("4", "111111111111", "/aws/lambda/function1"),
+		createLogGroupMessage("5", emptyString, "/aws/rds/instance1"),
+	} {
+		var event Event
+		assert.Nil(t, json.Unmarshal([]byte(message.Body), &event))
+		coalesced, err := batch.add(context.Background(), event, message.MessageId)
+		assert.Nil(t, err)
+		assert.True(t, coalesced)
+	}
+
+	coalesced, err := batch.add(context.Background(), Event{Detail: json.RawMessage(`{"eventName": "SubscriptionFilterEvent", "requestParameters": {"Action": "add"}}`)}, "6")
+	assert.Nil(t, err)
+	assert.False(t, coalesced)
+
+	thisTarget := accountRegion{}
+	memberTarget := accountRegion{account: "111111111111"}
+	assert.Equal(t, []accountRegion{thisTarget, memberTarget}, batch.targets)
+	assert.Equal(t, []string{"/aws/lambda/function1", "/aws/lambda/function2"}, batch.logGroups[thisTarget])
+	assert.Equal(t, []string{"/aws/lambda/function1"}, batch.logGroups[memberTarget])
+	assert.Equal(t, []string{"1", "3", "2"}, batch.messagesOf(thisTarget, batch.logGroups[thisTarget]))
+	assert.Equal(t, []string{"4"}, batch.messagesOf(memberTarget, batch.logGroups[memberTarget]))
+}
+
+func TestAddNewLogGroups(t *testing.T) {
+	setupSFTest()
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name            string
+		ctx             context.Context
+		logGroups       []string
+		expectedToRetry []string
+	}{
+		{
+			name:      "all successful",
+			ctx:       context.Background(),
+			logGroups: []string{"group1", "group2", "unchangedGroup"},
+		},
+		{
+			name:      "permanent failure is not retried",
+			ctx:       context.Background(),
+			logGroups: []string{"group1", "errorGroup"},
+		},
+		{
+			name:            "out of time",
+			ctx:             canceledCtx,
+			logGroups:       []string{"group1", "group2"},
+			expectedToRetry: []string{"group1", "group2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockClient := new(MockCloudWatchLogsClient)
+			mockClient.On("PutSubscriptionFilter", mock.MatchedBy(func(input *cloudwatchlogs.PutSubscriptionFilterInput) bool {
+				return *input.LogGroupName == "errorGroup"
+			})).Return(nil, fmt.Errorf("an error occurred"))
+			mockClient.On("PutSubscriptionFilter", mock.Anything).Return(&cloudwatchlogs.PutSubscriptionFilterOutput{}, nil)
+
+			toRetry := addNewLogGroups(test.ctx, &CloudWatchLogsClient{Client: mockClient}, test.logGroups)
+
+			assert.ElementsMatch(t, test.expectedToRetry, toRetry)
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/logzio/firehose-logs/common"
+)
+
+// SSMClient is a client for AWS Systems Manager API
+type SSMClient struct {
+	Client ssmiface.SSMAPI
+}
+
+// getSSMClient returns a client for AWS Systems Manager API
+func getSSMClient() (*SSMClient, error) {
+	sess, err := common.GetSession()
+	if err != nil {
+		sugLog.Error("Error while creating session: ", err.Error())
+		return nil, err
+	}
+	return &SSMClient{Client: ssm.New(sess)}, nil
+}
+
+// parameterVersion is a version of the custom log groups parameter
+type parameterVersion struct {
+	version int64
+	// label is the label which the version was found by, it's empty for the current version and a version which was
+	// found by its number
+	label           string
+	customLogGroups *customLogGroupsSpec
+}
+
+// getCustomLogGroupsSpecFromParameter returns the custom log groups in the current value of the parameter along with
+// their options and the excluded log groups
+func getCustomLogGroupsSpecFromParameter(ctx context.Context, parameterArn string) (*customLogGroupsSpec, error) {
+	name, err := parameterNameFromArn(parameterArn)
+	if err != nil {
+		return nil, err
+	}
+	ssmClient, err := getSSMClient()
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := ssmClient.getParameterVersion(ctx, parameterArn, name, emptyString)
+	if err != nil {
+		sugLog.Error("Error while extracting custom log groups from parameter: ", err.Error())
+		return nil, err
+	}
+	if current == nil {
+		return nil, fmt.Errorf("parameter %s doesn't exist", parameterArn)
+	}
+	return current.customLogGroups, nil
+}
+
+// updateParameterCustomLogGroups updates the custom log groups to monitor based on comparing the value of the
+// parameter which was applied last to its current value (helper of handleParameterChangedEvent). The current version
+// is labeled as applied once the subscription filters of every target were updated.
+func updateParameterCustomLogGroups(ctx context.Context, ssmClient *SSMClient, eventName, parameterArn string) (Result, error) {
+	name, err := parameterNameFromArn(parameterArn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	current, err := ssmClient.getParameterVersion(ctx, parameterArn, name, emptyString)
+	if err != nil {
+		sugLog.Error("Failed to get the new custom log groups from parameter")
+		return Result{}, err
+	}
+	if current == nil {
+		return Result{}, fmt.Errorf("parameter %s doesn't exist", parameterArn)
+	}
+
+	lastApplied, err := ssmClient.getLastAppliedParameterVersion(ctx, parameterArn, name, current)
+	if err != nil {
+		sugLog.Error("Failed to get the last applied custom log groups parameter version's value.")
+		return Result{}, err
+	}
+	if lastApplied != nil && lastApplied.label == parameterAppliedLabel && lastApplied.version == current.version {
+		sugLog.Debugf("Version %d of parameter %s was applied already, skipping", current.version, name)
+		return Result{Message: fmt.Sprintf("%s event skipped - the current version was applied already", eventName)}, nil
+	}
+
+	var oldCustomLogGroups *customLogGroupsSpec
+	if lastApplied != nil {
+		oldCustomLogGroups = lastApplied.customLogGroups
+	}
+	// the subscription filters are put with the options of the current version
+	envConfig.customLogGroupsSpec = current.customLogGroups
+	appliedVersion := &common.AppliedVersion{ParameterName: name, ParameterVersion: current.version}
+	return applyCustomLogGroupsVersion(ctx, customLogGroupsDiffJob(oldCustomLogGroups, current.customLogGroups), appliedVersion)
+}
+
+// isCustomLogGroupsParameter checks if the parameter name of an event refers to the configured parameter of the
+// custom log groups. The parameter is referred to by its name, with or without the leading slash of a hierarchy, or by
+// its ARN.
+func isCustomLogGroupsParameter(parameterName string) bool {
+	parameterArn := envConfig.customGroupsValue
+	if parameterName == parameterArn {
+		return true
+	}
+
+	name, err := parameterNameFromArn(parameterArn)
+	if err != nil {
+		sugLog.Debugf("Failed to get the parameter name from ARN %s: %v", parameterArn, err)
+		return false
+	}
+	return strings.TrimPrefix(parameterName, "/") == strings.TrimPrefix(name, "/")
+}
+
+// getParameterVersion returns the version of the parameter with the given selector, which is either a label or a
+// version number, or its current version when the selector is empty. It's nil when there is no such version.
+func (ssmClient *SSMClient) getParameterVersion(ctx context.Context, parameterArn, name, selector string) (*parameterVersion, error) {
+	selected := name
+	if selector != emptyString {
+		selected = name + ":" + selector
+	}
+
+	output, err := ssmClient.Client.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(selected),
+		WithDecryption: aws.Bool(true),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && (awsErr.Code() == ssm.ErrCodeParameterNotFound || awsErr.Code() == ssm.ErrCodeParameterVersionNotFound) {
+		sugLog.Debugf("Parameter %s doesn't have a version %s", name, selector)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parameter %s: %w", selected, err)
+	}
+
+	parameter := output.Parameter
+	customLogGroups, err := parseCustomLogGroupsParameter(parameterArn, aws.StringValue(parameter.Type), aws.StringValue(parameter.Value), envConfig.destinations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter %s: %w", selected, err)
+	}
+
+	version := &parameterVersion{version: aws.Int64Value(parameter.Version), customLogGroups: customLogGroups}
+	if _, err := strconv.ParseInt(selector, 10, 64); err != nil {
+		version.label = selector
+	}
+	return version, nil
+}
+
+// getLastAppliedParameterVersion returns the version of the parameter whose custom log groups were applied last. It
+// falls back to the version before the current one before any version was applied, and it's nil when there is neither.
+func (ssmClient *SSMClient) getLastAppliedParameterVersion(ctx context.Context, parameterArn, name string, current *parameterVersion) (*parameterVersion, error) {
+	lastApplied, err := ssmClient.getParameterVersion(ctx, parameterArn, name, parameterAppliedLabel)
+	if err != nil || lastApplied != nil {
+		return lastApplied, err
+	}
+	if current.version <= 1 {
+		return nil, nil
+	}
+	return ssmClient.getParameterVersion(ctx, parameterArn, name, strconv.FormatInt(current.version-1, 10))
+}
+
+// markApplied moves the applied label of the parameter to the given version, once the result of applying it is
+// complete. A version which continued in another invocation, or whose log groups or targets failed, is not labeled. A
+// failure is only logged, since the next change of the parameter is then compared to an older version, whose changes
+// were applied already.
+func (ssmClient *SSMClient) markApplied(ctx context.Context, version *common.AppliedVersion, result Result) {
+	name := version.ParameterName
+	if envConfig.dryRun || result.DryRun {
+		sugLog.Debugf("Dry run, not labeling version %d of parameter %s as applied", version.ParameterVersion, name)
+		return
+	}
+	if !result.complete() {
+		sugLog.Warnf("Not labeling version %d of parameter %s as applied, since its changes were not fully applied", version.ParameterVersion, name)
+		return
+	}
+
+	output, err := ssmClient.Client.LabelParameterVersionWithContext(ctx, &ssm.LabelParameterVersionInput{
+		Name:             aws.String(name),
+		ParameterVersion: aws.Int64(version.ParameterVersion),
+		Labels:           aws.StringSlice([]string{parameterAppliedLabel}),
+	})
+	if err == nil && len(output.InvalidLabels) > 0 {
+		err = fmt.Errorf("invalid labels %v", aws.StringValueSlice(output.InvalidLabels))
+	}
+	if err != nil {
+		sugLog.Warnf("Failed to label version %d of parameter %s as applied: %v", version.ParameterVersion, name, err)
+	}
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/logzio/firehose-logs/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testParameterArn = "arn:aws:ssm:us-east-1:486140753397:parameter/logzio/custom-groups"
+
+type mockSSMClient struct {
+	mock.Mock
+	ssmiface.SSMAPI
+}
+
+func (m *mockSSMClient) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	args := m.Called(aws.StringValue(input.Name))
+	return args.Get(0).(*ssm.GetParameterOutput), args.Error(1)
+}
+
+func (m *mockSSMClient) GetParameterWithContext(ctx aws.Context, input *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, error) {
+	return m.GetParameter(input)
+}
+
+func (m *mockSSMClient) LabelParameterVersion(input *ssm.LabelParameterVersionInput) (*ssm.LabelParameterVersionOutput, error) {
+	args := m.Called(input)
+	return &ssm.LabelParameterVersionOutput{}, args.Error(0)
+}
+
+func (m *mockSSMClient) LabelParameterVersionWithContext(ctx aws.Context, input *ssm.LabelParameterVersionInput, opts ...request.Option) (*ssm.LabelParameterVersionOutput, error) {
+	return m.LabelParameterVersion(input)
+}
+
+// parameterOutput returns the output of GetParameter of a version of the custom log groups parameter
+func parameterOutput(version int64, customLogGroups string) *ssm.GetParameterOutput {
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{
+		Type:    aws.String("StringList"),
+		Value:   aws.String(customLogGroups),
+		Version: aws.Int64(version),
+	}}
+}
+
+// setupParameterTest sets the custom log groups parameter in the account and region of the function
+func setupParameterTest() {
+	setupSFTest()
+	envConfig.awsPartition = "aws"
+	envConfig.region = "us-east-1"
+	envConfig.accountId = "486140753397"
+	envConfig.customGroupsValue = testParameterArn
+}
+
+func TestIsCustomLogGroupsParameter(t *testing.T) {
+	setupParameterTest()
+	defer setupSFTest()
+
+	assert.True(t, isCustomLogGroupsParameter("/logzio/custom-groups"))
+	assert.True(t, isCustomLogGroupsParameter("logzio/custom-groups"))
+	assert.True(t, isCustomLogGroupsParameter(testParameterArn))
+	assert.False(t, isCustomLogGroupsParameter("/logzio/custom-groups-old"))
+	assert.False(t, isCustomLogGroupsParameter("custom-groups"))
+}
+
+func TestParameterChangedEventSkipped(t *testing.T) {
+	setupParameterTest()
+	defer setupSFTest()
+	envConfig.secretEnabled = false
+
+	result, err := parameterChangedEvent{Name: "/other/parameter"}.handle(context.Background(), emptyString, emptyString)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "PutParameter event skipped - not the custom log groups parameter", result.Message)
+}
+
+func TestGetLastAppliedParameterVersion(t *testing.T) {
+	setupParameterTest()
+	defer setupSFTest()
+	notFound := awserr.New(ssm.ErrCodeParameterVersionNotFound, "version not found", nil)
+	name := "/logzio/custom-groups"
+
+	tests := []struct {
+		name            string
+		currentVersion  int64
+		appliedVersion  *ssm.GetParameterOutput
+		appliedError    error
+		previousVersion *ssm.GetParameterOutput
+		expectedVersion *parameterVersion
+		expectedError   bool
+	}{
+		{
+			name:            "applied version",
+			currentVersion:  3,
+			appliedVersion:  parameterOutput(1, "g1,g2"),
+			expectedVersion: &parameterVersion{version: 1, label: parameterAppliedLabel, customLogGroups: newCustomLogGroupsSpec([]string{"g1", "g2"})},
+		},
+		{
+			name:            "previous version before any version was applied",
+			currentVersion:  3,
+			appliedError:    notFound,
+			previousVersion: parameterOutput(2, "g1"),
+			expectedVersion: &parameterVersion{version: 2, customLogGroups: newCustomLogGroupsSpec([]string{"g1"})},
+		},
+		{
+			name:           "first version",
+			currentVersion: 1,
+			appliedError:   notFound,
+		},
+		{
+			name:           "failed getting the applied version",
+			currentVersion: 3,
+			appliedError:   fmt.Errorf("an error occurred"),
+			expectedError:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockClient := new(mockSSMClient)
+			mockClient.On("GetParameter", name+":"+parameterAppliedLabel).Return(test.appliedVersion, test.appliedError)
+			mockClient.On("GetParameter", name+":2").Return(test.previousVersion, nil)
+			ssmClient := &SSMClient{Client: mockClient}
+
+			version, err := ssmClient.getLastAppliedParameterVersion(context.Background(), testParameterArn, name, &parameterVersion{version: test.currentVersion})
+
+			if test.expectedError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedVersion, version)
+			}
+		})
+	}
+}
+
+func TestParameterMarkApplied(t *testing.T) {
+	setupParameterTest()
+	defer setupSFTest()
+	name := "/logzio/custom-groups"
+	expectedInput := &ssm.LabelParameterVersionInput{
+		Name:             aws.String(name),
+		ParameterVersion: aws.Int64(3),
+		Labels:           aws.StringSlice([]string{parameterAppliedLabel}),
+	}
+
+	tests := []struct {
+		name          string
+		result        Result
+		dryRun        bool
+		labelError    error
+		expectedCalls int
+	}{
+		{name: "label the version", expectedCalls: 1},
+		{name: "failed labeling the version", labelError: fmt.Errorf("an error occurred"), expectedCalls: 1},
+		{name: "dry run", dryRun: true},
+		{name: "continued in another invocation", result: Result{Added: []string{"group1"}, Continued: true}},
+		{name: "failed log groups", result: Result{Failed: map[string]string{"group2": "access denied"}}},
+		{
+			name:   "failed target",
+			result: Result{Accounts: map[string]*Result{"111111111111": {Error: "failed to assume role"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envConfig.dryRun = test.dryRun
+			defer func() { envConfig.dryRun = false }()
+			mockClient := new(mockSSMClient)
+			mockClient.On("LabelParameterVersion", expectedInput).Return(test.labelError)
+			ssmClient := &SSMClient{Client: mockClient}
+
+			ssmClient.markApplied(context.Background(), &common.AppliedVersion{ParameterName: name, ParameterVersion: 3}, test.result)
+
+			mockClient.AssertNumberOfCalls(t, "LabelParameterVersion", test.expectedCalls)
+		})
+	}
+}
+
+func TestParameterMarkAppliedAfterTargetContinues(t *testing.T) {
+	setupParameterTest()
+	defer setupSFTest()
+	envConfig.regions = []string{"us-west-2"}
+	name := "/logzio/custom-groups"
+	j := &job{action: common.AddSF, logGroupsToAdd: []string{"group1", "group2"}, canContinue: true, appliedVersion: &common.AppliedVersion{ParameterName: name, ParameterVersion: 3}}
+
+	// the target runs out of time in the first invocation, which leaves labeling the version to the fan out
+	targetJob := j.forTarget(emptyString, "us-west-2")
+	assert.False(t, targetJob.marksAppliedVersion())
+	targetJob.logGroupsToAdd, targetJob.result = []string{"group2"}, Result{Added: []string{"group1"}}
+
+	// the target finishes in its continuation, which labels the version
+	continued := continuedJob(t, targetJob)
+	assert.True(t, continued.marksAppliedVersion())
+	continued.logGroupsToAdd = nil
+	continued.result.Added = append(continued.result.Added, "group2")
+
+	mockClient := new(mockSSMClient)
+	mockClient.On("LabelParameterVersion", &ssm.LabelParameterVersionInput{
+		Name:             aws.String(name),
+		ParameterVersion: aws.Int64(3),
+		Labels:           aws.StringSlice([]string{parameterAppliedLabel}),
+	}).Return(nil)
+	(&SSMClient{Client: mockClient}).markApplied(context.Background(), continued.appliedVersion, continued.result)
+
+	mockClient.AssertNumberOfCalls(t, "LabelParameterVersion", 1)
+}
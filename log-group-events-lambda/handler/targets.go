@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/hashicorp/go-multierror"
+	"github.com/logzio/firehose-logs/common"
+)
+
+// getCloudWatchLogsClientFor returns a client of the log groups of the given account and region, where an empty
+// account or region is the one of the function. The client of a member account uses the member role of the account.
+func getCloudWatchLogsClientFor(account, region string) (*CloudWatchLogsClient, error) {
+	if !envConfig.isManagedAccount(account) {
+		return nil, fmt.Errorf("account %s is not a member account", account)
+	}
+	if !envConfig.isManagedRegion(region) {
+		return nil, fmt.Errorf("region %s is not a managed region", region)
+	}
+	if envConfig.isThisAccount(account) && envConfig.isThisRegion(region) {
+		return getCloudWatchLogsClient()
+	}
+
+	// the client of this account or region keeps them empty, so they default to the ones of the function
+	if envConfig.isThisAccount(account) {
+		account = emptyString
+	}
+	if envConfig.isThisRegion(region) {
+		region = emptyString
+	}
+	sessionRegion := region
+	if sessionRegion == emptyString {
+		sessionRegion = envConfig.region
+	}
+
+	var sess *session.Session
+	var err error
+	if account == emptyString {
+		sess, err = common.GetSessionInRegion(sessionRegion)
+	} else {
+		sess, err = common.GetSessionWithRole(sessionRegion, envConfig.memberRoleArn(account), envConfig.memberExternalId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newCloudWatchLogsClient(sess, account, region), nil
+}
+
+// forTarget returns a copy of the job which wasn't started yet, to run in the given account and region
+func (j *job) forTarget(account, region string) *job {
+	return &job{
+		action:            j.action,
+		account:           account,
+		region:            region,
+		logGroupsToAdd:    slices.Clone(j.logGroupsToAdd),
+		logGroupsToRemove: slices.Clone(j.logGroupsToRemove),
+		prefixesToAdd:     slices.Clone(j.prefixesToAdd),
+		prefixesToRemove:  slices.Clone(j.prefixesToRemove),
+		dryRun:            j.dryRun,
+		canContinue:       j.canContinue,
+		monitored:         j.monitored,
+		appliedVersion:    j.appliedVersion,
+	}
+}
+
+// fansOut checks if the jobs run in other regions or member accounts, besides the account and region of the function
+func (c *Config) fansOut() bool {
+	return len(c.regions) > 0 || len(c.memberAccounts) > 0
+}
+
+// fanOutJob executes the job in the account and region of the function, and concurrently in every other managed
+// region and member account
+func fanOutJob(ctx context.Context, j *job) (Result, error) {
+	if err := ensureMemberAccounts(ctx); err != nil {
+		return Result{}, err
+	}
+
+	// the copies are made before the job starts, so each of them has all of its work
+	jobs := []*job{j}
+	for _, region := range envConfig.regions {
+		jobs = append(jobs, j.forTarget(emptyString, region))
+	}
+	for _, account := range envConfig.memberAccounts {
+		jobs = append(jobs, accountJobs(j, account)...)
+	}
+	return executeTargetJobs(ctx, jobs)
+}
+
+// fanOutJobToAccount executes a copy of the job concurrently in every managed region of the member account
+func fanOutJobToAccount(ctx context.Context, j *job, account string) (Result, error) {
+	return executeTargetJobs(ctx, accountJobs(j, account))
+}
+
+// accountJobs returns a copy of the job for every managed region of the member account
+func accountJobs(j *job, account string) []*job {
+	regions := append([]string{emptyString}, envConfig.regions...)
+	jobs := make([]*job, 0, len(regions))
+	for _, region := range regions {
+		jobs = append(jobs, j.forTarget(account, region))
+	}
+	return jobs
+}
+
+// targetOutcome is the result and the error of the job of a target
+type targetOutcome struct {
+	label  string
+	result Result
+	err    error
+}
+
+// executeTargetJobs executes the jobs of the targets concurrently, up to the maximum concurrency of the function, and
+// returns their aggregated result. The error of the job of the account and region of the function fails the
+// invocation. The errors of the other targets are reported in their results rather than failing the invocation, so a
+// retry doesn't repeat the work of all of them, unless their work didn't finish.
+func executeTargetJobs(ctx context.Context, jobs []*job) (Result, error) {
+	byLabel := make(map[string]*job, len(jobs))
+	labels := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		label := targetLabel(j.account, j.region)
+		byLabel[label] = j
+		labels = append(labels, label)
+	}
+
+	pool := newWorkerPool[targetOutcome](envConfig.maxConcurrency)
+	outcomes, err := pool.run(ctx, labels, func(ctx context.Context, label string) ([]targetOutcome, error) {
+		j := byLabel[label]
+		if label != emptyString {
+			sugLog.Infof("Handling %s action in %s", j.action, label)
+		}
+		result, err := executeJob(ctx, j)
+		return []targetOutcome{{label: label, result: result, err: err}}, nil
+	})
+
+	outcomeOf := make(map[string]targetOutcome, len(labels))
+	for _, outcome := range outcomes {
+		outcomeOf[outcome.label] = outcome
+	}
+	notStarted, _ := splitPending(err)
+	for _, label := range notStarted {
+		outcomeOf[label] = targetOutcome{label: label, err: &unfinishedError{action: byLabel[label].action, reason: "wasn't started before the function deadline"}}
+	}
+
+	// the result of the account and region of the function is added first, since it replaces the aggregated result
+	var result Result
+	var errs *multierror.Error
+	for _, label := range labels {
+		j, outcome := byLabel[label], outcomeOf[label]
+		if label == emptyString {
+			result.addTarget(j.account, j.region, outcome.result)
+			errs = multierror.Append(errs, outcome.err)
+			continue
+		}
+
+		var unfinished *unfinishedError
+		if outcome.err != nil {
+			sugLog.Errorf("Failed to handle %s action in %s: %v", j.action, label, outcome.err)
+			outcome.result.Error = outcome.err.Error()
+			if errors.As(outcome.err, &unfinished) {
+				errs = multierror.Append(errs, fmt.Errorf("%s: %w", label, outcome.err))
+			}
+		}
+		result.addTarget(j.account, j.region, outcome.result)
+	}
+	return result, errs.ErrorOrNil()
+}
+
+// executeTargetJob executes the job of a member account or of another region, and records its error in the result
+func executeTargetJob(ctx context.Context, j *job) Result {
+	target := targetLabel(j.account, j.region)
+	sugLog.Infof("Handling %s action in %s", j.action, target)
+	result, err := executeJob(ctx, j)
+	if err != nil {
+		sugLog.Errorf("Failed to handle %s action in %s: %v", j.action, target, err)
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// targetLabel returns the label of the account and region in the result, where this account and region are omitted
+func targetLabel(account, region string) string {
+	if envConfig.isThisAccount(account) {
+		account = emptyString
+	}
+	if envConfig.isThisRegion(region) {
+		region = emptyString
+	}
+	switch {
+	case account == emptyString:
+		return region
+	case region == emptyString:
+		return account
+	default:
+		return account + targetSeparator + region
+	}
+}
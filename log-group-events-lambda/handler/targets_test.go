@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/logzio/firehose-logs/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCloudWatchLogsClientFor(t *testing.T) {
+	setupSFTest()
+	envConfig.region = "us-east-1"
+	envConfig.regions = []string{"us-west-2"}
+	envConfig.memberAccounts = []string{"111111111111"}
+	envConfig.memberRoleName = "member-role"
+	defer setupSFTest()
+
+	tests := []struct {
+		name              string
+		account           string
+		region            string
+		expectedAccountId string
+		expectedRegion    string
+		errorExpected     bool
+	}{
+		{
+			name:    "this account and region",
+			account: "",
+			region:  "us-east-1",
+		},
+		{
+			name:              "member account",
+			account:           "111111111111",
+			expectedAccountId: "111111111111",
+		},
+		{
+			name:           "other region",
+			region:         "us-west-2",
+			expectedRegion: "us-west-2",
+		},
+		{
+			name:              "member account in other region",
+			account:           "111111111111",
+			region:            "us-west-2",
+			expectedAccountId: "111111111111",
+			expectedRegion:    "us-west-2",
+		},
+		{
+			name:          "unmanaged account",
+			account:       "333333333333",
+			errorExpected: true,
+		},
+		{
+			name:          "unmanaged region",
+			region:        "eu-west-1",
+			errorExpected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cwClient, err := getCloudWatchLogsClientFor(test.account, test.region)
+
+			if test.errorExpected {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedAccountId, cwClient.accountId)
+				assert.Equal(t, test.expectedRegion, cwClient.region)
+			}
+		})
+	}
+}
+
+func TestJobForTarget(t *testing.T) {
+	j := &job{
+		action:         common.AddSF,
+		iteration:      3,
+		logGroupsToAdd: []string{"group1"},
+		prefixesToAdd:  []common.PrefixCursor{{Prefix: "/aws/lambda/"}},
+		result:         Result{Added: []string{"group0"}},
+		dryRun:         true,
+		canContinue:    true,
+		appliedVersion: &common.AppliedVersion{ParameterName: "/logzio/custom-groups", ParameterVersion: 3},
+	}
+
+	targetJob := j.forTarget("111111111111", "us-west-2")
+	j.logGroupsToAdd[0] = "changed"
+
+	assert.Equal(t, &job{
+		action:         common.AddSF,
+		account:        "111111111111",
+		region:         "us-west-2",
+		logGroupsToAdd: []string{"group1"},
+		prefixesToAdd:  []common.PrefixCursor{{Prefix: "/aws/lambda/"}},
+		dryRun:         true,
+		canContinue:    true,
+		appliedVersion: &common.AppliedVersion{ParameterName: "/logzio/custom-groups", ParameterVersion: 3},
+	}, targetJob)
+}
+
+func TestTargetLabel(t *testing.T) {
+	setupSFTest()
+	envConfig.region = "us-east-1"
+
+	assert.Equal(t, "", targetLabel("", "us-east-1"))
+	assert.Equal(t, "us-west-2", targetLabel("aws-account-id", "us-west-2"))
+	assert.Equal(t, "111111111111", targetLabel("111111111111", ""))
+	assert.Equal(t, "111111111111/us-west-2", targetLabel("111111111111", "us-west-2"))
+}
+
+func TestFanOutJobUnfinishedTargets(t *testing.T) {
+	setupSFTest()
+	envConfig.region = "us-east-1"
+	envConfig.regions = []string{"us-west-2"}
+	envConfig.memberAccounts = []string{"111111111111"}
+	envConfig.memberRoleName = "member-role"
+	defer setupSFTest()
+
+	// the deadline is within the continuation margin, so the synchronous jobs can't finish
+	nearDeadline, cancelNear := context.WithTimeout(context.Background(), time.Second)
+	defer cancelNear()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name           string
+		ctx            context.Context
+		expectedReason string
+	}{
+		{name: "deadline is near", ctx: nearDeadline, expectedReason: "delete action didn't finish before the function deadline"},
+		{name: "not started", ctx: cancelled, expectedReason: "delete action wasn't started before the function deadline"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			j := &job{action: common.DeleteSF, logGroupsToRemove: []string{"group1"}}
+
+			result, err := fanOutJob(test.ctx, j)
+
+			assert.NotNil(t, err)
+			for _, target := range []string{"us-west-2", "111111111111", "111111111111/us-west-2"} {
+				assert.ErrorContains(t, err, target+": "+test.expectedReason)
+			}
+			assert.Equal(t, []string{"111111111111", "111111111111/us-west-2", "us-west-2"}, result.failedTargets())
+			assert.Equal(t, test.expectedReason, result.Regions["us-west-2"].Error)
+		})
+	}
+}
@@ -2,49 +2,13 @@ package handler
 
 import (
 	"strings"
+
+	"github.com/logzio/firehose-logs/config"
 )
 
+// getServicesMap returns the log group name prefix of every supported service, by service name
 func getServicesMap() map[string]string {
-	return map[string]string{
-		"apigateway":       "/aws/apigateway/",
-		"apigateway-rest":  "API-Gateway-Execution-Logs*",
-		"rds":              "/aws/rds/",
-		"cloudhsm":         "/aws/cloudhsm/",
-		"codebuild":        "/aws/codebuild/",
-		"connect":          "/aws/connect/",
-		"elasticbeanstalk": "/aws/elasticbeanstalk/",
-		"ecs":              "/aws/ecs/containerinsights/",
-		"eks":              "/aws/eks/",
-		"aws-glue":         "/aws-glue/",
-		"aws-iot":          "AWSIotLogsV2",
-		"lambda":           "/aws/lambda/",
-		"vpc":              "/aws/vpc/",
-		"macie":            "/aws/macie/",
-		"amazon-mq":        "/aws/amazonmq/broker/",
-		"batch":            "/aws/batch/",
-		"athena":           "/aws-athena/",
-		"cloudfront":       "/aws/cloudfront/",
-		"codepipeline":     "/aws/codepipeline/",
-		"config":           "/aws/config/",
-		"dms":              "/aws/dms/",
-		"emr":              "/aws/elasticmapreduce/",
-		"es":               "/aws/es/",
-		"events":           "/aws/events/",
-		"firehose":         "/aws/kinesisfirehose/",
-		"fsx":              "/aws/fsx/",
-		"guardduty":        "/aws/guardduty/",
-		"inspector":        "/aws/inspector/",
-		"kafka":            "/aws/msk/",
-		"kinesis":          "/aws/kinesis/",
-		"redshift":         "/aws/redshift/",
-		"route53":          "/aws/route53/",
-		"sagemaker":        "/aws/sagemaker/",
-		"secretsmanager":   "/aws/secretsmanager/",
-		"sns":              "sns/",
-		"ssm":              "/aws/ssm/",
-		"stepfunctions":    "/aws/states/",
-		"transfer":         "/aws/transfer/",
-	}
+	return config.ServicePrefixes()
 }
 
 func convertStrToArr(s string) []string {
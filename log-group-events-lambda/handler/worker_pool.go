@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/logzio/firehose-logs/common"
+)
+
+// workerPool runs tasks over a bounded number of goroutines, and collects their outputs of type T
+type workerPool[T any] struct {
+	workers int
+}
+
+// taskResult is the outcome of a single task of the worker pool
+type taskResult[T any] struct {
+	item   string
+	output []T
+	err    error
+}
+
+// pendingError reports items which were not processed since the invocation ran out of time
+type pendingError struct {
+	items []string
+}
+
+func (e *pendingError) Error() string {
+	return fmt.Sprintf("%d items were not processed before the function deadline", len(e.items))
+}
+
+// isOutOfTimeError checks if the error was caused by the invocation running out of time
+func isOutOfTimeError(err error) bool {
+	return errors.Is(err, errNoTimeLeft) ||
+		errors.Is(err, common.ErrDeadlineNear) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled)
+}
+
+// splitPending extracts the pending items out of err, and returns them along with the rest of the errors
+func splitPending(err error) ([]string, error) {
+	if err == nil {
+		return nil, nil
+	}
+
+	var errs []error
+	var merr *multierror.Error
+	if errors.As(err, &merr) {
+		errs = merr.Errors
+	} else {
+		errs = []error{err}
+	}
+
+	var pending []string
+	var result *multierror.Error
+	for _, e := range errs {
+		var pErr *pendingError
+		if errors.As(e, &pErr) {
+			pending = append(pending, pErr.items...)
+			continue
+		}
+		result = multierror.Append(result, e)
+	}
+
+	return pending, result.ErrorOrNil()
+}
+
+// newWorkerPool returns a worker pool with the given number of workers, or with the default number if it's not positive
+func newWorkerPool[T any](workers int) *workerPool[T] {
+	if workers <= 0 {
+		workers = defaultMaxConcurrency
+	}
+	return &workerPool[T]{workers: workers}
+}
+
+// run calls task for every item, and returns the outputs of the tasks which succeeded along with the errors of the ones which failed.
+// Items which were not started before ctx is done, or which failed since the invocation ran out of time, are reported
+// as a single *pendingError.
+func (p *workerPool[T]) run(ctx context.Context, items []string, task func(ctx context.Context, item string) ([]T, error)) ([]T, error) {
+	jobs := make(chan string)
+	results := make(chan taskResult[T])
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers && i < len(items); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				// the feeder may still hand over an item after ctx is done
+				if err := ctx.Err(); err != nil {
+					results <- taskResult[T]{item: item, err: err}
+					continue
+				}
+				output, err := task(ctx, item)
+				results <- taskResult[T]{item: item, output: output, err: err}
+			}
+		}()
+	}
+
+	var notStarted []string
+	go func() {
+		defer close(jobs)
+		for i, item := range items {
+			select {
+			case <-ctx.Done():
+				notStarted = items[i:]
+				return
+			case jobs <- item:
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// results are collected by this goroutine only, so no locking is needed
+	outputs := make([]T, 0, len(items))
+	var pending []string
+	var errs *multierror.Error
+	for res := range results {
+		if res.err != nil && isOutOfTimeError(res.err) {
+			pending = append(pending, res.item)
+			continue
+		}
+		if res.err != nil {
+			errs = multierror.Append(errs, res.err)
+		}
+		outputs = append(outputs, res.output...)
+	}
+
+	pending = append(pending, notStarted...)
+	if len(pending) > 0 {
+		errs = multierror.Append(errs, &pendingError{items: pending})
+	}
+
+	return outputs, errs.ErrorOrNil()
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolRun(t *testing.T) {
+	tests := []struct {
+		name           string
+		workers        int
+		items          []string
+		expectedOutput []string
+		expectedError  bool
+	}{
+		{
+			name:           "all successful",
+			workers:        2,
+			items:          []string{"group1", "group2", "group3"},
+			expectedOutput: []string{"group1", "group2", "group3"},
+			expectedError:  false,
+		},
+		{
+			name:           "error on one item",
+			workers:        2,
+			items:          []string{"group1", "errorGroup", "group3"},
+			expectedOutput: []string{"group1", "group3"},
+			expectedError:  true,
+		},
+		{
+			name:           "more workers than items",
+			workers:        10,
+			items:          []string{"group1"},
+			expectedOutput: []string{"group1"},
+			expectedError:  false,
+		},
+		{
+			name:           "no items",
+			workers:        0,
+			items:          []string{},
+			expectedOutput: []string{},
+			expectedError:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := newWorkerPool[string](test.workers).run(context.Background(), test.items, func(ctx context.Context, item string) ([]string, error) {
+				if item == "errorGroup" {
+					return nil, fmt.Errorf("an error occurred")
+				}
+				return []string{item}, nil
+			})
+			sort.Strings(output)
+
+			assert.Equal(t, test.expectedOutput, output)
+			if test.expectedError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolBoundedConcurrency(t *testing.T) {
+	items := make([]string, 50)
+	for i := range items {
+		items[i] = fmt.Sprintf("group%d", i)
+	}
+
+	var running, maxRunning int32
+	output, err := newWorkerPool[string](3).run(context.Background(), items, func(ctx context.Context, item string) ([]string, error) {
+		curr := atomic.AddInt32(&running, 1)
+		for {
+			prev := atomic.LoadInt32(&maxRunning)
+			if curr <= prev || atomic.CompareAndSwapInt32(&maxRunning, prev, curr) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return []string{item}, nil
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, output, len(items))
+	assert.LessOrEqual(t, maxRunning, int32(3))
+}
+
+func TestWorkerPoolCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	output, err := newWorkerPool[string](1).run(ctx, []string{"group1", "group2", "group3"}, func(ctx context.Context, item string) ([]string, error) {
+		return []string{item}, nil
+	})
+
+	assert.NotNil(t, err)
+	assert.Less(t, len(output), 3)
+}
@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(handler.HandleInvocation)
 }